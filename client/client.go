@@ -76,6 +76,24 @@ type Client struct {
 	// Example: scope1 scope-2 scope.3 scope:4
 	Scope string `json:"scope"`
 
+	// OAuth 2.0 Client Optional Scopes
+	//
+	// OptionalScopes is a string containing a space-separated list of scope values
+	// that the end-user can deselect on the consent screen. The remaining scopes
+	// are required, and the `openid` scope is always required.
+	//
+	// Example: scope1 scope-2
+	OptionalScopes string `json:"optional_scopes,omitempty"`
+
+	// OAuth 2.0 Client Allowed Users Filter
+	//
+	// AllowedUsersFilter is a PocketBase filter expression evaluated against the
+	// authenticated user record. Users who don't satisfy the filter are not
+	// allowed to sign in to the client. If empty, all users are allowed.
+	//
+	// Example: role = 'staff' && verified = true
+	AllowedUsersFilter string `json:"allowed_users_filter,omitempty"`
+
 	// OAuth 2.0 Client Audience
 	//
 	// An allow-list defining the audiences this client is allowed to request tokens for. An audience limits
@@ -211,38 +229,38 @@ type Client struct {
 	// as a UTF-8 encoded JSON object using the application/json content-type.
 	UserinfoSignedResponseAlgorithm string `json:"userinfo_signed_response_alg,omitempty"`
 
-	// // OpenID Connect Front-Channel Logout URI
-	// //
-	// // RP URL that will cause the RP to log itself out when rendered in an iframe by the OP. An iss (issuer) query
-	// // parameter and a sid (session ID) query parameter MAY be included by the OP to enable the RP to validate the
-	// // request and to determine which of the potentially multiple sessions is to be logged out; if either is
-	// // included, both MUST be.
-	// FrontChannelLogoutURI string `json:"frontchannel_logout_uri,omitempty"`
-
-	// // OpenID Connect Front-Channel Logout Session Required
-	// //
-	// // Boolean value specifying whether the RP requires that iss (issuer) and sid (session ID) query parameters be
-	// // included to identify the RP session with the OP when the frontchannel_logout_uri is used.
-	// // If omitted, the default value is false.
-	// FrontChannelLogoutSessionRequired bool `json:"frontchannel_logout_session_required,omitempty"`
-
-	// // Allowed Post-Redirect Logout URIs
-	// //
-	// // Array of URLs supplied by the RP to which it MAY request that the End-User's User Agent be redirected using the
-	// // post_logout_redirect_uri parameter after a logout has been performed.
-	// PostLogoutRedirectURIs []string `json:"post_logout_redirect_uris,omitempty"`
-
-	// // OpenID Connect Back-Channel Logout URI
-	// //
-	// // RP URL that will cause the RP to log itself out when sent a Logout Token by the OP.
-	// BackChannelLogoutURI string `json:"backchannel_logout_uri,omitempty"`
-
-	// // OpenID Connect Back-Channel Logout Session Required
-	// //
-	// // Boolean value specifying whether the RP requires that a sid (session ID) Claim be included in the Logout
-	// // Token to identify the RP session with the OP when the backchannel_logout_uri is used.
-	// // If omitted, the default value is false.
-	// BackChannelLogoutSessionRequired bool `json:"backchannel_logout_session_required,omitempty"`
+	// OpenID Connect Front-Channel Logout URI
+	//
+	// RP URL that will cause the RP to log itself out when rendered in an iframe by the OP. An iss (issuer) query
+	// parameter and a sid (session ID) query parameter MAY be included by the OP to enable the RP to validate the
+	// request and to determine which of the potentially multiple sessions is to be logged out; if either is
+	// included, both MUST be.
+	FrontChannelLogoutURI string `json:"frontchannel_logout_uri,omitempty"`
+
+	// OpenID Connect Front-Channel Logout Session Required
+	//
+	// Boolean value specifying whether the RP requires that iss (issuer) and sid (session ID) query parameters be
+	// included to identify the RP session with the OP when the frontchannel_logout_uri is used.
+	// If omitted, the default value is false.
+	FrontChannelLogoutSessionRequired bool `json:"frontchannel_logout_session_required,omitempty"`
+
+	// Allowed Post-Redirect Logout URIs
+	//
+	// Array of URLs supplied by the RP to which it MAY request that the End-User's User Agent be redirected using the
+	// post_logout_redirect_uri parameter after a logout has been performed.
+	PostLogoutRedirectURIs []string `json:"post_logout_redirect_uris,omitempty"`
+
+	// OpenID Connect Back-Channel Logout URI
+	//
+	// RP URL that will cause the RP to log itself out when sent a Logout Token by the OP.
+	BackChannelLogoutURI string `json:"backchannel_logout_uri,omitempty"`
+
+	// OpenID Connect Back-Channel Logout Session Required
+	//
+	// Boolean value specifying whether the RP requires that a sid (session ID) Claim be included in the Logout
+	// Token to identify the RP session with the OP when the backchannel_logout_uri is used.
+	// If omitted, the default value is false.
+	BackChannelLogoutSessionRequired bool `json:"backchannel_logout_session_required,omitempty"`
 
 	// OAuth 2.0 Client Metadata
 	//
@@ -292,6 +310,12 @@ func (c *Client) GetScopes() fosite.Arguments {
 	return strings.Split(c.Scope, " ")
 }
 
+// GetOptionalScopes returns the scopes the end-user can deselect on the
+// consent screen.
+func (c *Client) GetOptionalScopes() fosite.Arguments {
+	return strings.Fields(c.OptionalScopes)
+}
+
 // IsPublic implements [fosite.Client].
 func (c *Client) IsPublic() bool {
 	return c.TokenEndpointAuthMethod == "none"
@@ -190,3 +190,14 @@ func TestClientScopesSplitBySpace(t *testing.T) {
 		}
 	}
 }
+
+func TestClientGetOptionalScopes(t *testing.T) {
+	c := &Client{OptionalScopes: "profile  email"}
+	scopes := c.GetOptionalScopes()
+	if len(scopes) != 2 || scopes[0] != "profile" || scopes[1] != "email" {
+		t.Errorf("GetOptionalScopes() = %v, want [profile email]", scopes)
+	}
+	if scopes := (&Client{}).GetOptionalScopes(); len(scopes) != 0 {
+		t.Errorf("GetOptionalScopes() = %v, want []", scopes)
+	}
+}
@@ -5,13 +5,20 @@ package consts
 // models and migration code, which both need to reference the collection names.
 
 const (
-	ClientCollectionName        = "_oauth2Clients"
-	AuthCodeCollectionName      = "_oauth2AuthCode"
-	AccessCollectionName        = "_oauth2Access"
-	RefreshCollectionName       = "_oauth2Refresh"
-	PKCECollectionName          = "_oauth2PKCE"
-	OpenIDConnectCollectionName = "_oauth2OpenID"
-	JTICollectionName           = "_oauth2JTI"
+	ClientCollectionName            = "_oauth2Clients"
+	AuthCodeCollectionName          = "_oauth2AuthCode"
+	AccessCollectionName            = "_oauth2Access"
+	RefreshCollectionName           = "_oauth2Refresh"
+	PKCECollectionName              = "_oauth2PKCE"
+	OpenIDConnectCollectionName     = "_oauth2OpenID"
+	JTICollectionName               = "_oauth2JTI"
+	ConsentCollectionName           = "_oauth2Consents"
+	LoginChallengeCollectionName    = "_oauth2LoginChallenges"
+	BackChannelLogoutCollectionName = "_oauth2BackChannelLogouts"
+	BrowserSessionCollectionName    = "_oauth2BrowserSessions"
+	RevokedTokenCollectionName      = "_oauth2RevokedTokens"
+	PARCollectionName               = "_oauth2PAR"
 
-	CleanupExpiredSessionsJobName = "__pbOAuth2Cleanup__"
+	CleanupExpiredSessionsJobName    = "__pbOAuth2Cleanup__"
+	DeliverBackChannelLogoutsJobName = "__pbOAuth2BackChannelLogout__"
 )
@@ -0,0 +1,37 @@
+package migrations
+
+import (
+	"github.com/pocketbase/pocketbase/core"
+)
+
+func init() {
+	core.SystemMigrations.Register(func(txApp core.App) error {
+
+		// RFC 9396 Authorization Details
+
+		for _, name := range sessionCollections {
+			collection, err := txApp.FindCollectionByNameOrId(name)
+			if err != nil {
+				return err
+			}
+			collection.Fields.Add(
+				&core.JSONField{Name: "authorization_details"},
+			)
+			if err := txApp.Save(collection); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}, func(txApp core.App) error {
+		for _, name := range sessionCollections {
+			if collection, err := txApp.FindCollectionByNameOrId(name); err == nil {
+				collection.Fields.RemoveByName("authorization_details")
+				if err := txApp.Save(collection); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,33 @@
+package migrations
+
+import (
+	"github.com/benjamesfleming/pocketbase-ext-oauth2/consts"
+	"github.com/pocketbase/pocketbase/core"
+)
+
+func init() {
+	core.SystemMigrations.Register(func(txApp core.App) error {
+
+		// OAuth2 Consent Grants Collection
+
+		collection := core.NewBaseCollection(consts.ConsentCollectionName)
+		collection.System = true
+		collection.Fields.Add(
+			&core.TextField{Name: "subject"},
+			&core.TextField{Name: "collection"},
+			&core.TextField{Name: "client_id"},
+			&core.TextField{Name: "scopes"},
+			&core.TextField{Name: "audience"},
+			&core.NumberField{Name: "expires_at"},
+			&core.AutodateField{Name: "created", OnCreate: true},
+			&core.AutodateField{Name: "updated", OnCreate: true, OnUpdate: true},
+		)
+		collection.AddIndex("idx_oauth2_consents_subject_client", true, "subject, collection, client_id", "")
+		return txApp.Save(collection)
+	}, func(txApp core.App) error {
+		if collection, err := txApp.FindCollectionByNameOrId(consts.ConsentCollectionName); err == nil {
+			_ = txApp.Delete(collection)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,28 @@
+package migrations
+
+import (
+	"github.com/benjamesfleming/pocketbase-ext-oauth2/consts"
+	"github.com/pocketbase/pocketbase/core"
+)
+
+func init() {
+	core.SystemMigrations.Register(func(txApp core.App) error {
+
+		// Per-Client User Access Policies
+
+		collection, err := txApp.FindCollectionByNameOrId(consts.ClientCollectionName)
+		if err != nil {
+			return err
+		}
+		collection.Fields.Add(
+			&core.TextField{Name: "allowed_users_filter"},
+		)
+		return txApp.Save(collection)
+	}, func(txApp core.App) error {
+		if collection, err := txApp.FindCollectionByNameOrId(consts.ClientCollectionName); err == nil {
+			collection.Fields.RemoveByName("allowed_users_filter")
+			return txApp.Save(collection)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,42 @@
+package migrations
+
+import (
+	"github.com/benjamesfleming/pocketbase-ext-oauth2/consts"
+	"github.com/pocketbase/pocketbase/core"
+)
+
+func init() {
+	core.SystemMigrations.Register(func(txApp core.App) error {
+
+		// OAuth2 Login Challenges Collection
+
+		collection := core.NewBaseCollection(consts.LoginChallengeCollectionName)
+		collection.System = true
+		collection.Fields.Add(
+			&core.TextField{Name: "client_id"},
+			&core.TextField{Name: "request_form"},
+			&core.NumberField{Name: "requested_at"},
+			&core.NumberField{Name: "expires_at"},
+			&core.TextField{Name: "phase"},
+			&core.JSONField{Name: "state"},
+			&core.TextField{Name: "subject"},
+			&core.TextField{Name: "collection"},
+			&core.NumberField{Name: "auth_time"},
+			&core.TextField{Name: "error"},
+			&core.TextField{Name: "login_verifier"},
+			&core.TextField{Name: "consent_verifier"},
+			&core.BoolField{Name: "consent_granted"},
+			&core.JSONField{Name: "granted_scopes"},
+			&core.AutodateField{Name: "created", OnCreate: true},
+			&core.AutodateField{Name: "updated", OnCreate: true, OnUpdate: true},
+		)
+		collection.AddIndex("idx_oauth2_login_challenges_login_verifier", false, "login_verifier", "")
+		collection.AddIndex("idx_oauth2_login_challenges_consent_verifier", false, "consent_verifier", "")
+		return txApp.Save(collection)
+	}, func(txApp core.App) error {
+		if collection, err := txApp.FindCollectionByNameOrId(consts.LoginChallengeCollectionName); err == nil {
+			_ = txApp.Delete(collection)
+		}
+		return nil
+	})
+}
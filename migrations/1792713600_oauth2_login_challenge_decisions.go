@@ -0,0 +1,34 @@
+package migrations
+
+import (
+	"github.com/benjamesfleming/pocketbase-ext-oauth2/consts"
+	"github.com/pocketbase/pocketbase/core"
+)
+
+func init() {
+	core.SystemMigrations.Register(func(txApp core.App) error {
+
+		// Login and Consent Decisions
+
+		collection, err := txApp.FindCollectionByNameOrId(consts.LoginChallengeCollectionName)
+		if err != nil {
+			return err
+		}
+		collection.Fields.Add(
+			&core.TextField{Name: "error_description"},
+			&core.BoolField{Name: "login_remember"},
+			&core.BoolField{Name: "consent_remember"},
+			&core.TextField{Name: "acr"},
+			&core.JSONField{Name: "amr"},
+		)
+		return txApp.Save(collection)
+	}, func(txApp core.App) error {
+		if collection, err := txApp.FindCollectionByNameOrId(consts.LoginChallengeCollectionName); err == nil {
+			for _, name := range []string{"error_description", "login_remember", "consent_remember", "acr", "amr"} {
+				collection.Fields.RemoveByName(name)
+			}
+			return txApp.Save(collection)
+		}
+		return nil
+	})
+}
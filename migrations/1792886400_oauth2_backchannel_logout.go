@@ -0,0 +1,52 @@
+package migrations
+
+import (
+	"github.com/benjamesfleming/pocketbase-ext-oauth2/consts"
+	"github.com/pocketbase/pocketbase/core"
+)
+
+func init() {
+	core.SystemMigrations.Register(func(txApp core.App) error {
+
+		// Back-Channel Logout
+
+		clients, err := txApp.FindCollectionByNameOrId(consts.ClientCollectionName)
+		if err != nil {
+			return err
+		}
+		clients.Fields.Add(
+			&core.TextField{Name: "backchannel_logout_uri"},
+			&core.BoolField{Name: "backchannel_logout_session_required"},
+		)
+		if err := txApp.Save(clients); err != nil {
+			return err
+		}
+
+		// OAuth2 Back-Channel Logout Deliveries Collection
+
+		collection := core.NewBaseCollection(consts.BackChannelLogoutCollectionName)
+		collection.System = true
+		collection.Fields.Add(
+			&core.TextField{Name: "client_id"},
+			&core.TextField{Name: "subject"},
+			&core.TextField{Name: "sid"},
+			&core.NumberField{Name: "attempts"},
+			&core.NumberField{Name: "next_attempt_at"},
+			&core.TextField{Name: "last_error"},
+			&core.AutodateField{Name: "created", OnCreate: true},
+			&core.AutodateField{Name: "updated", OnCreate: true, OnUpdate: true},
+		)
+		collection.AddIndex("idx_oauth2_backchannel_logouts_next_attempt_at", false, "next_attempt_at", "")
+		return txApp.Save(collection)
+	}, func(txApp core.App) error {
+		if collection, err := txApp.FindCollectionByNameOrId(consts.BackChannelLogoutCollectionName); err == nil {
+			_ = txApp.Delete(collection)
+		}
+		if clients, err := txApp.FindCollectionByNameOrId(consts.ClientCollectionName); err == nil {
+			clients.Fields.RemoveByName("backchannel_logout_uri")
+			clients.Fields.RemoveByName("backchannel_logout_session_required")
+			return txApp.Save(clients)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,30 @@
+package migrations
+
+import (
+	"github.com/benjamesfleming/pocketbase-ext-oauth2/consts"
+	"github.com/pocketbase/pocketbase/core"
+)
+
+func init() {
+	core.SystemMigrations.Register(func(txApp core.App) error {
+
+		// Front-Channel Logout
+
+		collection, err := txApp.FindCollectionByNameOrId(consts.ClientCollectionName)
+		if err != nil {
+			return err
+		}
+		collection.Fields.Add(
+			&core.TextField{Name: "frontchannel_logout_uri"},
+			&core.BoolField{Name: "frontchannel_logout_session_required"},
+		)
+		return txApp.Save(collection)
+	}, func(txApp core.App) error {
+		if collection, err := txApp.FindCollectionByNameOrId(consts.ClientCollectionName); err == nil {
+			collection.Fields.RemoveByName("frontchannel_logout_uri")
+			collection.Fields.RemoveByName("frontchannel_logout_session_required")
+			return txApp.Save(collection)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,33 @@
+package migrations
+
+import (
+	"github.com/benjamesfleming/pocketbase-ext-oauth2/consts"
+	"github.com/pocketbase/pocketbase/core"
+)
+
+func init() {
+	core.SystemMigrations.Register(func(txApp core.App) error {
+
+		// OAuth2 Browser Sessions Collection
+
+		collection := core.NewBaseCollection(consts.BrowserSessionCollectionName)
+		collection.System = true
+		collection.Fields.Add(
+			&core.TextField{Name: "sid"},
+			&core.TextField{Name: "token_hash"},
+			&core.JSONField{Name: "accounts"},
+			&core.BoolField{Name: "remember"},
+			&core.NumberField{Name: "expires_at"},
+			&core.AutodateField{Name: "created", OnCreate: true},
+			&core.AutodateField{Name: "updated", OnCreate: true, OnUpdate: true},
+		)
+		collection.AddIndex("idx_oauth2_browser_sessions_sid", true, "sid", "")
+		collection.AddIndex("idx_oauth2_browser_sessions_token_hash", true, "token_hash", "")
+		return txApp.Save(collection)
+	}, func(txApp core.App) error {
+		if collection, err := txApp.FindCollectionByNameOrId(consts.BrowserSessionCollectionName); err == nil {
+			_ = txApp.Delete(collection)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,28 @@
+package migrations
+
+import (
+	"github.com/benjamesfleming/pocketbase-ext-oauth2/consts"
+	"github.com/pocketbase/pocketbase/core"
+)
+
+func init() {
+	core.SystemMigrations.Register(func(txApp core.App) error {
+
+		// OAuth2 Revoked Tokens Collection
+
+		collection := core.NewBaseCollection(consts.RevokedTokenCollectionName)
+		collection.System = true
+		collection.Fields.Add(
+			&core.TextField{Name: "signature"},
+			&core.NumberField{Name: "expires_at"},
+			&core.AutodateField{Name: "created", OnCreate: true},
+		)
+		collection.AddIndex("idx_oauth2_revoked_tokens_signature", true, "signature", "")
+		return txApp.Save(collection)
+	}, func(txApp core.App) error {
+		if collection, err := txApp.FindCollectionByNameOrId(consts.RevokedTokenCollectionName); err == nil {
+			_ = txApp.Delete(collection)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,31 @@
+package migrations
+
+import (
+	"github.com/benjamesfleming/pocketbase-ext-oauth2/consts"
+	"github.com/pocketbase/pocketbase/core"
+)
+
+func init() {
+	core.SystemMigrations.Register(func(txApp core.App) error {
+
+		// OAuth2 Pushed Authorization Requests Collection
+
+		if err := createSessionCollection(txApp, consts.PARCollectionName); err != nil {
+			return err
+		}
+		collection, err := txApp.FindCollectionByNameOrId(consts.PARCollectionName)
+		if err != nil {
+			return err
+		}
+		collection.Fields.Add(
+			&core.JSONField{Name: "authorization_details"},
+		)
+		collection.AddIndex("idx_oauth2_par_signature", true, "signature", "")
+		return txApp.Save(collection)
+	}, func(txApp core.App) error {
+		if collection, err := txApp.FindCollectionByNameOrId(consts.PARCollectionName); err == nil {
+			_ = txApp.Delete(collection)
+		}
+		return nil
+	})
+}
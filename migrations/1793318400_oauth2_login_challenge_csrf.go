@@ -0,0 +1,28 @@
+package migrations
+
+import (
+	"github.com/benjamesfleming/pocketbase-ext-oauth2/consts"
+	"github.com/pocketbase/pocketbase/core"
+)
+
+func init() {
+	core.SystemMigrations.Register(func(txApp core.App) error {
+
+		// Login Challenge Browser Binding
+
+		collection, err := txApp.FindCollectionByNameOrId(consts.LoginChallengeCollectionName)
+		if err != nil {
+			return err
+		}
+		collection.Fields.Add(
+			&core.TextField{Name: "csrf_token"},
+		)
+		return txApp.Save(collection)
+	}, func(txApp core.App) error {
+		if collection, err := txApp.FindCollectionByNameOrId(consts.LoginChallengeCollectionName); err == nil {
+			collection.Fields.RemoveByName("csrf_token")
+			return txApp.Save(collection)
+		}
+		return nil
+	})
+}
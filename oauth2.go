@@ -15,6 +15,7 @@ import (
 	"github.com/go-jose/go-jose/v3"
 	"github.com/ory/fosite"
 	"github.com/ory/fosite/compose"
+	"github.com/ory/fosite/token/jwt"
 	"github.com/pkg/errors"
 
 	"github.com/benjamesfleming/pocketbase-ext-oauth2/consts"
@@ -24,6 +25,7 @@ import (
 	"github.com/benjamesfleming/pocketbase-ext-oauth2/rfc9728"
 	"github.com/benjamesfleming/pocketbase-ext-oauth2/ui"
 	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/apis"
 	"github.com/pocketbase/pocketbase/core"
 	"github.com/pocketbase/pocketbase/tools/router"
 )
@@ -35,9 +37,24 @@ type Config struct {
 
 	PathPrefix                             string
 	UserCollection                         string
+	LoginURL                               string
 	UserInfoClaimStrategy                  UserInfoClaimStrategy
+	UserInfoClaimMappings                  ClaimMappings
+	ScopeGrantStrategy                     ScopeGrantStrategy
+	ScopeGrantFilters                      ScopeGrantFilters
 	EnableRFC7591DynamicClientRegistration bool
 	EnableRFC9728ProtectedResourceMetadata bool
+	EnableAggregatedAndDistributedClaims   bool
+	ConsentLifespan                        time.Duration
+	BrowserSessionLifespan                 time.Duration
+	RevokeRefreshTokensOnLogout            bool
+	// LevelsOfAssurance map the methods the users log in with to the acr
+	// claim of the ID token. The methods are recorded in the PocketBase auth
+	// token of a login with the login UI, which passes the pending
+	// login_challenge to the auth endpoint. The auth tokens of the other
+	// logins of the user collection are left unchanged.
+	LevelsOfAssurance         LevelsOfAssurance
+	AuthorizationDetailsTypes []*AuthorizationDetailsType
 }
 
 var oauth2 fosite.OAuth2Provider
@@ -77,26 +94,52 @@ func Register(app core.App, config *Config) error {
 	if oauth2GlobalCfg.PathPrefix == "" {
 		oauth2GlobalCfg.PathPrefix = "/oauth2"
 	}
+	if oauth2GlobalCfg.ConsentLifespan == 0 {
+		oauth2GlobalCfg.ConsentLifespan = time.Hour * 24 * 30
+	}
+	if oauth2GlobalCfg.BrowserSessionLifespan == 0 {
+		oauth2GlobalCfg.BrowserSessionLifespan = time.Hour * 24 * 30
+	}
+	if len(oauth2GlobalCfg.LevelsOfAssurance) == 0 {
+		oauth2GlobalCfg.LevelsOfAssurance = DefaultLevelsOfAssurance
+	}
 	if oauth2GlobalCfg.UserInfoClaimStrategy == nil {
-		oauth2GlobalCfg.UserInfoClaimStrategy = &DefaultUserInfoClaimStrategy{}
+		if len(oauth2GlobalCfg.UserInfoClaimMappings) > 0 {
+			oauth2GlobalCfg.UserInfoClaimStrategy = &MappedUserInfoClaimStrategy{
+				Mappings: oauth2GlobalCfg.UserInfoClaimMappings,
+			}
+		} else {
+			oauth2GlobalCfg.UserInfoClaimStrategy = &DefaultUserInfoClaimStrategy{}
+		}
 	}
+	if oauth2GlobalCfg.ScopeGrantStrategy == nil {
+		oauth2GlobalCfg.ScopeGrantStrategy = &FilterScopeGrantStrategy{
+			Filters: oauth2GlobalCfg.ScopeGrantFilters,
+		}
+	}
+	// Allow clients to request tokens for the registered protected resources
+	// using the RFC 8707 resource parameter.
+	oauth2GlobalCfg.AudienceMatchingStrategy = newResourceAudienceMatchingStrategy(
+		oauth2GlobalCfg.GetAudienceStrategy(context.Background()),
+	)
 	// Create the OAuth2 store
 	oauth2GlobalStore = NewOAuth2Store(app)
 	// Create the OAuth2 provider
+	getPrivateKey := func(ctx context.Context) (interface{}, error) {
+		if oauth2PrivateKey == nil {
+			panic("[Plugin/OAuth2] Private key is not initialized!! This should never happen because we load it during app bootstrap.")
+		}
+		return oauth2PrivateKey, nil
+	}
 	oauth2 = compose.Compose(
 		oauth2GlobalCfg.BaseConfig,
 		oauth2GlobalStore,
 		compose.CommonStrategy{
-			CoreStrategy: NewPocketBaseStrategy(app, oauth2GlobalCfg),
-			OpenIDConnectTokenStrategy: compose.NewOpenIDConnectStrategy(
-				func(ctx context.Context) (interface{}, error) {
-					if oauth2PrivateKey == nil {
-						panic("[Plugin/OAuth2] Private key is not initialized!! This should never happen because we load it during app bootstrap.")
-					}
-					return oauth2PrivateKey, nil
-				},
-				oauth2GlobalCfg,
-			),
+			CoreStrategy:               NewPocketBaseStrategy(app, oauth2GlobalCfg),
+			OpenIDConnectTokenStrategy: compose.NewOpenIDConnectStrategy(getPrivateKey, oauth2GlobalCfg),
+			// The OpenID Connect request validator decodes the id_token_hint
+			// with this signer.
+			Signer: &jwt.DefaultSigner{GetPrivateKey: getPrivateKey},
 		},
 
 		compose.OAuth2AuthorizeExplicitFactory,
@@ -104,6 +147,7 @@ func Register(app core.App, config *Config) error {
 		compose.OAuth2TokenIntrospectionFactory,
 		compose.OAuth2TokenRevocationFactory,
 		compose.OAuth2PKCEFactory,
+		compose.PushedAuthorizeHandlerFactory,
 
 		compose.OpenIDConnectExplicitFactory,
 		compose.OpenIDConnectImplicitFactory,
@@ -121,6 +165,8 @@ func Register(app core.App, config *Config) error {
 			RevocationEndpoint:    app.Settings().Meta.AppURL + config.PathPrefix + "/revoke",
 			IntrospectionEndpoint: app.Settings().Meta.AppURL + config.PathPrefix + "/introspect",
 
+			PushedAuthorizationRequestEndpoint: app.Settings().Meta.AppURL + config.PathPrefix + "/par",
+
 			TokenEndpointAuthMethodsSupported:         []string{"client_secret_basic", "client_secret_post"},
 			RevocationEndpointAuthMethodsSupported:    []string{"client_secret_basic", "client_secret_post"},
 			IntrospectionEndpointAuthMethodsSupported: []string{"client_secret_basic", "client_secret_post"},
@@ -156,11 +202,14 @@ func Register(app core.App, config *Config) error {
 				"S256",
 			},
 		},
-		UserInfoEndpoint: app.Settings().Meta.AppURL + config.PathPrefix + "/userinfo",
-		AcrValuesSupported: []string{
-			"loa1",
-			"loa2",
-		},
+		UserInfoEndpoint:                   app.Settings().Meta.AppURL + config.PathPrefix + "/userinfo",
+		CheckSessionIframe:                 app.Settings().Meta.AppURL + config.PathPrefix + "/check-session",
+		EndSessionEndpoint:                 app.Settings().Meta.AppURL + config.PathPrefix + "/logout",
+		FrontChannelLogoutSupported:        true,
+		FrontChannelLogoutSessionSupported: true,
+		BackChannelLogoutSupported:         true,
+		BackChannelLogoutSessionSupported:  true,
+		AcrValuesSupported:                 oauth2GlobalCfg.LevelsOfAssurance.Values(),
 		SubjectTypesSupported: []string{
 			"public",
 		},
@@ -176,10 +225,17 @@ func Register(app core.App, config *Config) error {
 		DisplayValuesSupported: []string{
 			"page",
 		},
+		PromptValuesSupported: []string{
+			"none",
+			"login",
+			"consent",
+			"select_account",
+		},
 		ClaimTypesSupported: []string{
 			"normal",
 		},
 		ClaimsSupported: []string{
+			"acr",
 			"amr",
 			"aud",
 			"azp",
@@ -189,6 +245,7 @@ func Register(app core.App, config *Config) error {
 			"iss",
 			"jti",
 			"rat",
+			"sid",
 			"sub",
 			"name",
 			"given_name",
@@ -216,6 +273,30 @@ func Register(app core.App, config *Config) error {
 		RequireRequestURIRegistration: true,
 	}
 
+	if config.EnableAggregatedAndDistributedClaims {
+		oauth2ProviderMetadata.ClaimTypesSupported = append(oauth2ProviderMetadata.ClaimTypesSupported, "aggregated", "distributed")
+	}
+
+	// Register the RFC 9396 authorization details types.
+	for _, t := range config.AuthorizationDetailsTypes {
+		RegisterAuthorizationDetailsType(t)
+	}
+
+	// Advertise any custom scopes and claims defined by the claim mappings,
+	// as long as they are the ones releasing the claims.
+	if s, ok := config.UserInfoClaimStrategy.(*MappedUserInfoClaimStrategy); ok {
+		for _, scope := range s.Mappings.Scopes() {
+			if !slices.Contains(oauth2ProviderMetadata.ScopesSupported, scope) {
+				oauth2ProviderMetadata.ScopesSupported = append(oauth2ProviderMetadata.ScopesSupported, scope)
+			}
+		}
+		for _, claim := range s.Mappings.Claims() {
+			if !slices.Contains(oauth2ProviderMetadata.ClaimsSupported, claim) {
+				oauth2ProviderMetadata.ClaimsSupported = append(oauth2ProviderMetadata.ClaimsSupported, claim)
+			}
+		}
+	}
+
 	// Attach bootstrap handler
 
 	loadParams := func(app core.App) (err error) {
@@ -243,9 +324,20 @@ func Register(app core.App, config *Config) error {
 		})
 	}
 
+	// Let the rfc9728 middlewares look up the presented access tokens
+	rfc9728.SetAccessTokenInfoResolver(resolveAccessTokenInfo)
+	rfc9728.SetACRMatchingStrategy(func(acr string, required []string) bool {
+		return GetOAuth2Config().LevelsOfAssurance.Satisfies(acr, required)
+	})
+	rfc9728.SetScopeMatchingStrategy(func(granted []string, scope string) bool {
+		return GetOAuth2Config().GetScopeStrategy(context.Background())(granted, scope)
+	})
+
 	// Attach HTTP handlers
 
 	app.OnServe().BindFunc(func(se *core.ServeEvent) error {
+		// reject the revoked access tokens on every route
+		se.Router.Bind(loadRevokedAccessTokens())
 		// route handlers
 		bindOAuth2Handlers(oauth2GlobalCfg, se.Router)
 		bindOAuth2WellKnownHandlers(oauth2GlobalCfg, se.Router)
@@ -260,7 +352,13 @@ func Register(app core.App, config *Config) error {
 				ScopesSupported:        []string{"openid", "profile", "email"},
 			},
 		)
-		return se.Next()
+		if err := se.Next(); err != nil {
+			return err
+		}
+		// routes guarded by rfc9728.RequireScopes, once all the routes have
+		// been added
+		registerProtectedRoutes(se.App, rfc9728.GetProtectedRoutes())
+		return nil
 	})
 
 	// Attach event listeners
@@ -281,6 +379,29 @@ func Register(app core.App, config *Config) error {
 			return e.Next()
 		})
 
+	// Record the methods the users log in with, for the amr and acr claims of
+	// the ID token.
+	app.OnRecordAuthRequest(config.UserCollection).
+		BindFunc(recordAuthMethods)
+
+	// Revoke the sessions of the users and clients that are deleted or change
+	// their credentials.
+	app.OnRecordUpdate(config.UserCollection).
+		BindFunc(revokeUserSessionsOnUpdate)
+	app.OnRecordDelete(config.UserCollection).
+		BindFunc(revokeUserSessionsOnDelete)
+	app.OnRecordUpdate(consts.ClientCollectionName).
+		BindFunc(revokeClientSessionsOnUpdate)
+	app.OnRecordDelete(consts.ClientCollectionName).
+		BindFunc(revokeClientSessionsOnDelete)
+
+	// Deliver the back-channel logout tokens as soon as they are queued.
+	app.OnRecordAfterCreateSuccess(consts.BackChannelLogoutCollectionName).
+		BindFunc(func(e *core.RecordEvent) error {
+			go deliverBackChannelLogouts(app)
+			return e.Next()
+		})
+
 	// Attach cron jobs
 
 	app.Cron().MustAdd(consts.CleanupExpiredSessionsJobName, "0 * * * *", func() {
@@ -291,6 +412,11 @@ func Register(app core.App, config *Config) error {
 			consts.PKCECollectionName,
 			consts.OpenIDConnectCollectionName,
 			consts.JTICollectionName,
+			consts.ConsentCollectionName,
+			consts.LoginChallengeCollectionName,
+			consts.BrowserSessionCollectionName,
+			consts.RevokedTokenCollectionName,
+			consts.PARCollectionName,
 		} {
 			records, err := app.FindAllRecords(
 				collection,
@@ -317,6 +443,10 @@ func Register(app core.App, config *Config) error {
 		}
 	})
 
+	app.Cron().MustAdd(consts.DeliverBackChannelLogoutsJobName, "* * * * *", func() {
+		deliverBackChannelLogouts(app)
+	})
+
 	//
 
 	return nil
@@ -366,6 +496,10 @@ func ResetGlobalStateForTests() {
 	oauth2ProtectedResourceMetadataMu.Lock()
 	oauth2ProtectedResourceMetadata = map[string]*rfc9728.ProtectedResourceMetadata{}
 	oauth2ProtectedResourceMetadataMu.Unlock()
+	oauth2AuthorizationDetailsTypesMu.Lock()
+	oauth2AuthorizationDetailsTypes = map[string]*AuthorizationDetailsType{}
+	oauth2AuthorizationDetailsTypesMu.Unlock()
+	rfc9728.ResetGlobalStateForTests()
 }
 
 //
@@ -376,22 +510,52 @@ func bindOAuth2Handlers(cfg *Config, r *router.Router[*core.RequestEvent]) {
 	rg.POST("/auth", api_OAuth2Authorize)
 	rg.GET("/token", api_OAuth2Token)
 	rg.POST("/token", api_OAuth2Token)
+	rg.POST("/par", api_OAuth2PushedAuthorize)
 	rg.POST("/revoke", api_OAuth2Revoke)
 	rg.POST("/introspect", api_OAuth2Introspect)
 	rg.GET("/userinfo", api_OAuth2UserInfo).Bind(rfc9728.RequireAuthRFC9728WWWAuthenticateResponse())
 	rg.POST("/userinfo", api_OAuth2UserInfo).Bind(rfc9728.RequireAuthRFC9728WWWAuthenticateResponse())
+	// login challenges
+	// Used by the login UI to complete the login and consent steps of an
+	// authorization request.
+	rg.GET("/auth/requests/login", api_OAuth2GetLoginRequest)
+	rg.POST("/auth/requests/login/accept", api_OAuth2AcceptLoginRequest)
+	rg.POST("/auth/requests/login/reject", api_OAuth2RejectLoginRequest)
+	rg.GET("/auth/requests/consent", api_OAuth2GetConsentRequest)
+	rg.POST("/auth/requests/consent/accept", api_OAuth2AcceptConsentRequest)
+	rg.POST("/auth/requests/consent/reject", api_OAuth2RejectConsentRequest)
+	// rp-initiated logout
+	// @ref https://openid.net/specs/openid-connect-rpinitiated-1_0.html
+	rg.GET("/logout", api_OAuth2Logout)
+	rg.POST("/logout", api_OAuth2Logout)
+	rg.GET("/auth/requests/logout", api_OAuth2GetLogoutRequest)
+	rg.POST("/auth/requests/logout/accept", api_OAuth2AcceptLogoutRequest)
+	// session management
+	// @ref https://openid.net/specs/openid-connect-session-1_0.html
+	rg.GET("/check-session", api_OAuth2CheckSessionIframe)
 	// rfc7591
 	// Dynamic Client Registration
 	// @ref https://datatracker.ietf.org/doc/html/rfc7591
 	if cfg.EnableRFC7591DynamicClientRegistration {
 		rg.POST("/register", api_OAuth2Register)
 	}
+	// connected apps
+	// Lets users list and revoke the clients holding grants for them.
+	rg.GET("/connected-apps", api_OAuth2ListConnectedApps)
+	rg.DELETE("/connected-apps/{client_id}", api_OAuth2RevokeConnectedApp)
+	// sign out everywhere
+	// Lets superusers revoke all the sessions of a user or a client.
+	rg.DELETE("/sessions", api_OAuth2RevokeSessions).Bind(apis.RequireSuperuserAuth())
 	// ui
 	uiHandler := func(e *core.RequestEvent) error {
+		if state := e.Request.URL.Query().Get("state"); state != "" && !verifyConnectedAppsState(state) {
+			return e.BadRequestError("The state is invalid.", nil)
+		}
 		return e.FileFS(ui.DistDirFS, "login.html")
 	}
 	r.GET("/oauth2/login", uiHandler)
 	r.POST("/oauth2/login", uiHandler)
+	rg.GET("/apps", redirectToConnectedAppsUI)
 }
 
 func bindOAuth2WellKnownHandlers(cfg *Config, r *router.Router[*core.RequestEvent]) {
@@ -426,7 +590,7 @@ func bindOAuth2WellKnownHandlers(cfg *Config, r *router.Router[*core.RequestEven
 	// Protected Resource Metadata
 	// @ref https://datatracker.ietf.org/doc/html/rfc9728
 	if cfg.EnableRFC9728ProtectedResourceMetadata {
-		handleJSON(r, "/.well-known/oauth-protected-resource/{resource}", func(e *core.RequestEvent) (interface{}, error) {
+		handleJSON(r, "/.well-known/oauth-protected-resource/{resource...}", func(e *core.RequestEvent) (interface{}, error) {
 			oauth2ProtectedResourceMetadataMu.RLock()
 			defer oauth2ProtectedResourceMetadataMu.RUnlock()
 
@@ -436,6 +600,15 @@ func bindOAuth2WellKnownHandlers(cfg *Config, r *router.Router[*core.RequestEven
 			key := strings.Trim(e.Request.PathValue("resource"), "/")
 
 			if md, ok := oauth2ProtectedResourceMetadata[key]; ok {
+				// Advertise the registered authorization details types, unless the
+				// resource lists the types it supports itself.
+				if len(md.AuthorizationDetailsTypesSupported) == 0 {
+					if types := getAuthorizationDetailsTypes(); len(types) > 0 {
+						ret := *md
+						ret.AuthorizationDetailsTypesSupported = types
+						return &ret, nil
+					}
+				}
 				return md, nil
 			} else {
 				return nil, e.NotFoundError("", nil)
@@ -1,14 +1,15 @@
 package oauth2
 
 import (
-	"database/sql"
-	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"log/slog"
 	"net/http"
+	"net/url"
+	"slices"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/benjamesfleming/pocketbase-ext-oauth2/client"
@@ -40,73 +41,175 @@ func api_OAuth2Authorize(e *core.RequestEvent) error {
 	}
 	// You have now access to authorizeRequest, Code ResponseTypes, Scopes ...
 
-	var u *core.Record
-	var issuedAt time.Time
-	var requestedAt time.Time
+	// A pushed authorization request is merged into the request and deleted,
+	// so the login and consent screens resume the request with its params
+	// rather than with the request_uri.
+	// @ref https://datatracker.ietf.org/doc/html/rfc9126#section-4
+	ar.GetRequestForm().Del("request_uri")
 
-	//
-
-	if err := ar.GetRequestForm().Get("error"); err != "" {
-		switch err {
-		case "account_selection_required", "consent_required", "interaction_required":
-			oauth2.WriteAuthorizeError(ctx, w, ar, fosite.ErrInteractionRequired)
-		case "login_required":
-			oauth2.WriteAuthorizeError(ctx, w, ar, fosite.ErrLoginRequired)
-		default:
-			oauth2.WriteAuthorizeError(ctx, w, ar, fosite.ErrServerError.WithDebug(fmt.Sprintf("Unknown error: %s", err)))
+	// Validate the requested resources, the granted audience of the tokens is
+	// restricted to these resources.
+	// @ref https://datatracker.ietf.org/doc/html/rfc8707#section-2.1
+	resources, err := getRequestedResources(ar.GetRequestForm())
+	if err == nil {
+		err = validateRequestedResources(ctx, ar.GetClient(), resources)
+	}
+	if err != nil {
+		e.App.Logger().Info("[Plugin/OAuth2] Error occurred in validateRequestedResources", slog.Any("error", err))
+		oauth2.WriteAuthorizeError(ctx, w, ar, err)
+		return nil
+	}
+	for _, resource := range resources {
+		if !slices.Contains(ar.GetRequestedAudience(), resource) {
+			ar.SetRequestedAudience(append(ar.GetRequestedAudience(), resource))
 		}
+	}
+
+	// Validate the requested authorization details against the registered
+	// authorization details types.
+	// @ref https://datatracker.ietf.org/doc/html/rfc9396#section-2
+	authorizationDetails, err := getRequestedAuthorizationDetails(ar.GetRequestForm(), ar.GetClient())
+	if err != nil {
+		e.App.Logger().Info("[Plugin/OAuth2] Error occurred in getRequestedAuthorizationDetails", slog.Any("error", err))
+		oauth2.WriteAuthorizeError(ctx, w, ar, err)
 		return nil
 	}
 
-	if token := ar.GetRequestForm().Get("pb_token"); len(token) > 0 {
-		if u, err = e.App.FindAuthRecordByToken(token); err != nil {
-			if !errors.Is(err, sql.ErrNoRows) {
+	// Validate the id_token_hint, the logged in user must be the subject of the
+	// ID token.
+	// @ref https://openid.net/specs/openid-connect-core-1_0.html#AuthRequest
+	var idTokenHint *IDTokenHint
+	if hint := ar.GetRequestForm().Get("id_token_hint"); hint != "" {
+		idTokenHint, err = ValidateIDTokenHint(ctx, hint)
+		if err == nil && !idTokenHint.HasAudience(ar.GetClient().GetID()) {
+			err = fosite.ErrInvalidRequest.WithHint("The id_token_hint was not issued to this client.")
+		}
+		if err != nil {
+			e.App.Logger().Info("[Plugin/OAuth2] Error occurred in ValidateIDTokenHint", slog.Any("error", err))
+			oauth2.WriteAuthorizeError(ctx, w, ar, err)
+			return nil
+		}
+	}
+
+	// The login and consent screens resume the request with a one-time
+	// verifier, everything else about the user's login is read from the login
+	// challenge rather than from the request.
+
+	loginVerifier := ar.GetRequestForm().Get("login_verifier")
+	consentVerifier := ar.GetRequestForm().Get("consent_verifier")
+	for _, param := range ignoredAuthorizeParams {
+		ar.GetRequestForm().Del(param)
+	}
+
+	acrValues, acrEssential := getRequestedACRValues(ar.GetRequestForm())
+
+	if loginVerifier == "" && consentVerifier == "" {
+		// Work out which methods the user must log in with to reach the
+		// requested acr values, failing early if the users can't.
+		var requiredAMR [][]string
+		if len(acrValues) > 0 {
+			c, err := e.App.FindCachedCollectionByNameOrId(GetOAuth2Config().UserCollection)
+			if err != nil {
 				return e.InternalServerError("Internal Error", err)
 			}
+			requiredAMR = slices.DeleteFunc(GetOAuth2Config().LevelsOfAssurance.GetRequiredAMR(acrValues), func(amr []string) bool {
+				return !canLoginWithAMR(c, amr)
+			})
+			if len(requiredAMR) == 0 && acrEssential {
+				oauth2.WriteAuthorizeError(ctx, w, ar, ErrUnmetAuthenticationRequirements.WithHint("None of the requested acr values can be reached."))
+				return nil
+			}
+		}
+		challenge, err := createLoginChallenge(e, ar, authorizationDetails, idTokenHint, requiredAMR)
+		if err != nil {
+			return e.InternalServerError("Internal Error", err)
 		}
-	}
 
-	if tokenIat := ar.GetRequestForm().Get("pb_token_iat"); len(tokenIat) > 0 {
-		if iatInt, err := strconv.ParseInt(tokenIat, 10, 64); err == nil {
-			issuedAt = time.Unix(iatInt, 0).In(time.UTC)
+		// A prompt=none request is logged in with the account of the browser
+		// session, without showing the login UI. Browsers without a matching
+		// account in their session fail with login_required.
+		if fosite.Arguments(strings.Fields(ar.GetRequestForm().Get("prompt"))).Has("none") {
+			bs, account, err := findBrowserSessionAccount(e, ar, idTokenHint)
+			if err == nil {
+				setLoginChallengeAccount(challenge, bs, account)
+				redirectTo, err := getLoginChallengeRedirect(e, challenge, "login_verifier")
+				if err != nil {
+					return e.InternalServerError("Internal Error", err)
+				}
+				return e.Redirect(http.StatusTemporaryRedirect, redirectTo)
+			}
+			if errors.Is(err, fosite.ErrNotFound) {
+				err = fosite.ErrLoginRequired.WithHint("The request has prompt=none, but the user is not logged in.")
+			} else if !errors.Is(err, ErrAccountSelectionRequired) {
+				return e.InternalServerError("Internal Error", err)
+			}
+			_ = e.App.Delete(challenge)
+			oauth2.WriteAuthorizeError(ctx, w, ar, err)
+			return nil
 		}
+		return redirectToLoginUI(e, challenge)
 	}
 
-	if rat := ar.GetRequestForm().Get("rat"); len(rat) > 0 {
-		if ratInt, err := strconv.ParseInt(rat, 10, 64); err == nil {
-			requestedAt = time.Unix(ratInt, 0).In(time.UTC)
-		}
+	var challenge *LoginChallengeModel
+	if consentVerifier != "" {
+		challenge, err = consumeLoginChallengeVerifier(e.App, "consent_verifier", consentVerifier)
+	} else {
+		challenge, err = consumeLoginChallengeVerifier(e.App, "login_verifier", loginVerifier)
 	}
-	if requestedAt.IsZero() {
-		requestedAt = ar.GetRequestedAt()
+	if err == nil && (challenge.GetClientID() != ar.GetClient().GetID() || challenge.GetRequestForm() != ar.GetRequestForm().Encode() || !hasLoginChallengeCookie(e, challenge)) {
+		err = fosite.ErrNotFound
+	}
+	if err != nil {
+		if !errors.Is(err, fosite.ErrNotFound) {
+			return e.InternalServerError("Internal Error", err)
+		}
+		e.App.Logger().Info("[Plugin/OAuth2] Invalid login or consent verifier", slog.Any("client_id", ar.GetClient().GetID()))
+		oauth2.WriteAuthorizeError(ctx, w, ar, fosite.ErrInvalidRequest.WithHint("The login or consent verifier is invalid or has expired."))
+		return nil
 	}
 
-	ar.GetRequestForm().Del("pb_token")
-	ar.GetRequestForm().Del("pb_token_iat")
-
-	if !ar.GetRequestForm().Has("rat") {
-		ar.GetRequestForm().Set("rat", strconv.FormatInt(requestedAt.Unix(), 10))
+	if err := challenge.GetError(); err != "" {
+		_ = e.App.Delete(challenge)
+		var rfcErr *fosite.RFC6749Error
+		switch err {
+		case "access_denied":
+			rfcErr = fosite.ErrAccessDenied
+		case "account_selection_required":
+			rfcErr = ErrAccountSelectionRequired
+		case "interaction_required":
+			rfcErr = fosite.ErrInteractionRequired
+		case "consent_required":
+			rfcErr = fosite.ErrConsentRequired
+		case "login_required":
+			rfcErr = fosite.ErrLoginRequired
+		case "unmet_authentication_requirements":
+			rfcErr = ErrUnmetAuthenticationRequirements
+		default:
+			rfcErr = fosite.ErrServerError.WithDebug(fmt.Sprintf("Unknown error: %s", err))
+		}
+		if description := challenge.GetErrorDescription(); description != "" {
+			rfcErr = rfcErr.WithHint(description)
+		}
+		oauth2.WriteAuthorizeError(ctx, w, ar, rfcErr)
+		return nil
 	}
 
-	if u == nil {
-		c, _ := ar.GetClient().(*client.Client)
-		state := map[string]interface{}{
-			"collection":       GetOAuth2Config().UserCollection,
-			"client_id":        c.ID,
-			"client_name":      c.Name,
-			"client_uri":       c.ClientURI,
-			"prompt":           ar.GetRequestForm().Get("prompt"),
-			"max_age":          ar.GetRequestForm().Get("max_age"),
-			"login_hint":       ar.GetRequestForm().Get("login_hint"),
-			"requested_scopes": ar.GetRequestedScopes(),
-			"redirect_uri":     e.App.Settings().Meta.AppURL + GetOAuth2Config().PathPrefix + "/auth?" + ar.GetRequestForm().Encode(),
+	u, err := findLoginChallengeUser(e.App, challenge)
+	if err != nil {
+		if !errors.Is(err, fosite.ErrNotFound) {
+			return e.InternalServerError("Internal Error", err)
 		}
-		// Base64-URL encode the state to make it safe for URL usage.
-		stateBytes, _ := json.Marshal(state)
-		stateB64Str := base64.RawURLEncoding.EncodeToString(stateBytes)
-		return e.Redirect(http.StatusTemporaryRedirect, e.App.Settings().Meta.AppURL+GetOAuth2Config().PathPrefix+"/login?state="+stateB64Str)
+		oauth2.WriteAuthorizeError(ctx, w, ar, fosite.ErrLoginRequired.WithHint("The user that logged in no longer exists."))
+		return nil
 	}
 
+	issuedAt := challenge.GetAuthTime()
+	requestedAt := challenge.GetRequestedAt()
+	ar.GetRequestForm().Set("rat", strconv.FormatInt(requestedAt.Unix(), 10))
+
+	consentGranted := consentVerifier != "" && challenge.IsConsentGranted()
+	consentScopes, hasConsentScopes := challenge.GetGrantedScopes()
+
 	// Check if the user belongs to the expected collection. This is optional,
 	// but it can be a good way to ensure that the login hasn't been tampered
 	// with.
@@ -115,11 +218,134 @@ func api_OAuth2Authorize(e *core.RequestEvent) error {
 		return e.BadRequestError("Invalid user collection", nil)
 	}
 
-	// At this point, the user is authenticated and we can grant the requested scopes.
+	// The login challenge records the methods the user logged in with, the acr
+	// is the level of assurance they reach unless a headless login provider
+	// reported it.
 
-	for _, scope := range ar.GetRequestedScopes() {
+	amr := challenge.GetAMR()
+	acr := challenge.GetACR()
+	if acr == "" {
+		acr = GetOAuth2Config().LevelsOfAssurance.GetACR(amr)
+	}
+
+	// Check that the login satisfies the prompt, max_age, login_hint,
+	// id_token_hint and essential acr_values params of the request. The login UI should already have made sure of this, but
+	// we can't rely on it.
+
+	if err := checkAuthenticationRequirements(ar, u, issuedAt, requestedAt, idTokenHint, acr); err != nil {
+		e.App.Logger().Info("[Plugin/OAuth2] Login doesn't satisfy the authentication requirements", slog.Any("client_id", ar.GetClient().GetID()), slog.Any("error", err))
+		oauth2.WriteAuthorizeError(ctx, w, ar, err)
+		return nil
+	}
+
+	// Check that the user is allowed to sign in to the client.
+
+	if ok, err := isAllowedUser(e.App, ar.GetClient(), u); err != nil {
+		e.App.Logger().Error("[Plugin/OAuth2] Failed to evaluate the allowed users filter", slog.Any("client_id", ar.GetClient().GetID()), slog.Any("error", err))
+		oauth2.WriteAuthorizeError(ctx, w, ar, fosite.ErrServerError.WithWrap(err))
+		return nil
+	} else if !ok {
+		e.App.Logger().Warn(
+			"[Plugin/OAuth2] User is not allowed to sign in to the client",
+			slog.Any("client_id", ar.GetClient().GetID()),
+			slog.Any("user_id", u.Id),
+		)
+		oauth2.WriteAuthorizeError(ctx, w, ar, fosite.ErrAccessDenied.WithHint("The user is not allowed to sign in to this client."))
+		return nil
+	}
+
+	// Decide which of the requested scopes can be granted to the client for the
+	// user, and narrow them down to the scopes granted on the consent screen.
+
+	approvedScopes, err := GetOAuth2Config().ScopeGrantStrategy.GetGrantedScopes(e, u, ar.GetClient(), ar.GetRequestedAudience(), ar.GetRequestedScopes())
+	if err != nil {
+		e.App.Logger().Error("[Plugin/OAuth2] Failed to resolve the granted scopes", slog.Any("error", err))
+		oauth2.WriteAuthorizeError(ctx, w, ar, fosite.ErrServerError.WithWrap(err))
+		return nil
+	}
+	if consentGranted && hasConsentScopes {
+		approvedScopes = slices.DeleteFunc(approvedScopes, func(scope string) bool {
+			return !slices.Contains(consentScopes, scope)
+		})
+	}
+
+	// Check that the user has consented to the request. The consent screen is
+	// skipped when an unexpired consent grant already covers the requested
+	// scopes and audience, unless the client asks for it with prompt=consent.
+	// Authorization details describe a single transaction, so they always
+	// require consent.
+	// @ref https://openid.net/specs/openid-connect-core-1_0.html#Consent
+
+	if consentGranted {
+		// The consent grant is only stored if the consent should be
+		// remembered, otherwise it applies to this request only.
+		if challenge.IsConsentRemembered() {
+			err := saveConsentModel(e.App, u, ar.GetClient().GetID(), approvedScopes, ar.GetRequestedAudience(), GetOAuth2Config().ConsentLifespan)
+			if err != nil {
+				e.App.Logger().Error("[Plugin/OAuth2] Failed to save consent grant", slog.Any("error", err))
+				oauth2.WriteAuthorizeError(ctx, w, ar, fosite.ErrServerError.WithWrap(err))
+				return nil
+			}
+		}
+	} else {
+		prompt := fosite.Arguments(strings.Fields(ar.GetRequestForm().Get("prompt")))
+		consent, err := findConsentModel(e.App, u, ar.GetClient().GetID())
+		if err != nil && !errors.Is(err, fosite.ErrNotFound) {
+			return e.InternalServerError("Internal Error", err)
+		}
+		if err != nil || prompt.Has("consent") || len(authorizationDetails) > 0 || !consent.Covers(ctx, approvedScopes, ar.GetRequestedAudience()) {
+			if prompt.Has("none") {
+				oauth2.WriteAuthorizeError(ctx, w, ar, fosite.ErrConsentRequired)
+				return nil
+			}
+			state := challenge.GetState()
+			state["consent_subject"] = u.Id
+			state["requested_scopes"] = approvedScopes
+			challenge.Set("phase", LoginChallengePhaseConsent)
+			challenge.Set("state", state)
+			if err := e.App.Save(challenge); err != nil {
+				return e.InternalServerError("Internal Error", err)
+			}
+			return redirectToLoginUI(e, challenge)
+		}
+	}
+
+	// Incremental authorization, the new grant includes the scopes the user has
+	// previously granted to the client, as long as the client is still allowed
+	// to request them.
+	// @ref https://developers.google.com/identity/protocols/oauth2/web-server#incrementalAuth
+
+	if ar.GetRequestForm().Get("include_granted_scopes") == "true" {
+		scopes, err := findGrantedScopes(e.App, u, ar.GetClient().GetID())
+		if err != nil {
+			return e.InternalServerError("Internal Error", err)
+		}
+		scopeStrategy := GetOAuth2Config().GetScopeStrategy(ctx)
+		scopes = slices.DeleteFunc(scopes, func(scope string) bool {
+			return !scopeStrategy(ar.GetClient().GetScopes(), scope)
+		})
+		scopes, err = GetOAuth2Config().ScopeGrantStrategy.GetGrantedScopes(e, u, ar.GetClient(), ar.GetRequestedAudience(), scopes)
+		if err != nil {
+			e.App.Logger().Error("[Plugin/OAuth2] Failed to resolve the granted scopes", slog.Any("error", err))
+			oauth2.WriteAuthorizeError(ctx, w, ar, fosite.ErrServerError.WithWrap(err))
+			return nil
+		}
+		approvedScopes = mergeArguments(approvedScopes, scopes)
+	}
+
+	// At this point, the user is authenticated and we can grant the scopes they
+	// approved. Clients must handle partial grants when the user deselects any
+	// of their optional scopes.
+
+	for _, scope := range approvedScopes {
 		ar.GrantScope(scope)
 	}
+	for _, audience := range ar.GetRequestedAudience() {
+		ar.GrantAudience(audience)
+	}
+	for _, audience := range getResourceAudience(resources, ar.GetGrantedScopes()) {
+		ar.GrantAudience(audience)
+	}
 
 	//
 
@@ -127,21 +353,37 @@ func api_OAuth2Authorize(e *core.RequestEvent) error {
 	mySessionData := NewSession(e.App, u.Id, u.Collection().Id)
 	mySessionData.Claims.AuthTime = issuedAt
 	mySessionData.Claims.RequestedAt = requestedAt
+	mySessionData.AuthorizationDetails = authorizationDetails
+	mySessionData.TokenKeyHash = hashTokenKey(u.TokenKey())
 
-	var loa int = 1  // Level of Assurance (LOA)
-	var amr []string // Authentication Methods References (AMR)
-	if u.Collection().PasswordAuth.Enabled {
-		amr = append(amr, "pwd")
+	if len(amr) > 0 {
+		mySessionData.Claims.AuthenticationMethodsReferences = amr
 	}
-	if u.Collection().OTP.Enabled {
-		amr = append(amr, "otp")
+	mySessionData.Claims.AuthenticationContextClassReference = acr
+
+	// The ID token identifies the browser session the user logged in with, so
+	// that the client can match it with later logout requests.
+	// @ref https://openid.net/specs/openid-connect-frontchannel-1_0.html#ClaimsContents
+	browserSession, err := findOrNewBrowserSession(e)
+	if err != nil {
+		return e.InternalServerError("Internal Error", err)
 	}
-	if u.Collection().MFA.Enabled {
-		loa += 1
-		amr = append(amr, "mfa")
+	mySessionData.Claims.Add("sid", browserSession.GetSID())
+
+	// Include any aggregated and distributed claims in the ID token, these are
+	// resolved using the same strategy as the /userinfo endpoint.
+	if GetOAuth2Config().EnableAggregatedAndDistributedClaims {
+		sources, err := getIDTokenClaimSources(e, u, ar.GetGrantedScopes())
+		if err != nil {
+			e.App.Logger().Error("[Plugin/OAuth2] Failed to resolve aggregated and distributed claims", slog.Any("error", err))
+			oauth2.WriteAuthorizeError(ctx, w, ar, fosite.ErrServerError.WithWrap(err))
+			return nil
+		}
+		if !sources.IsEmpty() {
+			mySessionData.Claims.Add("_claim_names", sources.ClaimNames)
+			mySessionData.Claims.Add("_claim_sources", sources.ClaimSources)
+		}
 	}
-	mySessionData.Claims.AuthenticationMethodsReferences = amr
-	mySessionData.Claims.AuthenticationContextClassReference = fmt.Sprintf("loa%d", loa)
 
 	// When using the HMACSHA strategy you must use something that implements the HMACSessionContainer.
 	// It brings you the power of overriding the default values.
@@ -184,7 +426,142 @@ func api_OAuth2Authorize(e *core.RequestEvent) error {
 		return nil
 	}
 
+	// Record the login and the client in the browser session, so that later
+	// prompt=none requests and the logout can find them.
+	if err := saveBrowserSessionLogin(e, browserSession, challenge, ar.GetClient().GetID()); err != nil {
+		e.App.Logger().Error("[Plugin/OAuth2] Failed to save browser session", slog.Any("error", err))
+		oauth2.WriteAuthorizeError(ctx, w, ar, fosite.ErrServerError.WithWrap(err))
+		return nil
+	}
+
+	// Clients using OIDC Session Management compare the session_state with
+	// the browser state in the check session iframe.
+	// @ref https://openid.net/specs/openid-connect-session-1_0.html#CreatingUpdatingSessions
+	if ar.GetGrantedScopes().Has("openid") {
+		response.AddParameter("session_state", getSessionState(ar.GetClient().GetID(), ar.GetRedirectURI(), getBrowserState(browserSession)))
+	}
+
+	// The login challenge is complete, make sure it can't be replayed.
+	if err := e.App.Delete(challenge); err != nil {
+		e.App.Logger().Warn("[Plugin/OAuth2] Failed to delete login challenge", slog.Any("error", err))
+	}
+
 	// Last but not least, send the response!
 	oauth2.WriteAuthorizeResponse(ctx, w, ar, response)
 	return nil
 }
+
+// getOptionalScopes returns the requested scopes that the client marked as
+// optional, which the user can deselect on the consent screen. The openid
+// scope is always required.
+func getOptionalScopes(ar fosite.AuthorizeRequester) []string {
+	ret := []string{}
+	c, ok := ar.GetClient().(*client.Client)
+	if !ok {
+		return ret
+	}
+	for _, scope := range ar.GetRequestedScopes() {
+		if scope != "openid" && c.GetOptionalScopes().Has(scope) {
+			ret = append(ret, scope)
+		}
+	}
+	return ret
+}
+
+// getApprovedScopes returns the scopes that the user approved on the consent
+// screen. The required scopes are always approved, and the optional scopes
+// only if the user kept them selected.
+func getApprovedScopes(scopes []string, optional fosite.Arguments, selected []string) []string {
+	ret := []string{}
+	for _, scope := range scopes {
+		if !optional.Has(scope) || slices.Contains(selected, scope) {
+			ret = append(ret, scope)
+		}
+	}
+	return ret
+}
+
+// checkAuthenticationRequirements checks that the user's login satisfies the
+// prompt, max_age, login_hint, id_token_hint and essential acr_values params
+// of the authorization request.
+// @ref https://openid.net/specs/openid-connect-core-1_0.html#AuthRequest
+func checkAuthenticationRequirements(ar fosite.AuthorizeRequester, u *core.Record, authTime time.Time, requestedAt time.Time, idTokenHint *IDTokenHint, acr string) error {
+	form := ar.GetRequestForm()
+	prompt := fosite.Arguments(strings.Fields(form.Get("prompt")))
+
+	// A max_age of zero is equivalent to prompt=login.
+	if maxAge, err := strconv.ParseInt(form.Get("max_age"), 10, 64); err == nil && maxAge >= 0 {
+		if authTime.IsZero() || authTime.Add(time.Duration(maxAge)*time.Second).Before(requestedAt) {
+			return fosite.ErrLoginRequired.WithHint("The user's authentication is older than the max_age of the request.")
+		}
+	}
+
+	if prompt.Has("login") && (authTime.IsZero() || authTime.Before(requestedAt)) {
+		return fosite.ErrLoginRequired.WithHint("The request has prompt=login, but the user did not log in again.")
+	}
+
+	// The login_hint is only a hint for interactive requests, the user may
+	// choose to log in with another account.
+	if hint := form.Get("login_hint"); hint != "" && prompt.Has("none") && !matchLoginHint(u, hint) {
+		return fosite.ErrLoginRequired.WithHint("The logged in user does not match the login_hint of the request.")
+	}
+
+	if idTokenHint != nil && idTokenHint.Subject != u.Id {
+		return fosite.ErrLoginRequired.WithHint("The logged in user is not the subject of the id_token_hint.")
+	}
+
+	// Voluntary acr values are met on a best effort basis, the ID token tells
+	// the client which level the login actually reached.
+	if values, essential := getRequestedACRValues(form); essential && !GetOAuth2Config().LevelsOfAssurance.Satisfies(acr, values) {
+		return ErrUnmetAuthenticationRequirements.WithHintf("The login reached the acr %q, which doesn't meet the requested acr values.", acr)
+	}
+
+	return nil
+}
+
+// getRequestedACRValues returns the acr values requested by the client, and
+// whether they are essential. The acr values are voluntary, unless they are
+// requested as an essential claim with the claims param.
+// @ref https://openid.net/specs/openid-connect-core-1_0.html#acrSemantics
+func getRequestedACRValues(form url.Values) ([]string, bool) {
+	var claims struct {
+		IDToken map[string]*struct {
+			Essential bool     `json:"essential"`
+			Value     string   `json:"value"`
+			Values    []string `json:"values"`
+		} `json:"id_token"`
+	}
+	if err := json.Unmarshal([]byte(form.Get("claims")), &claims); err == nil {
+		if acr := claims.IDToken["acr"]; acr != nil {
+			values := acr.Values
+			if acr.Value != "" {
+				values = append(values, acr.Value)
+			}
+			if len(values) > 0 {
+				return values, acr.Essential
+			}
+		}
+	}
+	return strings.Fields(form.Get("acr_values")), false
+}
+
+// matchLoginHint reports whether the login hint identifies the user, by their
+// email or username.
+func matchLoginHint(u *core.Record, hint string) bool {
+	if email := u.Email(); email != "" && strings.EqualFold(email, hint) {
+		return true
+	}
+	if username := u.GetString("username"); username != "" && strings.EqualFold(username, hint) {
+		return true
+	}
+	return false
+}
+
+// isAllowedUser reports whether the user satisfies the allowed users filter of
+// the client.
+func isAllowedUser(app core.App, c fosite.Client, user *core.Record) (bool, error) {
+	if c, ok := c.(*client.Client); ok {
+		return matchRecordFilter(app, user, c.AllowedUsersFilter)
+	}
+	return true, nil
+}
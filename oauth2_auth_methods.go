@@ -0,0 +1,257 @@
+package oauth2
+
+import (
+	"errors"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/ory/fosite"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/security"
+)
+
+// Authentication Method Reference (AMR) values of the PocketBase auth methods.
+// PocketBase doesn't tell which upstream methods an OAuth2 provider used, so
+// logins with a provider are recorded as federated.
+// @ref https://datatracker.ietf.org/doc/html/rfc8176#section-2
+const (
+	AMRPassword    = "pwd"
+	AMROTP         = "otp"
+	AMRMultiFactor = "mfa"
+	AMRFederated   = "fed"
+)
+
+// authTokenAMRClaim and authTokenAuthTimeClaim are the claims of the user's
+// PocketBase auth token that record the methods the user logged in with, and
+// when they did.
+const (
+	authTokenAMRClaim      = "amr"
+	authTokenAuthTimeClaim = "auth_time"
+)
+
+// ErrUnmetAuthenticationRequirements is returned when the login can't reach
+// the acr values that the client requested as essential.
+// @ref https://openid.net/specs/openid-connect-unmet-authentication-requirements-1_0.html
+var ErrUnmetAuthenticationRequirements = &fosite.RFC6749Error{
+	ErrorField:       "unmet_authentication_requirements",
+	DescriptionField: "The Authorization Server is unable to meet the requirements of the Relying Party for the authentication of the End-User.",
+	CodeField:        http.StatusBadRequest,
+}
+
+// LevelOfAssurance is an Authentication Context Class Reference (ACR) value,
+// along with the AMR values that the user must have all logged in with to
+// reach it.
+type LevelOfAssurance struct {
+	ACR string   `json:"acr"`
+	AMR []string `json:"amr"`
+}
+
+// LevelsOfAssurance maps the methods a user logged in with to an ACR value.
+// The levels are ordered from the lowest to the highest, and a login gets the
+// ACR of the highest level it reaches. Several levels can share the same ACR
+// to allow different combinations of methods, for example
+//
+//	LevelsOfAssurance{
+//		{ACR: "loa1"},
+//		{ACR: "loa2", AMR: []string{"mfa"}},
+//		{ACR: "loa2", AMR: []string{"fed"}},
+//	}
+type LevelsOfAssurance []LevelOfAssurance
+
+// DefaultLevelsOfAssurance is used when the config doesn't define any levels,
+// any login is "loa1" and a login with a second factor is "loa2".
+var DefaultLevelsOfAssurance = LevelsOfAssurance{
+	{ACR: "loa1"},
+	{ACR: "loa2", AMR: []string{AMRMultiFactor}},
+}
+
+// GetACR returns the ACR of the highest level reached with the AMR values, or
+// an empty string if no level is reached.
+func (l LevelsOfAssurance) GetACR(amr []string) string {
+	for i := len(l) - 1; i >= 0; i-- {
+		if !slices.ContainsFunc(l[i].AMR, func(method string) bool { return !slices.Contains(amr, method) }) {
+			return l[i].ACR
+		}
+	}
+	return ""
+}
+
+// Values returns the distinct ACR values of the levels, from the lowest to the
+// highest.
+func (l LevelsOfAssurance) Values() []string {
+	ret := []string{}
+	for _, level := range l {
+		if !slices.Contains(ret, level.ACR) {
+			ret = append(ret, level.ACR)
+		}
+	}
+	return ret
+}
+
+// Satisfies reports whether the acr meets any of the requested acr values. A
+// level meets the requested values of the same or lower levels, unknown values
+// are only met by the same acr.
+func (l LevelsOfAssurance) Satisfies(acr string, requested []string) bool {
+	if len(requested) == 0 {
+		return true
+	}
+	values := l.Values()
+	for _, value := range requested {
+		if value == acr {
+			return true
+		}
+		if rank := slices.Index(values, value); rank >= 0 && slices.Index(values, acr) >= rank {
+			return true
+		}
+	}
+	return false
+}
+
+// GetRequiredAMR returns the combinations of AMR values that reach any of the
+// requested acr values.
+func (l LevelsOfAssurance) GetRequiredAMR(requested []string) [][]string {
+	ret := [][]string{}
+	for _, level := range l {
+		if l.Satisfies(level.ACR, requested) {
+			ret = append(ret, append([]string{}, level.AMR...))
+		}
+	}
+	return ret
+}
+
+//
+
+// canLoginWithAMR reports whether the users of the collection can log in with
+// all the AMR values. Values other than the PocketBase auth methods can only
+// be reported by a headless login provider, so they are assumed to be
+// possible.
+func canLoginWithAMR(c *core.Collection, amr []string) bool {
+	for _, method := range amr {
+		switch method {
+		case AMRPassword:
+			if !c.PasswordAuth.Enabled {
+				return false
+			}
+		case AMROTP:
+			if !c.OTP.Enabled {
+				return false
+			}
+		case AMRFederated:
+			if !c.OAuth2.Enabled {
+				return false
+			}
+		case AMRMultiFactor:
+			if !c.MFA.Enabled {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// getAuthMethodAMR returns the AMR value of a PocketBase auth method.
+func getAuthMethodAMR(method string) string {
+	switch method {
+	case core.MFAMethodPassword:
+		return AMRPassword
+	case core.MFAMethodOTP:
+		return AMROTP
+	case core.MFAMethodOAuth2:
+		return AMRFederated
+	}
+	return ""
+}
+
+// recordAuthMethods adds the methods the user logged in with, and the time
+// they did, to the auth token, so that the login challenge can pass them on
+// to the ID token.
+// Only the logins of the login UI, which pass the pending login_challenge
+// they are for, are recorded. Other auth tokens of the user collection are
+// left as PocketBase issued them, and so are refreshed tokens, as the user
+// didn't log in again.
+func recordAuthMethods(e *core.RecordAuthRequestEvent) error {
+	info, err := e.RequestInfo()
+	if err != nil {
+		return err
+	}
+	if _, err := findLoginChallenge(e.App, info.Query["login_challenge"], "login"); err != nil {
+		if errors.Is(err, fosite.ErrNotFound) {
+			return e.Next()
+		}
+		return err
+	}
+
+	amr := []string{}
+
+	// The first factor of an MFA login is recorded in the MFA record, which is
+	// deleted once the login completes.
+	mfaId := info.Query["mfaId"]
+	if mfaId == "" {
+		mfaId, _ = info.Body["mfaId"].(string)
+	}
+	if mfaId != "" {
+		mfa, err := e.App.FindMFAById(mfaId)
+		if err == nil && mfa.RecordRef() == e.Record.Id && mfa.CollectionRef() == e.Record.Collection().Id {
+			if method := getAuthMethodAMR(mfa.Method()); method != "" {
+				amr = append(amr, method)
+			}
+		}
+	}
+	if method := getAuthMethodAMR(e.AuthMethod); method != "" && !slices.Contains(amr, method) {
+		amr = append(amr, method)
+	}
+	if len(amr) == 0 {
+		return e.Next()
+	}
+	if len(amr) > 1 {
+		amr = append(amr, AMRMultiFactor)
+	}
+
+	claims, err := security.ParseUnverifiedJWT(e.Token)
+	if err != nil {
+		return err
+	}
+	claims[authTokenAMRClaim] = amr
+	claims[authTokenAuthTimeClaim] = time.Now().Unix()
+	token, err := security.NewJWT(
+		claims,
+		e.Record.TokenKey()+e.Record.Collection().AuthToken.Secret,
+		e.Record.Collection().AuthToken.DurationTime(),
+	)
+	if err != nil {
+		return err
+	}
+	e.Token = token
+	return e.Next()
+}
+
+// getAuthTokenAMR returns the methods recorded in the user's auth token.
+func getAuthTokenAMR(token string) []string {
+	ret := []string{}
+	claims, err := security.ParseUnverifiedJWT(token)
+	if err != nil {
+		return ret
+	}
+	amr, _ := claims[authTokenAMRClaim].([]any)
+	for _, v := range amr {
+		if s, ok := v.(string); ok {
+			ret = append(ret, s)
+		}
+	}
+	return ret
+}
+
+// getAuthTokenAuthTime returns the time the user logged in, as recorded in
+// their auth token, or the zero time if the token doesn't record it.
+func getAuthTokenAuthTime(token string) time.Time {
+	claims, err := security.ParseUnverifiedJWT(token)
+	if err != nil {
+		return time.Time{}
+	}
+	authTime, ok := claims[authTokenAuthTimeClaim].(float64)
+	if !ok {
+		return time.Time{}
+	}
+	return time.Unix(int64(authTime), 0).UTC()
+}
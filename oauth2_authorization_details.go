@@ -0,0 +1,153 @@
+package oauth2
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"reflect"
+	"slices"
+	"sort"
+	"sync"
+
+	"github.com/ory/fosite"
+)
+
+// @ref https://datatracker.ietf.org/doc/html/rfc9396
+
+// ErrInvalidAuthorizationDetails is returned when the authorization details
+// parameter is malformed, uses an unknown type or fails validation.
+// @ref https://datatracker.ietf.org/doc/html/rfc9396#section-5
+var ErrInvalidAuthorizationDetails = &fosite.RFC6749Error{
+	ErrorField:       "invalid_authorization_details",
+	DescriptionField: "The authorization details are invalid, use an unknown type, or are not allowed for the client.",
+	CodeField:        http.StatusBadRequest,
+}
+
+// AuthorizationDetail is a single authorization details object. Besides the
+// required "type" field, the common fields are "locations", "actions",
+// "datatypes", "identifier" and "privileges", any other fields are specific
+// to the type.
+type AuthorizationDetail map[string]any
+
+// Type returns the type of the authorization details object.
+func (d AuthorizationDetail) Type() string {
+	v, _ := d["type"].(string)
+	return v
+}
+
+// AuthorizationDetailsType describes an authorization details type that clients
+// can request using the authorization_details parameter.
+type AuthorizationDetailsType struct {
+	// Type
+	// The identifier of the authorization details type, matched against the
+	// "type" field of the requested authorization details objects.
+	Type string
+
+	// Describe
+	// Optional. Returns a human readable description of the authorization
+	// details object, shown to the user on the consent screen.
+	Describe func(detail AuthorizationDetail) string
+
+	// Validate
+	// Optional. Validates the authorization details object requested by the
+	// client. Returning an error rejects the request with the
+	// invalid_authorization_details error.
+	Validate func(client fosite.Client, detail AuthorizationDetail) error
+}
+
+var oauth2AuthorizationDetailsTypes = map[string]*AuthorizationDetailsType{}
+var oauth2AuthorizationDetailsTypesMu = &sync.RWMutex{}
+
+// RegisterAuthorizationDetailsType adds an authorization details type to the
+// registry. The type is advertised in the authorization server metadata and
+// the protected resource metadata.
+func RegisterAuthorizationDetailsType(t *AuthorizationDetailsType) {
+	oauth2ProviderMetadataMu.Lock()
+	oauth2AuthorizationDetailsTypesMu.Lock()
+
+	oauth2AuthorizationDetailsTypes[t.Type] = t
+
+	if !slices.Contains(oauth2ProviderMetadata.AuthorizationDetailsTypesSupported, t.Type) {
+		oauth2ProviderMetadata.AuthorizationDetailsTypesSupported = append(oauth2ProviderMetadata.AuthorizationDetailsTypesSupported, t.Type)
+	}
+
+	oauth2AuthorizationDetailsTypesMu.Unlock()
+	oauth2ProviderMetadataMu.Unlock()
+}
+
+// getAuthorizationDetailsTypes returns the sorted identifiers of the
+// registered authorization details types.
+func getAuthorizationDetailsTypes() []string {
+	oauth2AuthorizationDetailsTypesMu.RLock()
+	defer oauth2AuthorizationDetailsTypesMu.RUnlock()
+
+	ret := make([]string, 0, len(oauth2AuthorizationDetailsTypes))
+	for k := range oauth2AuthorizationDetailsTypes {
+		ret = append(ret, k)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// getRequestedAuthorizationDetails parses and validates the authorization
+// details parameter of the request.
+func getRequestedAuthorizationDetails(form url.Values, client fosite.Client) ([]AuthorizationDetail, error) {
+	raw := form.Get("authorization_details")
+	if raw == "" {
+		return nil, nil
+	}
+
+	var details []AuthorizationDetail
+	if err := json.Unmarshal([]byte(raw), &details); err != nil {
+		return nil, ErrInvalidAuthorizationDetails.WithHint("The authorization_details parameter must be a JSON array of objects.").WithWrap(err).WithDebug(err.Error())
+	}
+
+	oauth2AuthorizationDetailsTypesMu.RLock()
+	defer oauth2AuthorizationDetailsTypesMu.RUnlock()
+
+	for _, detail := range details {
+		t, ok := oauth2AuthorizationDetailsTypes[detail.Type()]
+		if !ok {
+			return nil, ErrInvalidAuthorizationDetails.WithHintf("The authorization details type '%s' is not supported.", detail.Type())
+		}
+		if t.Validate != nil {
+			if err := t.Validate(client, detail); err != nil {
+				return nil, ErrInvalidAuthorizationDetails.WithHintf("The authorization details of type '%s' are invalid.", detail.Type()).WithWrap(err).WithDebug(err.Error())
+			}
+		}
+	}
+
+	return details, nil
+}
+
+// validateGrantedAuthorizationDetails checks that each of the authorization
+// details requested at the token endpoint was part of the original grant.
+func validateGrantedAuthorizationDetails(granted []AuthorizationDetail, details []AuthorizationDetail) error {
+	for _, detail := range details {
+		if !slices.ContainsFunc(granted, func(g AuthorizationDetail) bool { return reflect.DeepEqual(g, detail) }) {
+			return ErrInvalidAuthorizationDetails.WithHintf("The authorization details of type '%s' were not part of the original grant.", detail.Type())
+		}
+	}
+	return nil
+}
+
+// describeAuthorizationDetails returns the authorization details along with
+// their descriptions, for display on the consent screen.
+func describeAuthorizationDetails(details []AuthorizationDetail) []map[string]any {
+	oauth2AuthorizationDetailsTypesMu.RLock()
+	defer oauth2AuthorizationDetailsTypesMu.RUnlock()
+
+	ret := make([]map[string]any, 0, len(details))
+	for _, detail := range details {
+		description := detail.Type()
+		if t, ok := oauth2AuthorizationDetailsTypes[detail.Type()]; ok && t.Describe != nil {
+			description = t.Describe(detail)
+		}
+		ret = append(ret, map[string]any{
+			"type":        detail.Type(),
+			"description": description,
+			"detail":      detail,
+		})
+	}
+	return ret
+}
@@ -0,0 +1,216 @@
+package oauth2
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/benjamesfleming/pocketbase-ext-oauth2/client"
+	"github.com/benjamesfleming/pocketbase-ext-oauth2/consts"
+	"github.com/google/uuid"
+	"github.com/ory/fosite"
+	"github.com/ory/fosite/token/jwt"
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+)
+
+// @ref https://openid.net/specs/openid-connect-backchannel-1_0.html
+
+const (
+	backChannelLogoutEvent = "http://schemas.openid.net/event/backchannel-logout"
+
+	// backChannelLogoutTokenLifespan is how long a logout token is valid for
+	// after it is issued. A new token is issued for each delivery attempt.
+	backChannelLogoutTokenLifespan = time.Minute * 2
+
+	// backChannelLogoutMaxAttempts is the number of times a delivery is
+	// attempted before it is given up on. The delay between attempts doubles
+	// each time, starting at one minute, up to an hour.
+	backChannelLogoutMaxAttempts = 8
+)
+
+var backChannelLogoutHTTPClient = &http.Client{
+	Timeout: time.Second * 10,
+	// The RP must respond to the backchannel_logout_uri itself.
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// backChannelLogoutMu prevents the same delivery from being attempted twice
+// at once, when a delivery is triggered while the cron job is running.
+var backChannelLogoutMu sync.Mutex
+
+// enqueueBackChannelLogouts queues a logout token for each of the clients that
+// registered a backchannel_logout_uri. The deliveries are attempted as soon as
+// they are saved, and retried by the cron job if they fail.
+func enqueueBackChannelLogouts(app core.App, subject string, sid string, clientIDs []string) error {
+	ctx := context.Background()
+	for _, clientID := range clientIDs {
+		fc, err := GetOAuth2Store().GetClient(ctx, clientID)
+		if err != nil {
+			if errors.Is(err, fosite.ErrNotFound) {
+				continue
+			}
+			return err
+		}
+		if c, ok := fc.(*client.Client); !ok || c.BackChannelLogoutURI == "" {
+			continue
+		}
+
+		m := NewBackChannelLogoutModel(app)
+		m.Set("client_id", clientID)
+		m.Set("subject", subject)
+		m.Set("sid", sid)
+		m.Set("attempts", 0)
+		m.Set("next_attempt_at", time.Now().Unix())
+		if err := app.Save(m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deliverBackChannelLogouts attempts all the deliveries that are due, and logs
+// the result of each attempt.
+func deliverBackChannelLogouts(app core.App) {
+	backChannelLogoutMu.Lock()
+	defer backChannelLogoutMu.Unlock()
+
+	var deliveries []*BackChannelLogoutModel
+	err := app.RecordQuery(consts.BackChannelLogoutCollectionName).
+		AndWhere(dbx.NewExp("next_attempt_at <= {:now}", dbx.Params{"now": time.Now().Unix()})).
+		OrderBy("next_attempt_at ASC").
+		All(&deliveries)
+	if err != nil {
+		app.Logger().Error("[Plugin/OAuth2] Failed to query back-channel logout deliveries", slog.Any("error", err))
+		return
+	}
+
+	for _, m := range deliveries {
+		logAttrs := []any{
+			slog.Any("client_id", m.GetClientID()),
+			slog.Any("subject", m.GetSubject()),
+			slog.Any("sid", m.GetSID()),
+		}
+
+		err := deliverBackChannelLogout(m)
+		switch {
+		case err == nil:
+			app.Logger().Info("[Plugin/OAuth2] Back-channel logout delivered", logAttrs...)
+		case errors.Is(err, errBackChannelLogoutSkipped):
+			app.Logger().Warn("[Plugin/OAuth2] Back-channel logout skipped", append(logAttrs, slog.Any("reason", err))...)
+		case m.GetAttempts()+1 >= backChannelLogoutMaxAttempts:
+			app.Logger().Error("[Plugin/OAuth2] Back-channel logout failed, giving up", append(logAttrs, slog.Any("attempts", m.GetAttempts()+1), slog.Any("error", err))...)
+		default:
+			attempts := m.GetAttempts() + 1
+			m.Set("attempts", attempts)
+			m.Set("next_attempt_at", time.Now().Add(getBackChannelLogoutRetryDelay(attempts)).Unix())
+			m.Set("last_error", err.Error())
+			app.Logger().Warn("[Plugin/OAuth2] Back-channel logout failed, will retry", append(logAttrs, slog.Any("attempts", attempts), slog.Any("error", err))...)
+			if err := app.Save(m); err != nil {
+				app.Logger().Error("[Plugin/OAuth2] Failed to save back-channel logout delivery", append(logAttrs, slog.Any("error", err))...)
+			}
+			continue
+		}
+
+		if err := app.Delete(m); err != nil {
+			app.Logger().Error("[Plugin/OAuth2] Failed to delete back-channel logout delivery", append(logAttrs, slog.Any("error", err))...)
+		}
+	}
+}
+
+// getBackChannelLogoutRetryDelay returns the delay before the next attempt,
+// after the given number of failed attempts.
+func getBackChannelLogoutRetryDelay(attempts int) time.Duration {
+	return min(time.Minute<<(attempts-1), time.Hour)
+}
+
+var errBackChannelLogoutSkipped = errors.New("back-channel logout skipped")
+
+// deliverBackChannelLogout posts a logout token to the backchannel_logout_uri
+// of the client. Deliveries that can't be made, because the client no longer
+// exists, its URI isn't an http(s) URI, or it requires a sid the logout
+// doesn't have, are skipped rather than retried. Redirects aren't followed.
+func deliverBackChannelLogout(m *BackChannelLogoutModel) error {
+	ctx := context.Background()
+	fc, err := GetOAuth2Store().GetClient(ctx, m.GetClientID())
+	if errors.Is(err, fosite.ErrNotFound) {
+		return fmt.Errorf("%w: the client no longer exists", errBackChannelLogoutSkipped)
+	} else if err != nil {
+		return err
+	}
+	c, ok := fc.(*client.Client)
+	if !ok || c.BackChannelLogoutURI == "" {
+		return fmt.Errorf("%w: the client has no backchannel_logout_uri", errBackChannelLogoutSkipped)
+	}
+	if !isSecureClientURI(c.BackChannelLogoutURI, true) {
+		return fmt.Errorf("%w: the backchannel_logout_uri isn't an http(s) URI", errBackChannelLogoutSkipped)
+	}
+	if c.BackChannelLogoutSessionRequired && m.GetSID() == "" {
+		return fmt.Errorf("%w: the client requires a sid, but the logout isn't tied to a session", errBackChannelLogoutSkipped)
+	}
+
+	token, err := NewLogoutToken(ctx, c.ID, m.GetSubject(), m.GetSID())
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.BackChannelLogoutURI, strings.NewReader(url.Values{"logout_token": {token}}.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	res, err := backChannelLogoutHTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("the backchannel_logout_uri responded with status %d", res.StatusCode)
+	}
+	return nil
+}
+
+// NewLogoutToken returns a logout token for the client, signed with the
+// provider's private key. It identifies the user by the subject, and the OP
+// session they logged out of by the sid, either of which can be empty.
+// @ref https://openid.net/specs/openid-connect-backchannel-1_0.html#LogoutToken
+func NewLogoutToken(ctx context.Context, clientID string, subject string, sid string) (string, error) {
+	now := time.Now()
+	claims := jwt.MapClaims{
+		"iss": oauth2ProviderMetadata.Issuer,
+		"aud": []string{clientID},
+		"iat": now.Unix(),
+		"exp": now.Add(backChannelLogoutTokenLifespan).Unix(),
+		"jti": uuid.NewString(),
+		"events": map[string]any{
+			backChannelLogoutEvent: map[string]any{},
+		},
+	}
+	if subject != "" {
+		claims["sub"] = subject
+	}
+	if sid != "" {
+		claims["sid"] = sid
+	}
+
+	signer := &jwt.DefaultSigner{
+		GetPrivateKey: func(ctx context.Context) (interface{}, error) {
+			if oauth2PrivateKey == nil {
+				return nil, errors.New("private key is not initialized")
+			}
+			return oauth2PrivateKey, nil
+		},
+	}
+	token, _, err := signer.Generate(ctx, claims, &jwt.Headers{
+		Extra: map[string]interface{}{"typ": "logout+jwt"},
+	})
+	return token, err
+}
@@ -0,0 +1,237 @@
+package oauth2
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/benjamesfleming/pocketbase-ext-oauth2/consts"
+	"github.com/google/uuid"
+	"github.com/ory/fosite"
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/security"
+)
+
+// browserSessionCookieName is the name of the cookie holding the token of the
+// browser session. Only a hash of the token is stored.
+const browserSessionCookieName = "pb_oauth2_session"
+
+// hashBrowserSessionToken hashes a browser session token for storage.
+func hashBrowserSessionToken(token string) string {
+	mac := hmac.New(sha256.New, GetOAuth2Config().GlobalSecret)
+	mac.Write([]byte("session:" + token))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// findBrowserSession finds the unexpired browser session of the request's
+// session cookie.
+func findBrowserSession(e *core.RequestEvent) (*BrowserSessionModel, error) {
+	cookie, err := e.Request.Cookie(browserSessionCookieName)
+	if err != nil || cookie.Value == "" {
+		return nil, fosite.ErrNotFound
+	}
+	m := &BrowserSessionModel{}
+	err = e.App.RecordQuery(consts.BrowserSessionCollectionName).
+		AndWhere(dbx.HashExp{"token_hash": hashBrowserSessionToken(cookie.Value)}).
+		One(m)
+	if err != nil {
+		return nil, mapRFCErr(err)
+	}
+	if m.IsExpired() {
+		return nil, fosite.ErrNotFound
+	}
+	return m, nil
+}
+
+// findOrNewBrowserSession finds the browser session of the request, or returns
+// a new unsaved session if there is none.
+func findOrNewBrowserSession(e *core.RequestEvent) (*BrowserSessionModel, error) {
+	m, err := findBrowserSession(e)
+	if errors.Is(err, fosite.ErrNotFound) {
+		m = NewBrowserSessionModel(e.App)
+		m.Set("sid", uuid.NewString())
+		m.Set("accounts", []*BrowserSessionAccount{})
+		return m, nil
+	}
+	return m, err
+}
+
+// saveBrowserSessionLogin records the login of the challenge in the browser
+// session, along with the client the user signed in to. The session token is
+// rotated on every login, and the lifespan of the session is extended.
+func saveBrowserSessionLogin(e *core.RequestEvent, m *BrowserSessionModel, challenge *LoginChallengeModel, clientID string) error {
+	account := m.GetAccount(challenge.GetSubject(), challenge.GetCollectionId())
+	if account == nil {
+		account = &BrowserSessionAccount{
+			Subject:    challenge.GetSubject(),
+			Collection: challenge.GetCollectionId(),
+			Clients:    []string{},
+		}
+	}
+	account.AuthTime = 0
+	if authTime := challenge.GetAuthTime(); !authTime.IsZero() {
+		account.AuthTime = authTime.Unix()
+	}
+	account.ACR = challenge.GetACR()
+	account.AMR = challenge.GetAMR()
+	if !slices.Contains(account.Clients, clientID) {
+		account.Clients = append(account.Clients, clientID)
+	}
+	m.SetAccount(account)
+
+	token := security.RandomString(48)
+	m.Set("token_hash", hashBrowserSessionToken(token))
+	m.Set("remember", challenge.IsLoginRemembered())
+	m.Set("expires_at", time.Now().Add(GetOAuth2Config().BrowserSessionLifespan).Unix())
+	if err := e.App.Save(m); err != nil {
+		return err
+	}
+
+	// The browser state cookie lives as long as the session cookie.
+	for _, cookie := range []*http.Cookie{newBrowserSessionCookie(e, token), newBrowserStateCookie(e, getBrowserState(m))} {
+		if m.IsRemembered() {
+			cookie.Expires = m.GetExpiresAt()
+		}
+		e.SetCookie(cookie)
+	}
+	return nil
+}
+
+// clearBrowserSession deletes the browser session, and expires the session
+// and browser state cookies.
+func clearBrowserSession(e *core.RequestEvent, m *BrowserSessionModel) error {
+	for _, cookie := range []*http.Cookie{newBrowserSessionCookie(e, ""), newBrowserStateCookie(e, "")} {
+		cookie.MaxAge = -1
+		e.SetCookie(cookie)
+	}
+	return e.App.Delete(m)
+}
+
+// newBrowserSessionCookie returns the session cookie holding the token. The
+// cookie is only sent to the OAuth2 endpoints, and can't be read by scripts.
+func newBrowserSessionCookie(e *core.RequestEvent, token string) *http.Cookie {
+	return &http.Cookie{
+		Name:     browserSessionCookieName,
+		Value:    token,
+		Path:     GetOAuth2Config().PathPrefix,
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(e.App.Settings().Meta.AppURL, "https://"),
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+// findBrowserSessionAccount finds the account of the browser session that a
+// prompt=none request can be logged in with. The accounts are narrowed down
+// by the id_token_hint and login_hint of the request, if more than one
+// remains the user has to choose.
+func findBrowserSessionAccount(e *core.RequestEvent, ar fosite.AuthorizeRequester, idTokenHint *IDTokenHint) (*BrowserSessionModel, *BrowserSessionAccount, error) {
+	m, err := findBrowserSession(e)
+	if err != nil {
+		return nil, nil, err
+	}
+	c, err := e.App.FindCachedCollectionByNameOrId(GetOAuth2Config().UserCollection)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var ret []*BrowserSessionAccount
+	for _, account := range m.GetAccounts() {
+		if account.Collection != c.Id || (idTokenHint != nil && idTokenHint.Subject != account.Subject) {
+			continue
+		}
+		u, err := e.App.FindRecordById(c, account.Subject)
+		if err != nil {
+			continue
+		}
+		if hint := ar.GetRequestForm().Get("login_hint"); hint != "" && !matchLoginHint(u, hint) {
+			continue
+		}
+		ret = append(ret, account)
+	}
+
+	switch len(ret) {
+	case 0:
+		return nil, nil, fosite.ErrNotFound
+	case 1:
+		return m, ret[0], nil
+	default:
+		return nil, nil, ErrAccountSelectionRequired.WithHint("More than one account is logged in, the user has to choose one.")
+	}
+}
+
+// setLoginChallengeAccount accepts the login challenge with the account of the
+// browser session, as the login UI would have.
+func setLoginChallengeAccount(m *LoginChallengeModel, bs *BrowserSessionModel, account *BrowserSessionAccount) {
+	m.Set("subject", account.Subject)
+	m.Set("collection", account.Collection)
+	m.Set("auth_time", account.AuthTime)
+	m.Set("acr", account.ACR)
+	m.Set("amr", account.AMR)
+	m.Set("login_remember", bs.IsRemembered())
+}
+
+// browserSessionLogout is a login removed from a browser session, with the
+// clients the user signed in to during the session.
+type browserSessionLogout struct {
+	Subject   string
+	SID       string
+	ClientIDs []string
+}
+
+// removeBrowserSessionLogins removes the subject's accounts from every browser
+// session, or the client from every account if the clientID is not empty, and
+// returns the logins that were removed.
+func removeBrowserSessionLogins(app core.App, subject string, clientID string) ([]*browserSessionLogout, error) {
+	q := app.RecordQuery(consts.BrowserSessionCollectionName)
+	if subject != "" {
+		q.AndWhere(dbx.NewExp(
+			"EXISTS (SELECT 1 FROM json_each([[accounts]]) WHERE json_extract(json_each.value, '$.subject') = {:subject})",
+			dbx.Params{"subject": subject},
+		))
+	}
+	if clientID != "" {
+		q.AndWhere(dbx.NewExp(
+			"EXISTS (SELECT 1 FROM json_each([[accounts]]) AS a, json_each(a.value, '$.clients') AS c WHERE c.value = {:clientID})",
+			dbx.Params{"clientID": clientID},
+		))
+	}
+	var sessions []*BrowserSessionModel
+	if err := q.All(&sessions); err != nil {
+		return nil, err
+	}
+
+	ret := []*browserSessionLogout{}
+	for _, m := range sessions {
+		accounts := []*BrowserSessionAccount{}
+		for _, account := range m.GetAccounts() {
+			if subject != "" && account.Subject != subject {
+				accounts = append(accounts, account)
+				continue
+			}
+			logout := &browserSessionLogout{Subject: account.Subject, SID: m.GetSID(), ClientIDs: account.Clients}
+			if clientID != "" {
+				if !slices.Contains(account.Clients, clientID) {
+					accounts = append(accounts, account)
+					continue
+				}
+				logout.ClientIDs = []string{clientID}
+				account.Clients = slices.DeleteFunc(account.Clients, func(id string) bool {
+					return id == clientID
+				})
+				accounts = append(accounts, account)
+			}
+			ret = append(ret, logout)
+		}
+		m.Set("accounts", accounts)
+		if err := app.Save(m); err != nil {
+			return nil, err
+		}
+	}
+	return ret, nil
+}
@@ -0,0 +1,128 @@
+package oauth2
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/security"
+)
+
+// @ref https://openid.net/specs/openid-connect-session-1_0.html
+
+// browserStateCookieName is the name of the cookie holding the OP browser
+// state, which the check session iframe compares the session_state of the
+// clients against. Unlike the session cookie it can be read by scripts, so it
+// holds no secrets.
+const browserStateCookieName = "pb_oauth2_browser_state"
+
+// getBrowserState returns the OP browser state of the browser session. It
+// changes whenever an account logs in to or out of the session, but not when
+// an account signs in to another client.
+func getBrowserState(m *BrowserSessionModel) string {
+	accounts := []string{}
+	for _, account := range m.GetAccounts() {
+		accounts = append(accounts, account.Collection+":"+account.Subject)
+	}
+	slices.Sort(accounts)
+
+	mac := hmac.New(sha256.New, GetOAuth2Config().GlobalSecret)
+	mac.Write([]byte("browser_state:" + m.GetSID() + ":" + strings.Join(accounts, " ")))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// getSessionState returns the session_state of an authorization response,
+// which the client passes to the check session iframe to find out whether the
+// browser state has changed since.
+// @ref https://openid.net/specs/openid-connect-session-1_0.html#CreatingUpdatingSessions
+func getSessionState(clientID string, redirectURI *url.URL, browserState string) string {
+	origin := redirectURI.Scheme + "://" + redirectURI.Host
+	salt := security.RandomString(16)
+	hash := sha256.Sum256([]byte(clientID + " " + origin + " " + browserState + " " + salt))
+	return hex.EncodeToString(hash[:]) + "." + salt
+}
+
+// newBrowserStateCookie returns the cookie holding the browser state. The
+// check session iframe is embedded by the clients, so the cookie has to be
+// sent in cross-site requests when the app URL is HTTPS.
+func newBrowserStateCookie(e *core.RequestEvent, browserState string) *http.Cookie {
+	cookie := &http.Cookie{
+		Name:     browserStateCookieName,
+		Value:    browserState,
+		Path:     GetOAuth2Config().PathPrefix,
+		SameSite: http.SameSiteLaxMode,
+	}
+	if strings.HasPrefix(e.App.Settings().Meta.AppURL, "https://") {
+		cookie.Secure = true
+		cookie.SameSite = http.SameSiteNoneMode
+	}
+	return cookie
+}
+
+//
+
+// api_OAuth2CheckSessionIframe serves the check session iframe, which the
+// clients embed and poll with postMessage. The iframe answers "unchanged" if
+// the session_state still matches the browser state, "changed" if it doesn't,
+// and "error" if the message is malformed.
+func api_OAuth2CheckSessionIframe(e *core.RequestEvent) error {
+	// The iframe is meant to be embedded by the clients.
+	e.Response.Header().Del("X-Frame-Options")
+	return e.HTML(http.StatusOK, checkSessionIframeHTML)
+}
+
+const checkSessionIframeHTML = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Check Session</title>
+</head>
+<body>
+<script>
+(function () {
+    function getBrowserState() {
+        var cookies = document.cookie.split(";");
+        for (var i = 0; i < cookies.length; i++) {
+            var cookie = cookies[i].trim();
+            if (cookie.indexOf("` + browserStateCookieName + `=") === 0) {
+                return decodeURIComponent(cookie.substring("` + browserStateCookieName + `=".length));
+            }
+        }
+        return "";
+    }
+
+    function sha256(value) {
+        return crypto.subtle.digest("SHA-256", new TextEncoder().encode(value)).then(function (buf) {
+            return Array.from(new Uint8Array(buf)).map(function (b) {
+                return b.toString(16).padStart(2, "0");
+            }).join("");
+        });
+    }
+
+    window.addEventListener("message", function (e) {
+        if (e.source === window) {
+            return;
+        }
+        var parts = typeof e.data === "string" ? e.data.split(" ") : [];
+        var salt = parts.length === 2 ? parts[1].split(".")[1] : "";
+        if (!salt) {
+            e.source.postMessage("error", e.origin);
+            return;
+        }
+        sha256(parts[0] + " " + e.origin + " " + getBrowserState() + " " + salt).then(function (hash) {
+            e.source.postMessage(hash + "." + salt === parts[1] ? "unchanged" : "changed", e.origin);
+        }, function () {
+            e.source.postMessage("error", e.origin);
+        });
+    });
+})();
+</script>
+</body>
+</html>
+`
@@ -0,0 +1,189 @@
+package oauth2
+
+import (
+	"cmp"
+	"crypto/hmac"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/benjamesfleming/pocketbase-ext-oauth2/client"
+	"github.com/benjamesfleming/pocketbase-ext-oauth2/consts"
+	"github.com/ory/fosite"
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+)
+
+// ConnectedApp is a client that holds an active grant for the user, as listed
+// by the connected apps endpoint.
+type ConnectedApp struct {
+	ClientID          string   `json:"client_id"`
+	ClientName        string   `json:"client_name"`
+	ClientURI         string   `json:"client_uri"`
+	LogoURI           string   `json:"logo_uri"`
+	PolicyURI         string   `json:"policy_uri"`
+	TermsOfServiceURI string   `json:"tos_uri"`
+	Scopes            []string `json:"scopes"`
+	Audience          []string `json:"audience"`
+
+	// LastUsedAt
+	// The last time a token was issued to the client for the user, or the
+	// time the user consented if no tokens are active.
+	LastUsedAt time.Time `json:"last_used_at"`
+
+	// SignedIn
+	// Whether the user signed in to the client during the browser session of
+	// the request.
+	SignedIn bool `json:"signed_in"`
+}
+
+// requireFirstPartyAuth ensures that the request is authenticated with a
+// PocketBase auth token of the user collection, rather than an access token
+// issued to a client. This prevents clients from managing the user's grants
+// or logging the user in to other clients.
+func requireFirstPartyAuth(e *core.RequestEvent) error {
+	if e.Auth == nil || e.Auth.Collection().Name != GetOAuth2Config().UserCollection {
+		return e.UnauthorizedError("The request requires valid user authorization token.", nil)
+	}
+	if isOAuth2AccessToken(getRequestAccessToken(e)) {
+		return e.ForbiddenError("OAuth2 access tokens are not allowed to access this endpoint.", nil)
+	}
+	return nil
+}
+
+func api_OAuth2ListConnectedApps(e *core.RequestEvent) error {
+	if err := requireFirstPartyAuth(e); err != nil {
+		return err
+	}
+
+	apps := map[string]*ConnectedApp{}
+	getApp := func(clientID string) *ConnectedApp {
+		if _, ok := apps[clientID]; !ok {
+			apps[clientID] = &ConnectedApp{ClientID: clientID}
+		}
+		return apps[clientID]
+	}
+
+	// Group the active access and refresh token sessions by client.
+	for _, collection := range []string{consts.AccessCollectionName, consts.RefreshCollectionName} {
+		records, err := findActiveSessionRecordsBySubject(e.App, collection, e.Auth.Id)
+		if err != nil {
+			return e.InternalServerError("Internal Error", err)
+		}
+		for _, record := range records {
+			m := &BaseSessionModel{}
+			m.SetProxyRecord(record)
+			app := getApp(m.GetClientID())
+			app.Scopes = mergeArguments(app.Scopes, m.GetGrantedScopes())
+			app.Audience = mergeArguments(app.Audience, m.GetGrantedAudience())
+			if m.GetRequestedAt().After(app.LastUsedAt) {
+				app.LastUsedAt = m.GetRequestedAt()
+			}
+		}
+	}
+
+	// Include the unexpired consent grants, which let the client skip the
+	// consent screen even when it holds no tokens.
+	var consents []*ConsentModel
+	err := e.App.RecordQuery(consts.ConsentCollectionName).
+		AndWhere(dbx.HashExp{
+			"subject":    e.Auth.Id,
+			"collection": e.Auth.Collection().Id,
+		}).
+		AndWhere(dbx.NewExp("expires_at > {:now}", dbx.Params{"now": time.Now().Unix()})).
+		All(&consents)
+	if err != nil {
+		return e.InternalServerError("Internal Error", err)
+	}
+	for _, consent := range consents {
+		app := getApp(consent.GetClientID())
+		app.Scopes = mergeArguments(app.Scopes, consent.GetScopes())
+		app.Audience = mergeArguments(app.Audience, consent.GetAudience())
+		if app.LastUsedAt.IsZero() {
+			app.LastUsedAt = consent.GetDateTime("updated").Time()
+		}
+	}
+
+	// Mark the clients the user signed in to during the browser session.
+	bs, err := findBrowserSession(e)
+	if err != nil && !errors.Is(err, fosite.ErrNotFound) {
+		return e.InternalServerError("Internal Error", err)
+	}
+	if bs != nil {
+		if account := bs.GetAccount(e.Auth.Id, e.Auth.Collection().Id); account != nil {
+			for _, clientID := range account.Clients {
+				if app, ok := apps[clientID]; ok {
+					app.SignedIn = true
+				}
+			}
+		}
+	}
+
+	// Attach the client metadata, skipping any clients that no longer exist.
+	ret := make([]*ConnectedApp, 0, len(apps))
+	for _, app := range apps {
+		c, err := oauth2GlobalStore.GetClient(e.Request.Context(), app.ClientID)
+		if err != nil {
+			if errors.Is(err, fosite.ErrNotFound) {
+				continue
+			}
+			return e.InternalServerError("Internal Error", err)
+		}
+		if c, ok := c.(*client.Client); ok {
+			app.ClientName = c.Name
+			app.ClientURI = c.ClientURI
+			app.LogoURI = c.LogoURI
+			app.PolicyURI = c.PolicyURI
+			app.TermsOfServiceURI = c.TermsOfServiceURI
+		}
+		ret = append(ret, app)
+	}
+	slices.SortFunc(ret, func(a, b *ConnectedApp) int {
+		return cmp.Or(b.LastUsedAt.Compare(a.LastUsedAt), cmp.Compare(a.ClientID, b.ClientID))
+	})
+
+	return e.JSON(http.StatusOK, ret)
+}
+
+func api_OAuth2RevokeConnectedApp(e *core.RequestEvent) error {
+	if err := requireFirstPartyAuth(e); err != nil {
+		return err
+	}
+
+	// Sign the user out of the client everywhere, and forget the consent
+	// grant so that the client has to ask for it again.
+	clientID := e.Request.PathValue("client_id")
+	if err := revokeSessions(e.App, e.Auth.Id, clientID); err != nil {
+		return e.InternalServerError("Internal Error", err)
+	}
+	if err := deleteConsentModels(e.App, dbx.HashExp{"subject": e.Auth.Id, "client_id": clientID}); err != nil {
+		return e.InternalServerError("Internal Error", err)
+	}
+
+	return e.NoContent(http.StatusNoContent)
+}
+
+// redirectToConnectedAppsUI redirects the user to the connected apps page of
+// the login UI. The state is signed like the login challenges, so that links
+// to the login UI can't point it at another collection or endpoint.
+func redirectToConnectedAppsUI(e *core.RequestEvent) error {
+	state := map[string]interface{}{
+		"mode":                "connected-apps",
+		"collection":          GetOAuth2Config().UserCollection,
+		"connected_apps_path": GetOAuth2Config().PathPrefix + "/connected-apps",
+	}
+	stateBytes, _ := json.Marshal(state)
+	stateB64Str := base64.RawURLEncoding.EncodeToString(stateBytes)
+	return e.Redirect(http.StatusTemporaryRedirect, e.App.Settings().Meta.AppURL+GetOAuth2Config().PathPrefix+"/login?state="+signLoginChallenge(stateB64Str, "connected-apps"))
+}
+
+// verifyConnectedAppsState reports whether the state of the login UI was
+// signed by redirectToConnectedAppsUI.
+func verifyConnectedAppsState(state string) bool {
+	payload, _, _ := strings.Cut(state, ".")
+	return hmac.Equal([]byte(signLoginChallenge(payload, "connected-apps")), []byte(state))
+}
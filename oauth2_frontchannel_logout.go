@@ -0,0 +1,55 @@
+package oauth2
+
+import (
+	"context"
+	"errors"
+	"net/url"
+
+	"github.com/benjamesfleming/pocketbase-ext-oauth2/client"
+	"github.com/ory/fosite"
+)
+
+// @ref https://openid.net/specs/openid-connect-frontchannel-1_0.html
+
+// getFrontChannelLogoutURIs returns the frontchannel_logout_uri of each client
+// that registered one, for the login UI to render in iframes. The iss and sid
+// query parameters are added when the logout is tied to an OP session, and
+// clients that require them are left out otherwise.
+func getFrontChannelLogoutURIs(ctx context.Context, clientIDs []string, sid string) ([]string, error) {
+	ret := []string{}
+	for _, clientID := range clientIDs {
+		fc, err := GetOAuth2Store().GetClient(ctx, clientID)
+		if err != nil {
+			if errors.Is(err, fosite.ErrNotFound) {
+				continue
+			}
+			return nil, err
+		}
+		c, ok := fc.(*client.Client)
+		if !ok || c.FrontChannelLogoutURI == "" {
+			continue
+		}
+		// The login UI renders the URI in an iframe on the provider's origin,
+		// so anything but an http(s) URI is never handed to it.
+		if !isSecureClientURI(c.FrontChannelLogoutURI, true) {
+			continue
+		}
+		if sid == "" {
+			if !c.FrontChannelLogoutSessionRequired {
+				ret = append(ret, c.FrontChannelLogoutURI)
+			}
+			continue
+		}
+
+		u, err := url.Parse(c.FrontChannelLogoutURI)
+		if err != nil {
+			continue
+		}
+		q := u.Query()
+		q.Set("iss", oauth2ProviderMetadata.Issuer)
+		q.Set("sid", sid)
+		u.RawQuery = q.Encode()
+		ret = append(ret, u.String())
+	}
+	return ret, nil
+}
@@ -0,0 +1,93 @@
+package oauth2
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"slices"
+
+	"github.com/ory/fosite"
+	"github.com/ory/fosite/token/jwt"
+)
+
+// ErrAccountSelectionRequired is returned when the user is logged in with more
+// than one account, and the request doesn't identify which one to use.
+// @ref https://openid.net/specs/openid-connect-core-1_0.html#AuthError
+var ErrAccountSelectionRequired = &fosite.RFC6749Error{
+	ErrorField:       "account_selection_required",
+	DescriptionField: "The End-User is required to select a session at the Authorization Server.",
+	CodeField:        http.StatusBadRequest,
+}
+
+// IDTokenHint is an ID token previously issued by the provider, that a client
+// passes back to identify the user it expects to be logged in.
+// @ref https://openid.net/specs/openid-connect-core-1_0.html#AuthRequest
+type IDTokenHint struct {
+	Subject  string
+	Audience []string
+	Claims   jwt.MapClaims
+}
+
+// HasAudience reports whether the ID token was issued to the client.
+func (h *IDTokenHint) HasAudience(clientID string) bool {
+	return slices.Contains(h.Audience, clientID)
+}
+
+// GetClientID returns the client the ID token was issued to, from the azp
+// claim or the audience if it is the only one. It returns an empty string if
+// the client is ambiguous.
+func (h *IDTokenHint) GetClientID() string {
+	if azp, _ := h.Claims["azp"].(string); azp != "" {
+		return azp
+	}
+	if len(h.Audience) == 1 {
+		return h.Audience[0]
+	}
+	return ""
+}
+
+// ValidateIDTokenHint checks that the id_token_hint was signed with the
+// provider's signing key and issued by the provider. Expired ID tokens are
+// accepted, as the hint only identifies the user.
+func ValidateIDTokenHint(ctx context.Context, hint string) (*IDTokenHint, error) {
+	signer := &jwt.DefaultSigner{
+		GetPrivateKey: func(ctx context.Context) (interface{}, error) {
+			if oauth2PrivateKey == nil {
+				return nil, errors.New("private key is not initialized")
+			}
+			return oauth2PrivateKey, nil
+		},
+	}
+	token, err := signer.Decode(ctx, hint)
+	var ve *jwt.ValidationError
+	if errors.As(err, &ve) && ve.Errors == jwt.ValidationErrorExpired {
+		// Expired ID tokens are allowed as values to id_token_hint
+	} else if err != nil {
+		return nil, fosite.ErrInvalidRequest.WithHint("The id_token_hint is not a valid ID token.").WithWrap(err).WithDebug(err.Error())
+	}
+
+	claims := token.Claims
+	if iss, _ := claims["iss"].(string); iss != oauth2ProviderMetadata.Issuer {
+		return nil, fosite.ErrInvalidRequest.WithHint("The id_token_hint was not issued by this provider.")
+	}
+	sub, _ := claims["sub"].(string)
+	if sub == "" {
+		return nil, fosite.ErrInvalidRequest.WithHint("The id_token_hint does not have a subject.")
+	}
+
+	ret := &IDTokenHint{
+		Subject: sub,
+		Claims:  claims,
+	}
+	switch aud := claims["aud"].(type) {
+	case string:
+		ret.Audience = []string{aud}
+	case []interface{}:
+		for _, v := range aud {
+			if s, ok := v.(string); ok {
+				ret.Audience = append(ret.Audience, s)
+			}
+		}
+	}
+	return ret, nil
+}
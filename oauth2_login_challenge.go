@@ -0,0 +1,430 @@
+package oauth2
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/benjamesfleming/pocketbase-ext-oauth2/client"
+	"github.com/benjamesfleming/pocketbase-ext-oauth2/consts"
+	"github.com/ory/fosite"
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/security"
+)
+
+// loginChallengeLifespan is how long the user has to log in and consent
+// before the authorization request must be restarted.
+const loginChallengeLifespan = 15 * time.Minute
+
+// loginChallengeCookiePrefix is the prefix of the cookies that bind the login
+// challenges to the browser that started them, followed by the challenge id
+// so that each tab has its own.
+const loginChallengeCookiePrefix = "pb_oauth2_login_"
+
+// loginChallengeErrors are the errors the login and consent screens can
+// reject an authorization request with.
+var loginChallengeErrors = []string{
+	"access_denied",
+	"account_selection_required",
+	"consent_required",
+	"interaction_required",
+	"login_required",
+	"unmet_authentication_requirements",
+}
+
+// ignoredAuthorizeParams are removed from every authorization request before
+// it is processed. The login flow used to pass its result back to the
+// authorization endpoint in these parameters, they are now only read from the
+// login challenge so that clients cannot forge them.
+var ignoredAuthorizeParams = []string{
+	"login_verifier",
+	"consent_verifier",
+	"error",
+	"pb_token",
+	"pb_token_iat",
+	"rat",
+	"consent",
+	"granted_scopes",
+}
+
+// signLoginChallenge returns the challenge handed to the login UI for the
+// login challenge record and phase. The challenge is signed with the global
+// secret so that it cannot be guessed from the record id.
+func signLoginChallenge(id string, phase string) string {
+	mac := hmac.New(sha256.New, GetOAuth2Config().GlobalSecret)
+	mac.Write([]byte(phase + ":" + id))
+	return id + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// hashLoginVerifier hashes a login or consent verifier for storage.
+func hashLoginVerifier(verifier string) string {
+	mac := hmac.New(sha256.New, GetOAuth2Config().GlobalSecret)
+	mac.Write([]byte("verifier:" + verifier))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// hashLoginChallengeCSRFToken hashes the token of a login challenge cookie for
+// storage.
+func hashLoginChallengeCSRFToken(token string) string {
+	mac := hmac.New(sha256.New, GetOAuth2Config().GlobalSecret)
+	mac.Write([]byte("csrf:" + token))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// createLoginChallenge saves a login challenge for the authorization request,
+// along with the details of the request shown by the login UI.
+func createLoginChallenge(e *core.RequestEvent, ar fosite.AuthorizeRequester, authorizationDetails []AuthorizationDetail, idTokenHint *IDTokenHint, requiredAMR [][]string) (*LoginChallengeModel, error) {
+	c, _ := ar.GetClient().(*client.Client)
+	state := map[string]interface{}{
+		"collection":            GetOAuth2Config().UserCollection,
+		"client_id":             c.ID,
+		"client_name":           c.Name,
+		"client_uri":            c.ClientURI,
+		"prompt":                ar.GetRequestForm().Get("prompt"),
+		"max_age":               ar.GetRequestForm().Get("max_age"),
+		"login_hint":            ar.GetRequestForm().Get("login_hint"),
+		"requested_scopes":      ar.GetRequestedScopes(),
+		"optional_scopes":       getOptionalScopes(ar),
+		"authorization_details": describeAuthorizationDetails(authorizationDetails),
+	}
+	if idTokenHint != nil {
+		state["id_token_hint_subject"] = idTokenHint.Subject
+	}
+	if len(requiredAMR) > 0 {
+		state["acr_values"], state["acr_essential"] = getRequestedACRValues(ar.GetRequestForm())
+		state["acr_amr"] = requiredAMR
+	}
+
+	m := NewLoginChallengeModel(e.App)
+	m.Set("client_id", ar.GetClient().GetID())
+	m.Set("request_form", ar.GetRequestForm().Encode())
+	m.Set("requested_at", ar.GetRequestedAt().Unix())
+	m.Set("expires_at", time.Now().Add(loginChallengeLifespan).Unix())
+	m.Set("phase", LoginChallengePhaseLogin)
+	m.Set("state", state)
+
+	return m, saveLoginChallenge(e, m)
+}
+
+// saveLoginChallenge saves the challenge, and binds it to the browser that
+// sent the request with a cookie, see hasLoginChallengeCookie.
+func saveLoginChallenge(e *core.RequestEvent, m *LoginChallengeModel) error {
+	token := security.RandomString(32)
+	m.Set("csrf_token", hashLoginChallengeCSRFToken(token))
+	if err := e.App.Save(m); err != nil {
+		return err
+	}
+	e.SetCookie(&http.Cookie{
+		Name:     loginChallengeCookiePrefix + m.Id,
+		Value:    token,
+		Path:     GetOAuth2Config().PathPrefix,
+		MaxAge:   int(loginChallengeLifespan / time.Second),
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(e.App.Settings().Meta.AppURL, "https://"),
+		SameSite: http.SameSiteLaxMode,
+	})
+	return nil
+}
+
+// hasLoginChallengeCookie reports whether the request was sent by the browser
+// that started the login challenge. Otherwise the verifier of a login was
+// handed to another browser, e.g. by an attacker sending the victim the
+// authorization endpoint URL of their own login, which would log the victim in
+// to the client as the attacker, or a logout challenge is accepted by someone
+// other than the user logging out.
+func hasLoginChallengeCookie(e *core.RequestEvent, m *LoginChallengeModel) bool {
+	cookie, err := e.Request.Cookie(loginChallengeCookiePrefix + m.Id)
+	if err != nil || m.GetCSRFToken() == "" {
+		return false
+	}
+	return hmac.Equal([]byte(hashLoginChallengeCSRFToken(cookie.Value)), []byte(m.GetCSRFToken()))
+}
+
+// findLoginChallenge finds the unexpired login challenge waiting on the phase.
+func findLoginChallenge(app core.App, challenge string, phase string) (*LoginChallengeModel, error) {
+	id, _, _ := strings.Cut(challenge, ".")
+	if !hmac.Equal([]byte(signLoginChallenge(id, phase)), []byte(challenge)) {
+		return nil, fosite.ErrNotFound
+	}
+	m := &LoginChallengeModel{}
+	err := app.RecordQuery(consts.LoginChallengeCollectionName).
+		AndWhere(dbx.HashExp{"id": id}).
+		One(m)
+	if err != nil {
+		return nil, mapRFCErr(err)
+	}
+	if m.IsExpired() || m.GetPhase() != phase {
+		return nil, fosite.ErrNotFound
+	}
+	return m, nil
+}
+
+// consumeLoginChallengeVerifier finds the unexpired login challenge for the
+// login or consent verifier. The verifier is cleared so that it can only be
+// used once.
+func consumeLoginChallengeVerifier(app core.App, field string, verifier string) (*LoginChallengeModel, error) {
+	m := &LoginChallengeModel{}
+	err := app.RecordQuery(consts.LoginChallengeCollectionName).
+		AndWhere(dbx.HashExp{field: hashLoginVerifier(verifier)}).
+		One(m)
+	if err != nil {
+		return nil, mapRFCErr(err)
+	}
+	if m.IsExpired() {
+		return nil, fosite.ErrNotFound
+	}
+	m.Set(field, "")
+	return m, app.Save(m)
+}
+
+// redirectToLoginUI redirects the user to the login UI, which logs the user in
+// or asks for their consent before returning to the authorization endpoint.
+// The embedded UI is used unless an external LoginURL is configured.
+func redirectToLoginUI(e *core.RequestEvent, m *LoginChallengeModel) error {
+	loginURL := GetOAuth2Config().LoginURL
+	if loginURL == "" {
+		loginURL = e.App.Settings().Meta.AppURL + GetOAuth2Config().PathPrefix + "/login"
+	}
+	sep := "?"
+	if strings.Contains(loginURL, "?") {
+		sep = "&"
+	}
+	param := m.GetPhase() + "_challenge"
+	return e.Redirect(http.StatusTemporaryRedirect, loginURL+sep+url.Values{param: {signLoginChallenge(m.Id, m.GetPhase())}}.Encode())
+}
+
+// getLoginChallengeRedirect returns the authorization endpoint URL that resumes
+// the request of the login challenge with a new one-time verifier, which is
+// stored in the field of the challenge.
+func getLoginChallengeRedirect(e *core.RequestEvent, m *LoginChallengeModel, field string) (string, error) {
+	verifier := security.RandomString(48)
+	m.Set(field, hashLoginVerifier(verifier))
+	if err := e.App.Save(m); err != nil {
+		return "", err
+	}
+	return e.App.Settings().Meta.AppURL + GetOAuth2Config().PathPrefix + "/auth?" + m.GetRequestForm() + "&" + url.Values{field: {verifier}}.Encode(), nil
+}
+
+//
+
+// getLoginChallengeFromRequest finds the login challenge of the request for
+// the phase, writing a not found error if it is invalid or has expired.
+func getLoginChallengeFromRequest(e *core.RequestEvent, phase string) (*LoginChallengeModel, error) {
+	m, err := findLoginChallenge(e.App, e.Request.URL.Query().Get(phase+"_challenge"), phase)
+	if err != nil {
+		if errors.Is(err, fosite.ErrNotFound) {
+			return nil, e.NotFoundError("The "+phase+" challenge is invalid or has expired.", nil)
+		}
+		return nil, e.InternalServerError("Internal Error", err)
+	}
+	return m, nil
+}
+
+// writeLoginChallengeState writes the details of the login challenge shown by
+// the login UI.
+func writeLoginChallengeState(e *core.RequestEvent, phase string) error {
+	m, err := getLoginChallengeFromRequest(e, phase)
+	if err != nil {
+		return err
+	}
+	state := m.GetState()
+	state["challenge"] = e.Request.URL.Query().Get(phase + "_challenge")
+	state["requested_at"] = m.GetRequestedAt().Unix()
+	state["request_url"] = e.App.Settings().Meta.AppURL + GetOAuth2Config().PathPrefix + "/auth?" + m.GetRequestForm()
+	return e.JSON(http.StatusOK, state)
+}
+
+// requireLoginProviderAuth ensures that the request is authenticated either
+// as a superuser, acting as a headless login provider, or as the user with a
+// PocketBase auth token, as used by the embedded login UI.
+func requireLoginProviderAuth(e *core.RequestEvent) error {
+	if e.HasSuperuserAuth() {
+		return nil
+	}
+	return requireFirstPartyAuth(e)
+}
+
+// rejectLoginChallenge rejects the authorization request of the login
+// challenge with the error from the request body.
+func rejectLoginChallenge(e *core.RequestEvent, phase string) error {
+	m, err := getLoginChallengeFromRequest(e, phase)
+	if err != nil {
+		return err
+	}
+
+	body := struct {
+		Error            string `json:"error" form:"error"`
+		ErrorDescription string `json:"error_description" form:"error_description"`
+	}{}
+	if err := e.BindBody(&body); err != nil {
+		return e.BadRequestError("Failed to read the request body.", err)
+	}
+	if body.Error == "" {
+		body.Error = "access_denied"
+	}
+	if !slices.Contains(loginChallengeErrors, body.Error) {
+		return e.BadRequestError("Unsupported error "+body.Error+".", nil)
+	}
+
+	m.Set("error", body.Error)
+	m.Set("error_description", body.ErrorDescription)
+	redirectTo, err := getLoginChallengeRedirect(e, m, phase+"_verifier")
+	if err != nil {
+		return e.InternalServerError("Internal Error", err)
+	}
+	return e.JSON(http.StatusOK, map[string]string{"redirect_to": redirectTo})
+}
+
+func api_OAuth2GetLoginRequest(e *core.RequestEvent) error {
+	return writeLoginChallengeState(e, LoginChallengePhaseLogin)
+}
+
+func api_OAuth2AcceptLoginRequest(e *core.RequestEvent) error {
+	m, err := getLoginChallengeFromRequest(e, LoginChallengePhaseLogin)
+	if err != nil {
+		return err
+	}
+	if err := requireLoginProviderAuth(e); err != nil {
+		return err
+	}
+
+	body := struct {
+		Subject  string   `json:"subject" form:"subject"`
+		Remember bool     `json:"remember" form:"remember"`
+		AuthTime int64    `json:"auth_time" form:"auth_time"`
+		ACR      string   `json:"acr" form:"acr"`
+		AMR      []string `json:"amr" form:"amr"`
+	}{}
+	if err := e.BindBody(&body); err != nil {
+		return e.BadRequestError("Failed to read the request body.", err)
+	}
+
+	var user *core.Record
+	var authTime time.Time
+	if e.HasSuperuserAuth() {
+		// A headless login provider logs the user in and tells us who they are
+		// and how they authenticated.
+		if body.Subject == "" {
+			return e.BadRequestError("The subject is required.", nil)
+		}
+		if user, err = e.App.FindRecordById(GetOAuth2Config().UserCollection, body.Subject); err != nil {
+			return e.BadRequestError("The subject is not a user of the "+GetOAuth2Config().UserCollection+" collection.", err)
+		}
+		authTime = time.Now().UTC()
+		if body.AuthTime > 0 {
+			authTime = time.Unix(body.AuthTime, 0).UTC()
+		}
+		if authTime.After(time.Now().Add(5 * time.Second)) {
+			return e.BadRequestError("The auth_time can't be in the future.", nil)
+		}
+		m.Set("acr", body.ACR)
+		m.Set("amr", body.AMR)
+	} else {
+		// The user logged in with the embedded UI, we can't trust them to
+		// report their own authentication context. The time and methods they
+		// logged in with are recorded in their auth token.
+		user = e.Auth
+		authTime = getAuthTokenAuthTime(getRequestAccessToken(e))
+		amr := getAuthTokenAMR(getRequestAccessToken(e))
+
+		// A refreshed auth token doesn't record when and how the user logged
+		// in, the browser session still knows when they last authenticated.
+		if authTime.IsZero() {
+			bs, err := findBrowserSession(e)
+			if err != nil && !errors.Is(err, fosite.ErrNotFound) {
+				return e.InternalServerError("Internal Error", err)
+			}
+			if bs != nil {
+				if account := bs.GetAccount(user.Id, user.Collection().Id); account != nil {
+					authTime = account.GetAuthTime()
+					amr = account.AMR
+				}
+			}
+		}
+		m.Set("amr", amr)
+	}
+
+	m.Set("subject", user.Id)
+	m.Set("collection", user.Collection().Id)
+	if !authTime.IsZero() {
+		m.Set("auth_time", authTime.Unix())
+	}
+	m.Set("login_remember", body.Remember)
+	redirectTo, err := getLoginChallengeRedirect(e, m, "login_verifier")
+	if err != nil {
+		return e.InternalServerError("Internal Error", err)
+	}
+	return e.JSON(http.StatusOK, map[string]string{"redirect_to": redirectTo})
+}
+
+func api_OAuth2RejectLoginRequest(e *core.RequestEvent) error {
+	return rejectLoginChallenge(e, LoginChallengePhaseLogin)
+}
+
+func api_OAuth2GetConsentRequest(e *core.RequestEvent) error {
+	return writeLoginChallengeState(e, LoginChallengePhaseConsent)
+}
+
+func api_OAuth2AcceptConsentRequest(e *core.RequestEvent) error {
+	m, err := getLoginChallengeFromRequest(e, LoginChallengePhaseConsent)
+	if err != nil {
+		return err
+	}
+	if err := requireLoginProviderAuth(e); err != nil {
+		return err
+	}
+	if !e.HasSuperuserAuth() && (e.Auth.Id != m.GetSubject() || e.Auth.Collection().Id != m.GetCollectionId()) {
+		return e.ForbiddenError("The consent challenge belongs to another user.", nil)
+	}
+
+	body := struct {
+		GrantedScopes []string `json:"granted_scopes" form:"granted_scopes"`
+		Remember      bool     `json:"remember" form:"remember"`
+	}{}
+	if err := e.BindBody(&body); err != nil {
+		return e.BadRequestError("Failed to read the request body.", err)
+	}
+
+	m.Set("consent_granted", true)
+	m.Set("consent_remember", body.Remember)
+	if body.GrantedScopes != nil {
+		// Accept both a list of scopes and a single space-delimited string.
+		scopes := strings.Fields(strings.Join(body.GrantedScopes, " "))
+		if !e.HasSuperuserAuth() {
+			// Users can only deselect the optional scopes, a headless login
+			// provider decides exactly which scopes are granted.
+			scopes = getApprovedScopes(m.GetRequestedScopes(), m.GetOptionalScopes(), scopes)
+		}
+		m.Set("granted_scopes", scopes)
+	}
+	redirectTo, err := getLoginChallengeRedirect(e, m, "consent_verifier")
+	if err != nil {
+		return e.InternalServerError("Internal Error", err)
+	}
+	return e.JSON(http.StatusOK, map[string]string{"redirect_to": redirectTo})
+}
+
+func api_OAuth2RejectConsentRequest(e *core.RequestEvent) error {
+	return rejectLoginChallenge(e, LoginChallengePhaseConsent)
+}
+
+// findLoginChallengeUser finds the user that accepted the login challenge.
+func findLoginChallengeUser(app core.App, m *LoginChallengeModel) (*core.Record, error) {
+	u, err := app.FindRecordById(m.GetCollectionId(), m.GetSubject())
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fosite.ErrNotFound
+		}
+		return nil, err
+	}
+	return u, nil
+}
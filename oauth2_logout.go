@@ -0,0 +1,245 @@
+package oauth2
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"slices"
+	"time"
+
+	"github.com/benjamesfleming/pocketbase-ext-oauth2/client"
+	"github.com/benjamesfleming/pocketbase-ext-oauth2/consts"
+	"github.com/ory/fosite"
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+)
+
+// @ref https://openid.net/specs/openid-connect-rpinitiated-1_0.html
+
+// createLogoutChallenge saves a logout challenge for the logout request, along
+// with the details of the request shown by the login UI. The user is asked to
+// confirm the logout unless the request came with a valid id_token_hint, as
+// anyone can send the user to the logout endpoint. The challenge is bound to
+// the browser, so only the browser being logged out can accept it.
+func createLogoutChallenge(e *core.RequestEvent, c *client.Client, idTokenHint *IDTokenHint, form url.Values) (*LoginChallengeModel, error) {
+	state := map[string]interface{}{
+		"collection": GetOAuth2Config().UserCollection,
+		"confirm":    idTokenHint == nil,
+	}
+	m := NewLoginChallengeModel(e.App)
+	if c != nil {
+		state["client_id"] = c.ID
+		state["client_name"] = c.Name
+		state["client_uri"] = c.ClientURI
+		m.Set("client_id", c.ID)
+	}
+	if idTokenHint != nil {
+		state["id_token_hint_subject"] = idTokenHint.Subject
+		m.Set("subject", idTokenHint.Subject)
+	}
+
+	m.Set("request_form", url.Values{
+		"post_logout_redirect_uri": {form.Get("post_logout_redirect_uri")},
+		"state":                    {form.Get("state")},
+	}.Encode())
+	m.Set("requested_at", time.Now().Unix())
+	m.Set("expires_at", time.Now().Add(loginChallengeLifespan).Unix())
+	m.Set("phase", LoginChallengePhaseLogout)
+	m.Set("state", state)
+
+	return m, saveLoginChallenge(e, m)
+}
+
+// getLogoutRedirect returns the post_logout_redirect_uri of the logout
+// challenge with the client's state, or an empty string if the client didn't
+// ask to be redirected.
+func getLogoutRedirect(m *LoginChallengeModel) string {
+	form, _ := url.ParseQuery(m.GetRequestForm())
+	redirectURI := form.Get("post_logout_redirect_uri")
+	// The login UI navigates to the URI, so anything but an http(s) URI is
+	// never handed to it.
+	if redirectURI == "" || !isSecureClientURI(redirectURI, true) {
+		return ""
+	}
+	u, err := url.Parse(redirectURI)
+	if err != nil {
+		return ""
+	}
+	if state := form.Get("state"); state != "" {
+		q := u.Query()
+		q.Set("state", state)
+		u.RawQuery = q.Encode()
+	}
+	return u.String()
+}
+
+//
+
+// api_OAuth2Logout validates the logout request of a client, and hands it over
+// to the login UI with a logout challenge.
+func api_OAuth2Logout(e *core.RequestEvent) error {
+	if err := e.Request.ParseForm(); err != nil {
+		return e.BadRequestError("Failed to read the request.", err)
+	}
+	form := e.Request.Form
+	ctx := e.Request.Context()
+
+	var idTokenHint *IDTokenHint
+	if v := form.Get("id_token_hint"); v != "" {
+		hint, err := ValidateIDTokenHint(ctx, v)
+		if err != nil {
+			return e.BadRequestError("The id_token_hint is invalid.", err)
+		}
+		idTokenHint = hint
+	}
+
+	// The client is identified by the client_id, or by the id_token_hint it
+	// was issued.
+	clientID := form.Get("client_id")
+	if clientID == "" && idTokenHint != nil {
+		clientID = idTokenHint.GetClientID()
+	}
+	var c *client.Client
+	if clientID != "" {
+		fc, err := GetOAuth2Store().GetClient(ctx, clientID)
+		if err != nil {
+			if errors.Is(err, fosite.ErrNotFound) {
+				return e.BadRequestError("The client_id is invalid.", nil)
+			}
+			return e.InternalServerError("Internal Error", err)
+		}
+		c, _ = fc.(*client.Client)
+		if idTokenHint != nil && !idTokenHint.HasAudience(clientID) {
+			return e.BadRequestError("The id_token_hint was not issued to this client.", nil)
+		}
+	}
+
+	// The user can only be sent back to one of the client's registered
+	// post_logout_redirect_uris.
+	if redirectURI := form.Get("post_logout_redirect_uri"); redirectURI != "" {
+		if c == nil {
+			return e.BadRequestError("The post_logout_redirect_uri requires the client_id or id_token_hint.", nil)
+		}
+		if !slices.Contains(c.PostLogoutRedirectURIs, redirectURI) {
+			return e.BadRequestError("The post_logout_redirect_uri is not registered for the client.", nil)
+		}
+	}
+
+	m, err := createLogoutChallenge(e, c, idTokenHint, form)
+	if err != nil {
+		return e.InternalServerError("Internal Error", err)
+	}
+	return redirectToLoginUI(e, m)
+}
+
+func api_OAuth2GetLogoutRequest(e *core.RequestEvent) error {
+	m, err := getLoginChallengeFromRequest(e, LoginChallengePhaseLogout)
+	if err != nil {
+		return err
+	}
+	state := m.GetState()
+	state["challenge"] = e.Request.URL.Query().Get("logout_challenge")
+	state["requested_at"] = m.GetRequestedAt().Unix()
+	return e.JSON(http.StatusOK, state)
+}
+
+// api_OAuth2AcceptLogoutRequest completes the logout once the login UI has
+// forgotten the user's accounts and ends the browser session, and returns the
+// front-channel logout URIs to render and where to send the user next. Only
+// the accounts of the browser session are logged out. The challenge is deleted
+// so that it can only be used once.
+func api_OAuth2AcceptLogoutRequest(e *core.RequestEvent) error {
+	m, err := getLoginChallengeFromRequest(e, LoginChallengePhaseLogout)
+	if err != nil {
+		return err
+	}
+	if !hasLoginChallengeCookie(e, m) {
+		return e.ForbiddenError("The logout challenge was started by another browser.", nil)
+	}
+
+	bs, err := findBrowserSession(e)
+	if err != nil && !errors.Is(err, fosite.ErrNotFound) {
+		return e.InternalServerError("Internal Error", err)
+	}
+
+	// Notify the clients the user is signed in to, before their sessions are
+	// revoked. The back-channel logouts are delivered by the server, and the
+	// front-channel logouts are rendered by the login UI.
+	frontChannelLogoutURIs := []string{}
+	notify := func(subject string, sid string, clientIDs []string) error {
+		if err := enqueueBackChannelLogouts(e.App, subject, sid, clientIDs); err != nil {
+			return err
+		}
+		uris, err := getFrontChannelLogoutURIs(e.Request.Context(), clientIDs, sid)
+		if err != nil {
+			return err
+		}
+		for _, uri := range uris {
+			if !slices.Contains(frontChannelLogoutURIs, uri) {
+				frontChannelLogoutURIs = append(frontChannelLogoutURIs, uri)
+			}
+		}
+		return nil
+	}
+
+	// The browser session knows every account logged in with the browser, and
+	// which clients they signed in to during the session.
+	var hinted *BrowserSessionAccount
+	if bs != nil {
+		for _, account := range bs.GetAccounts() {
+			if err := notify(account.Subject, bs.GetSID(), account.Clients); err != nil {
+				return e.InternalServerError("Internal Error", err)
+			}
+			if account.Subject == m.GetSubject() {
+				hinted = account
+			}
+		}
+	}
+
+	// The user named by the id_token_hint is also logged out of the clients
+	// they hold a session with outside of the browser session, which isn't
+	// tied to a sid. The hint alone doesn't prove the user is logging out, as
+	// it may have been leaked, so this is only done when the user is signed
+	// in to the browser session.
+	if hinted != nil {
+		clientIDs, err := findSessionClientIDs(e.App, dbx.HashExp{"subject": hinted.Subject})
+		if err != nil {
+			return e.InternalServerError("Internal Error", err)
+		}
+		var others []string
+		for _, clientID := range clientIDs[hinted.Subject] {
+			if !slices.Contains(hinted.Clients, clientID) {
+				others = append(others, clientID)
+			}
+		}
+		if err := notify(hinted.Subject, "", others); err != nil {
+			return e.InternalServerError("Internal Error", err)
+		}
+	}
+
+	if GetOAuth2Config().RevokeRefreshTokensOnLogout && hinted != nil && m.GetClientID() != "" {
+		err := revokeSessionRecords(
+			e.App,
+			[]string{consts.AccessCollectionName, consts.RefreshCollectionName},
+			dbx.HashExp{"subject": hinted.Subject, "client_id": m.GetClientID()},
+		)
+		if err != nil {
+			return e.InternalServerError("Internal Error", err)
+		}
+	}
+
+	if bs != nil {
+		if err := clearBrowserSession(e, bs); err != nil {
+			return e.InternalServerError("Internal Error", err)
+		}
+	}
+
+	redirectTo := getLogoutRedirect(m)
+	if err := e.App.Delete(m); err != nil {
+		return e.InternalServerError("Internal Error", err)
+	}
+	return e.JSON(http.StatusOK, map[string]any{
+		"redirect_to":              redirectTo,
+		"frontchannel_logout_uris": frontChannelLogoutURIs,
+	})
+}
@@ -0,0 +1,76 @@
+package oauth2
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+
+	"github.com/ory/fosite"
+	"github.com/pocketbase/pocketbase/core"
+)
+
+// @ref https://datatracker.ietf.org/doc/html/rfc9126
+
+// pushedAuthorizeCredentialParams are the client credentials of a pushed
+// authorization request. They are removed from the request before it is
+// stored, as the request is later resumed at the authorization endpoint.
+var pushedAuthorizeCredentialParams = []string{
+	"client_secret",
+	"client_assertion",
+	"client_assertion_type",
+}
+
+func api_OAuth2PushedAuthorize(e *core.RequestEvent) error {
+	r := e.Request
+	w := e.Response
+	ctx := r.Context()
+
+	//
+
+	// The pushed request is authenticated like the token endpoint, and
+	// validated like the authorization endpoint.
+	ar, err := oauth2.NewPushedAuthorizeRequest(ctx, r)
+	if err != nil {
+		e.App.Logger().Info("[Plugin/OAuth2] Error occurred in NewPushedAuthorizeRequest", slog.Any("error", err))
+		var rfc6749err *fosite.RFC6749Error
+		if errors.As(err, &rfc6749err) {
+			e.App.Logger().Debug(fmt.Sprintf("[Plugin/OAuth2] %s", rfc6749err.DebugField))
+			e.App.Logger().Debug(fmt.Sprintf("[Plugin/OAuth2] %+v", rfc6749err.StackTrace()))
+		}
+		oauth2.WritePushedAuthorizeError(ctx, w, ar, err)
+		return nil
+	}
+
+	// Validate the requested resources and authorization details up front, so
+	// that the client learns about invalid requests before redirecting the
+	// user. The authorization endpoint validates them again when the request
+	// is resumed.
+	resources, err := getRequestedResources(ar.GetRequestForm())
+	if err == nil {
+		err = validateRequestedResources(ctx, ar.GetClient(), resources)
+	}
+	if err == nil {
+		_, err = getRequestedAuthorizationDetails(ar.GetRequestForm(), ar.GetClient())
+	}
+	if err != nil {
+		e.App.Logger().Info("[Plugin/OAuth2] Error occurred in the pushed authorization request", slog.Any("error", err))
+		oauth2.WritePushedAuthorizeError(ctx, w, ar, err)
+		return nil
+	}
+
+	for _, param := range pushedAuthorizeCredentialParams {
+		ar.GetRequestForm().Del(param)
+	}
+
+	// The user is not known yet, the session is created at the authorization
+	// endpoint once they log in.
+	response, err := oauth2.NewPushedAuthorizeResponse(ctx, ar, NewSession(e.App, "", ""))
+	if err != nil {
+		e.App.Logger().Info("[Plugin/OAuth2] Error occurred in NewPushedAuthorizeResponse", slog.Any("error", err))
+		oauth2.WritePushedAuthorizeError(ctx, w, ar, err)
+		return nil
+	}
+
+	oauth2.WritePushedAuthorizeResponse(ctx, w, ar, response)
+	return nil
+}
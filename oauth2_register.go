@@ -3,13 +3,24 @@ package oauth2
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"net/http"
+	"net/url"
 
 	"github.com/go-jose/go-jose/v3"
 	"github.com/ory/fosite"
 	"github.com/pocketbase/pocketbase/core"
 )
 
+// ErrInvalidClientMetadata is returned when the value of one of the client
+// metadata fields is invalid.
+// @ref https://datatracker.ietf.org/doc/html/rfc7591#section-3.2.2
+var ErrInvalidClientMetadata = &fosite.RFC6749Error{
+	ErrorField:       "invalid_client_metadata",
+	DescriptionField: "The value of one of the client metadata fields is invalid.",
+	CodeField:        http.StatusBadRequest,
+}
+
 type RFC7591ClientStorage interface {
 	// RegisterClient registers a new client with the given metadata
 	// and returns the created client or an error if the registration failed.
@@ -18,6 +29,7 @@ type RFC7591ClientStorage interface {
 
 type RFC7591ClientMetadataRequest struct {
 	Scope                   string              `json:"scope"`
+	OptionalScopes          string              `json:"optional_scopes,omitempty"`
 	RedirectURIs            []string            `json:"redirect_uris"`
 	TokenEndpointAuthMethod string              `json:"token_endpoint_auth_method"`
 	GrantTypes              []string            `json:"grant_types"`
@@ -36,6 +48,59 @@ type RFC7591ClientMetadataRequest struct {
 	// The following fields are not part of the RFC7591 but are required for OpenID Connect client registration.
 	// @ref https://openid.net/specs/openid-connect-core-1_0.html#rfc.section.6.2
 	RequestURIs []string `json:"request_uris,omitempty"`
+
+	// @ref https://openid.net/specs/openid-connect-rpinitiated-1_0.html#ClientMetadata
+	PostLogoutRedirectURIs []string `json:"post_logout_redirect_uris,omitempty"`
+
+	// @ref https://openid.net/specs/openid-connect-frontchannel-1_0.html#RPLogout
+	FrontChannelLogoutURI             string `json:"frontchannel_logout_uri,omitempty"`
+	FrontChannelLogoutSessionRequired bool   `json:"frontchannel_logout_session_required,omitempty"`
+
+	// @ref https://openid.net/specs/openid-connect-backchannel-1_0.html#BCRegistration
+	BackChannelLogoutURI             string `json:"backchannel_logout_uri,omitempty"`
+	BackChannelLogoutSessionRequired bool   `json:"backchannel_logout_session_required,omitempty"`
+}
+
+// Validate checks the client metadata fields that the provider later hands to
+// the browser or calls itself.
+func (md *RFC7591ClientMetadataRequest) Validate() error {
+	for _, uri := range md.PostLogoutRedirectURIs {
+		if !isSecureClientURI(uri, true) {
+			return ErrInvalidClientMetadata.WithHintf("The post_logout_redirect_uri '%s' must be an absolute https URI without a fragment component.", uri)
+		}
+	}
+	if md.FrontChannelLogoutURI != "" && !isSecureClientURI(md.FrontChannelLogoutURI, true) {
+		return ErrInvalidClientMetadata.WithHintf("The frontchannel_logout_uri '%s' must be an absolute https URI without a fragment component.", md.FrontChannelLogoutURI)
+	}
+	// The provider POSTs to the URI itself, so it must not point back at the
+	// provider's own host or network.
+	if md.BackChannelLogoutURI != "" && (!isSecureClientURI(md.BackChannelLogoutURI, false) || isLoopbackClientURI(md.BackChannelLogoutURI)) {
+		return ErrInvalidClientMetadata.WithHintf("The backchannel_logout_uri '%s' must be an absolute https URI without a fragment component, and must not be a loopback address.", md.BackChannelLogoutURI)
+	}
+	return nil
+}
+
+// isLoopbackClientURI reports whether the raw URI points at a loopback host.
+func isLoopbackClientURI(raw string) bool {
+	u, err := url.Parse(raw)
+	return err == nil && fosite.IsLocalhost(u)
+}
+
+// isSecureClientURI reports whether the raw URI is absolute, has no fragment
+// component and uses https. Plain http is allowed for loopback hosts when
+// allowLoopback is set.
+func isSecureClientURI(raw string, allowLoopback bool) bool {
+	u, err := url.Parse(raw)
+	if err != nil || !fosite.IsValidRedirectURI(u) {
+		return false
+	}
+	switch u.Scheme {
+	case "https":
+		return u.Host != ""
+	case "http":
+		return allowLoopback && fosite.IsLocalhost(u)
+	}
+	return false
 }
 
 type RFC7591ClientMetadata struct {
@@ -64,6 +129,14 @@ func api_OAuth2Register(e *core.RequestEvent) error {
 		return e.BadRequestError("redirect_uris is required", nil)
 	}
 
+	if err := md.Validate(); err != nil {
+		var rfc6749err *fosite.RFC6749Error
+		if errors.As(err, &rfc6749err) {
+			return e.JSON(rfc6749err.CodeField, rfc6749err)
+		}
+		return e.BadRequestError(err.Error(), err)
+	}
+
 	//
 
 	c, clientSecret, err := GetOAuth2Store().RegisterClient(r.Context(), &md)
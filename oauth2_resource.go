@@ -0,0 +1,169 @@
+package oauth2
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+
+	"github.com/benjamesfleming/pocketbase-ext-oauth2/rfc9728"
+	"github.com/ory/fosite"
+	"github.com/pocketbase/pocketbase/core"
+)
+
+// @ref https://datatracker.ietf.org/doc/html/rfc8707
+
+// ErrInvalidTarget is returned when the requested resource is invalid, unknown
+// or not allowed for the client.
+// @ref https://datatracker.ietf.org/doc/html/rfc8707#section-2
+var ErrInvalidTarget = &fosite.RFC6749Error{
+	ErrorField:       "invalid_target",
+	DescriptionField: "The requested resource is invalid, missing, unknown, or malformed.",
+	CodeField:        http.StatusBadRequest,
+}
+
+// getRequestedResources returns the resource indicators of the request. Each
+// resource must be an absolute URI without a fragment component.
+func getRequestedResources(form url.Values) ([]string, error) {
+	var ret []string
+	for _, resource := range form["resource"] {
+		u, err := url.Parse(resource)
+		if err != nil || !u.IsAbs() || u.Fragment != "" {
+			return nil, ErrInvalidTarget.WithHintf("The resource '%s' must be an absolute URI without a fragment component.", resource)
+		}
+		if !slices.Contains(ret, resource) {
+			ret = append(ret, resource)
+		}
+	}
+	return ret, nil
+}
+
+// validateRequestedResources checks that the client is allowed to request
+// tokens for each of the resources, either because it is in the client's
+// audience allow-list or because it is a registered protected resource.
+func validateRequestedResources(ctx context.Context, client fosite.Client, resources []string) error {
+	if err := GetOAuth2Config().GetAudienceStrategy(ctx)(client.GetAudience(), resources); err != nil {
+		return ErrInvalidTarget.WithWrap(err).WithDebug(err.Error())
+	}
+	return nil
+}
+
+// validateGrantedResources checks that each of the resources requested at the
+// token endpoint was part of the original grant.
+func validateGrantedResources(requester fosite.Requester, resources []string) error {
+	for _, resource := range resources {
+		if !slices.Contains(requester.GetRequestedAudience(), resource) {
+			return ErrInvalidTarget.WithHintf("The resource '%s' was not part of the original grant.", resource)
+		}
+	}
+	return nil
+}
+
+// getResourceAudience returns the audience of a token issued for the given
+// resources. Tokens granted the openid scope are always valid at the userinfo
+// endpoint, so it is added to the audience of any resource restricted token.
+func getResourceAudience(resources []string, scopes fosite.Arguments) []string {
+	if len(resources) == 0 {
+		return nil
+	}
+	ret := slices.Clone(resources)
+	if scopes.Has("openid") {
+		userInfo := oauth2ProviderMetadata.UserInfoEndpoint
+		if !slices.Contains(ret, userInfo) {
+			ret = append(ret, userInfo)
+		}
+	}
+	return ret
+}
+
+// newResourceAudienceMatchingStrategy wraps an audience matching strategy so
+// that the registered protected resources are allowed for every client, in
+// addition to the client's own audience allow-list.
+func newResourceAudienceMatchingStrategy(next fosite.AudienceMatchingStrategy) fosite.AudienceMatchingStrategy {
+	return func(haystack []string, needle []string) error {
+		var remaining []string
+		for _, n := range needle {
+			if !isProtectedResource(n) {
+				remaining = append(remaining, n)
+			}
+		}
+		return next(haystack, remaining)
+	}
+}
+
+// isProtectedResource reports whether the resource identifier belongs to a
+// registered protected resource, or is the userinfo endpoint.
+func isProtectedResource(resource string) bool {
+	if resource == oauth2ProviderMetadata.UserInfoEndpoint {
+		return true
+	}
+
+	oauth2ProtectedResourceMetadataMu.RLock()
+	defer oauth2ProtectedResourceMetadataMu.RUnlock()
+
+	for _, md := range oauth2ProtectedResourceMetadata {
+		if fosite.DefaultAudienceMatchingStrategy([]string{md.Resource}, []string{resource}) == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveAccessTokenInfo implements the [rfc9728.SetAccessTokenInfoResolver]
+// callback using the stored access token sessions.
+func resolveAccessTokenInfo(e *core.RequestEvent) (*rfc9728.AccessTokenInfo, error) {
+	token := getRequestAccessToken(e)
+	if !isOAuth2AccessToken(token) {
+		return nil, nil
+	}
+	m, err := findAccessTokenModelByToken(e.App, token)
+	if err != nil {
+		// The session of the access token is deleted when it is revoked, or
+		// replaced by a refresh.
+		if errors.Is(err, fosite.ErrNotFound) {
+			return nil, rfc9728.ErrInactiveAccessToken
+		}
+		return nil, err
+	}
+	session := &Session{}
+	if err := json.Unmarshal(m.GetSessionData(), session); err != nil {
+		return nil, err
+	}
+	info := &rfc9728.AccessTokenInfo{
+		Audience: m.GetGrantedAudience(),
+		Scopes:   m.GetGrantedScopes(),
+	}
+	if session.Claims != nil {
+		info.ACR = session.Claims.AuthenticationContextClassReference
+		info.AuthTime = session.Claims.AuthTime
+	}
+	return info, nil
+}
+
+// registerProtectedRoutes registers the routes guarded by
+// [rfc9728.RequireScopes] as protected resources. Routes with metadata that
+// was registered explicitly are left as is.
+func registerProtectedRoutes(app core.App, routes []*rfc9728.ProtectedRoute) {
+	appURL := strings.TrimRight(app.Settings().Meta.AppURL, "/")
+	for _, route := range routes {
+		oauth2ProtectedResourceMetadataMu.RLock()
+		_, ok := oauth2ProtectedResourceMetadata[route.Path]
+		oauth2ProtectedResourceMetadataMu.RUnlock()
+		if ok {
+			continue
+		}
+		RegisterProtectedResourceMetadata(
+			&rfc9728.ProtectedResourceMetadata{
+				Resource: appURL + "/" + route.Path,
+				AuthorizationServers: []string{
+					app.Settings().Meta.AppURL,
+				},
+				BearerMethodsSupported: []string{"header"},
+				ScopesSupported:        route.Scopes,
+			},
+		)
+	}
+}
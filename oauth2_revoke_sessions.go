@@ -0,0 +1,216 @@
+package oauth2
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"log/slog"
+	"net/http"
+	"slices"
+
+	"github.com/benjamesfleming/pocketbase-ext-oauth2/consts"
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/apis"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/hook"
+)
+
+// revokeSessions revokes all the auth codes, access tokens, refresh tokens,
+// PKCE and OpenID Connect sessions of the subject, of the client, or of the
+// subject with the client, and removes them from the browser sessions. The
+// consent grants are kept.
+//
+// The access tokens are added to the revoked tokens, so that PocketBase no
+// longer accepts them. The clients are notified with a back-channel logout,
+// for the browser sessions the user signed in to them with, or for the user
+// otherwise.
+func revokeSessions(app core.App, subject string, clientID string) error {
+	exp := dbx.HashExp{}
+	if subject != "" {
+		exp["subject"] = subject
+	}
+	if clientID != "" {
+		exp["client_id"] = clientID
+	}
+	if len(exp) == 0 {
+		return errors.New("either the subject or the client_id is required")
+	}
+
+	// Find the clients of each user before their sessions are deleted.
+	clientIDsBySubject, err := findSessionClientIDs(app, exp)
+	if err != nil {
+		return err
+	}
+
+	var logouts []*browserSessionLogout
+	err = app.RunInTransaction(func(txApp core.App) error {
+		err := revokeSessionRecords(txApp, []string{
+			consts.AuthCodeCollectionName,
+			consts.AccessCollectionName,
+			consts.RefreshCollectionName,
+			consts.PKCECollectionName,
+			consts.OpenIDConnectCollectionName,
+		}, exp)
+		if err != nil {
+			return err
+		}
+		logouts, err = removeBrowserSessionLogins(txApp, subject, clientID)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	// Notify each client once per browser session the user signed in to it
+	// with, and once for the user if it isn't part of any browser session.
+	// The sessions are already revoked at this point, so a failure to notify
+	// the clients is logged rather than returned.
+	for _, logout := range logouts {
+		if err := enqueueBackChannelLogouts(app, logout.Subject, logout.SID, logout.ClientIDs); err != nil {
+			app.Logger().Error("[Plugin/OAuth2] Failed to enqueue back-channel logouts", slog.String("subject", logout.Subject), slog.Any("error", err))
+		}
+		clientIDsBySubject[logout.Subject] = slices.DeleteFunc(clientIDsBySubject[logout.Subject], func(id string) bool {
+			return slices.Contains(logout.ClientIDs, id)
+		})
+	}
+	for s, clientIDs := range clientIDsBySubject {
+		if err := enqueueBackChannelLogouts(app, s, "", clientIDs); err != nil {
+			app.Logger().Error("[Plugin/OAuth2] Failed to enqueue back-channel logouts", slog.String("subject", s), slog.Any("error", err))
+		}
+	}
+	return nil
+}
+
+// signOutUser revokes all the sessions of the user, and refreshes the token
+// key of the user, which also invalidates the user's own PocketBase auth
+// tokens. The sessions are revoked by the [revokeUserSessionsOnUpdate] hook
+// when the token key is saved.
+func signOutUser(app core.App, subject string) error {
+	u, err := app.FindRecordById(GetOAuth2Config().UserCollection, subject)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return revokeSessions(app, subject, "")
+		}
+		return err
+	}
+	u.RefreshTokenKey()
+	return app.Save(u)
+}
+
+// hashTokenKey hashes the token key of the user, for the sessions to record
+// the token key they were granted with.
+func hashTokenKey(tokenKey string) string {
+	mac := hmac.New(sha256.New, GetOAuth2Config().GlobalSecret)
+	mac.Write([]byte("token_key:" + tokenKey))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// revokeUserSessionsOnUpdate revokes all the sessions of the user when the
+// token key of the user changes, as it does when the password or email is
+// changed. A record that wasn't loaded from the database has no original
+// token key, and is left as is.
+func revokeUserSessionsOnUpdate(e *core.RecordEvent) error {
+	if err := e.Next(); err != nil {
+		return err
+	}
+	if original := e.Record.Original().TokenKey(); original == "" || original == e.Record.TokenKey() {
+		return nil
+	}
+	return revokeSessions(e.App, e.Record.Id, "")
+}
+
+// revokeUserSessionsOnDelete revokes all the sessions of a deleted user, and
+// deletes the consent grants.
+func revokeUserSessionsOnDelete(e *core.RecordEvent) error {
+	if err := e.Next(); err != nil {
+		return err
+	}
+	if err := revokeSessions(e.App, e.Record.Id, ""); err != nil {
+		return err
+	}
+	return deleteConsentModels(e.App, dbx.HashExp{"subject": e.Record.Id})
+}
+
+// revokeClientSessionsOnUpdate revokes all the sessions of the client when
+// its client_id or client_secret changes. A record that wasn't loaded from the
+// database has no original client_id, and is left as is.
+func revokeClientSessionsOnUpdate(e *core.RecordEvent) error {
+	if err := e.Next(); err != nil {
+		return err
+	}
+	original := e.Record.Original()
+	if original.GetString("client_id") == "" ||
+		(original.GetString("client_id") == e.Record.GetString("client_id") &&
+			original.GetString("client_secret") == e.Record.GetString("client_secret")) {
+		return nil
+	}
+	return revokeSessions(e.App, "", original.GetString("client_id"))
+}
+
+// revokeClientSessionsOnDelete revokes all the sessions of a deleted client,
+// and deletes the consent grants.
+func revokeClientSessionsOnDelete(e *core.RecordEvent) error {
+	if err := e.Next(); err != nil {
+		return err
+	}
+	clientID := e.Record.GetString("client_id")
+	if err := revokeSessions(e.App, "", clientID); err != nil {
+		return err
+	}
+	return deleteConsentModels(e.App, dbx.HashExp{"client_id": clientID})
+}
+
+// loadRevokedAccessTokens unsets the auth record of requests made with a
+// revoked access token, as PocketBase would otherwise accept it until it
+// expires. The revoked tokens are only looked up for OAuth2 access tokens,
+// not for the PocketBase auth tokens of the users' own logins.
+func loadRevokedAccessTokens() *hook.Handler[*core.RequestEvent] {
+	return &hook.Handler[*core.RequestEvent]{
+		Id: "pbOAuth2RevokedAccessTokens",
+		Func: func(e *core.RequestEvent) error {
+			if e.Auth == nil {
+				return e.Next()
+			}
+			token := getRequestAccessToken(e)
+			if !isOAuth2AccessToken(token) {
+				return e.Next()
+			}
+			revoked, err := isRevokedAccessToken(e.App, token)
+			if err != nil {
+				return e.InternalServerError("Internal Error", err)
+			}
+			if revoked {
+				e.Auth = nil
+			}
+			return e.Next()
+		},
+		// Make sure this runs after the default LoadAuthToken middleware, and
+		// before the rfc9728 middlewares.
+		Priority: apis.DefaultLoadAuthTokenMiddlewarePriority + 5,
+	}
+}
+
+//
+
+// api_OAuth2RevokeSessions signs the user given by the subject param out
+// everywhere, or all users out of the client given by the client_id param, or
+// the user out of the client if both are given.
+func api_OAuth2RevokeSessions(e *core.RequestEvent) error {
+	subject := e.Request.URL.Query().Get("subject")
+	clientID := e.Request.URL.Query().Get("client_id")
+	if subject == "" && clientID == "" {
+		return e.BadRequestError("Either the subject or the client_id is required.", nil)
+	}
+	var err error
+	if clientID == "" {
+		err = signOutUser(e.App, subject)
+	} else {
+		err = revokeSessions(e.App, subject, clientID)
+	}
+	if err != nil {
+		return e.InternalServerError("Internal Error", err)
+	}
+	return e.NoContent(http.StatusNoContent)
+}
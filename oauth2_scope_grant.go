@@ -0,0 +1,112 @@
+package oauth2
+
+import (
+	"database/sql"
+	"errors"
+	"slices"
+	"strings"
+
+	"github.com/ory/fosite"
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+)
+
+// ScopeGrantStrategy defines the interface for deciding which of the requested
+// scopes are granted to a client for a user. It is called at the authorization
+// endpoint and whenever a refresh token is used, so that changes to the user
+// record are reflected in the refreshed grant.
+type ScopeGrantStrategy interface {
+	GetGrantedScopes(e *core.RequestEvent, user *core.Record, client fosite.Client, audience []string, scopes []string) ([]string, error)
+}
+
+//
+
+// ScopeGrantFilters maps scope patterns to PocketBase filter expressions that
+// the user record must satisfy for the scope to be granted. A pattern ending
+// with "*" matches all scopes with that prefix, for example
+//
+//	ScopeGrantFilters{
+//		"admin:*": "role = 'admin'",
+//		"billing": "verified = true && plan != 'free'",
+//	}
+type ScopeGrantFilters map[string]string
+
+// FilterScopeGrantStrategy is the default [ScopeGrantStrategy]. A requested
+// scope is granted when the user record satisfies the filters of all the
+// patterns matching the scope. Scopes without a matching pattern are granted.
+type FilterScopeGrantStrategy struct {
+	Filters ScopeGrantFilters
+}
+
+// GetGrantedScopes implements [ScopeGrantStrategy].
+func (s *FilterScopeGrantStrategy) GetGrantedScopes(e *core.RequestEvent, user *core.Record, client fosite.Client, audience []string, scopes []string) ([]string, error) {
+	// Evaluate each filter at most once, multiple scopes often share a pattern.
+	results := map[string]bool{}
+
+	ret := []string{}
+	for _, scope := range scopes {
+		granted := true
+		for _, pattern := range s.patterns() {
+			if !matchScopePattern(pattern, scope) {
+				continue
+			}
+			ok, seen := results[pattern]
+			if !seen {
+				var err error
+				if ok, err = matchRecordFilter(e.App, user, s.Filters[pattern]); err != nil {
+					return nil, err
+				}
+				results[pattern] = ok
+			}
+			if !ok {
+				granted = false
+				break
+			}
+		}
+		if granted {
+			ret = append(ret, scope)
+		}
+	}
+	return ret, nil
+}
+
+// patterns returns the sorted scope patterns, for deterministic evaluation.
+func (s *FilterScopeGrantStrategy) patterns() []string {
+	ret := make([]string, 0, len(s.Filters))
+	for pattern := range s.Filters {
+		ret = append(ret, pattern)
+	}
+	slices.Sort(ret)
+	return ret
+}
+
+var _ ScopeGrantStrategy = (*FilterScopeGrantStrategy)(nil)
+
+// matchScopePattern reports whether the scope matches the pattern. A pattern
+// ending with "*" matches all scopes with that prefix.
+func matchScopePattern(pattern string, scope string) bool {
+	if prefix, ok := strings.CutSuffix(pattern, "*"); ok {
+		return strings.HasPrefix(scope, prefix)
+	}
+	return pattern == scope
+}
+
+// matchRecordFilter reports whether the record satisfies the PocketBase filter
+// expression. An empty filter always matches.
+func matchRecordFilter(app core.App, record *core.Record, filter string) (bool, error) {
+	if strings.TrimSpace(filter) == "" {
+		return true, nil
+	}
+	_, err := app.FindFirstRecordByFilter(
+		record.Collection(),
+		"id = {:__oauth2_record_id} && ("+filter+")",
+		dbx.Params{"__oauth2_record_id": record.Id},
+	)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
@@ -1,6 +1,7 @@
 package oauth2
 
 import (
+	"database/sql"
 	"errors"
 	"fmt"
 	"log/slog"
@@ -34,6 +35,37 @@ func api_OAuth2Token(e *core.RequestEvent) error {
 		return nil
 	}
 
+	// Validate the requested resources. For grants issued at the authorization
+	// endpoint the resources must be a subset of the original grant.
+	// @ref https://datatracker.ietf.org/doc/html/rfc8707#section-2.2
+	resources, err := getRequestedResources(accessRequest.GetRequestForm())
+	if err == nil {
+		if accessRequest.GetGrantTypes().ExactOne("client_credentials") {
+			err = validateRequestedResources(ctx, accessRequest.GetClient(), resources)
+		} else {
+			err = validateGrantedResources(accessRequest, resources)
+		}
+	}
+	if err != nil {
+		e.App.Logger().Info("[Plugin/OAuth2] Error occurred in validateRequestedResources", slog.Any("error", err))
+		oauth2.WriteAccessError(ctx, w, accessRequest, err)
+		return nil
+	}
+
+	// Validate the requested authorization details. For grants issued at the
+	// authorization endpoint they must be a subset of the original grant.
+	// @ref https://datatracker.ietf.org/doc/html/rfc9396#section-6
+	session, _ := accessRequest.GetSession().(*Session)
+	authorizationDetails, err := getRequestedAuthorizationDetails(accessRequest.GetRequestForm(), accessRequest.GetClient())
+	if err == nil && session != nil && !accessRequest.GetGrantTypes().ExactOne("client_credentials") {
+		err = validateGrantedAuthorizationDetails(session.AuthorizationDetails, authorizationDetails)
+	}
+	if err != nil {
+		e.App.Logger().Info("[Plugin/OAuth2] Error occurred in getRequestedAuthorizationDetails", slog.Any("error", err))
+		oauth2.WriteAccessError(ctx, w, accessRequest, err)
+		return nil
+	}
+
 	// If this is a client_credentials grant, grant all requested scopes
 	// NewAccessRequest validated that all requested scopes the client is allowed to perform
 	// based on configured scope matching strategy.
@@ -41,6 +73,40 @@ func api_OAuth2Token(e *core.RequestEvent) error {
 		for _, scope := range accessRequest.GetRequestedScopes() {
 			accessRequest.GrantScope(scope)
 		}
+		for _, audience := range resources {
+			accessRequest.GrantAudience(audience)
+		}
+		if session != nil {
+			session.AuthorizationDetails = authorizationDetails
+		}
+	}
+
+	// Decide again which of the granted scopes can be granted to the client when
+	// a refresh token is used, so that the refreshed grant reflects the current
+	// state of the user record.
+	if accessRequest.GetGrantTypes().ExactOne("refresh_token") && session != nil {
+		if ar, ok := accessRequest.(*fosite.AccessRequest); ok {
+			scopes, err := getRefreshedScopes(e, ar, session)
+			if err != nil {
+				e.App.Logger().Info("[Plugin/OAuth2] Error occurred in getRefreshedScopes", slog.Any("error", err))
+				oauth2.WriteAccessError(ctx, w, accessRequest, err)
+				return nil
+			}
+			ar.GrantedScope = scopes
+		}
+	}
+
+	// Narrow the audience and authorization details of the access token to the
+	// requested resources and authorization details. The refresh token keeps
+	// the original grant, so that it can be used to obtain access tokens for
+	// the other resources. An access token without an audience is accepted by
+	// every protected resource.
+	if session != nil && !accessRequest.GetGrantTypes().ExactOne("client_credentials") {
+		session.AccessTokenAudience = getResourceAudience(resources, accessRequest.GetGrantedScopes())
+		session.AccessTokenAuthorizationDetails = authorizationDetails
+		if len(authorizationDetails) == 0 {
+			authorizationDetails = session.AuthorizationDetails
+		}
 	}
 
 	// Next we create a response for the access request. Again, we iterate through the TokenEndpointHandlers
@@ -57,8 +123,47 @@ func api_OAuth2Token(e *core.RequestEvent) error {
 		return nil
 	}
 
+	// Return the authorization details granted for the access token.
+	if len(authorizationDetails) > 0 {
+		response.SetExtra("authorization_details", authorizationDetails)
+	}
+
 	// All done, send the response.
 	// The client now has a valid access token
 	oauth2.WriteAccessResponse(ctx, w, accessRequest, response)
 	return nil
 }
+
+// getRefreshedScopes returns the scopes of the original grant that can still be
+// granted to the client for the user of the refresh token. The refresh fails if
+// the user is no longer allowed to sign in to the client, or if the user's
+// token key has changed since the grant.
+func getRefreshedScopes(e *core.RequestEvent, ar *fosite.AccessRequest, session *Session) ([]string, error) {
+	u, err := e.App.FindRecordById(session.CollectionId, session.GetSubject())
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fosite.ErrInvalidGrant.WithHint("The user of the refresh token no longer exists.")
+		}
+		return nil, fosite.ErrServerError.WithWrap(err)
+	}
+	// The token key changes when the user changes their password or email, or
+	// is signed out everywhere.
+	if session.TokenKeyHash != "" && session.TokenKeyHash != hashTokenKey(u.TokenKey()) {
+		return nil, fosite.ErrInvalidGrant.WithHint("The credentials of the user have changed since the refresh token was issued.")
+	}
+	if ok, err := isAllowedUser(e.App, ar.GetClient(), u); err != nil {
+		return nil, fosite.ErrServerError.WithWrap(err)
+	} else if !ok {
+		e.App.Logger().Warn(
+			"[Plugin/OAuth2] User is not allowed to sign in to the client",
+			slog.Any("client_id", ar.GetClient().GetID()),
+			slog.Any("user_id", u.Id),
+		)
+		return nil, fosite.ErrInvalidGrant.WithHint("The user is no longer allowed to sign in to this client.")
+	}
+	scopes, err := GetOAuth2Config().ScopeGrantStrategy.GetGrantedScopes(e, u, ar.GetClient(), ar.GetGrantedAudience(), ar.GetGrantedScopes())
+	if err != nil {
+		return nil, fosite.ErrServerError.WithWrap(err)
+	}
+	return scopes, nil
+}
@@ -3,7 +3,9 @@ package oauth2
 import (
 	"net/http"
 	"slices"
+	"strings"
 
+	"github.com/ory/fosite"
 	"github.com/pkg/errors"
 	"github.com/pocketbase/pocketbase/core"
 )
@@ -140,6 +142,11 @@ type UserInfoClaims struct {
 	// Time the End-User's information was last updated. Its value is a JSON number representing
 	// the number of seconds from 1970-01-01T00:00:00Z as measured in UTC until the date/time.
 	UpdatedAt int64 `json:"updated_at,omitempty"`
+
+	// Aggregated and Distributed Claims
+	// Claims asserted by a Claims Provider other than the OpenID Provider,
+	// see [ClaimSources].
+	ClaimSources
 }
 
 type UserInfoAddressClaim struct {
@@ -189,10 +196,23 @@ type UserInfoClaimStrategy interface {
 
 //
 
+// ErrInvalidToken is returned by the claim strategies when the request isn't
+// authenticated as the user to release the claims of.
+// @ref https://datatracker.ietf.org/doc/html/rfc6750#section-3.1
+var ErrInvalidToken = &fosite.RFC6749Error{
+	ErrorField:       "invalid_token",
+	DescriptionField: "The access token provided is expired, revoked, malformed, or invalid for other reasons.",
+	CodeField:        http.StatusUnauthorized,
+}
+
 type DefaultUserInfoClaimStrategy struct{}
 
 // GetUserInfoClaims implements [UserInfoClaimStrategy].
 func (d *DefaultUserInfoClaimStrategy) GetUserInfoClaims(e *core.RequestEvent, scopes []string) (interface{}, error) {
+	if e.Auth == nil {
+		return nil, ErrInvalidToken
+	}
+
 	ret := &UserInfoClaims{}
 
 	// For the default strategy, we'll just try to populate the standard claims from
@@ -325,20 +345,44 @@ var _ UserInfoClaimStrategy = (*DefaultUserInfoClaimStrategy)(nil)
 //
 
 func api_OAuth2UserInfo(e *core.RequestEvent) error {
-
-	// TODO: Support provided scopes to determine which claims to return.
-	//       For now we will just return all claims that we can populate
-	//       from the user record.
-	//
-	// TODO/conformance: The lack of scope support results in an OpenID Connect conformance
-	//                   warning. "EnsureUserInfoDoesNotContainName: Unexpectedly found
-	//                   name in userinfo response."
-	scopes := []string{"openid", "profile", "address", "email"}
+	scopes, err := getUserInfoScopes(e)
+	if err != nil {
+		return e.InternalServerError("", err)
+	}
 
 	info, err := GetOAuth2Config().UserInfoClaimStrategy.GetUserInfoClaims(e, scopes)
-	if err != nil {
+	if errors.Is(err, ErrInvalidToken) {
+		e.Response.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		return e.JSON(http.StatusUnauthorized, ErrInvalidToken)
+	} else if err != nil {
 		return e.InternalServerError("", errors.Wrap(err, "GetUserInfoClaims"))
 	} else {
 		return e.JSON(http.StatusOK, info)
 	}
 }
+
+// getUserInfoScopes returns the scopes to release the claims of, for every
+// claim strategy. These are the scopes granted to the presented access token.
+// Plain PocketBase auth tokens that weren't issued through the token endpoint
+// have no granted scopes, so we fall back to returning all the claims that we
+// can populate from the user record.
+func getUserInfoScopes(e *core.RequestEvent) ([]string, error) {
+	m, err := findAccessTokenModelByToken(e.App, getRequestAccessToken(e))
+	if err != nil {
+		if errors.Is(err, fosite.ErrNotFound) {
+			return []string{"openid", "profile", "address", "email"}, nil
+		}
+		return nil, err
+	}
+	return m.GetGrantedScopes(), nil
+}
+
+// getRequestAccessToken returns the raw access token presented in the
+// Authorization header of the request, or an empty string if there is none.
+func getRequestAccessToken(e *core.RequestEvent) string {
+	token := e.Request.Header.Get("Authorization")
+	if len(token) > 7 && strings.EqualFold(token[:7], "Bearer ") {
+		token = token[7:]
+	}
+	return token
+}
@@ -0,0 +1,452 @@
+package oauth2
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/types"
+	"github.com/spf13/cast"
+)
+
+// ClaimMappings declaratively maps scopes to the claims they release.
+//
+// The outer key is the scope name, the inner key is the claim name and the
+// value is a field expression that is evaluated against the authenticated
+// user record. Nested claims, such as the members of the "address" claim,
+// can be targeted using a dot separated claim name (e.g. "address.locality").
+//
+// Field expressions support the following forms:
+//
+//   - "field"                 the raw value of a field on the user record.
+//   - "relation.field"        the value of a field on an expanded relation.
+//     Multiple relations produce an array of values.
+//   - "json_field.key"        the value of a key inside a JSON field.
+//   - "field|format"          the value converted using one of the supported
+//     formats: string, bool, number, unix, date, datetime, file_url, split.
+//   - "{first} {last}"        a template combining multiple field expressions
+//     into a single string value.
+//
+// Claims whose field doesn't exist or resolves to an empty value are omitted.
+// An empty field expression can be used to disable a claim.
+//
+// Example:
+//
+//	oauth2.ClaimMappings{
+//		"profile": {
+//			"name":    "{first_name} {last_name}",
+//			"picture": "avatar|file_url",
+//		},
+//		"groups": {
+//			"groups": "groups.name",
+//		},
+//	}
+type ClaimMappings map[string]map[string]string
+
+// DefaultClaimMappings returns claim mappings for the standard OpenID Connect
+// scopes based on the standard claim names and the default PocketBase user
+// collection. The returned value can be extended or modified before use.
+func DefaultClaimMappings() ClaimMappings {
+	return ClaimMappings{
+		"profile": {
+			"name":               "name",
+			"given_name":         "given_name",
+			"family_name":        "family_name",
+			"middle_name":        "middle_name",
+			"nickname":           "nickname",
+			"preferred_username": "preferred_username",
+			"profile":            "profile",
+			"picture":            "avatar|file_url",
+			"website":            "website",
+			"gender":             "gender",
+			"birthdate":          "birthdate|date",
+			"zoneinfo":           "zoneinfo",
+			"locale":             "locale",
+			"updated_at":         "updated|unix",
+		},
+		"email": {
+			"email":          "email",
+			"email_verified": "verified|bool",
+		},
+		"phone": {
+			"phone_number":          "phone_number",
+			"phone_number_verified": "phone_number_verified|bool",
+		},
+		"address": {
+			"address.street_address": "address_street",
+			"address.locality":       "address_locality",
+			"address.region":         "address_region",
+			"address.postal_code":    "address_postal_code",
+			"address.country":        "address_country",
+		},
+	}
+}
+
+// Merge returns a copy of the mappings with the claims from other added on top.
+// Claims defined in both are taken from other.
+func (m ClaimMappings) Merge(other ClaimMappings) ClaimMappings {
+	ret := ClaimMappings{}
+	for _, src := range []ClaimMappings{m, other} {
+		for scope, claims := range src {
+			if ret[scope] == nil {
+				ret[scope] = map[string]string{}
+			}
+			for claim, expr := range claims {
+				ret[scope][claim] = expr
+			}
+		}
+	}
+	return ret
+}
+
+// Scopes returns the sorted list of scopes defined by the mappings.
+func (m ClaimMappings) Scopes() []string {
+	ret := make([]string, 0, len(m))
+	for scope := range m {
+		ret = append(ret, scope)
+	}
+	slices.Sort(ret)
+	return ret
+}
+
+// Claims returns the sorted list of top-level claim names defined by the mappings.
+func (m ClaimMappings) Claims() []string {
+	ret := []string{}
+	for _, claims := range m {
+		for claim, expr := range claims {
+			name, _, _ := strings.Cut(claim, ".")
+			if expr != "" && !slices.Contains(ret, name) {
+				ret = append(ret, name)
+			}
+		}
+	}
+	slices.Sort(ret)
+	return ret
+}
+
+//
+
+// MappedUserInfoClaimStrategy is a [UserInfoClaimStrategy] that builds the
+// user info claims from declarative [ClaimMappings] instead of guessing them
+// from the user collection field names.
+type MappedUserInfoClaimStrategy struct {
+	Mappings ClaimMappings
+
+	// ClaimSources optionally returns the aggregated and distributed claims
+	// for the user, e.g. claims held by another service. It is only called if
+	// EnableAggregatedAndDistributedClaims is set.
+	ClaimSources func(e *core.RequestEvent, scopes []string) (*ClaimSources, error)
+}
+
+// GetUserInfoClaims implements [UserInfoClaimStrategy].
+func (s *MappedUserInfoClaimStrategy) GetUserInfoClaims(e *core.RequestEvent, scopes []string) (interface{}, error) {
+	if e.Auth == nil {
+		return nil, ErrInvalidToken
+	}
+
+	// Work on a copy of the auth record so that any relation expansion doesn't
+	// leak into the request event.
+	record := e.Auth.Clone()
+
+	ret := map[string]any{
+		"sub": record.Id,
+	}
+
+	for _, scope := range scopes {
+		claims := s.Mappings[scope]
+
+		// Sort the claim names to produce a deterministic result when multiple
+		// scopes map to the same claim.
+		names := make([]string, 0, len(claims))
+		for name := range claims {
+			names = append(names, name)
+		}
+		slices.Sort(names)
+
+		for _, name := range names {
+			if name == "sub" || claims[name] == "" {
+				continue
+			}
+			value, err := evalClaimExpression(e.App, record, claims[name])
+			if err != nil {
+				return nil, fmt.Errorf("failed to evaluate claim %q: %w", name, err)
+			}
+			if isEmptyClaimValue(value) {
+				continue
+			}
+			setNestedClaim(ret, name, value)
+		}
+	}
+
+	// The claim sources are only resolved if the aggregated and distributed
+	// claims are enabled.
+	if s.ClaimSources != nil && GetOAuth2Config().EnableAggregatedAndDistributedClaims {
+		sources, err := s.ClaimSources(e, scopes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get claim sources: %w", err)
+		}
+		if !sources.IsEmpty() {
+			ret["_claim_names"] = sources.ClaimNames
+			ret["_claim_sources"] = sources.ClaimSources
+		}
+	}
+
+	return ret, nil
+}
+
+var _ UserInfoClaimStrategy = (*MappedUserInfoClaimStrategy)(nil)
+
+//
+
+var claimTemplateRegex = regexp.MustCompile(`\{([^{}]+)\}`)
+
+// evalClaimExpression evaluates a single claim mapping field expression
+// against the given record.
+func evalClaimExpression(app core.App, record *core.Record, expr string) (any, error) {
+	expr = strings.TrimSpace(expr)
+
+	// Templates - replace each {expr} placeholder with its string value.
+	if strings.Contains(expr, "{") {
+		var evalErr error
+		ret := claimTemplateRegex.ReplaceAllStringFunc(expr, func(m string) string {
+			value, err := evalClaimExpression(app, record, m[1:len(m)-1])
+			if err != nil {
+				evalErr = err
+				return ""
+			}
+			if arr, ok := value.([]any); ok {
+				return strings.Join(cast.ToStringSlice(arr), " ")
+			}
+			return cast.ToString(value)
+		})
+		if evalErr != nil {
+			return nil, evalErr
+		}
+		return strings.Join(strings.Fields(ret), " "), nil
+	}
+
+	path, format, _ := strings.Cut(expr, "|")
+	path = strings.TrimSpace(path)
+	format = strings.TrimSpace(format)
+
+	leaves, multiple := resolveClaimLeaves(app, record, strings.Split(path, "."))
+	if len(leaves) == 0 {
+		if multiple {
+			return []any{}, nil
+		}
+		return nil, nil
+	}
+
+	values := []any{}
+	for _, leaf := range leaves {
+		value, err := leaf.format(app, format)
+		if err != nil {
+			return nil, err
+		}
+		if arr, ok := value.([]any); ok {
+			values = append(values, arr...)
+			multiple = true
+		} else if !isEmptyClaimValue(value) {
+			values = append(values, value)
+		}
+	}
+
+	if multiple {
+		return values, nil
+	}
+	if len(values) == 0 {
+		return nil, nil
+	}
+	if len(values) == 1 {
+		return values[0], nil
+	}
+	return values, nil
+}
+
+// claimLeaf references the record field (and optional JSON path inside that
+// field) that a claim field expression resolves to.
+type claimLeaf struct {
+	record   *core.Record
+	field    core.Field
+	jsonPath []string
+}
+
+// resolveClaimLeaves walks the field path, expanding relations as required.
+// The multiple return value reports whether the path passes through a field
+// that can hold more than one value.
+func resolveClaimLeaves(app core.App, record *core.Record, path []string) ([]claimLeaf, bool) {
+	if len(path) == 0 || path[0] == "" {
+		return nil, false
+	}
+
+	field := record.Collection().Fields.GetByName(path[0])
+	if field == nil {
+		return nil, false
+	}
+
+	switch f := field.(type) {
+	case *core.RelationField:
+		if len(path) == 1 {
+			break
+		}
+		if record.Expand()[f.Name] == nil {
+			app.ExpandRecord(record, []string{f.Name}, nil)
+		}
+		var ret []claimLeaf
+		multiple := f.IsMultiple()
+		for _, rel := range record.ExpandedAll(f.Name) {
+			leaves, m := resolveClaimLeaves(app, rel, path[1:])
+			ret = append(ret, leaves...)
+			multiple = multiple || m
+		}
+		return ret, multiple
+	case *core.JSONField:
+		return []claimLeaf{{record: record, field: field, jsonPath: path[1:]}}, false
+	}
+
+	if len(path) > 1 {
+		return nil, false // path continues past a field that can't be traversed
+	}
+
+	multiple := false
+	if mf, ok := field.(core.MultiValuer); ok {
+		multiple = mf.IsMultiple()
+	}
+
+	return []claimLeaf{{record: record, field: field}}, multiple
+}
+
+// format returns the value of the leaf converted to the requested format.
+func (l claimLeaf) format(app core.App, format string) (any, error) {
+	raw := l.record.Get(l.field.GetName())
+
+	if _, ok := l.field.(*core.JSONField); ok {
+		var value any
+		if v, ok := raw.(types.JSONRaw); ok && len(v) > 0 {
+			if err := json.Unmarshal(v, &value); err != nil {
+				return nil, err
+			}
+		}
+		for _, key := range l.jsonPath {
+			m, ok := value.(map[string]any)
+			if !ok {
+				return nil, nil
+			}
+			value = m[key]
+		}
+		raw = value
+	}
+
+	if format == "" {
+		switch l.field.(type) {
+		case *core.FileField:
+			// Raw filenames aren't useful outside of PocketBase so file fields
+			// resolve to their public URL unless a format is given.
+			format = "file_url"
+		case *core.PasswordField:
+			return nil, nil // never release password hashes
+		}
+	}
+
+	if arr, ok := raw.([]string); ok {
+		ret := make([]any, 0, len(arr))
+		for _, v := range arr {
+			fv, err := l.formatValue(app, v, format)
+			if err != nil {
+				return nil, err
+			}
+			ret = append(ret, fv)
+		}
+		return ret, nil
+	}
+
+	return l.formatValue(app, raw, format)
+}
+
+func (l claimLeaf) formatValue(app core.App, value any, format string) (any, error) {
+	switch format {
+	case "":
+		if dt, ok := value.(types.DateTime); ok {
+			if dt.IsZero() {
+				return nil, nil
+			}
+			return dt.String(), nil
+		}
+		return value, nil
+	case "string":
+		return cast.ToString(value), nil
+	case "bool":
+		return cast.ToBool(value), nil
+	case "number":
+		return cast.ToFloat64(value), nil
+	case "unix":
+		if dt := claimDateTime(value); !dt.IsZero() {
+			return dt.Time().Unix(), nil
+		}
+		return nil, nil
+	case "date":
+		if dt := claimDateTime(value); !dt.IsZero() {
+			return dt.Time().Format("2006-01-02"), nil
+		}
+		return nil, nil
+	case "datetime":
+		if dt := claimDateTime(value); !dt.IsZero() {
+			return dt.Time().Format("2006-01-02T15:04:05Z07:00"), nil
+		}
+		return nil, nil
+	case "file_url":
+		filename := cast.ToString(value)
+		if filename == "" {
+			return nil, nil
+		}
+		if strings.HasPrefix(filename, "http://") || strings.HasPrefix(filename, "https://") {
+			return filename, nil
+		}
+		return app.Settings().Meta.AppURL + "/api/files/" + l.record.BaseFilesPath() + "/" + filename, nil
+	case "split":
+		ret := []any{}
+		for _, v := range strings.Fields(cast.ToString(value)) {
+			ret = append(ret, v)
+		}
+		return ret, nil
+	default:
+		return nil, fmt.Errorf("unsupported claim format %q", format)
+	}
+}
+
+func claimDateTime(value any) types.DateTime {
+	dt, _ := types.ParseDateTime(value)
+	return dt
+}
+
+func isEmptyClaimValue(value any) bool {
+	switch v := value.(type) {
+	case nil:
+		return true
+	case string:
+		return v == ""
+	case []any:
+		return len(v) == 0
+	case []string:
+		return len(v) == 0
+	}
+	return false
+}
+
+// setNestedClaim sets the claim value in the claims map, creating any
+// intermediate objects for dot separated claim names.
+func setNestedClaim(claims map[string]any, name string, value any) {
+	parts := strings.Split(name, ".")
+	for _, part := range parts[:len(parts)-1] {
+		next, ok := claims[part].(map[string]any)
+		if !ok {
+			next = map[string]any{}
+			claims[part] = next
+		}
+		claims = next
+	}
+	claims[parts[len(parts)-1]] = value
+}
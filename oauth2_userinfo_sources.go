@@ -0,0 +1,154 @@
+package oauth2
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/ory/fosite/token/jwt"
+	"github.com/pkg/errors"
+	"github.com/pocketbase/pocketbase/core"
+)
+
+// @ref https://openid.net/specs/openid-connect-core-1_0.html#AggregatedDistributedClaims
+
+// ClaimSources holds the aggregated and distributed claims of a user info
+// response. It can be embedded in the value returned by a [UserInfoClaimStrategy]
+// (as [UserInfoClaims] does) or merged into a map based response.
+type ClaimSources struct {
+	// Claim Names
+	// JSON object whose member names are the Claim Names for the Aggregated and
+	// Distributed Claims. The member values are references to the member names
+	// in the _claim_sources member from which the actual Claim Values can be
+	// retrieved.
+	ClaimNames map[string]string `json:"_claim_names,omitempty"`
+
+	// Claim Sources
+	// JSON object whose member names are referenced by the member values of the
+	// _claim_names member. The member values contain sets of Aggregated Claims
+	// or reference locations for Distributed Claims.
+	ClaimSources map[string]ClaimSource `json:"_claim_sources,omitempty"`
+}
+
+type ClaimSource struct {
+	// JWT
+	// JWT containing Claim Values. Set for Aggregated Claims.
+	JWT string `json:"JWT,omitempty"`
+
+	// Endpoint
+	// OAuth 2.0 resource endpoint from which the associated Claim can be
+	// retrieved. Set for Distributed Claims.
+	Endpoint string `json:"endpoint,omitempty"`
+
+	// Access Token
+	// Access Token enabling retrieval of the Claims from the endpoint URL by
+	// using the OAuth 2.0 Bearer Token Usage [RFC6750] protocol. Claims SHOULD
+	// be requested using the Authorization Request header field and Claims
+	// Providers MUST support this method.
+	AccessToken string `json:"access_token,omitempty"`
+}
+
+// AddAggregated adds a set of aggregated claims, passed by value in the signed
+// JWT, under the given source name.
+func (c *ClaimSources) AddAggregated(source string, signedJWT string, claimNames ...string) {
+	c.add(source, ClaimSource{JWT: signedJWT}, claimNames)
+}
+
+// AddDistributed adds a set of distributed claims, passed by reference to the
+// endpoint they can be retrieved from, under the given source name.
+func (c *ClaimSources) AddDistributed(source string, endpoint string, accessToken string, claimNames ...string) {
+	c.add(source, ClaimSource{Endpoint: endpoint, AccessToken: accessToken}, claimNames)
+}
+
+// Merge adds all the claim sources from other.
+func (c *ClaimSources) Merge(other *ClaimSources) {
+	if other == nil {
+		return
+	}
+	for name, source := range other.ClaimNames {
+		c.add(source, other.ClaimSources[source], []string{name})
+	}
+}
+
+// IsEmpty reports whether there are no aggregated or distributed claims.
+func (c *ClaimSources) IsEmpty() bool {
+	return c == nil || len(c.ClaimNames) == 0
+}
+
+func (c *ClaimSources) add(source string, value ClaimSource, claimNames []string) {
+	if c.ClaimNames == nil {
+		c.ClaimNames = map[string]string{}
+	}
+	if c.ClaimSources == nil {
+		c.ClaimSources = map[string]ClaimSource{}
+	}
+	c.ClaimSources[source] = value
+	for _, name := range claimNames {
+		c.ClaimNames[name] = source
+	}
+}
+
+//
+
+// NewAggregatedClaimsJWT returns a JWT containing the given claims, signed
+// with the provider's private key, that can be used as an aggregated claim
+// source for claims that the provider asserts itself (e.g. claims loaded
+// from another collection).
+func NewAggregatedClaimsJWT(ctx context.Context, claims map[string]any) (string, error) {
+	mapClaims := jwt.MapClaims{}
+	for k, v := range claims {
+		mapClaims[k] = v
+	}
+	mapClaims["iss"] = oauth2ProviderMetadata.Issuer
+	mapClaims["iat"] = time.Now().Unix()
+	mapClaims["jti"] = uuid.NewString()
+
+	signer := &jwt.DefaultSigner{
+		GetPrivateKey: func(ctx context.Context) (interface{}, error) {
+			if oauth2PrivateKey == nil {
+				return nil, errors.New("private key is not initialized")
+			}
+			return oauth2PrivateKey, nil
+		},
+	}
+	token, _, err := signer.Generate(ctx, mapClaims, &jwt.Headers{})
+	return token, err
+}
+
+// getClaimSources extracts the aggregated and distributed claims from the
+// value returned by a [UserInfoClaimStrategy].
+func getClaimSources(info any) (*ClaimSources, error) {
+	switch v := info.(type) {
+	case *ClaimSources:
+		return v, nil
+	case *UserInfoClaims:
+		return &v.ClaimSources, nil
+	}
+	raw, err := json.Marshal(info)
+	if err != nil {
+		return nil, err
+	}
+	ret := &ClaimSources{}
+	if err := json.Unmarshal(raw, ret); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// getIDTokenClaimSources evaluates the configured [UserInfoClaimStrategy] for
+// the given user and returns the aggregated and distributed claims that should
+// be included in the ID token.
+func getIDTokenClaimSources(e *core.RequestEvent, user *core.Record, scopes []string) (*ClaimSources, error) {
+	// The strategy expects the user to be the authenticated record of the request,
+	// so we pass a new event for the same request with the auth record replaced.
+	ue := &core.RequestEvent{App: e.App, Auth: user}
+	ue.Request = e.Request
+	ue.Response = e.Response
+
+	info, err := GetOAuth2Config().UserInfoClaimStrategy.GetUserInfoClaims(ue, scopes)
+	if err != nil {
+		return nil, errors.Wrap(err, "GetUserInfoClaims")
+	}
+	return getClaimSources(info)
+}
@@ -128,4 +128,55 @@ type OpenIDProviderMetadata struct {
 	// pre-registered using the request_uris registration parameter. Pre-registration is REQUIRED
 	// when the value is true. If omitted, the default value is false.
 	RequireRequestURIRegistration bool `json:"require_request_uri_registration,omitempty"`
+
+	// Prompt Values Supported
+	// OPTIONAL. JSON array containing the list of prompt values that this OP supports.
+	// @ref https://openid.net/specs/openid-connect-prompt-create-1_0.html#section-4.1
+	PromptValuesSupported []string `json:"prompt_values_supported,omitempty"`
+
+	// Check Session Iframe
+	// REQUIRED. URL of an OP iframe that supports cross-origin communications
+	// for session state information with the RP Client, using the HTML5
+	// postMessage API. This URL MUST use the https scheme and MAY contain port,
+	// path, and query parameter components.
+	// @ref https://openid.net/specs/openid-connect-session-1_0.html#OPMetadata
+	CheckSessionIframe string `json:"check_session_iframe,omitempty"`
+
+	// End Session Endpoint
+	// REQUIRED. URL at the OP to which an RP can perform a redirect to request
+	// that the End-User be logged out at the OP. This URL MUST use the https
+	// scheme and MAY contain port, path, and query parameter components.
+	// @ref https://openid.net/specs/openid-connect-rpinitiated-1_0.html#OPMetadata
+	EndSessionEndpoint string `json:"end_session_endpoint,omitempty"`
+
+	// Front-Channel Logout Supported
+	// OPTIONAL. Boolean value specifying whether the OP supports HTTP-based
+	// logout, with true indicating support. If omitted, the default value is
+	// false.
+	// @ref https://openid.net/specs/openid-connect-frontchannel-1_0.html#OPLogout
+	FrontChannelLogoutSupported bool `json:"frontchannel_logout_supported,omitempty"`
+
+	// Front-Channel Logout Session Supported
+	// OPTIONAL. Boolean value specifying whether the OP can pass iss (issuer)
+	// and sid (session ID) query parameters to identify the RP session with the
+	// OP when the frontchannel_logout_uri is used. If supported, the sid Claim
+	// is also included in ID Tokens issued by the OP. If omitted, the default
+	// value is false.
+	// @ref https://openid.net/specs/openid-connect-frontchannel-1_0.html#OPLogout
+	FrontChannelLogoutSessionSupported bool `json:"frontchannel_logout_session_supported,omitempty"`
+
+	// Back-Channel Logout Supported
+	// OPTIONAL. Boolean value specifying whether the OP supports back-channel
+	// logout, with true indicating support. If omitted, the default value is
+	// false.
+	// @ref https://openid.net/specs/openid-connect-backchannel-1_0.html#BCSupport
+	BackChannelLogoutSupported bool `json:"backchannel_logout_supported,omitempty"`
+
+	// Back-Channel Logout Session Supported
+	// OPTIONAL. Boolean value specifying whether the OP can pass a sid (session
+	// ID) Claim in the Logout Token to identify the RP session with the OP. If
+	// supported, the sid Claim is also included in ID Tokens issued by the OP.
+	// If omitted, the default value is false.
+	// @ref https://openid.net/specs/openid-connect-backchannel-1_0.html#BCSupport
+	BackChannelLogoutSessionSupported bool `json:"backchannel_logout_session_supported,omitempty"`
 }
@@ -201,4 +201,23 @@ type AuthorizationServerMetadata struct {
 	// [IANA.OAuth.Parameters].  If omitted, the authorization server
 	// does not support PKCE.
 	CodeChallengeMethodsSupported []string `json:"code_challenge_methods_supported,omitempty"`
+
+	// Authorization Details Types Supported
+	// OPTIONAL. JSON array containing the authorization details types the
+	// authorization server supports, as defined in Section 10 of
+	// [RFC9396].
+	AuthorizationDetailsTypesSupported []string `json:"authorization_details_types_supported,omitempty"`
+
+	// Pushed Authorization Request Endpoint
+	// The URL of the pushed authorization request endpoint at which a
+	// client can post an authorization request to exchange for a
+	// "request_uri" value usable at the authorization server, as defined
+	// in Section 5 of [RFC9126].
+	PushedAuthorizationRequestEndpoint string `json:"pushed_authorization_request_endpoint,omitempty"`
+
+	// Require Pushed Authorization Requests
+	// Boolean parameter indicating whether the authorization server
+	// accepts authorization request data only via PAR.  If omitted, the
+	// default value is false.
+	RequirePushedAuthorizationRequests bool `json:"require_pushed_authorization_requests,omitempty"`
 }
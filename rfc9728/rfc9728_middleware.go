@@ -1,28 +1,159 @@
 package rfc9728
 
 import (
+	"errors"
 	"fmt"
+	"slices"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/ory/fosite"
 	"github.com/pocketbase/pocketbase/apis"
 	"github.com/pocketbase/pocketbase/core"
 	"github.com/pocketbase/pocketbase/tools/hook"
 )
 
+// AccessTokenInfo describes the OAuth2 access token presented with a request.
+type AccessTokenInfo struct {
+	// Audience
+	// The resources the access token was issued for, as requested with the
+	// RFC 8707 resource parameter. An empty audience means the token is not
+	// restricted to any resource.
+	Audience []string
+
+	// ACR
+	// The Authentication Context Class Reference of the user's login.
+	ACR string
+
+	// AuthTime
+	// The time the user logged in, zero if it is unknown.
+	AuthTime time.Time
+
+	// Scopes
+	// The scopes granted to the access token.
+	Scopes []string
+}
+
+// ErrInactiveAccessToken is returned by the access token resolver if the
+// request was authenticated with an OAuth2 access token that was revoked, or
+// replaced by a refresh, even though PocketBase still accepts it.
+var ErrInactiveAccessToken = errors.New("the access token is no longer active")
+
+var accessTokenInfoResolver func(e *core.RequestEvent) (*AccessTokenInfo, error)
+
+// acrMatchingStrategy reports whether the acr of a login meets the required
+// acr values, it defaults to an exact match.
+var acrMatchingStrategy = func(acr string, required []string) bool {
+	return slices.Contains(required, acr)
+}
+
+// scopeMatchingStrategy reports whether the granted scopes include the scope,
+// it defaults to an exact match.
+var scopeMatchingStrategy = func(granted []string, scope string) bool {
+	return slices.Contains(granted, scope)
+}
+
+// SetAccessTokenInfoResolver sets the function used by the middlewares in this
+// package to look up the OAuth2 access token presented with a request. The
+// resolver returns nil if the request wasn't authenticated with an OAuth2
+// access token (e.g. a regular PocketBase auth token), and
+// [ErrInactiveAccessToken] if the access token is no longer active. This is
+// set by the
+// OAuth2 plugin when it is registered.
+func SetAccessTokenInfoResolver(fn func(e *core.RequestEvent) (*AccessTokenInfo, error)) {
+	accessTokenInfoResolver = fn
+}
+
+// SetACRMatchingStrategy sets the function used by
+// [RequireAuthRFC9470StepUpResponse] to check whether the acr of a login meets
+// the required acr values. This is set by the OAuth2 plugin when it is
+// registered, so that a higher level of assurance meets a lower one.
+func SetACRMatchingStrategy(fn func(acr string, required []string) bool) {
+	acrMatchingStrategy = fn
+}
+
+// SetScopeMatchingStrategy sets the function used by [RequireScopes] to check
+// whether the granted scopes include a required scope. This is set by the
+// OAuth2 plugin when it is registered, to match the scope strategy of the
+// authorization server.
+func SetScopeMatchingStrategy(fn func(granted []string, scope string) bool) {
+	scopeMatchingStrategy = fn
+}
+
 func RequireAuthRFC9728WWWAuthenticateResponse() *hook.Handler[*core.RequestEvent] {
+	return RequireAuthRFC9470StepUpResponse("", 0)
+}
+
+// RequireAuthRFC9470StepUpResponse is like
+// [RequireAuthRFC9728WWWAuthenticateResponse], but also requires the user to
+// have logged in with the acr, and no longer than maxAge ago. An empty acr or
+// a zero maxAge is not checked. If the login of the access token falls short,
+// the response asks the client to step the user up with the acr_values and
+// max_age params. Requests authenticated with a regular PocketBase auth token,
+// rather than an OAuth2 access token, are not checked.
+// @ref https://datatracker.ietf.org/doc/html/rfc9470#section-3
+func RequireAuthRFC9470StepUpResponse(acr string, maxAge time.Duration) *hook.Handler[*core.RequestEvent] {
+	return newRequireAccessTokenHandler("", func(e *core.RequestEvent, info *AccessTokenInfo) bool {
+		if acr != "" && !acrMatchingStrategy(info.ACR, []string{acr}) {
+			writeInsufficientUserAuthenticationResponse(e, "A different authentication level is required.", acr, maxAge)
+			return false
+		}
+		if maxAge > 0 && (info.AuthTime.IsZero() || time.Since(info.AuthTime) > maxAge) {
+			writeInsufficientUserAuthenticationResponse(e, "More recent authentication is required.", acr, maxAge)
+			return false
+		}
+		return true
+	})
+}
+
+// newRequireAccessTokenHandler returns a middleware that requires the request
+// to be authenticated, and the OAuth2 access token to be issued for the
+// requested resource. The resource is identified by the path, or by the
+// requested route if the path is empty. The check is then called with the
+// access token, and returns false if it rejected the request and wrote the
+// response.
+func newRequireAccessTokenHandler(path string, check func(e *core.RequestEvent, info *AccessTokenInfo) bool) *hook.Handler[*core.RequestEvent] {
 	return &hook.Handler[*core.RequestEvent]{
 		Func: func(e *core.RequestEvent) error {
+			if path != "" {
+				e.Set(resourcePathKey, path)
+			}
+
 			if e.Auth == nil {
-				resourceMetadataURL := fmt.Sprintf(
-					"%s/.well-known/oauth-protected-resource/%s",
-					strings.Trim(e.App.Settings().Meta.AppURL, "/"),
-					strings.Trim(e.Request.URL.Path, "/"),
-				)
-
-				e.Response.Header().Add("WWW-Authenticate", fmt.Sprintf(`Bearer error="invalid_token", error_description="The access token provided is expired, revoked, malformed, or invalid for other reasons.", resource_metadata="%s"`, resourceMetadataURL))
-				e.Response.WriteHeader(401)
+				writeInvalidTokenResponse(e, "The access token provided is expired, revoked, malformed, or invalid for other reasons.")
+				return nil
+			}
+
+			if accessTokenInfoResolver == nil {
+				return e.Next()
+			}
+			info, err := accessTokenInfoResolver(e)
+			if errors.Is(err, ErrInactiveAccessToken) {
+				writeInvalidTokenResponse(e, "The access token provided is expired, revoked, malformed, or invalid for other reasons.")
+				return nil
+			}
+			if err != nil {
+				return e.InternalServerError("", err)
+			}
+			if info == nil {
+				return e.Next()
+			}
+
+			// Make sure the access token was issued for this resource. A token
+			// minted for another resource must not be accepted here.
+			// @ref https://datatracker.ietf.org/doc/html/rfc8707#section-2
+			if len(info.Audience) > 0 {
+				if err := fosite.DefaultAudienceMatchingStrategy(info.Audience, []string{resourceURL(e)}); err != nil {
+					writeInvalidTokenResponse(e, "The access token provided was not issued for this resource.")
+					return nil
+				}
+			}
+
+			if !check(e, info) {
 				return nil
 			}
+
 			return e.Next()
 		},
 		// Make sure this runs after the default LoadAuthToken middleware.
@@ -31,3 +162,83 @@ func RequireAuthRFC9728WWWAuthenticateResponse() *hook.Handler[*core.RequestEven
 		Priority: apis.DefaultLoadAuthTokenMiddlewarePriority + 10,
 	}
 }
+
+// resourceURL returns the resource identifier of the requested route.
+func resourceURL(e *core.RequestEvent) string {
+	return fmt.Sprintf(
+		"%s/%s",
+		strings.Trim(e.App.Settings().Meta.AppURL, "/"),
+		resourcePath(e),
+	)
+}
+
+// resourceMetadataURL returns the URL of the protected resource metadata for
+// the requested route.
+func resourceMetadataURL(e *core.RequestEvent) string {
+	return fmt.Sprintf(
+		"%s/.well-known/oauth-protected-resource/%s",
+		strings.Trim(e.App.Settings().Meta.AppURL, "/"),
+		resourcePath(e),
+	)
+}
+
+// resourcePathKey is the request store key of the resource path that a
+// middleware was bound with.
+const resourcePathKey = "rfc9728.resourcePath"
+
+// resourcePath returns the path of the requested resource, without the
+// leading and trailing slashes. It is the path the middleware was bound with,
+// or else the path of the requested route. Routes with wildcards are
+// identified by the static part of their pattern, so that every path they
+// match is the same resource.
+func resourcePath(e *core.RequestEvent) string {
+	if path, _ := e.Get(resourcePathKey).(string); path != "" {
+		return path
+	}
+	if e.Request.Pattern != "" {
+		return getPatternResourcePath(e.Request.Pattern)
+	}
+	return strings.Trim(e.Request.URL.Path, "/")
+}
+
+// getPatternResourcePath returns the resource path of a route pattern, e.g.
+// "GET /api/notes/{id}" is "api/notes".
+func getPatternResourcePath(pattern string) string {
+	// Drop the method and host of the pattern
+	if i := strings.Index(pattern, "/"); i >= 0 {
+		pattern = pattern[i:]
+	}
+	if i := strings.Index(pattern, "{"); i >= 0 {
+		pattern = pattern[:i]
+	}
+	return strings.Trim(pattern, "/")
+}
+
+// writeInsufficientUserAuthenticationResponse writes the step-up challenge,
+// with the acr and max age the user must log in with.
+// @ref https://datatracker.ietf.org/doc/html/rfc9470#section-3
+func writeInsufficientUserAuthenticationResponse(e *core.RequestEvent, description string, acr string, maxAge time.Duration) {
+	challenge := fmt.Sprintf(`Bearer error="insufficient_user_authentication", error_description="%s"`, description)
+	if acr != "" {
+		challenge += fmt.Sprintf(`, acr_values="%s"`, acr)
+	}
+	if maxAge > 0 {
+		challenge += fmt.Sprintf(`, max_age="%s"`, strconv.FormatInt(int64(maxAge/time.Second), 10))
+	}
+	challenge += fmt.Sprintf(`, resource_metadata="%s"`, resourceMetadataURL(e))
+	e.Response.Header().Add("WWW-Authenticate", challenge)
+	e.Response.WriteHeader(401)
+}
+
+// writeInsufficientScopeResponse writes the challenge for an access token that
+// wasn't granted the scopes required by the route.
+// @ref https://datatracker.ietf.org/doc/html/rfc6750#section-3.1
+func writeInsufficientScopeResponse(e *core.RequestEvent, scopes []string) {
+	e.Response.Header().Add("WWW-Authenticate", fmt.Sprintf(`Bearer error="insufficient_scope", error_description="%s", scope="%s", resource_metadata="%s"`, "The request requires higher privileges than provided by the access token.", strings.Join(scopes, " "), resourceMetadataURL(e)))
+	e.Response.WriteHeader(403)
+}
+
+func writeInvalidTokenResponse(e *core.RequestEvent, description string) {
+	e.Response.Header().Add("WWW-Authenticate", fmt.Sprintf(`Bearer error="invalid_token", error_description="%s", resource_metadata="%s"`, description, resourceMetadataURL(e)))
+	e.Response.WriteHeader(401)
+}
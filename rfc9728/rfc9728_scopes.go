@@ -0,0 +1,91 @@
+package rfc9728
+
+import (
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/hook"
+)
+
+// ProtectedRoute is a resource guarded by [RequireScopes].
+type ProtectedRoute struct {
+	// Path
+	// The resource path of the route, without the leading and trailing
+	// slashes.
+	Path string
+
+	// Scopes
+	// The scopes required by the route.
+	Scopes []string
+}
+
+var (
+	protectedRoutesMu sync.RWMutex
+	protectedRoutes   = []*ProtectedRoute{}
+)
+
+// RequireScopes requires the request to be authenticated with an OAuth2
+// access token that was granted all the scopes, and was issued for the
+// resource. Otherwise the response is a 403 with an insufficient_scope
+// challenge listing the scopes. Requests authenticated with a regular
+// PocketBase auth token, rather than an OAuth2 access token, are not checked.
+//
+// The path is the resource of the routes it is bound to, e.g. "/api/notes"
+// for the "/api/notes/{id}" route, or the prefix of a group. The resource is
+// registered as a protected resource by the OAuth2 plugin once the app starts
+// serving, see [GetProtectedRoutes].
+// @ref https://datatracker.ietf.org/doc/html/rfc6750#section-3.1
+func RequireScopes(path string, scopes ...string) *hook.Handler[*core.RequestEvent] {
+	path = strings.Trim(path, "/")
+	addProtectedRoute(path, scopes)
+
+	return newRequireAccessTokenHandler(path, func(e *core.RequestEvent, info *AccessTokenInfo) bool {
+		for _, scope := range scopes {
+			if !scopeMatchingStrategy(info.Scopes, scope) {
+				writeInsufficientScopeResponse(e, scopes)
+				return false
+			}
+		}
+		return true
+	})
+}
+
+// GetProtectedRoutes returns the resources guarded by [RequireScopes].
+// Resources guarded more than once are returned once, with the scopes of all
+// the guards.
+func GetProtectedRoutes() []*ProtectedRoute {
+	protectedRoutesMu.RLock()
+	defer protectedRoutesMu.RUnlock()
+
+	ret := make([]*ProtectedRoute, 0, len(protectedRoutes))
+	for _, route := range protectedRoutes {
+		ret = append(ret, &ProtectedRoute{Path: route.Path, Scopes: slices.Clone(route.Scopes)})
+	}
+	return ret
+}
+
+// ResetGlobalStateForTests forgets the resources guarded by [RequireScopes],
+// so each test gets a clean slate.
+func ResetGlobalStateForTests() {
+	protectedRoutesMu.Lock()
+	protectedRoutes = []*ProtectedRoute{}
+	protectedRoutesMu.Unlock()
+}
+
+func addProtectedRoute(path string, scopes []string) {
+	protectedRoutesMu.Lock()
+	defer protectedRoutesMu.Unlock()
+
+	i := slices.IndexFunc(protectedRoutes, func(route *ProtectedRoute) bool { return route.Path == path })
+	if i < 0 {
+		protectedRoutes = append(protectedRoutes, &ProtectedRoute{Path: path, Scopes: []string{}})
+		i = len(protectedRoutes) - 1
+	}
+	for _, scope := range scopes {
+		if !slices.Contains(protectedRoutes[i].Scopes, scope) {
+			protectedRoutes[i].Scopes = append(protectedRoutes[i].Scopes, scope)
+		}
+	}
+}
@@ -41,9 +41,25 @@ type Session struct {
 	fositeopenid.DefaultSession
 
 	CollectionId string `json:"collection,omitempty"`
+
+	// AuthorizationDetails holds the RFC 9396 authorization details granted
+	// for this session.
+	AuthorizationDetails []AuthorizationDetail `json:"authorization_details,omitempty"`
+
+	// AccessTokenAudience and AccessTokenAuthorizationDetails narrow the grant
+	// of the access token issued at the token endpoint to the requested
+	// resources and authorization details. They are not stored, so the
+	// refresh token keeps the full grant.
+	AccessTokenAudience             []string              `json:"-"`
+	AccessTokenAuthorizationDetails []AuthorizationDetail `json:"-"`
+
+	// TokenKeyHash is the hash of the user's token key when the session was
+	// granted. Refreshes are rejected once the token key changes.
+	TokenKeyHash string `json:"token_key_hash,omitempty"`
 }
 
 var _ fositeopenid.Session = (*Session)(nil)
+var _ fosite.ExtraClaimsSession = (*Session)(nil)
 
 func (s *Session) GetJWTClaims() jwt.JWTClaimsContainer {
 	claims := &jwt.JWTClaims{}
@@ -54,6 +70,16 @@ func (s *Session) GetJWTClaims() jwt.JWTClaimsContainer {
 	return claims
 }
 
+// GetExtraClaims implements [fosite.ExtraClaimsSession]. The extra claims are
+// included in the token introspection response.
+func (s *Session) GetExtraClaims() map[string]interface{} {
+	ret := map[string]interface{}{}
+	if len(s.AuthorizationDetails) > 0 {
+		ret["authorization_details"] = s.AuthorizationDetails
+	}
+	return ret
+}
+
 func (s *Session) Clone() fosite.Session {
 	if s == nil {
 		return nil
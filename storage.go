@@ -4,6 +4,8 @@ import (
 	"context"
 	"database/sql"
 	"errors"
+	"slices"
+	"strings"
 	"time"
 
 	"github.com/ory/fosite"
@@ -112,7 +114,7 @@ func (s *OAuth2Store) InvalidateAuthorizeCodeSession(ctx context.Context, code s
 func (s *OAuth2Store) CreateAccessTokenSession(ctx context.Context, signature string, request fosite.Requester) (err error) {
 	m := newSessionModel(s.app, &AccessTokenModel{})
 	m.SetSignature(signature)
-	m.SetRequester(request, fosite.AccessToken)
+	m.SetRequester(narrowAccessTokenRequester(request), fosite.AccessToken)
 
 	return s.app.Save(m)
 }
@@ -158,20 +160,21 @@ func (s *OAuth2Store) GetRefreshTokenSession(ctx context.Context, signature stri
 
 // RevokeAccessToken implements [oauth2.AccessTokenStorage].
 func (s *OAuth2Store) RevokeAccessToken(ctx context.Context, requestID string) error {
-	return deleteSessionModelByRequestID(s.app, &AccessTokenModel{}, requestID)
+	return revokeSessionRecords(s.app, []string{consts.AccessCollectionName}, dbx.HashExp{"request_id": requestID})
 }
 
 // RevokeRefreshToken implements [oauth2.RefreshTokenStorage].
 func (s *OAuth2Store) RevokeRefreshToken(ctx context.Context, requestID string) error {
-	return deleteSessionModelByRequestID(s.app, &RefreshTokenModel{}, requestID)
+	return revokeSessionRecords(s.app, []string{consts.RefreshCollectionName}, dbx.HashExp{"request_id": requestID})
 }
 
 // RotateRefreshToken implements [oauth2.RefreshTokenStorage].
 func (s *OAuth2Store) RotateRefreshToken(ctx context.Context, requestID string, refreshTokenSignature string) (err error) {
 	// TODO: Is this a 1-1? If not we might need to delete some more sessions here.
-	deleteSessionModelBySignature(s.app, &RefreshTokenModel{}, refreshTokenSignature)
-	deleteSessionModelByRequestID(s.app, &AccessTokenModel{}, requestID)
-	return nil
+	if err := revokeSessionRecords(s.app, []string{consts.RefreshCollectionName}, dbx.HashExp{"signature": refreshTokenSignature}); err != nil {
+		return err
+	}
+	return revokeSessionRecords(s.app, []string{consts.AccessCollectionName}, dbx.HashExp{"request_id": requestID})
 }
 
 // CreatePKCERequestSession implements [pkce.PKCERequestStorage].
@@ -225,6 +228,79 @@ func (s *OAuth2Store) GetOpenIDConnectSession(ctx context.Context, authorizeCode
 	return m.ToRequest(ctx, s, requester.GetSession())
 }
 
+// CreatePARSession implements [fosite.PARStorage].
+func (s *OAuth2Store) CreatePARSession(ctx context.Context, requestURI string, request fosite.AuthorizeRequester) error {
+	m := newSessionModel(s.app, &PARModel{})
+	m.SetSignature(requestURI)
+	if err := m.SetRequester(request, fosite.PushedAuthorizeRequestContext); err != nil {
+		return err
+	}
+
+	return s.app.Save(m)
+}
+
+// GetPARSession implements [fosite.PARStorage]. The authorize request is
+// rebuilt from the pushed form, which fosite validated before storing it.
+func (s *OAuth2Store) GetPARSession(ctx context.Context, requestURI string) (fosite.AuthorizeRequester, error) {
+	m, err := findSessionModelBySignature(s.app, &PARModel{}, requestURI)
+	if err != nil {
+		return nil, err
+	}
+	if exp := m.GetExpiresAt(); exp != nil && exp.Before(time.Now()) {
+		return nil, fosite.ErrNotFound.WithHint("The pushed authorization request has expired.")
+	}
+
+	req, err := m.ToRequest(ctx, s, &Session{})
+	if err != nil {
+		return nil, err
+	}
+
+	redirectURI, err := fosite.MatchRedirectURIWithClientRedirectURIs(req.Form.Get("redirect_uri"), req.Client)
+	if err != nil {
+		return nil, err
+	}
+
+	ar := fosite.NewAuthorizeRequest()
+	ar.Request = *req
+	ar.ResponseTypes = fosite.RemoveEmpty(strings.Split(req.Form.Get("response_type"), " "))
+	ar.RedirectURI = redirectURI
+	ar.State = req.Form.Get("state")
+	ar.ResponseMode = fosite.ResponseModeType(req.Form.Get("response_mode"))
+	if ar.ResponseTypes.ExactOne("code") {
+		ar.SetDefaultResponseMode(fosite.ResponseModeQuery)
+	} else {
+		ar.SetDefaultResponseMode(fosite.ResponseModeFragment)
+	}
+	return ar, nil
+}
+
+// DeletePARSession implements [fosite.PARStorage].
+func (s *OAuth2Store) DeletePARSession(ctx context.Context, requestURI string) error {
+	return deleteSessionModelBySignature(s.app, &PARModel{}, requestURI)
+}
+
+// RevokeSessionsBySubject signs the user out everywhere. It revokes all the
+// auth codes, access tokens, refresh tokens, PKCE and OpenID Connect sessions
+// of the subject, invalidates all of the user's PocketBase auth tokens, and
+// notifies the clients with a back-channel logout.
+func (s *OAuth2Store) RevokeSessionsBySubject(ctx context.Context, subject string) error {
+	if subject == "" {
+		return fosite.ErrInvalidRequest.WithHint("The subject is required.")
+	}
+	return signOutUser(s.app, subject)
+}
+
+// RevokeSessionsByClientID signs all users out of the client. It revokes all
+// the auth codes, access tokens, refresh tokens, PKCE and OpenID Connect
+// sessions of the client, so that PocketBase no longer accepts its access
+// tokens, and notifies the client with a back-channel logout.
+func (s *OAuth2Store) RevokeSessionsByClientID(ctx context.Context, clientID string) error {
+	if clientID == "" {
+		return fosite.ErrInvalidRequest.WithHint("The client_id is required.")
+	}
+	return revokeSessions(s.app, "", clientID)
+}
+
 var _ fosite.Storage = (*OAuth2Store)(nil)
 var _ fositeoauth2.AuthorizeCodeStorage = (*OAuth2Store)(nil)
 var _ fositeoauth2.AccessTokenStorage = (*OAuth2Store)(nil)
@@ -232,6 +308,7 @@ var _ fositeoauth2.RefreshTokenStorage = (*OAuth2Store)(nil)
 var _ fositeoauth2.TokenRevocationStorage = (*OAuth2Store)(nil)
 var _ fositepkce.PKCERequestStorage = (*OAuth2Store)(nil)
 var _ fositeopenid.OpenIDConnectRequestStorage = (*OAuth2Store)(nil)
+var _ fosite.PARStorage = (*OAuth2Store)(nil)
 var _ RFC7591ClientStorage = (*OAuth2Store)(nil)
 
 // HELPER FUNCTIONS
@@ -279,16 +356,197 @@ func deleteSessionModelBySignature[T SessionModel](app core.App, m T, signature
 	return app.Delete(m.ProxyRecord())
 }
 
-func deleteSessionModelByRequestID[T SessionModel](app core.App, m T, requestID string) error {
-	m, err := findSessionModelByRequestID(app, m, requestID)
+// findAccessTokenModelByToken finds the access token session for a raw access
+// token, i.e. a PocketBase auth token issued through the token endpoint.
+func findAccessTokenModelByToken(app core.App, token string) (*AccessTokenModel, error) {
+	signature := (&PocketBaseStrategy{}).AccessTokenSignature(context.Background(), token)
+	if signature == "" {
+		return nil, fosite.ErrNotFound
+	}
+	return findSessionModelBySignature(app, &AccessTokenModel{}, signature)
+}
+
+// narrowAccessTokenRequester returns the requester of an access token, with
+// its granted audience and authorization details narrowed to the ones
+// requested at the token endpoint. The requester is returned as is when the
+// grant isn't narrowed.
+func narrowAccessTokenRequester(requester fosite.Requester) fosite.Requester {
+	session, ok := requester.GetSession().(*Session)
+	if !ok || (session.AccessTokenAudience == nil && session.AccessTokenAuthorizationDetails == nil) {
+		return requester
+	}
+	r, ok := requester.Sanitize(nil).(*fosite.Request)
+	if !ok {
+		return requester
+	}
+	session = session.Clone().(*Session)
+	if session.AccessTokenAudience != nil {
+		r.GrantedAudience = session.AccessTokenAudience
+	}
+	if session.AccessTokenAuthorizationDetails != nil {
+		session.AuthorizationDetails = session.AccessTokenAuthorizationDetails
+	}
+	session.AccessTokenAudience = nil
+	session.AccessTokenAuthorizationDetails = nil
+	r.Session = session
+	return r
+}
+
+//
+
+// findActiveSessionRecordsBySubject returns the unexpired sessions of the
+// subject in the given session collection.
+func findActiveSessionRecordsBySubject(app core.App, collection string, subject string) ([]*core.Record, error) {
+	return app.FindAllRecords(
+		collection,
+		dbx.HashExp{"subject": subject},
+		dbx.NewExp("expires_at >= {:now}", dbx.Params{"now": time.Now().Unix()}),
+	)
+}
+
+// findSessionClientIDs returns the clients that hold access or refresh tokens
+// for each subject, or that were issued an ID token for them, of the sessions
+// matching the expression.
+func findSessionClientIDs(app core.App, exp dbx.Expression) (map[string][]string, error) {
+	ret := map[string][]string{}
+	for _, collection := range []string{
+		consts.AccessCollectionName,
+		consts.RefreshCollectionName,
+		consts.OpenIDConnectCollectionName,
+	} {
+		records, err := app.FindAllRecords(collection, exp)
+		if err != nil {
+			return nil, err
+		}
+		for _, record := range records {
+			subject, clientID := record.GetString("subject"), record.GetString("client_id")
+			if !slices.Contains(ret[subject], clientID) {
+				ret[subject] = append(ret[subject], clientID)
+			}
+		}
+	}
+	return ret, nil
+}
+
+// revokeSessionRecords deletes the sessions matching the expression from the
+// session collections. The access tokens are added to the revoked tokens, as
+// PocketBase would otherwise keep accepting them until they expire.
+func revokeSessionRecords(app core.App, collections []string, exp dbx.Expression) error {
+	return app.RunInTransaction(func(txApp core.App) error {
+		for _, collection := range collections {
+			records, err := txApp.FindAllRecords(collection, exp)
+			if err != nil {
+				return err
+			}
+			for _, record := range records {
+				if collection == consts.AccessCollectionName {
+					expiresAt := time.Unix(int64(record.GetInt("expires_at")), 0)
+					if err := newRevokedTokenModel(txApp, record.GetString("signature"), expiresAt); err != nil {
+						return err
+					}
+				}
+				if err := txApp.Delete(record); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// deleteConsentModels deletes the consent grants matching the expression.
+func deleteConsentModels(app core.App, exp dbx.Expression) error {
+	records, err := app.FindAllRecords(consts.ConsentCollectionName, exp)
 	if err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			return nil // if the session is not found, we can consider it already deleted and return no error
-		} else {
+		return err
+	}
+	for _, record := range records {
+		if err := app.Delete(record); err != nil {
 			return err
 		}
 	}
-	return app.Delete(m.ProxyRecord())
+	return nil
+}
+
+// findConsentModel finds the consent grant of the user for the client.
+func findConsentModel(app core.App, user *core.Record, clientID string) (*ConsentModel, error) {
+	m := &ConsentModel{}
+	c, err := app.FindCachedCollectionByNameOrId(consts.ConsentCollectionName)
+	if err != nil {
+		c = core.NewBaseCollection("@__invalid__")
+	}
+	err = app.RecordQuery(c).
+		AndWhere(dbx.HashExp{
+			"subject":    user.Id,
+			"collection": user.Collection().Id,
+			"client_id":  clientID,
+		}).
+		One(m)
+	return m, mapRFCErr(err)
+}
+
+// saveConsentModel records the user's consent to grant the scopes and audience
+// to the client. The scopes and audience of an unexpired existing grant are
+// kept, and the expiry of the grant is extended by the lifespan.
+func saveConsentModel(app core.App, user *core.Record, clientID string, scopes []string, audience []string, lifespan time.Duration) error {
+	m, err := findConsentModel(app, user, clientID)
+	if err != nil {
+		if !errors.Is(err, fosite.ErrNotFound) {
+			return err
+		}
+		m = NewConsentModel(app)
+		m.Set("subject", user.Id)
+		m.Set("collection", user.Collection().Id)
+		m.Set("client_id", clientID)
+	} else if !m.IsExpired() {
+		scopes = mergeArguments(m.GetScopes(), scopes)
+		audience = mergeArguments(m.GetAudience(), audience)
+	}
+	m.Set("scopes", strings.Join(scopes, "|"))
+	m.Set("audience", strings.Join(audience, "|"))
+	m.Set("expires_at", time.Now().Add(lifespan).Unix())
+
+	return app.Save(m)
+}
+
+// findGrantedScopes returns the scopes the user has previously granted to the
+// client, from the unexpired consent grant and the active sessions.
+func findGrantedScopes(app core.App, user *core.Record, clientID string) ([]string, error) {
+	var ret []string
+
+	consent, err := findConsentModel(app, user, clientID)
+	if err != nil && !errors.Is(err, fosite.ErrNotFound) {
+		return nil, err
+	} else if err == nil && !consent.IsExpired() {
+		ret = mergeArguments(ret, consent.GetScopes())
+	}
+
+	for _, collection := range []string{consts.AccessCollectionName, consts.RefreshCollectionName} {
+		records, err := findActiveSessionRecordsBySubject(app, collection, user.Id)
+		if err != nil {
+			return nil, err
+		}
+		for _, record := range records {
+			m := &BaseSessionModel{}
+			m.SetProxyRecord(record)
+			if m.GetClientID() == clientID {
+				ret = mergeArguments(ret, m.GetGrantedScopes())
+			}
+		}
+	}
+
+	return ret, nil
+}
+
+// mergeArguments returns the union of a and b, preserving the order.
+func mergeArguments(a []string, b []string) []string {
+	ret := slices.Clone(a)
+	for _, v := range b {
+		if !slices.Contains(ret, v) {
+			ret = append(ret, v)
+		}
+	}
+	return ret
 }
 
 //
@@ -301,6 +559,26 @@ func newJTIModel(app core.App, jti string, exp time.Time) error {
 	return app.Save(m)
 }
 
+// newRevokedTokenModel revokes the access token with the signature until it
+// expires.
+func newRevokedTokenModel(app core.App, signature string, exp time.Time) error {
+	m := NewRevokedTokenModel(app)
+	m.Set("signature", signature)
+	m.Set("expires_at", exp.Unix())
+
+	return app.Save(m)
+}
+
+// isRevokedAccessToken reports whether the raw access token was revoked.
+func isRevokedAccessToken(app core.App, token string) (bool, error) {
+	signature := (&PocketBaseStrategy{}).AccessTokenSignature(context.Background(), token)
+	if signature == "" {
+		return false, nil
+	}
+	n, err := app.CountRecords(consts.RevokedTokenCollectionName, dbx.HashExp{"signature": signature})
+	return n > 0, err
+}
+
 func hasJTIModel(app core.App, jti string) error {
 	if n, err := app.CountRecords(consts.JTICollectionName, dbx.HashExp{"jti": jti}); err != nil {
 		return fosite.ErrServerError.WithWrap(err)
@@ -0,0 +1,53 @@
+package oauth2
+
+import (
+	"time"
+
+	"github.com/benjamesfleming/pocketbase-ext-oauth2/consts"
+	"github.com/pocketbase/pocketbase/core"
+)
+
+// BackChannelLogoutModel is a pending delivery of a logout token to the
+// backchannel_logout_uri of a client. Deliveries that fail are retried until
+// they succeed or run out of attempts.
+type BackChannelLogoutModel struct {
+	core.BaseRecordProxy
+}
+
+func NewBackChannelLogoutModel(app core.App) *BackChannelLogoutModel {
+	m := &BackChannelLogoutModel{}
+	c, err := app.FindCachedCollectionByNameOrId(consts.BackChannelLogoutCollectionName)
+	if err != nil {
+		c = core.NewBaseCollection("@__invalid__")
+	}
+	m.Record = core.NewRecord(c)
+	return m
+}
+
+func (m *BackChannelLogoutModel) GetClientID() string {
+	return m.GetString("client_id")
+}
+
+func (m *BackChannelLogoutModel) GetSubject() string {
+	return m.GetString("subject")
+}
+
+// GetSID returns the OP session the user logged out of, or an empty string if
+// the logout isn't tied to a session.
+func (m *BackChannelLogoutModel) GetSID() string {
+	return m.GetString("sid")
+}
+
+// GetAttempts returns the number of failed delivery attempts.
+func (m *BackChannelLogoutModel) GetAttempts() int {
+	return m.GetInt("attempts")
+}
+
+func (m *BackChannelLogoutModel) GetNextAttemptAt() time.Time {
+	return time.Unix(int64(m.GetInt("next_attempt_at")), 0)
+}
+
+// GetLastError returns the reason the last delivery attempt failed.
+func (m *BackChannelLogoutModel) GetLastError() string {
+	return m.GetString("last_error")
+}
@@ -0,0 +1,94 @@
+package oauth2
+
+import (
+	"slices"
+	"time"
+
+	"github.com/benjamesfleming/pocketbase-ext-oauth2/consts"
+	"github.com/pocketbase/pocketbase/core"
+)
+
+// BrowserSessionModel is the OP session of a browser, identified by the
+// session cookie. It tracks the accounts logged in with the browser, and the
+// clients each of them signed in to.
+type BrowserSessionModel struct {
+	core.BaseRecordProxy
+}
+
+// BrowserSessionAccount is an account logged in to the browser session.
+type BrowserSessionAccount struct {
+	Subject    string   `json:"subject"`
+	Collection string   `json:"collection"`
+	AuthTime   int64    `json:"auth_time"`
+	ACR        string   `json:"acr,omitempty"`
+	AMR        []string `json:"amr,omitempty"`
+
+	// Clients
+	// The clients the account signed in to during the session.
+	Clients []string `json:"clients"`
+}
+
+// GetAuthTime returns the time the account last authenticated.
+func (a *BrowserSessionAccount) GetAuthTime() time.Time {
+	if a.AuthTime > 0 {
+		return time.Unix(a.AuthTime, 0).In(time.UTC)
+	}
+	return time.Time{}
+}
+
+func NewBrowserSessionModel(app core.App) *BrowserSessionModel {
+	m := &BrowserSessionModel{}
+	c, err := app.FindCachedCollectionByNameOrId(consts.BrowserSessionCollectionName)
+	if err != nil {
+		c = core.NewBaseCollection("@__invalid__")
+	}
+	m.Record = core.NewRecord(c)
+	return m
+}
+
+// GetSID returns the session id, as used in the sid claim of the ID tokens
+// issued during the session.
+func (m *BrowserSessionModel) GetSID() string {
+	return m.GetString("sid")
+}
+
+// GetAccounts returns the accounts logged in to the session.
+func (m *BrowserSessionModel) GetAccounts() []*BrowserSessionAccount {
+	ret := []*BrowserSessionAccount{}
+	_ = m.UnmarshalJSONField("accounts", &ret)
+	return ret
+}
+
+// GetAccount returns the account of the user logged in to the session, or nil
+// if the user isn't logged in.
+func (m *BrowserSessionModel) GetAccount(subject string, collection string) *BrowserSessionAccount {
+	for _, a := range m.GetAccounts() {
+		if a.Subject == subject && a.Collection == collection {
+			return a
+		}
+	}
+	return nil
+}
+
+// SetAccount adds the account to the session, replacing the existing account
+// of the same user.
+func (m *BrowserSessionModel) SetAccount(account *BrowserSessionAccount) {
+	accounts := slices.DeleteFunc(m.GetAccounts(), func(a *BrowserSessionAccount) bool {
+		return a.Subject == account.Subject && a.Collection == account.Collection
+	})
+	m.Set("accounts", append(accounts, account))
+}
+
+// IsRemembered reports whether the session outlives the browser session, as
+// asked for by the last login.
+func (m *BrowserSessionModel) IsRemembered() bool {
+	return m.GetBool("remember")
+}
+
+func (m *BrowserSessionModel) GetExpiresAt() time.Time {
+	return time.Unix(int64(m.GetInt("expires_at")), 0)
+}
+
+func (m *BrowserSessionModel) IsExpired() bool {
+	return m.GetExpiresAt().Before(time.Now())
+}
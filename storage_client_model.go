@@ -25,6 +25,10 @@ func NewClientModel(app core.App) *ClientModel {
 }
 
 func NewClientFromRFC7591Metadata(app core.App, md *RFC7591ClientMetadataRequest) (*client.Client, string, error) {
+	if err := md.Validate(); err != nil {
+		return nil, "", err
+	}
+
 	m := NewClientModel(app)
 
 	clientID := uuid.New().String()
@@ -57,14 +61,24 @@ func NewClientFromRFC7591Metadata(app core.App, md *RFC7591ClientMetadataRequest
 		md.RequestURIs = []string{}
 	}
 
+	if md.PostLogoutRedirectURIs == nil {
+		md.PostLogoutRedirectURIs = []string{}
+	}
+
 	m.Set("client_id", clientID)
 	m.Set("client_name", md.ClientName)
 	m.Set("client_secret", clientSecret) // N.b. This will be hashed in the OnModelCreate hook before saving to the database.
 	m.Set("client_secret_expires_at", 0)
 	m.Set("redirect_uris", md.RedirectURIs)
+	m.Set("post_logout_redirect_uris", md.PostLogoutRedirectURIs)
+	m.Set("frontchannel_logout_uri", md.FrontChannelLogoutURI)
+	m.Set("frontchannel_logout_session_required", md.FrontChannelLogoutSessionRequired)
+	m.Set("backchannel_logout_uri", md.BackChannelLogoutURI)
+	m.Set("backchannel_logout_session_required", md.BackChannelLogoutSessionRequired)
 	m.Set("grant_types", md.GrantTypes)
 	m.Set("response_types", md.ResponseTypes)
 	m.Set("scope", md.Scope)
+	m.Set("optional_scopes", md.OptionalScopes)
 	m.Set("audience", []string{})
 	m.Set("owner", "")
 	m.Set("policy_uri", md.PolicyURI)
@@ -100,9 +114,16 @@ func (m *ClientModel) ToClient() (*client.Client, error) {
 	c.Secret = m.GetString("client_secret")
 	c.SecretExpiresAt = m.GetInt("client_secret_expires_at")
 	c.RedirectURIs = m.GetStringSlice("redirect_uris")
+	c.PostLogoutRedirectURIs = m.GetStringSlice("post_logout_redirect_uris")
+	c.FrontChannelLogoutURI = m.GetString("frontchannel_logout_uri")
+	c.FrontChannelLogoutSessionRequired = m.GetBool("frontchannel_logout_session_required")
+	c.BackChannelLogoutURI = m.GetString("backchannel_logout_uri")
+	c.BackChannelLogoutSessionRequired = m.GetBool("backchannel_logout_session_required")
 	c.GrantTypes = m.GetStringSlice("grant_types")
 	c.ResponseTypes = m.GetStringSlice("response_types")
 	c.Scope = m.GetString("scope")
+	c.OptionalScopes = m.GetString("optional_scopes")
+	c.AllowedUsersFilter = m.GetString("allowed_users_filter")
 	c.Audience = m.GetStringSlice("audience")
 	c.Owner = m.GetString("owner")
 	c.PolicyURI = m.GetString("policy_uri")
@@ -0,0 +1,82 @@
+package oauth2
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/benjamesfleming/pocketbase-ext-oauth2/consts"
+	"github.com/pocketbase/pocketbase/core"
+)
+
+// ConsentModel records the scopes and audience a user has consented to grant
+// a client, so that the consent screen can be skipped on subsequent requests.
+type ConsentModel struct {
+	core.BaseRecordProxy
+}
+
+func NewConsentModel(app core.App) *ConsentModel {
+	m := &ConsentModel{}
+	c, err := app.FindCachedCollectionByNameOrId(consts.ConsentCollectionName)
+	if err != nil {
+		c = core.NewBaseCollection("@__invalid__")
+	}
+	m.Record = core.NewRecord(c)
+	return m
+}
+
+func (m *ConsentModel) GetSubject() string {
+	return m.GetString("subject")
+}
+
+func (m *ConsentModel) GetCollectionId() string {
+	return m.GetString("collection")
+}
+
+func (m *ConsentModel) GetClientID() string {
+	return m.GetString("client_id")
+}
+
+func (m *ConsentModel) GetScopes() []string {
+	if v := m.GetString("scopes"); len(v) > 0 {
+		return strings.Split(v, "|")
+	}
+	return nil
+}
+
+func (m *ConsentModel) GetAudience() []string {
+	if v := m.GetString("audience"); len(v) > 0 {
+		return strings.Split(v, "|")
+	}
+	return nil
+}
+
+func (m *ConsentModel) GetExpiresAt() time.Time {
+	return time.Unix(int64(m.GetInt("expires_at")), 0)
+}
+
+// IsExpired reports whether the consent grant has expired.
+func (m *ConsentModel) IsExpired() bool {
+	return !m.GetExpiresAt().After(time.Now())
+}
+
+// Covers reports whether the consent grant is unexpired and covers all of the
+// given scopes and audience.
+func (m *ConsentModel) Covers(ctx context.Context, scopes []string, audience []string) bool {
+	if m.IsExpired() {
+		return false
+	}
+	scopeStrategy := GetOAuth2Config().GetScopeStrategy(ctx)
+	for _, scope := range scopes {
+		if !scopeStrategy(m.GetScopes(), scope) {
+			return false
+		}
+	}
+	for _, aud := range audience {
+		if !slices.Contains(m.GetAudience(), aud) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,166 @@
+package oauth2
+
+import (
+	"time"
+
+	"github.com/benjamesfleming/pocketbase-ext-oauth2/consts"
+	"github.com/pocketbase/pocketbase/core"
+)
+
+const (
+	LoginChallengePhaseLogin   = "login"
+	LoginChallengePhaseConsent = "consent"
+	LoginChallengePhaseLogout  = "logout"
+)
+
+// LoginChallengeModel records an authorization request while the user logs in
+// and consents, so that the authorization endpoint can resume the request
+// without trusting any state round-tripped through the browser.
+type LoginChallengeModel struct {
+	core.BaseRecordProxy
+}
+
+func NewLoginChallengeModel(app core.App) *LoginChallengeModel {
+	m := &LoginChallengeModel{}
+	c, err := app.FindCachedCollectionByNameOrId(consts.LoginChallengeCollectionName)
+	if err != nil {
+		c = core.NewBaseCollection("@__invalid__")
+	}
+	m.Record = core.NewRecord(c)
+	return m
+}
+
+func (m *LoginChallengeModel) GetClientID() string {
+	return m.GetString("client_id")
+}
+
+// GetRequestForm returns the encoded form of the original authorization
+// request, without any of the parameters set by the login flow.
+func (m *LoginChallengeModel) GetRequestForm() string {
+	return m.GetString("request_form")
+}
+
+func (m *LoginChallengeModel) GetRequestedAt() time.Time {
+	return time.Unix(int64(m.GetInt("requested_at")), 0).In(time.UTC)
+}
+
+func (m *LoginChallengeModel) GetExpiresAt() time.Time {
+	return time.Unix(int64(m.GetInt("expires_at")), 0)
+}
+
+// IsExpired reports whether the login challenge has expired.
+func (m *LoginChallengeModel) IsExpired() bool {
+	return !m.GetExpiresAt().After(time.Now())
+}
+
+// GetPhase returns the step of the flow the challenge is waiting on, either
+// [LoginChallengePhaseLogin] or [LoginChallengePhaseConsent], or
+// [LoginChallengePhaseLogout] for a logout request.
+func (m *LoginChallengeModel) GetPhase() string {
+	return m.GetString("phase")
+}
+
+// GetState returns the details of the request shown by the login UI.
+func (m *LoginChallengeModel) GetState() map[string]any {
+	ret := map[string]any{}
+	_ = m.UnmarshalJSONField("state", &ret)
+	return ret
+}
+
+// GetRequestedScopes returns the scopes shown on the consent screen.
+func (m *LoginChallengeModel) GetRequestedScopes() []string {
+	return m.getStateStrings("requested_scopes")
+}
+
+// GetOptionalScopes returns the scopes the user can deselect on the consent
+// screen.
+func (m *LoginChallengeModel) GetOptionalScopes() []string {
+	return m.getStateStrings("optional_scopes")
+}
+
+func (m *LoginChallengeModel) getStateStrings(key string) []string {
+	ret := []string{}
+	if v, ok := m.GetState()[key].([]any); ok {
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				ret = append(ret, s)
+			}
+		}
+	}
+	return ret
+}
+
+func (m *LoginChallengeModel) GetSubject() string {
+	return m.GetString("subject")
+}
+
+func (m *LoginChallengeModel) GetCollectionId() string {
+	return m.GetString("collection")
+}
+
+// GetAuthTime returns the time the user authenticated, or the zero time if
+// it is unknown.
+func (m *LoginChallengeModel) GetAuthTime() time.Time {
+	if v := m.GetInt("auth_time"); v > 0 {
+		return time.Unix(int64(v), 0).In(time.UTC)
+	}
+	return time.Time{}
+}
+
+// GetError returns the error the login or consent was rejected with.
+func (m *LoginChallengeModel) GetError() string {
+	return m.GetString("error")
+}
+
+func (m *LoginChallengeModel) IsConsentGranted() bool {
+	return m.GetBool("consent_granted")
+}
+
+// GetGrantedScopes returns the scopes the user approved on the consent
+// screen, and whether the consent included a scope selection at all.
+func (m *LoginChallengeModel) GetGrantedScopes() ([]string, bool) {
+	if v := m.GetString("granted_scopes"); v == "" || v == "null" {
+		return nil, false
+	}
+	ret := []string{}
+	_ = m.UnmarshalJSONField("granted_scopes", &ret)
+	return ret, true
+}
+
+// GetErrorDescription returns the human-readable description of the error the
+// login or consent was rejected with.
+func (m *LoginChallengeModel) GetErrorDescription() string {
+	return m.GetString("error_description")
+}
+
+// IsLoginRemembered reports whether the login provider asked to remember the
+// user's login.
+func (m *LoginChallengeModel) IsLoginRemembered() bool {
+	return m.GetBool("login_remember")
+}
+
+// IsConsentRemembered reports whether the consent should be stored, so that
+// later requests from the client can skip the consent screen.
+func (m *LoginChallengeModel) IsConsentRemembered() bool {
+	return m.GetBool("consent_remember")
+}
+
+// GetACR returns the Authentication Context Class Reference set by the login
+// provider, or an empty string if it is not set.
+func (m *LoginChallengeModel) GetACR() string {
+	return m.GetString("acr")
+}
+
+// GetAMR returns the Authentication Methods References set by the login
+// provider, or nil if they are not set.
+func (m *LoginChallengeModel) GetAMR() []string {
+	var ret []string
+	_ = m.UnmarshalJSONField("amr", &ret)
+	return ret
+}
+
+// GetCSRFToken returns the hash of the token of the cookie that binds the
+// login challenge to the browser that started it.
+func (m *LoginChallengeModel) GetCSRFToken() string {
+	return m.GetString("csrf_token")
+}
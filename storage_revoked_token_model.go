@@ -0,0 +1,23 @@
+package oauth2
+
+import (
+	"github.com/benjamesfleming/pocketbase-ext-oauth2/consts"
+	"github.com/pocketbase/pocketbase/core"
+)
+
+// RevokedTokenModel is an access token that was revoked before it expired.
+// Access tokens are PocketBase auth tokens, which PocketBase would otherwise
+// accept until they expire.
+type RevokedTokenModel struct {
+	core.BaseRecordProxy
+}
+
+func NewRevokedTokenModel(app core.App) *RevokedTokenModel {
+	m := &RevokedTokenModel{}
+	c, err := app.FindCachedCollectionByNameOrId(consts.RevokedTokenCollectionName)
+	if err != nil {
+		c = core.NewBaseCollection("@__invalid__")
+	}
+	m.Record = core.NewRecord(c)
+	return m
+}
@@ -54,6 +54,9 @@ func (m BaseSessionModel) SetRequester(requester fosite.Requester, tokenType fos
 	m.Set("form_data", requester.GetRequestForm().Encode())
 	m.Set("session_data", sessionBytes)
 	m.Set("subject", subject)
+	if s, ok := session.(*Session); ok {
+		m.Set("authorization_details", s.AuthorizationDetails)
+	}
 
 	return nil
 }
@@ -145,6 +148,12 @@ func (m BaseSessionModel) GetGrantedAudience() []string {
 	return nil
 }
 
+func (m BaseSessionModel) GetAuthorizationDetails() []AuthorizationDetail {
+	var ret []AuthorizationDetail
+	_ = m.UnmarshalJSONField("authorization_details", &ret)
+	return ret
+}
+
 func (m BaseSessionModel) GetFormData() string {
 	return m.GetString("form_data")
 }
@@ -209,8 +218,19 @@ func (p *OpenIDConnectSessionModel) GetCollectionName() string {
 	return consts.OpenIDConnectCollectionName
 }
 
+// PAR
+
+type PARModel struct {
+	BaseSessionModel
+}
+
+func (p *PARModel) GetCollectionName() string {
+	return consts.PARCollectionName
+}
+
 var _ SessionModel = (*AuthCodeModel)(nil)
 var _ SessionModel = (*AccessTokenModel)(nil)
 var _ SessionModel = (*RefreshTokenModel)(nil)
 var _ SessionModel = (*PKCEModel)(nil)
 var _ SessionModel = (*OpenIDConnectSessionModel)(nil)
+var _ SessionModel = (*PARModel)(nil)
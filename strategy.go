@@ -9,8 +9,15 @@ import (
 	fositeoauth2 "github.com/ory/fosite/handler/oauth2"
 	"github.com/pkg/errors"
 	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/security"
 )
 
+// accessTokenClientIDClaim is the claim of the OAuth2 access tokens that
+// records the client the token was issued to. It tells the access tokens
+// apart from the PocketBase auth tokens of the users' own logins.
+// @ref https://datatracker.ietf.org/doc/html/rfc9068#section-2.2
+const accessTokenClientIDClaim = "client_id"
+
 type PocketBaseStrategy struct {
 	App    core.App
 	Config interface {
@@ -54,9 +61,42 @@ func (s *PocketBaseStrategy) GenerateAccessToken(ctx context.Context, requester
 	if err != nil {
 		return "", "", errors.Wrap(err, "Failed to generate new auth token")
 	}
+	claims, err := security.ParseUnverifiedJWT(token)
+	if err != nil {
+		return "", "", errors.Wrap(err, "Failed to parse new auth token")
+	}
+	claims[accessTokenClientIDClaim] = requester.GetClient().GetID()
+	// The access tokens are revoked by their signature, so each one must be
+	// unique, even when a refresh reissues it within the same second.
+	claims["jti"] = security.RandomString(32)
+	// Resource servers read the granted authorization details from the token.
+	// @ref https://datatracker.ietf.org/doc/html/rfc9396#section-9.1
+	if narrowed, ok := narrowAccessTokenRequester(requester).GetSession().(*Session); ok && len(narrowed.AuthorizationDetails) > 0 {
+		claims["authorization_details"] = narrowed.AuthorizationDetails
+	}
+	token, err = security.NewJWT(
+		claims,
+		user.TokenKey()+user.Collection().AuthToken.Secret,
+		s.Config.GetAccessTokenLifespan(ctx),
+	)
+	if err != nil {
+		return "", "", errors.Wrap(err, "Failed to sign new auth token")
+	}
 	return token, s.AccessTokenSignature(ctx, token), nil
 }
 
+// isOAuth2AccessToken reports whether the token is an OAuth2 access token,
+// rather than the PocketBase auth token of a user's own login. The token must
+// have been verified already, e.g. by the LoadAuthToken middleware.
+func isOAuth2AccessToken(token string) bool {
+	claims, err := security.ParseUnverifiedJWT(token)
+	if err != nil {
+		return false
+	}
+	clientID, _ := claims[accessTokenClientIDClaim].(string)
+	return clientID != ""
+}
+
 // ValidateAccessToken implements [oauth2.CoreStrategy].
 func (s *PocketBaseStrategy) ValidateAccessToken(ctx context.Context, requester fosite.Requester, token string) error {
 	_, err := s.App.FindAuthRecordByToken(token, core.TokenTypeAuth)
@@ -0,0 +1,105 @@
+package oauth2
+
+import (
+	"net/url"
+	"testing"
+
+	oauth2 "github.com/benjamesfleming/pocketbase-ext-oauth2"
+)
+
+// essentialTestACR requests the acr values as an essential claim.
+const essentialTestACR = `{"id_token":{"acr":{"essential":true,"values":["loa2"]}}}`
+
+func TestACRValues_EssentialUnreachable(t *testing.T) {
+	f := newTestFixture(t)
+
+	// MFA isn't enabled for the users, so loa2 can't be reached.
+	location := authorizeTestRequest(t, f.App, f.Mux, url.Values{"claims": {essentialTestACR}, "consent": {"granted"}})
+	assertTestAuthorizeError(t, location, "unmet_authentication_requirements")
+}
+
+func TestACRValues_EssentialNotMet(t *testing.T) {
+	f := newTestFixture(t)
+
+	enableTestMFA(t, f.App, f.User)
+	location := authorizeTestRequest(t, f.App, f.Mux, url.Values{"claims": {essentialTestACR}, "consent": {"granted"}})
+	assertTestAuthorizeError(t, location, "unmet_authentication_requirements")
+}
+
+func TestACRValues_EssentialMet(t *testing.T) {
+	f := newTestFixture(t)
+
+	enableTestMFA(t, f.App, f.User)
+	location := authorizeTestRequestWithToken(t, f.Mux, loginTestUserWithMFA(t, f.App, f.Mux, f.User), url.Values{"claims": {essentialTestACR}, "consent": {"granted"}})
+	code := location.Query().Get("code")
+	if code == "" {
+		t.Fatalf("expected authorization code, got %q", location.String())
+	}
+	res := exchangeTestCode(t, f.Mux, code, nil)
+	if claims := decodeTestJWTClaims(t, res["id_token"].(string)); claims["acr"] != "loa2" {
+		t.Errorf("acr = %v, want %q", claims["acr"], "loa2")
+	}
+}
+
+func TestACRValues_HigherLevelMeetsLowerValue(t *testing.T) {
+	f := newTestFixture(t)
+
+	enableTestMFA(t, f.App, f.User)
+	location := authorizeTestRequestWithToken(t, f.Mux, loginTestUserWithMFA(t, f.App, f.Mux, f.User), url.Values{
+		"claims":  {`{"id_token":{"acr":{"essential":true,"value":"loa1"}}}`},
+		"consent": {"granted"},
+	})
+	if location.Query().Get("code") == "" {
+		t.Errorf("expected authorization code, got %q", location.String())
+	}
+}
+
+func TestACRValues_Voluntary(t *testing.T) {
+	f := newTestFixture(t)
+
+	// Voluntary acr values are met on a best effort basis.
+	location := authorizeTestRequest(t, f.App, f.Mux, url.Values{"acr_values": {"loa2"}, "consent": {"granted"}})
+	code := location.Query().Get("code")
+	if code == "" {
+		t.Fatalf("expected authorization code, got %q", location.String())
+	}
+	res := exchangeTestCode(t, f.Mux, code, nil)
+	if claims := decodeTestJWTClaims(t, res["id_token"].(string)); claims["acr"] != "loa1" {
+		t.Errorf("acr = %v, want %q", claims["acr"], "loa1")
+	}
+}
+
+func TestACRValues_LoginChallengeState(t *testing.T) {
+	f := newTestFixture(t, withTestConfig(func(cfg *oauth2.Config) {
+		cfg.LevelsOfAssurance = oauth2.LevelsOfAssurance{
+			{ACR: "loa1"},
+			{ACR: "loa2", AMR: []string{"mfa"}},
+			{ACR: "loa2", AMR: []string{"fed"}},
+		}
+	}))
+
+	enableTestMFA(t, f.App, f.User)
+	challenge := startTestLoginChallenge(t, f.Mux, url.Values{"claims": {essentialTestACR}})
+	state := decodeTestLoginState(t, f.Mux, &url.URL{RawQuery: url.Values{"login_challenge": {challenge}}.Encode()})
+	if state["acr_essential"] != true {
+		t.Errorf("acr_essential = %v, want true", state["acr_essential"])
+	}
+	// Logins with an OAuth2 provider aren't enabled, so only MFA reaches loa2.
+	amr, _ := state["acr_amr"].([]any)
+	if len(amr) != 1 {
+		t.Fatalf("acr_amr = %v, want [[mfa]]", state["acr_amr"])
+	}
+	if methods, _ := amr[0].([]any); len(methods) != 1 || methods[0] != "mfa" {
+		t.Errorf("acr_amr = %v, want [[mfa]]", state["acr_amr"])
+	}
+}
+
+func TestACRValues_Reject(t *testing.T) {
+	f := newTestFixture(t)
+
+	challenge := startTestLoginChallenge(t, f.Mux, nil)
+	location := resolveTestLoginChallenge(t, f.Mux, "login", challenge, "reject", url.Values{"error": {"unmet_authentication_requirements"}}, "")
+	if got := location.Query().Get("error"); got != "unmet_authentication_requirements" {
+		t.Errorf("error = %q, want %q", got, "unmet_authentication_requirements")
+	}
+}
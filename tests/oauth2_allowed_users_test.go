@@ -0,0 +1,66 @@
+package oauth2
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/pocketbase/pocketbase/core"
+)
+
+// allowedUsersTestOptions only allow the users matching the filter to sign
+// in to the test client. The users have a role to filter on.
+func allowedUsersTestOptions(filter string) []testFixtureOption {
+	return []testFixtureOption{
+		withTestClient(map[string]any{
+			"scope":                "openid profile email offline_access",
+			"allowed_users_filter": filter,
+		}),
+		withTestUserFields(&core.TextField{Name: "role"}),
+	}
+}
+
+func TestAllowedUsers_Denied(t *testing.T) {
+	f := newTestFixture(t, allowedUsersTestOptions("role = 'staff'")...)
+
+	location := authorizeTestRequest(t, f.App, f.Mux, url.Values{"consent": {"granted"}})
+	assertTestAuthorizeError(t, location, "access_denied")
+}
+
+func TestAllowedUsers_Allowed(t *testing.T) {
+	f := newTestFixture(t, allowedUsersTestOptions("role = 'staff'")...)
+
+	setTestUserRole(t, f.App, f.User, "staff")
+
+	code := authorizeTestUser(t, f.App, f.Mux, nil)
+	exchangeTestCode(t, f.Mux, code, nil)
+}
+
+func TestAllowedUsers_EmptyFilter(t *testing.T) {
+	f := newTestFixture(t, allowedUsersTestOptions("")...)
+
+	code := authorizeTestUser(t, f.App, f.Mux, nil)
+	exchangeTestCode(t, f.Mux, code, nil)
+}
+
+func TestAllowedUsers_RefreshDenied(t *testing.T) {
+	f := newTestFixture(t, allowedUsersTestOptions("role = 'staff'")...)
+
+	setTestUserRole(t, f.App, f.User, "staff")
+
+	code := authorizeTestUser(t, f.App, f.Mux, url.Values{"scope": {"openid offline_access"}})
+	res := exchangeTestCode(t, f.Mux, code, nil)
+	refreshToken, _ := res["refresh_token"].(string)
+
+	setTestUserRole(t, f.App, f.User, "")
+
+	r := doTestRequest(t, f.Mux, http.MethodPost, "/oauth2/token", url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {refreshToken},
+		"client_id":     {testClientID},
+		"client_secret": {testClientSecret},
+	}, nil)
+	if res := decodeTestJSONResponse(t, r); res["error"] != "invalid_grant" {
+		t.Errorf("error = %v, want %q", res["error"], "invalid_grant")
+	}
+}
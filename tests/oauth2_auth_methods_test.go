@@ -0,0 +1,247 @@
+package oauth2
+
+import (
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	oauth2 "github.com/benjamesfleming/pocketbase-ext-oauth2"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tests"
+)
+
+// loginTestUser logs the test user in with the PocketBase auth endpoint, for a
+// login challenge as the login UI does, and returns the decoded response.
+func loginTestUser(t testing.TB, mux http.Handler, method string, form url.Values) (int, map[string]any) {
+	t.Helper()
+	challenge := startTestLoginChallenge(t, mux, nil)
+	target := "/api/collections/" + testUserCollection + "/" + method + "?" + url.Values{"login_challenge": {challenge}}.Encode()
+	r := doTestRequest(t, mux, http.MethodPost, target, form, nil)
+	return r.StatusCode, decodeTestJSONResponse(t, r)
+}
+
+// authorizeTestLogin runs the authorization request with the user token and
+// returns the claims of the issued ID token.
+func authorizeTestLogin(t testing.TB, mux http.Handler, token string) map[string]any {
+	t.Helper()
+	location := authorizeTestRequestWithToken(t, mux, token, url.Values{"consent": {"granted"}})
+	code := location.Query().Get("code")
+	if code == "" {
+		t.Fatalf("expected authorization code, got %q", location.String())
+	}
+	res := exchangeTestCode(t, mux, code, nil)
+	return decodeTestJWTClaims(t, res["id_token"].(string))
+}
+
+func assertTestAMR(t testing.TB, claims map[string]any, want ...string) {
+	t.Helper()
+	amr, _ := claims["amr"].([]any)
+	got := []string{}
+	for _, v := range amr {
+		got = append(got, v.(string))
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("amr = %v, want %v", got, want)
+	}
+}
+
+func TestAuthMethods_Password(t *testing.T) {
+	f := newTestFixture(t)
+
+	status, res := loginTestUser(t, f.Mux, "auth-with-password", url.Values{
+		"identity": {testUserEmail},
+		"password": {testUserPassword},
+	})
+	if status != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %v", status, res)
+	}
+
+	claims := authorizeTestLogin(t, f.Mux, res["token"].(string))
+	assertTestAMR(t, claims, "pwd")
+	if claims["acr"] != "loa1" {
+		t.Errorf("acr = %v, want %q", claims["acr"], "loa1")
+	}
+}
+
+func TestAuthMethods_AuthTime(t *testing.T) {
+	f := newTestFixture(t)
+
+	_, res := loginTestUser(t, f.Mux, "auth-with-password", url.Values{
+		"identity": {testUserEmail},
+		"password": {testUserPassword},
+	})
+	token, _ := res["token"].(string)
+	authTime, _ := decodeTestJWTClaims(t, token)["auth_time"].(float64)
+	if d := time.Since(time.Unix(int64(authTime), 0)); d < 0 || d > time.Minute {
+		t.Errorf("expected the auth_time of the login, got %v", authTime)
+	}
+	if got := authorizeTestLogin(t, f.Mux, token)["auth_time"]; got != authTime {
+		t.Errorf("auth_time = %v, want %v", got, authTime)
+	}
+
+	// Refreshing the auth token isn't a new login.
+	r := doTestRequest(t, f.Mux, http.MethodPost, "/api/collections/"+testUserCollection+"/auth-refresh", nil, map[string]string{
+		"Authorization": token,
+	})
+	refreshed, _ := decodeTestJSONResponse(t, r)["token"].(string)
+	if claims := decodeTestJWTClaims(t, refreshed); claims["auth_time"] != nil || claims["amr"] != nil {
+		t.Errorf("expected the refreshed token to record no login, got %v", claims)
+	}
+}
+
+// enableTestMFA enables MFA with a password and an OTP for the users
+// collection.
+func enableTestMFA(t testing.TB, app core.App, user *core.Record) {
+	t.Helper()
+	c := user.Collection()
+	c.MFA.Enabled = true
+	c.OTP.Enabled = true
+	if err := app.Save(c); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// loginTestUserWithMFA logs the test user in with a password and an OTP, and
+// returns the auth token.
+func loginTestUserWithMFA(t testing.TB, app core.App, mux http.Handler, user *core.Record) string {
+	t.Helper()
+	status, res := loginTestUser(t, mux, "auth-with-password", url.Values{
+		"identity": {testUserEmail},
+		"password": {testUserPassword},
+	})
+	mfaId, _ := res["mfaId"].(string)
+	if status != http.StatusUnauthorized || mfaId == "" {
+		t.Fatalf("expected an MFA challenge, got status %d: %v", status, res)
+	}
+
+	otp := core.NewOTP(app)
+	otp.SetCollectionRef(user.Collection().Id)
+	otp.SetRecordRef(user.Id)
+	otp.SetPassword("123456")
+	if err := app.Save(otp); err != nil {
+		t.Fatal(err)
+	}
+	status, res = loginTestUser(t, mux, "auth-with-otp", url.Values{
+		"otpId":    {otp.Id},
+		"password": {"123456"},
+		"mfaId":    {mfaId},
+	})
+	if status != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %v", status, res)
+	}
+	return res["token"].(string)
+}
+
+func TestAuthMethods_MFA(t *testing.T) {
+	f := newTestFixture(t)
+
+	enableTestMFA(t, f.App, f.User)
+	claims := authorizeTestLogin(t, f.Mux, loginTestUserWithMFA(t, f.App, f.Mux, f.User))
+	assertTestAMR(t, claims, "pwd", "otp", "mfa")
+	if claims["acr"] != "loa2" {
+		t.Errorf("acr = %v, want %q", claims["acr"], "loa2")
+	}
+}
+
+func TestAuthMethods_UnknownMethods(t *testing.T) {
+	f := newTestFixture(t)
+
+	// The token wasn't issued by logging in, so the methods are unknown.
+	claims := authorizeTestLogin(t, f.Mux, generateTestUserToken(t, f.App))
+	if _, ok := claims["amr"]; ok {
+		t.Errorf("expected no amr claim, got %v", claims["amr"])
+	}
+	if claims["acr"] != "loa1" {
+		t.Errorf("acr = %v, want %q", claims["acr"], "loa1")
+	}
+}
+
+func TestAuthMethods_WithoutLoginChallenge(t *testing.T) {
+	// The auth tokens of the logins that don't accept a login challenge are
+	// left as PocketBase issued them.
+	expectNoAMR := func(t testing.TB, app *tests.TestApp, res *http.Response) {
+		token, _ := decodeTestJSONResponse(t, res)["token"].(string)
+		if _, ok := decodeTestJWTClaims(t, token)["amr"]; ok {
+			t.Errorf("expected no amr claim, got %v", decodeTestJWTClaims(t, token))
+		}
+	}
+	scenarios := []tests.ApiScenario{}
+	for name, query := range map[string]string{
+		"no challenge":      "",
+		"invalid challenge": "?login_challenge=invalid",
+	} {
+		scenarios = append(scenarios, tests.ApiScenario{
+			Name:   name,
+			Method: http.MethodPost,
+			URL:    "/api/collections/" + testUserCollection + "/auth-with-password" + query,
+			Body: strings.NewReader(url.Values{
+				"identity": {testUserEmail},
+				"password": {testUserPassword},
+			}.Encode()),
+			Headers:         map[string]string{"Content-Type": "application/x-www-form-urlencoded"},
+			ExpectedStatus:  200,
+			ExpectedContent: []string{`"token":`},
+			TestAppFactory:  newTestScenarioApp(nil),
+			AfterTestFunc:   expectNoAMR,
+		})
+	}
+	for _, scenario := range scenarios {
+		scenario.Test(t)
+	}
+}
+
+func TestAuthMethods_LevelsOfAssurance(t *testing.T) {
+	levels := oauth2.LevelsOfAssurance{
+		{ACR: "basic"},
+		{ACR: "strong", AMR: []string{"mfa"}},
+		{ACR: "strong", AMR: []string{"fed"}},
+		{ACR: "highest", AMR: []string{"fed", "mfa"}},
+	}
+	for _, tc := range []struct {
+		amr  []string
+		want string
+	}{
+		{nil, "basic"},
+		{[]string{"pwd"}, "basic"},
+		{[]string{"pwd", "otp", "mfa"}, "strong"},
+		{[]string{"fed"}, "strong"},
+		{[]string{"fed", "otp", "mfa"}, "highest"},
+	} {
+		if got := levels.GetACR(tc.amr); got != tc.want {
+			t.Errorf("GetACR(%v) = %q, want %q", tc.amr, got, tc.want)
+		}
+	}
+	if got := (oauth2.LevelsOfAssurance{{ACR: "strong", AMR: []string{"mfa"}}}).GetACR([]string{"pwd"}); got != "" {
+		t.Errorf("expected no acr when no level is reached, got %q", got)
+	}
+	if got := levels.Values(); !slices.Equal(got, []string{"basic", "strong", "highest"}) {
+		t.Errorf("Values() = %v", got)
+	}
+}
+
+func TestAuthMethods_ConfiguredLevels(t *testing.T) {
+	f := newTestFixture(t, withTestConfig(func(cfg *oauth2.Config) {
+		cfg.LevelsOfAssurance = oauth2.LevelsOfAssurance{
+			{ACR: "urn:example:basic"},
+			{ACR: "urn:example:password", AMR: []string{"pwd"}},
+		}
+	}))
+
+	_, res := loginTestUser(t, f.Mux, "auth-with-password", url.Values{
+		"identity": {testUserEmail},
+		"password": {testUserPassword},
+	})
+	claims := authorizeTestLogin(t, f.Mux, res["token"].(string))
+	if claims["acr"] != "urn:example:password" {
+		t.Errorf("acr = %v, want %q", claims["acr"], "urn:example:password")
+	}
+
+	r := doTestRequest(t, f.Mux, http.MethodGet, "/.well-known/openid-configuration", nil, nil)
+	values, _ := decodeTestJSONResponse(t, r)["acr_values_supported"].([]any)
+	if !slices.Equal(values, []any{"urn:example:basic", "urn:example:password"}) {
+		t.Errorf("acr_values_supported = %v", values)
+	}
+}
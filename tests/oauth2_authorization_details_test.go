@@ -0,0 +1,241 @@
+package oauth2
+
+import (
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"testing"
+
+	oauth2 "github.com/benjamesfleming/pocketbase-ext-oauth2"
+	"github.com/benjamesfleming/pocketbase-ext-oauth2/consts"
+	"github.com/ory/fosite"
+	"github.com/pocketbase/pocketbase/tests"
+)
+
+const testPaymentDetails = `[{"type":"payment_initiation","actions":["initiate"],"instructedAmount":{"currency":"EUR","amount":"123.50"}}]`
+
+// paymentInitiationType is an authorization details type that only allows
+// payments in EUR.
+var paymentInitiationType = &oauth2.AuthorizationDetailsType{
+	Type: "payment_initiation",
+	Describe: func(detail oauth2.AuthorizationDetail) string {
+		amount, _ := detail["instructedAmount"].(map[string]any)
+		return "Initiate a payment of " + amount["amount"].(string) + " " + amount["currency"].(string)
+	},
+	Validate: func(client fosite.Client, detail oauth2.AuthorizationDetail) error {
+		amount, _ := detail["instructedAmount"].(map[string]any)
+		if amount["currency"] != "EUR" {
+			return errors.New("only EUR payments are supported")
+		}
+		return nil
+	},
+}
+
+// authorizationDetailsTestOptions register the payment initiation type.
+var authorizationDetailsTestOptions = []testFixtureOption{
+	withTestConfig(func(cfg *oauth2.Config) {
+		cfg.AuthorizationDetailsTypes = []*oauth2.AuthorizationDetailsType{paymentInitiationType}
+	}),
+}
+
+func TestAuthorizationDetails_Discovery(t *testing.T) {
+	scenarios := []tests.ApiScenario{
+		{
+			Name:            "server metadata",
+			Method:          http.MethodGet,
+			URL:             "/.well-known/openid-configuration",
+			ExpectedStatus:  200,
+			ExpectedContent: []string{`"authorization_details_types_supported":["payment_initiation"]`},
+			TestAppFactory:  newTestScenarioApp(nil, authorizationDetailsTestOptions...),
+		},
+		{
+			Name:            "protected resource metadata",
+			Method:          http.MethodGet,
+			URL:             "/.well-known/oauth-protected-resource/oauth2/userinfo",
+			ExpectedStatus:  200,
+			ExpectedContent: []string{`"authorization_details_types_supported":["payment_initiation"]`},
+			TestAppFactory:  newTestScenarioApp(nil, authorizationDetailsTestOptions...),
+		},
+	}
+	for _, scenario := range scenarios {
+		scenario.Test(t)
+	}
+}
+
+func TestAuthorizationDetails_Granted(t *testing.T) {
+	f := newTestFixture(t, authorizationDetailsTestOptions...)
+
+	code := authorizeTestUser(t, f.App, f.Mux, url.Values{"authorization_details": {testPaymentDetails}})
+	res := exchangeTestCode(t, f.Mux, code, nil)
+
+	details, _ := res["authorization_details"].([]any)
+	if len(details) != 1 {
+		t.Fatalf("expected authorization_details in token response, got %v", res)
+	}
+	if detail, _ := details[0].(map[string]any); detail["type"] != "payment_initiation" {
+		t.Errorf("unexpected authorization details %v", details[0])
+	}
+
+	// The authorization details are stored in the session collections.
+	token, _ := res["access_token"].(string)
+	signature := (&oauth2.PocketBaseStrategy{}).AccessTokenSignature(t.Context(), token)
+	record, err := f.App.FindFirstRecordByData(consts.AccessCollectionName, "signature", signature)
+	if err != nil {
+		t.Fatalf("failed to find access token session: %v", err)
+	}
+	var stored []map[string]any
+	if err := record.UnmarshalJSONField("authorization_details", &stored); err != nil || len(stored) != 1 {
+		t.Errorf("expected authorization_details to be stored, got %v (%v)", record.Get("authorization_details"), err)
+	}
+
+	// The authorization details are a claim of the access token.
+	if details, _ := decodeTestJWTClaims(t, token)["authorization_details"].([]any); len(details) != 1 {
+		t.Errorf("expected authorization_details in the access token, got %v", decodeTestJWTClaims(t, token))
+	}
+
+	// The authorization details are returned by the introspection endpoint.
+	introspection := decodeTestJSONResponse(t, doTestRequest(t, f.Mux, http.MethodPost, "/oauth2/introspect", url.Values{
+		"token": {token},
+	}, map[string]string{
+		"Authorization": "Basic " + base64.StdEncoding.EncodeToString([]byte(testClientID+":"+testClientSecret)),
+	}))
+	if details, _ := introspection["authorization_details"].([]any); len(details) != 1 {
+		t.Errorf("expected authorization_details in introspection response, got %v", introspection)
+	}
+}
+
+func TestAuthorizationDetails_NarrowedAtTokenEndpoint(t *testing.T) {
+	f := newTestFixture(t, slices.Concat(authorizationDetailsTestOptions, []testFixtureOption{
+		withTestClient(map[string]any{"scope": "openid profile email offline_access"}),
+	})...)
+
+	first := `{"type":"payment_initiation","instructedAmount":{"currency":"EUR","amount":"1.00"}}`
+	second := `{"type":"payment_initiation","instructedAmount":{"currency":"EUR","amount":"2.00"}}`
+	code := authorizeTestUser(t, f.App, f.Mux, url.Values{
+		"scope":                 {"openid offline_access"},
+		"authorization_details": {"[" + first + "," + second + "]"},
+	})
+	res := exchangeTestCode(t, f.Mux, code, url.Values{"authorization_details": {"[" + second + "]"}})
+
+	// The access token is narrowed to the requested authorization details.
+	token, _ := res["access_token"].(string)
+	if details, _ := res["authorization_details"].([]any); len(details) != 1 {
+		t.Errorf("expected the narrowed authorization_details in the token response, got %v", res["authorization_details"])
+	}
+	if details, _ := decodeTestJWTClaims(t, token)["authorization_details"].([]any); len(details) != 1 {
+		t.Errorf("expected the narrowed authorization_details in the access token, got %v", details)
+	}
+	introspection := decodeTestJSONResponse(t, doTestRequest(t, f.Mux, http.MethodPost, "/oauth2/introspect", url.Values{
+		"token": {token},
+	}, map[string]string{
+		"Authorization": "Basic " + base64.StdEncoding.EncodeToString([]byte(testClientID+":"+testClientSecret)),
+	}))
+	if details, _ := introspection["authorization_details"].([]any); len(details) != 1 {
+		t.Errorf("expected the narrowed authorization_details in the introspection response, got %v", introspection["authorization_details"])
+	}
+
+	// The refresh token keeps the full grant.
+	refreshToken, _ := res["refresh_token"].(string)
+	res = decodeTestJSONResponse(t, doTestRequest(t, f.Mux, http.MethodPost, "/oauth2/token", url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {refreshToken},
+		"client_id":     {testClientID},
+		"client_secret": {testClientSecret},
+	}, nil))
+	token, _ = res["access_token"].(string)
+	if details, _ := decodeTestJWTClaims(t, token)["authorization_details"].([]any); len(details) != 2 {
+		t.Errorf("expected the refreshed access token to have the full grant, got %v", details)
+	}
+}
+
+func TestAuthorizationDetails_Invalid(t *testing.T) {
+	scenarios := []tests.ApiScenario{}
+	for name, details := range map[string]string{
+		"malformed":        `{"type":"payment_initiation"}`,
+		"unknown type":     `[{"type":"unknown"}]`,
+		"failed validator": `[{"type":"payment_initiation","instructedAmount":{"currency":"USD","amount":"1.00"}}]`,
+	} {
+		scenarios = append(scenarios, tests.ApiScenario{
+			Name:   name,
+			Method: http.MethodPost,
+			URL:    "/oauth2/auth",
+			Body: strings.NewReader(url.Values{
+				"response_type":         {"code"},
+				"client_id":             {testClientID},
+				"redirect_uri":          {testRedirectURI},
+				"scope":                 {"openid"},
+				"state":                 {"teststate1234"},
+				"authorization_details": {details},
+			}.Encode()),
+			Headers:        map[string]string{"Content-Type": "application/x-www-form-urlencoded"},
+			ExpectedStatus: 303,
+			TestAppFactory: newTestScenarioApp(nil, authorizationDetailsTestOptions...),
+			AfterTestFunc: func(t testing.TB, app *tests.TestApp, res *http.Response) {
+				location, err := res.Location()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got := location.Query().Get("error"); got != "invalid_authorization_details" {
+					t.Errorf("error = %q, want %q", got, "invalid_authorization_details")
+				}
+			},
+		})
+	}
+	for _, scenario := range scenarios {
+		scenario.Test(t)
+	}
+}
+
+func TestAuthorizationDetails_NotInGrantAtTokenEndpoint(t *testing.T) {
+	f := newTestFixture(t, authorizationDetailsTestOptions...)
+
+	code := authorizeTestUser(t, f.App, f.Mux, url.Values{"authorization_details": {testPaymentDetails}})
+	r := doTestRequest(t, f.Mux, http.MethodPost, "/oauth2/token", url.Values{
+		"grant_type":            {"authorization_code"},
+		"code":                  {code},
+		"client_id":             {testClientID},
+		"client_secret":         {testClientSecret},
+		"redirect_uri":          {testRedirectURI},
+		"authorization_details": {`[{"type":"payment_initiation","instructedAmount":{"currency":"EUR","amount":"999.00"}}]`},
+	}, nil)
+	if r.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected status 400, got %d", r.StatusCode)
+	}
+}
+
+func TestAuthorizationDetails_ConsentState(t *testing.T) {
+	var f *testFixture
+	scenario := tests.ApiScenario{
+		Method: http.MethodGet,
+		URL: "/oauth2/auth?" + url.Values{
+			"response_type":         {"code"},
+			"client_id":             {testClientID},
+			"redirect_uri":          {testRedirectURI},
+			"scope":                 {"openid"},
+			"state":                 {"teststate1234"},
+			"authorization_details": {testPaymentDetails},
+		}.Encode(),
+		ExpectedStatus: 307,
+		TestAppFactory: newTestScenarioApp(func(t testing.TB, fixture *testFixture) {
+			f = fixture
+		}, authorizationDetailsTestOptions...),
+		AfterTestFunc: func(t testing.TB, app *tests.TestApp, res *http.Response) {
+			location, err := res.Location()
+			if err != nil {
+				t.Fatal(err)
+			}
+			state := decodeTestLoginState(t, f.Mux, location)
+			details, _ := state["authorization_details"].([]any)
+			if len(details) != 1 {
+				t.Fatalf("expected authorization_details in login state, got %v", state)
+			}
+			if detail, _ := details[0].(map[string]any); detail["description"] != "Initiate a payment of 123.50 EUR" {
+				t.Errorf("unexpected consent description %v", detail["description"])
+			}
+		},
+	}
+	scenario.Test(t)
+}
@@ -0,0 +1,219 @@
+package oauth2
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	oauth2 "github.com/benjamesfleming/pocketbase-ext-oauth2"
+	"github.com/benjamesfleming/pocketbase-ext-oauth2/consts"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tests"
+)
+
+// waitForTestDeliveries waits until the pending back-channel logout deliveries
+// match the condition.
+func waitForTestDeliveries(t testing.TB, app core.App, cond func(records []*core.Record) bool) []*core.Record {
+	t.Helper()
+	deadline := time.Now().Add(time.Second * 5)
+	for {
+		records, err := app.FindAllRecords(consts.BackChannelLogoutCollectionName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cond(records) {
+			return records
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for the back-channel logout deliveries, got %d", len(records))
+		}
+		time.Sleep(time.Millisecond * 20)
+	}
+}
+
+// logoutTestUser logs the test user in with a browser session, and logs them
+// out of it again.
+func logoutTestUser(t testing.TB, f *testFixture) {
+	t.Helper()
+	cookie, res := loginTestBrowser(t, f, nil)
+	idToken, _ := res["id_token"].(string)
+	acceptTestLogout(t, f.Mux, startTestLogout(t, f.Mux, url.Values{"id_token_hint": {idToken}}), cookie)
+}
+
+func TestBackChannelLogout_Discovery(t *testing.T) {
+	scenario := tests.ApiScenario{
+		Method:          http.MethodGet,
+		URL:             "/.well-known/openid-configuration",
+		ExpectedStatus:  200,
+		ExpectedContent: []string{`"backchannel_logout_supported":true`},
+		TestAppFactory:  newTestScenarioApp(nil, withTestBackChannelLogout(false)),
+	}
+	scenario.Test(t)
+}
+
+func TestBackChannelLogout_Logout(t *testing.T) {
+	f := newTestFixture(t, withTestBackChannelLogout(false))
+
+	logoutTestUser(t, f)
+	token := f.RP.waitForTestLogoutToken(t)
+
+	// The logout token is signed by the provider.
+	if _, err := oauth2.ValidateIDTokenHint(context.Background(), token); err != nil {
+		t.Fatalf("expected a logout token signed by the provider: %v", err)
+	}
+	header := map[string]any{}
+	raw, _ := base64.RawURLEncoding.DecodeString(strings.Split(token, ".")[0])
+	if err := json.Unmarshal(raw, &header); err != nil || header["typ"] != "logout+jwt" {
+		t.Errorf("expected typ logout+jwt, got %v", header)
+	}
+
+	claims := decodeTestJWTClaims(t, token)
+	if claims["sub"] != f.User.Id {
+		t.Errorf("sub = %v, want %q", claims["sub"], f.User.Id)
+	}
+	if aud, _ := claims["aud"].([]any); len(aud) != 1 || aud[0] != testClientID {
+		t.Errorf("aud = %v, want [%s]", claims["aud"], testClientID)
+	}
+	if events, _ := claims["events"].(map[string]any); events["http://schemas.openid.net/event/backchannel-logout"] == nil {
+		t.Errorf("expected the back-channel logout event, got %v", claims["events"])
+	}
+	if _, ok := claims["nonce"]; ok {
+		t.Error("expected no nonce in the logout token")
+	}
+
+	// The delivery is removed once it succeeds.
+	waitForTestDeliveries(t, f.App, func(records []*core.Record) bool { return len(records) == 0 })
+}
+
+func TestBackChannelLogout_ConnectedAppRevoke(t *testing.T) {
+	f := newTestFixture(t, withTestBackChannelLogout(false))
+
+	exchangeTestCode(t, f.Mux, authorizeTestUser(t, f.App, f.Mux, nil), nil)
+	r := doTestRequest(t, f.Mux, http.MethodDelete, "/oauth2/connected-apps/"+testClientID, nil, map[string]string{
+		"Authorization": generateTestUserToken(t, f.App),
+	})
+	if r.StatusCode != http.StatusNoContent {
+		t.Fatalf("expected status 204, got %d", r.StatusCode)
+	}
+
+	if claims := decodeTestJWTClaims(t, f.RP.waitForTestLogoutToken(t)); claims["sub"] != f.User.Id {
+		t.Errorf("sub = %v, want %q", claims["sub"], f.User.Id)
+	}
+}
+
+func TestBackChannelLogout_Retry(t *testing.T) {
+	f := newTestFixture(t, withTestBackChannelLogout(false))
+
+	f.RP.status.Store(http.StatusServiceUnavailable)
+	logoutTestUser(t, f)
+	f.RP.waitForTestLogoutToken(t)
+
+	// The failed delivery is kept, and retried later.
+	records := waitForTestDeliveries(t, f.App, func(records []*core.Record) bool {
+		return len(records) == 1 && records[0].GetInt("attempts") == 1
+	})
+	if records[0].GetString("last_error") == "" {
+		t.Error("expected the last error to be recorded")
+	}
+	if next := records[0].GetInt("next_attempt_at"); int64(next) <= time.Now().Unix() {
+		t.Errorf("expected the next attempt to be delayed, got %d", next)
+	}
+
+	f.RP.status.Store(http.StatusOK)
+	records[0].Set("next_attempt_at", time.Now().Unix())
+	if err := f.App.Save(records[0]); err != nil {
+		t.Fatal(err)
+	}
+	runTestCronJob(t, f.App, consts.DeliverBackChannelLogoutsJobName)
+	f.RP.waitForTestLogoutToken(t)
+	waitForTestDeliveries(t, f.App, func(records []*core.Record) bool { return len(records) == 0 })
+}
+
+func TestBackChannelLogout_SessionRequired(t *testing.T) {
+	f := newTestFixture(t, withTestBackChannelLogout(true))
+
+	// The user didn't sign in to the client during the browser session, so
+	// the logout has no sid for the client.
+	cookie, res := loginTestBrowser(t, f, nil)
+	idToken, _ := res["id_token"].(string)
+	forgetTestBrowserSessionClients(t, f.App)
+	acceptTestLogout(t, f.Mux, startTestLogout(t, f.Mux, url.Values{"id_token_hint": {idToken}}), cookie)
+	waitForTestDeliveries(t, f.App, func(records []*core.Record) bool { return len(records) == 0 })
+	select {
+	case <-f.RP.tokens:
+		t.Error("expected no logout token without a sid")
+	default:
+	}
+}
+
+func TestBackChannelLogout_WithoutIDTokenHint(t *testing.T) {
+	f := newTestFixture(t, withTestBackChannelLogout(false))
+
+	// Without an id_token_hint the user isn't known, so no clients are
+	// notified.
+	exchangeTestCode(t, f.Mux, authorizeTestUser(t, f.App, f.Mux, nil), nil)
+	acceptTestLogout(t, f.Mux, startTestLogout(t, f.Mux, url.Values{"client_id": {testClientID}}), nil)
+	if n, _ := f.App.CountRecords(consts.BackChannelLogoutCollectionName); n != 0 {
+		t.Errorf("expected no deliveries, got %d", n)
+	}
+	select {
+	case <-f.RP.tokens:
+		t.Error("expected no logout token")
+	default:
+	}
+}
+
+func TestBackChannelLogout_UnsafeURI(t *testing.T) {
+	f := newTestFixture(t, withTestClient(map[string]any{
+		"backchannel_logout_uri": "gopher://127.0.0.1:8090/backchannel-logout",
+	}))
+
+	// The delivery is skipped rather than retried.
+	logoutTestUser(t, f)
+	waitForTestDeliveries(t, f.App, func(records []*core.Record) bool { return len(records) == 0 })
+}
+
+func TestBackChannelLogout_RegisterUnsafeURI(t *testing.T) {
+	for _, uri := range []string{
+		"http://169.254.169.254/latest/meta-data",
+		"http://localhost:8090/api/collections",
+		"https://localhost:8090/api/collections",
+		"https://rp.example.com/backchannel-logout#fragment",
+	} {
+		scenario := tests.ApiScenario{
+			Name:   "register - backchannel_logout_uri " + uri,
+			Method: http.MethodPost,
+			URL:    "/oauth2/register",
+			Body: strings.NewReader(`{
+				"client_name": "Bad Client",
+				"redirect_uris": ["http://localhost:3000/callback"],
+				"backchannel_logout_uri": "` + uri + `"
+			}`),
+			Headers: map[string]string{
+				"Content-Type": "application/json",
+			},
+			ExpectedStatus:  400,
+			ExpectedContent: []string{`"error":"invalid_client_metadata"`},
+			TestAppFactory: func(t testing.TB) *tests.TestApp {
+				return setupTestAppForScenario(t)
+			},
+		}
+		scenario.Test(t)
+	}
+}
+
+func runTestCronJob(t testing.TB, app core.App, id string) {
+	t.Helper()
+	for _, j := range app.Cron().Jobs() {
+		if j.Id() == id {
+			j.Run()
+			return
+		}
+	}
+	t.Fatalf("cron job %q not found", id)
+}
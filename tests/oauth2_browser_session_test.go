@@ -0,0 +1,296 @@
+package oauth2
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"slices"
+	"testing"
+
+	"github.com/benjamesfleming/pocketbase-ext-oauth2/consts"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tests"
+)
+
+const testBrowserSessionCookie = "pb_oauth2_session"
+
+// authorizeTestBrowserRequest runs the authorization request for the test
+// client like a browser would, sending the session cookie if given. The login
+// and consent challenges are accepted as the test user, and the final response
+// of the authorization endpoint is returned.
+func authorizeTestBrowserRequest(t testing.TB, app *tests.TestApp, mux http.Handler, params url.Values, cookie *http.Cookie) *http.Response {
+	t.Helper()
+	form := url.Values{
+		"response_type": {"code"},
+		"client_id":     {testClientID},
+		"redirect_uri":  {testRedirectURI},
+		"scope":         {"openid profile email"},
+		"state":         {"teststate1234"},
+	}
+	for k, v := range params {
+		form[k] = v
+	}
+	headers := map[string]string{}
+	if cookie != nil {
+		headers["Cookie"] = cookie.String()
+	}
+
+	res := doTestRequest(t, mux, http.MethodGet, "/oauth2/auth?"+form.Encode(), nil, headers)
+	for {
+		location, err := res.Location()
+		if err != nil {
+			t.Fatalf("expected authorization redirect, got status %d", res.StatusCode)
+		}
+		var target string
+		switch {
+		case location.Query().Has("login_challenge"):
+			target = "/oauth2/auth/requests/login/accept?" + url.Values{"login_challenge": {location.Query().Get("login_challenge")}}.Encode()
+		case location.Query().Has("consent_challenge"):
+			target = "/oauth2/auth/requests/consent/accept?" + url.Values{"consent_challenge": {location.Query().Get("consent_challenge")}}.Encode()
+		case location.Path == "/oauth2/auth":
+			res = doTestRequest(t, mux, http.MethodGet, location.RequestURI(), nil, headers)
+			continue
+		default:
+			return res
+		}
+		r := doTestRequest(t, mux, http.MethodPost, target, url.Values{"remember": {"true"}}, map[string]string{
+			"Authorization": generateTestUserToken(t, app),
+		})
+		ret := decodeTestJSONResponse(t, r)
+		if r.StatusCode != http.StatusOK {
+			t.Fatalf("failed to accept the challenge with status %d: %v", r.StatusCode, ret)
+		}
+		redirectTo, _ := url.Parse(ret["redirect_to"].(string))
+		res = doTestRequest(t, mux, http.MethodGet, redirectTo.RequestURI(), nil, headers)
+	}
+}
+
+// getTestBrowserSessionCookie returns the session cookie set by the response.
+func getTestBrowserSessionCookie(t testing.TB, res *http.Response) *http.Cookie {
+	t.Helper()
+	for _, cookie := range res.Cookies() {
+		if cookie.Name == testBrowserSessionCookie {
+			return cookie
+		}
+	}
+	t.Fatal("expected the browser session cookie to be set")
+	return nil
+}
+
+func getTestAuthorizationCode(t testing.TB, res *http.Response) string {
+	t.Helper()
+	location, _ := res.Location()
+	code := location.Query().Get("code")
+	if code == "" {
+		t.Fatalf("expected authorization code in redirect, got %q", location.String())
+	}
+	return code
+}
+
+func findTestBrowserSession(t testing.TB, app core.App) *core.Record {
+	t.Helper()
+	records, err := app.FindAllRecords(consts.BrowserSessionCollectionName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 {
+		t.Fatalf("expected one browser session, got %d", len(records))
+	}
+	return records[0]
+}
+
+func TestBrowserSession_Login(t *testing.T) {
+	f := newTestFixture(t)
+
+	res := authorizeTestBrowserRequest(t, f.App, f.Mux, nil, nil)
+	cookie := getTestBrowserSessionCookie(t, res)
+	if !cookie.HttpOnly || cookie.Path != "/oauth2" || cookie.Expires.IsZero() {
+		t.Errorf("expected a remembered HttpOnly cookie for /oauth2, got %v", cookie)
+	}
+
+	// Only a hash of the token is stored.
+	record := findTestBrowserSession(t, f.App)
+	if record.GetString("token_hash") == cookie.Value {
+		t.Error("expected the session token to be stored hashed")
+	}
+	accounts := []map[string]any{}
+	if err := record.UnmarshalJSONField("accounts", &accounts); err != nil || len(accounts) != 1 {
+		t.Fatalf("expected one account, got %v", record.Get("accounts"))
+	}
+	if accounts[0]["subject"] != f.User.Id || !slices.Equal(accounts[0]["clients"].([]any), []any{testClientID}) {
+		t.Errorf("unexpected account %v", accounts[0])
+	}
+
+	res2 := exchangeTestCode(t, f.Mux, getTestAuthorizationCode(t, res), nil)
+	idToken, _ := res2["id_token"].(string)
+	if sid := decodeTestJWTClaims(t, idToken)["sid"]; sid == nil || sid != record.GetString("sid") {
+		t.Errorf("sid = %v, want %q", sid, record.GetString("sid"))
+	}
+}
+
+func TestBrowserSession_PromptNone(t *testing.T) {
+	f := newTestFixture(t)
+
+	cookie := getTestBrowserSessionCookie(t, authorizeTestBrowserRequest(t, f.App, f.Mux, nil, nil))
+	sid := findTestBrowserSession(t, f.App).GetString("sid")
+
+	// The browser session logs the user in, without the login UI.
+	res := doTestRequest(t, f.Mux, http.MethodGet, "/oauth2/auth?"+url.Values{
+		"response_type": {"code"},
+		"client_id":     {testClientID},
+		"redirect_uri":  {testRedirectURI},
+		"scope":         {"openid profile email"},
+		"state":         {"teststate1234"},
+		"prompt":        {"none"},
+	}.Encode(), nil, map[string]string{"Cookie": cookie.String()})
+	if location, _ := res.Location(); location == nil || location.Path != "/oauth2/auth" || !location.Query().Has("login_verifier") {
+		t.Fatalf("expected a redirect back to the authorization endpoint, got %v", location)
+	}
+	res = authorizeTestBrowserRequest(t, f.App, f.Mux, url.Values{"prompt": {"none"}}, cookie)
+	res2 := exchangeTestCode(t, f.Mux, getTestAuthorizationCode(t, res), nil)
+	idToken, _ := res2["id_token"].(string)
+	if got := decodeTestJWTClaims(t, idToken)["sid"]; got != sid {
+		t.Errorf("sid = %v, want %q", got, sid)
+	}
+
+	// The session token is rotated on every login.
+	if rotated := getTestBrowserSessionCookie(t, res); rotated.Value == cookie.Value {
+		t.Error("expected the session token to be rotated")
+	}
+
+	// Without the session, the user has to log in.
+	res = doTestRequest(t, f.Mux, http.MethodGet, "/oauth2/auth?"+url.Values{
+		"response_type": {"code"},
+		"client_id":     {testClientID},
+		"redirect_uri":  {testRedirectURI},
+		"scope":         {"openid"},
+		"state":         {"teststate1234"},
+		"prompt":        {"none"},
+	}.Encode(), nil, nil)
+	location, err := res.Location()
+	if err != nil {
+		t.Fatalf("expected error redirect, got status %d", res.StatusCode)
+	}
+	assertTestAuthorizeError(t, location, "login_required")
+}
+
+func TestBrowserSession_PromptNoneAccountSelection(t *testing.T) {
+	f := newTestFixture(t)
+
+	cookie := getTestBrowserSessionCookie(t, authorizeTestBrowserRequest(t, f.App, f.Mux, nil, nil))
+
+	// Log another user in to the same browser session.
+	other := core.NewRecord(f.User.Collection())
+	other.SetEmail("other@example.com")
+	other.SetPassword(testUserPassword)
+	if err := f.App.Save(other); err != nil {
+		t.Fatal(err)
+	}
+	record := findTestBrowserSession(t, f.App)
+	accounts := []map[string]any{}
+	_ = record.UnmarshalJSONField("accounts", &accounts)
+	accounts = append(accounts, map[string]any{
+		"subject":    other.Id,
+		"collection": other.Collection().Id,
+		"auth_time":  accounts[0]["auth_time"],
+		"clients":    []string{},
+	})
+	record.Set("accounts", accounts)
+	if err := f.App.Save(record); err != nil {
+		t.Fatal(err)
+	}
+
+	res := authorizeTestBrowserRequest(t, f.App, f.Mux, url.Values{"prompt": {"none"}}, cookie)
+	location, _ := res.Location()
+	assertTestAuthorizeError(t, location, "account_selection_required")
+
+	// The login_hint tells the accounts apart.
+	res = authorizeTestBrowserRequest(t, f.App, f.Mux, url.Values{"prompt": {"none"}, "login_hint": {testUserEmail}}, cookie)
+	getTestAuthorizationCode(t, res)
+}
+
+func TestBrowserSession_Logout(t *testing.T) {
+	f := newTestFixture(t, withTestBackChannelLogout(true), withTestFrontChannelLogout(true))
+
+	cookie := getTestBrowserSessionCookie(t, authorizeTestBrowserRequest(t, f.App, f.Mux, nil, nil))
+	sid := findTestBrowserSession(t, f.App).GetString("sid")
+
+	// The browser session tells who is logging out, even without an
+	// id_token_hint.
+	challenge := startTestLogout(t, f.Mux, url.Values{"client_id": {testClientID}})
+	r := doTestRequest(t, f.Mux, http.MethodPost, "/oauth2/auth/requests/logout/accept?logout_challenge="+url.QueryEscape(challenge), nil, map[string]string{
+		"Cookie": cookie.String(),
+	})
+	res := decodeTestJSONResponse(t, r)
+	if r.StatusCode != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %v", r.StatusCode, res)
+	}
+
+	want := testFrontChannelLogoutURI + "?" + url.Values{"iss": {f.App.Settings().Meta.AppURL}, "sid": {sid}}.Encode()
+	if uris, _ := res["frontchannel_logout_uris"].([]any); !slices.Equal(uris, []any{want}) {
+		t.Errorf("frontchannel_logout_uris = %v, want [%s]", uris, want)
+	}
+	claims := decodeTestJWTClaims(t, f.RP.waitForTestLogoutToken(t))
+	if claims["sub"] != f.User.Id || claims["sid"] != sid {
+		t.Errorf("expected the logout token for sub %q and sid %q, got %v", f.User.Id, sid, claims)
+	}
+
+	// The session is ended, and the cookie expired.
+	if n, _ := f.App.CountRecords(consts.BrowserSessionCollectionName); n != 0 {
+		t.Errorf("expected the browser session to be deleted, got %d", n)
+	}
+	if expired := getTestBrowserSessionCookie(t, r); expired.MaxAge >= 0 {
+		t.Errorf("expected the session cookie to be expired, got %v", expired)
+	}
+}
+
+func TestBrowserSession_ConnectedApps(t *testing.T) {
+	f := newTestFixture(t)
+
+	res := authorizeTestBrowserRequest(t, f.App, f.Mux, nil, nil)
+	cookie := getTestBrowserSessionCookie(t, res)
+	exchangeTestCode(t, f.Mux, getTestAuthorizationCode(t, res), nil)
+
+	for name, headers := range map[string]map[string]string{
+		"with session":    {"Authorization": generateTestUserToken(t, f.App), "Cookie": cookie.String()},
+		"without session": {"Authorization": generateTestUserToken(t, f.App)},
+	} {
+		r := doTestRequest(t, f.Mux, http.MethodGet, "/oauth2/connected-apps", nil, headers)
+		var apps []map[string]any
+		if err := json.NewDecoder(r.Body).Decode(&apps); err != nil || len(apps) != 1 {
+			t.Fatalf("%s: expected one connected app, got %v", name, apps)
+		}
+		if got, want := apps[0]["signed_in"], name == "with session"; got != want {
+			t.Errorf("%s: signed_in = %v, want %v", name, got, want)
+		}
+	}
+
+	// Removing the app signs the user out of it.
+	r := doTestRequest(t, f.Mux, http.MethodDelete, "/oauth2/connected-apps/"+testClientID, nil, map[string]string{
+		"Authorization": generateTestUserToken(t, f.App),
+		"Cookie":        cookie.String(),
+	})
+	if r.StatusCode != http.StatusNoContent {
+		t.Fatalf("expected status 204, got %d", r.StatusCode)
+	}
+	accounts := []map[string]any{}
+	_ = findTestBrowserSession(t, f.App).UnmarshalJSONField("accounts", &accounts)
+	if clients, _ := accounts[0]["clients"].([]any); len(clients) != 0 {
+		t.Errorf("expected the client to be removed from the session, got %v", clients)
+	}
+}
+
+func TestBrowserSession_Discovery(t *testing.T) {
+	scenario := tests.ApiScenario{
+		Method:         http.MethodGet,
+		URL:            "/.well-known/openid-configuration",
+		ExpectedStatus: 200,
+		ExpectedContent: []string{
+			`"frontchannel_logout_session_supported":true`,
+			`"backchannel_logout_session_supported":true`,
+			`"sid"`,
+		},
+		TestAppFactory: newTestScenarioApp(nil),
+	}
+	scenario.Test(t)
+}
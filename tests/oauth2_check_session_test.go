@@ -0,0 +1,107 @@
+package oauth2
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/pocketbase/pocketbase/tests"
+)
+
+const testBrowserStateCookie = "pb_oauth2_browser_state"
+
+// getTestBrowserStateCookie returns the browser state cookie set by the
+// response.
+func getTestBrowserStateCookie(t testing.TB, res *http.Response) *http.Cookie {
+	t.Helper()
+	for _, cookie := range res.Cookies() {
+		if cookie.Name == testBrowserStateCookie {
+			return cookie
+		}
+	}
+	t.Fatal("expected the browser state cookie to be set")
+	return nil
+}
+
+// checkTestSessionState computes the session_state like the check session
+// iframe does, and reports whether it matches.
+func checkTestSessionState(t testing.TB, sessionState string, origin string, browserState string) bool {
+	t.Helper()
+	hash, salt, ok := strings.Cut(sessionState, ".")
+	if !ok || salt == "" {
+		t.Fatalf("malformed session_state %q", sessionState)
+	}
+	sum := sha256.Sum256([]byte(testClientID + " " + origin + " " + browserState + " " + salt))
+	return hex.EncodeToString(sum[:]) == hash
+}
+
+func TestCheckSession_Discovery(t *testing.T) {
+	scenario := tests.ApiScenario{
+		Method:          http.MethodGet,
+		URL:             "/.well-known/openid-configuration",
+		ExpectedStatus:  200,
+		ExpectedContent: []string{`"check_session_iframe":"` + testAppURL + `/oauth2/check-session"`},
+		TestAppFactory:  newTestScenarioApp(nil),
+	}
+	scenario.Test(t)
+}
+
+func TestCheckSession_Iframe(t *testing.T) {
+	scenario := tests.ApiScenario{
+		Method:          http.MethodGet,
+		URL:             "/oauth2/check-session",
+		ExpectedStatus:  200,
+		ExpectedContent: []string{"<html"},
+		TestAppFactory:  newTestScenarioApp(nil),
+		AfterTestFunc: func(t testing.TB, app *tests.TestApp, res *http.Response) {
+			if h := res.Header.Get("Content-Type"); !strings.HasPrefix(h, "text/html") {
+				t.Errorf("expected an HTML page, got %q", h)
+			}
+			// The clients embed the iframe from their own origin.
+			if h := res.Header.Get("X-Frame-Options"); h != "" {
+				t.Errorf("expected the iframe to be embeddable, got X-Frame-Options %q", h)
+			}
+		},
+	}
+	scenario.Test(t)
+}
+
+func TestCheckSession_SessionState(t *testing.T) {
+	f := newTestFixture(t)
+
+	res := authorizeTestBrowserRequest(t, f.App, f.Mux, nil, nil)
+	cookie := getTestBrowserSessionCookie(t, res)
+	browserState := getTestBrowserStateCookie(t, res)
+	if browserState.HttpOnly || browserState.Value == "" {
+		t.Fatalf("expected a browser state readable by the iframe, got %v", browserState)
+	}
+
+	// The session_state is bound to the client, the origin of its redirect
+	// URI and the browser state.
+	location, _ := res.Location()
+	sessionState := location.Query().Get("session_state")
+	if !checkTestSessionState(t, sessionState, "http://localhost:8090", browserState.Value) {
+		t.Errorf("session_state %q doesn't match the browser state", sessionState)
+	}
+	if checkTestSessionState(t, sessionState, "http://localhost:3000", browserState.Value) {
+		t.Error("expected the session_state not to match another origin")
+	}
+
+	// Signing in to the client again doesn't change the browser state.
+	res = authorizeTestBrowserRequest(t, f.App, f.Mux, url.Values{"prompt": {"none"}}, cookie)
+	if got := getTestBrowserStateCookie(t, res); got.Value != browserState.Value {
+		t.Errorf("expected the browser state to stay the same, got %q", got.Value)
+	}
+
+	// Logging out clears the browser state.
+	challenge := startTestLogout(t, f.Mux, url.Values{"client_id": {testClientID}})
+	r := doTestRequest(t, f.Mux, http.MethodPost, "/oauth2/auth/requests/logout/accept?logout_challenge="+url.QueryEscape(challenge), nil, map[string]string{
+		"Cookie": getTestBrowserSessionCookie(t, res).String(),
+	})
+	if got := getTestBrowserStateCookie(t, r); got.MaxAge >= 0 {
+		t.Errorf("expected the browser state cookie to be expired, got %v", got)
+	}
+}
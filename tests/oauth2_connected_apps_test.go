@@ -0,0 +1,194 @@
+package oauth2
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/benjamesfleming/pocketbase-ext-oauth2/consts"
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/tests"
+)
+
+// grantTestConnectedApp signs the test user in to the test client, and
+// authorizes the scenario request with the user's PocketBase auth token.
+func grantTestConnectedApp(t testing.TB, f *testFixture, params url.Values) map[string]any {
+	t.Helper()
+	res := exchangeTestCode(t, f.Mux, authorizeTestUser(t, f.App, f.Mux, params), nil)
+	f.setScenarioHeader("Authorization", generateTestUserToken(t, f.App))
+	return res
+}
+
+func TestConnectedApps_List(t *testing.T) {
+	scenarios := []tests.ApiScenario{
+		{
+			Name:            "no connected apps",
+			Method:          http.MethodGet,
+			URL:             "/oauth2/connected-apps",
+			ExpectedStatus:  200,
+			ExpectedContent: []string{"[]"},
+			TestAppFactory: newTestScenarioApp(func(t testing.TB, f *testFixture) {
+				f.setScenarioHeader("Authorization", generateTestUserToken(t, f.App))
+			}),
+		},
+		{
+			Name:           "granted client",
+			Method:         http.MethodGet,
+			URL:            "/oauth2/connected-apps",
+			ExpectedStatus: 200,
+			ExpectedContent: []string{
+				`"client_id":"` + testClientID + `"`,
+				`"client_name":"` + testClientName + `"`,
+				`"scopes":["openid","profile"]`,
+				`"signed_in":false`,
+			},
+			NotExpectedContent: []string{`"last_used_at":""`},
+			TestAppFactory: newTestScenarioApp(func(t testing.TB, f *testFixture) {
+				grantTestConnectedApp(t, f, url.Values{"scope": {"openid profile"}})
+			}),
+		},
+		{
+			Name:           "without auth",
+			Method:         http.MethodGet,
+			URL:            "/oauth2/connected-apps",
+			ExpectedStatus: 401,
+			ExpectedContent: []string{
+				`"status":401`,
+			},
+			TestAppFactory: newTestScenarioApp(nil),
+		},
+	}
+	for _, scenario := range scenarios {
+		scenario.Test(t)
+	}
+}
+
+func TestConnectedApps_Revoke(t *testing.T) {
+	var f *testFixture
+	var accessToken string
+	scenario := tests.ApiScenario{
+		Method:         http.MethodDelete,
+		URL:            "/oauth2/connected-apps/" + testClientID,
+		ExpectedStatus: 204,
+		TestAppFactory: newTestScenarioApp(func(t testing.TB, fixture *testFixture) {
+			f = fixture
+			accessToken, _ = grantTestConnectedApp(t, f, nil)["access_token"].(string)
+		}),
+		AfterTestFunc: func(t testing.TB, app *tests.TestApp, res *http.Response) {
+			for _, collection := range []string{consts.AccessCollectionName, consts.RefreshCollectionName, consts.ConsentCollectionName} {
+				if n, _ := app.CountRecords(collection, dbx.HashExp{"client_id": testClientID}); n != 0 {
+					t.Errorf("expected no records in %s, got %d", collection, n)
+				}
+			}
+
+			// The revoked access token is no longer active.
+			introspection := decodeTestJSONResponse(t, doTestRequest(t, f.Mux, http.MethodPost, "/oauth2/introspect", url.Values{
+				"token": {accessToken},
+			}, map[string]string{
+				"Authorization": "Basic " + base64.StdEncoding.EncodeToString([]byte(testClientID+":"+testClientSecret)),
+			}))
+			if introspection["active"] != false {
+				t.Errorf("expected revoked token to be inactive, got %v", introspection)
+			}
+		},
+	}
+	scenario.Test(t)
+}
+
+func TestConnectedApps_RejectsAccessTokens(t *testing.T) {
+	withAccessToken := newTestScenarioApp(func(t testing.TB, f *testFixture) {
+		res := exchangeTestCode(t, f.Mux, authorizeTestUser(t, f.App, f.Mux, nil), nil)
+		token, _ := res["access_token"].(string)
+		f.setScenarioHeader("Authorization", "Bearer "+token)
+	})
+	// The access token is rejected even once its session is gone.
+	withDeletedSession := newTestScenarioApp(func(t testing.TB, f *testFixture) {
+		res := exchangeTestCode(t, f.Mux, authorizeTestUser(t, f.App, f.Mux, nil), nil)
+		token, _ := res["access_token"].(string)
+		if _, err := f.App.DB().Delete(consts.AccessCollectionName, nil).Execute(); err != nil {
+			t.Fatal(err)
+		}
+		f.setScenarioHeader("Authorization", "Bearer "+token)
+	})
+	scenarios := []tests.ApiScenario{
+		{
+			Name:            "list",
+			Method:          http.MethodGet,
+			URL:             "/oauth2/connected-apps",
+			ExpectedStatus:  403,
+			ExpectedContent: []string{`"status":403`},
+			TestAppFactory:  withAccessToken,
+		},
+		{
+			Name:            "revoke",
+			Method:          http.MethodDelete,
+			URL:             "/oauth2/connected-apps/" + testClientID,
+			ExpectedStatus:  403,
+			ExpectedContent: []string{`"status":403`},
+			TestAppFactory:  withAccessToken,
+		},
+		{
+			Name:            "without session",
+			Method:          http.MethodGet,
+			URL:             "/oauth2/connected-apps",
+			ExpectedStatus:  403,
+			ExpectedContent: []string{`"status":403`},
+			TestAppFactory:  withDeletedSession,
+		},
+	}
+	for _, scenario := range scenarios {
+		scenario.Test(t)
+	}
+}
+
+func TestConnectedApps_UIRedirect(t *testing.T) {
+	var f *testFixture
+	scenario := tests.ApiScenario{
+		Method:         http.MethodGet,
+		URL:            "/oauth2/apps",
+		ExpectedStatus: 307,
+		TestAppFactory: newTestScenarioApp(func(t testing.TB, fixture *testFixture) {
+			f = fixture
+		}),
+		AfterTestFunc: func(t testing.TB, app *tests.TestApp, res *http.Response) {
+			location, err := res.Location()
+			if err != nil {
+				t.Fatal(err)
+			}
+			state := decodeTestLoginState(t, f.Mux, location)
+			if state["mode"] != "connected-apps" || state["collection"] != testUserCollection {
+				t.Errorf("unexpected login state %v", state)
+			}
+			if r := doTestRequest(t, f.Mux, http.MethodGet, location.RequestURI(), nil, nil); r.StatusCode != http.StatusOK {
+				t.Errorf("expected the login UI to accept the signed state, got status %d", r.StatusCode)
+			}
+		},
+	}
+	scenario.Test(t)
+}
+
+func TestConnectedApps_UIRejectsForgedState(t *testing.T) {
+	state := base64.RawURLEncoding.EncodeToString([]byte(`{"mode":"connected-apps","collection":"users","connected_apps_path":"https://attacker.example.com"}`))
+	scenarios := []tests.ApiScenario{
+		{
+			Name:            "unsigned",
+			Method:          http.MethodGet,
+			URL:             "/oauth2/login?state=" + state,
+			ExpectedStatus:  400,
+			ExpectedContent: []string{`"The state is invalid."`},
+			TestAppFactory:  newTestScenarioApp(nil),
+		},
+		{
+			Name:            "bad signature",
+			Method:          http.MethodGet,
+			URL:             "/oauth2/login?state=" + state + ".invalid",
+			ExpectedStatus:  400,
+			ExpectedContent: []string{`"The state is invalid."`},
+			TestAppFactory:  newTestScenarioApp(nil),
+		},
+	}
+	for _, scenario := range scenarios {
+		scenario.Test(t)
+	}
+}
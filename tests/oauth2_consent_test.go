@@ -0,0 +1,171 @@
+package oauth2
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/benjamesfleming/pocketbase-ext-oauth2/consts"
+	"github.com/pocketbase/pocketbase/core"
+)
+
+// assertConsentRedirect checks that the location is the login UI asking the
+// user for consent.
+func assertConsentRedirect(t testing.TB, mux http.Handler, location *url.URL, user *core.Record) {
+	t.Helper()
+	if !strings.HasSuffix(location.Path, "/login") || location.Query().Get("consent_challenge") == "" {
+		t.Fatalf("expected redirect to the consent screen, got %q", location.String())
+	}
+	if state := decodeTestLoginState(t, mux, location); state["consent_subject"] != user.Id {
+		t.Errorf("consent_subject = %v, want %q", state["consent_subject"], user.Id)
+	}
+}
+
+func TestConsent_RequiredWithoutGrant(t *testing.T) {
+	f := newTestFixture(t)
+
+	location := authorizeTestRequest(t, f.App, f.Mux, nil)
+	assertConsentRedirect(t, f.Mux, location, f.User)
+}
+
+func TestConsent_GrantedIsPersisted(t *testing.T) {
+	f := newTestFixture(t)
+
+	authorizeTestUser(t, f.App, f.Mux, nil)
+
+	record, err := f.App.FindFirstRecordByData(consts.ConsentCollectionName, "subject", f.User.Id)
+	if err != nil {
+		t.Fatalf("expected consent grant to be stored: %v", err)
+	}
+	if record.GetString("client_id") != testClientID {
+		t.Errorf("client_id = %q, want %q", record.GetString("client_id"), testClientID)
+	}
+	if record.GetString("scopes") != "openid|profile|email" {
+		t.Errorf("scopes = %q, want %q", record.GetString("scopes"), "openid|profile|email")
+	}
+	if record.GetInt("expires_at") <= int(time.Now().Unix()) {
+		t.Errorf("expected consent grant to expire in the future, got %d", record.GetInt("expires_at"))
+	}
+}
+
+func TestConsent_SkippedOnReuse(t *testing.T) {
+	f := newTestFixture(t)
+
+	authorizeTestUser(t, f.App, f.Mux, nil)
+
+	location := authorizeTestRequest(t, f.App, f.Mux, url.Values{"scope": {"openid email"}})
+	if location.Query().Get("code") == "" {
+		t.Errorf("expected consent to be skipped, got redirect %q", location.String())
+	}
+}
+
+func TestConsent_RequiredForNewScopes(t *testing.T) {
+	f := newTestFixture(t)
+
+	authorizeTestUser(t, f.App, f.Mux, url.Values{"scope": {"openid"}})
+
+	location := authorizeTestRequest(t, f.App, f.Mux, url.Values{"scope": {"openid profile"}})
+	assertConsentRedirect(t, f.Mux, location, f.User)
+}
+
+func TestConsent_RequiredWhenExpired(t *testing.T) {
+	f := newTestFixture(t)
+
+	authorizeTestUser(t, f.App, f.Mux, nil)
+
+	record, err := f.App.FindFirstRecordByData(consts.ConsentCollectionName, "subject", f.User.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	record.Set("expires_at", time.Now().Add(-time.Minute).Unix())
+	if err := f.App.Save(record); err != nil {
+		t.Fatal(err)
+	}
+
+	location := authorizeTestRequest(t, f.App, f.Mux, nil)
+	assertConsentRedirect(t, f.Mux, location, f.User)
+}
+
+func TestConsent_PromptConsent(t *testing.T) {
+	f := newTestFixture(t)
+
+	authorizeTestUser(t, f.App, f.Mux, nil)
+
+	location := authorizeTestRequest(t, f.App, f.Mux, url.Values{"prompt": {"consent"}})
+	assertConsentRedirect(t, f.Mux, location, f.User)
+
+	// Submitting the consent screen completes the request.
+	location = authorizeTestRequest(t, f.App, f.Mux, url.Values{"prompt": {"consent"}, "consent": {"granted"}})
+	if location.Query().Get("code") == "" {
+		t.Errorf("expected authorization code after consent, got redirect %q", location.String())
+	}
+}
+
+func TestConsent_PromptNone(t *testing.T) {
+	f := newTestFixture(t)
+
+	// Log the user in to a browser session, without a consent grant.
+	cookie := getTestBrowserSessionCookie(t, authorizeTestBrowserRequest(t, f.App, f.Mux, nil, nil))
+	if _, err := f.App.DB().Delete(consts.ConsentCollectionName, nil).Execute(); err != nil {
+		t.Fatal(err)
+	}
+
+	location, _ := authorizeTestBrowserRequest(t, f.App, f.Mux, url.Values{"prompt": {"none"}}, cookie).Location()
+	assertTestAuthorizeError(t, location, "consent_required")
+
+	authorizeTestUser(t, f.App, f.Mux, nil)
+
+	location, _ = authorizeTestBrowserRequest(t, f.App, f.Mux, url.Values{"prompt": {"none"}}, cookie).Location()
+	if location.Query().Get("code") == "" {
+		t.Errorf("expected authorization code with an existing grant, got redirect %q", location.String())
+	}
+}
+
+func TestConsent_OptionalScopesState(t *testing.T) {
+	f := newTestFixture(t, withTestClient(map[string]any{"optional_scopes": "openid email"}))
+
+	location := authorizeTestRequest(t, f.App, f.Mux, nil)
+	assertConsentRedirect(t, f.Mux, location, f.User)
+
+	// The openid scope is always required.
+	optional, _ := decodeTestLoginState(t, f.Mux, location)["optional_scopes"].([]any)
+	if len(optional) != 1 || optional[0] != "email" {
+		t.Errorf("optional_scopes = %v, want [email]", optional)
+	}
+}
+
+func TestConsent_GrantsOnlyApprovedScopes(t *testing.T) {
+	f := newTestFixture(t, withTestClient(map[string]any{"optional_scopes": "profile email"}))
+
+	// The user deselects the optional email scope, and tries to deselect the
+	// required openid scope.
+	code := authorizeTestUser(t, f.App, f.Mux, url.Values{"granted_scopes": {"profile"}})
+	res := exchangeTestCode(t, f.Mux, code, nil)
+	if res["scope"] != "openid profile" {
+		t.Errorf("scope = %v, want %q", res["scope"], "openid profile")
+	}
+
+	record, err := f.App.FindFirstRecordByData(consts.ConsentCollectionName, "subject", f.User.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.GetString("scopes") != "openid|profile" {
+		t.Errorf("consent scopes = %q, want %q", record.GetString("scopes"), "openid|profile")
+	}
+
+	// The deselected scope requires consent again.
+	location := authorizeTestRequest(t, f.App, f.Mux, nil)
+	assertConsentRedirect(t, f.Mux, location, f.User)
+}
+
+func TestConsent_GrantsAllScopesWithoutSelection(t *testing.T) {
+	f := newTestFixture(t, withTestClient(map[string]any{"optional_scopes": "profile email"}))
+
+	code := authorizeTestUser(t, f.App, f.Mux, nil)
+	res := exchangeTestCode(t, f.Mux, code, nil)
+	if res["scope"] != "openid profile email" {
+		t.Errorf("scope = %v, want %q", res["scope"], "openid profile email")
+	}
+}
@@ -1,10 +1,14 @@
 package oauth2
 
 import (
+	"context"
 	"net/http"
+	"net/url"
 	"strings"
 	"testing"
 
+	oauth2 "github.com/benjamesfleming/pocketbase-ext-oauth2"
+	"github.com/ory/fosite"
 	"github.com/pocketbase/pocketbase/core"
 	"github.com/pocketbase/pocketbase/tests"
 )
@@ -212,6 +216,87 @@ func TestUserInfoEndpoint_WithAuth(t *testing.T) {
 	scenario.Test(t)
 }
 
+func TestUserInfoEndpoint_DefaultStrategyGrantedScopes(t *testing.T) {
+	withDefaultStrategy := withTestConfig(func(cfg *oauth2.Config) {
+		cfg.UserInfoClaimStrategy = &oauth2.DefaultUserInfoClaimStrategy{}
+	})
+
+	scenarios := []tests.ApiScenario{
+		{
+			Name:               "userinfo - access token releases the claims of the granted scopes",
+			Method:             http.MethodGet,
+			URL:                "/oauth2/userinfo",
+			ExpectedStatus:     200,
+			ExpectedContent:    []string{`"sub":"` + testUserID + `"`, `"email":"` + testUserEmail + `"`},
+			NotExpectedContent: []string{`"name"`},
+			TestAppFactory: newTestScenarioApp(func(t testing.TB, f *testFixture) {
+				code := authorizeTestUser(t, f.App, f.Mux, url.Values{"scope": {"openid email"}})
+				token, _ := exchangeTestCode(t, f.Mux, code, nil)["access_token"].(string)
+				f.setScenarioHeader("Authorization", "Bearer "+token)
+			}, withDefaultStrategy),
+		},
+		{
+			Name:            "userinfo - PocketBase auth token releases all the claims",
+			Method:          http.MethodGet,
+			URL:             "/oauth2/userinfo",
+			ExpectedStatus:  200,
+			ExpectedContent: []string{`"email":"` + testUserEmail + `"`, `"name":"Test User"`},
+			TestAppFactory: newTestScenarioApp(func(t testing.TB, f *testFixture) {
+				f.setScenarioHeader("Authorization", generateTestUserToken(t, f.App))
+			}, withDefaultStrategy),
+		},
+	}
+	for _, scenario := range scenarios {
+		scenario.Test(t)
+	}
+}
+
+func TestUserInfoEndpoint_GrantedScopes(t *testing.T) {
+	var token string
+
+	scenario := tests.ApiScenario{
+		Name:   "userinfo - releases claims for the granted scopes only",
+		Method: http.MethodGet,
+		URL:    "/oauth2/userinfo",
+		TestAppFactory: func(t testing.TB) *tests.TestApp {
+			return setupTestAppForScenario(t)
+		},
+		BeforeTestFunc: func(t testing.TB, app *tests.TestApp, e *core.ServeEvent) {
+			seedTestClient(t, app)
+			user := seedTestUser(t, app)
+
+			var err error
+			token, err = user.NewStaticAuthToken(0)
+			if err != nil {
+				t.Fatalf("failed to generate auth token: %v", err)
+			}
+
+			req := newTestRequest(testClientID)
+			req.GrantedScope = fosite.Arguments{"openid", "email"}
+			req.GrantedAudience = nil
+			req.Session.(*oauth2.Session).Subject = user.Id
+
+			signature := (&oauth2.PocketBaseStrategy{}).AccessTokenSignature(context.Background(), token)
+			if err := oauth2.NewOAuth2Store(app).CreateAccessTokenSession(context.Background(), signature, req); err != nil {
+				t.Fatalf("CreateAccessTokenSession failed: %v", err)
+			}
+		},
+		ExpectedStatus:     200,
+		ExpectedContent:    []string{`"sub"`, `"email":"` + testUserEmail + `"`},
+		NotExpectedContent: []string{`"name"`},
+	}
+
+	// The token is only known once the user has been seeded, so the headers
+	// are filled in lazily.
+	beforeTestFunc := scenario.BeforeTestFunc
+	scenario.BeforeTestFunc = func(t testing.TB, app *tests.TestApp, e *core.ServeEvent) {
+		beforeTestFunc(t, app, e)
+		scenario.Headers = map[string]string{"Authorization": "Bearer " + token}
+	}
+
+	scenario.Test(t)
+}
+
 func TestRegisterEndpoint_ValidMetadata(t *testing.T) {
 	scenario := tests.ApiScenario{
 		Name:   "register - valid client metadata (RFC 7591)",
@@ -0,0 +1,119 @@
+package oauth2
+
+import (
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/pocketbase/pocketbase/tests"
+)
+
+const testFrontChannelLogoutURI = "http://localhost:8090/frontchannel-logout"
+
+// withTestFrontChannelLogout registers the front-channel logout URI of the
+// test client.
+func withTestFrontChannelLogout(sessionRequired bool) testFixtureOption {
+	return withTestClient(map[string]any{
+		"frontchannel_logout_uri":              testFrontChannelLogoutURI,
+		"frontchannel_logout_session_required": sessionRequired,
+	})
+}
+
+// acceptTestFrontChannelLogout accepts the logout challenge, with the browser
+// session cookie if set, and returns the front-channel logout URIs the login
+// UI has to render.
+func acceptTestFrontChannelLogout(t testing.TB, mux http.Handler, challenge string, cookie *http.Cookie) []any {
+	t.Helper()
+	r := doTestLogoutAccept(t, mux, challenge, cookie)
+	res := decodeTestJSONResponse(t, r)
+	if r.StatusCode != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %v", r.StatusCode, res)
+	}
+	uris, ok := res["frontchannel_logout_uris"].([]any)
+	if !ok {
+		t.Fatalf("expected frontchannel_logout_uris, got %v", res)
+	}
+	return uris
+}
+
+func TestFrontChannelLogout_Discovery(t *testing.T) {
+	scenario := tests.ApiScenario{
+		Method:          http.MethodGet,
+		URL:             "/.well-known/openid-configuration",
+		ExpectedStatus:  200,
+		ExpectedContent: []string{`"frontchannel_logout_supported":true`},
+		TestAppFactory:  newTestScenarioApp(nil, withTestFrontChannelLogout(false)),
+	}
+	scenario.Test(t)
+}
+
+func TestFrontChannelLogout_Logout(t *testing.T) {
+	f := newTestFixture(t, withTestFrontChannelLogout(false))
+
+	cookie, res := loginTestBrowser(t, f, nil)
+	idToken, _ := res["id_token"].(string)
+	forgetTestBrowserSessionClients(t, f.App)
+	uris := acceptTestFrontChannelLogout(t, f.Mux, startTestLogout(t, f.Mux, url.Values{"id_token_hint": {idToken}}), cookie)
+
+	// The user didn't sign in to the client during the browser session, so
+	// neither iss nor sid are passed.
+	if !slices.Equal(uris, []any{testFrontChannelLogoutURI}) {
+		t.Errorf("frontchannel_logout_uris = %v, want [%s]", uris, testFrontChannelLogoutURI)
+	}
+}
+
+func TestFrontChannelLogout_SessionRequired(t *testing.T) {
+	f := newTestFixture(t, withTestFrontChannelLogout(true))
+
+	cookie, res := loginTestBrowser(t, f, nil)
+	idToken, _ := res["id_token"].(string)
+	forgetTestBrowserSessionClients(t, f.App)
+	if uris := acceptTestFrontChannelLogout(t, f.Mux, startTestLogout(t, f.Mux, url.Values{"id_token_hint": {idToken}}), cookie); len(uris) != 0 {
+		t.Errorf("expected no front-channel logout without a sid, got %v", uris)
+	}
+}
+
+func TestFrontChannelLogout_WithoutIDTokenHint(t *testing.T) {
+	f := newTestFixture(t, withTestFrontChannelLogout(false))
+
+	exchangeTestCode(t, f.Mux, authorizeTestUser(t, f.App, f.Mux, nil), nil)
+	if uris := acceptTestFrontChannelLogout(t, f.Mux, startTestLogout(t, f.Mux, url.Values{"client_id": {testClientID}}), nil); len(uris) != 0 {
+		t.Errorf("expected no front-channel logout without a known user, got %v", uris)
+	}
+}
+
+func TestFrontChannelLogout_UnsafeURI(t *testing.T) {
+	f := newTestFixture(t, withTestClient(map[string]any{
+		"frontchannel_logout_uri": "javascript:alert(1)",
+	}))
+
+	cookie, res := loginTestBrowser(t, f, nil)
+	idToken, _ := res["id_token"].(string)
+	if uris := acceptTestFrontChannelLogout(t, f.Mux, startTestLogout(t, f.Mux, url.Values{"id_token_hint": {idToken}}), cookie); len(uris) != 0 {
+		t.Errorf("expected the unsafe front-channel logout URI to be left out, got %v", uris)
+	}
+}
+
+func TestFrontChannelLogout_RegisterUnsafeURI(t *testing.T) {
+	scenario := tests.ApiScenario{
+		Name:   "register - javascript frontchannel_logout_uri",
+		Method: http.MethodPost,
+		URL:    "/oauth2/register",
+		Body: strings.NewReader(`{
+			"client_name": "Bad Client",
+			"redirect_uris": ["http://localhost:3000/callback"],
+			"frontchannel_logout_uri": "javascript:alert(1)"
+		}`),
+		Headers: map[string]string{
+			"Content-Type": "application/json",
+		},
+		ExpectedStatus:  400,
+		ExpectedContent: []string{`"error":"invalid_client_metadata"`},
+		TestAppFactory: func(t testing.TB) *tests.TestApp {
+			return setupTestAppForScenario(t)
+		},
+	}
+	scenario.Test(t)
+}
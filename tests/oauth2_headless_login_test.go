@@ -0,0 +1,150 @@
+package oauth2
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	oauth2 "github.com/benjamesfleming/pocketbase-ext-oauth2"
+	"github.com/benjamesfleming/pocketbase-ext-oauth2/consts"
+)
+
+const testLoginURL = "https://login.example.com/signin?theme=dark"
+
+// withTestLoginURL configures the external login URL.
+func withTestLoginURL() testFixtureOption {
+	return withTestConfig(func(cfg *oauth2.Config) {
+		cfg.LoginURL = testLoginURL
+	})
+}
+
+// startTestHeadlessLogin starts an authorization request and returns the
+// login challenge passed to the external login URL.
+func startTestHeadlessLogin(t testing.TB, mux http.Handler) string {
+	t.Helper()
+	r := doTestRequest(t, mux, http.MethodGet, "/oauth2/auth?"+url.Values{
+		"response_type": {"code"},
+		"client_id":     {testClientID},
+		"redirect_uri":  {testRedirectURI},
+		"scope":         {"openid profile email"},
+		"state":         {"teststate1234"},
+	}.Encode(), nil, nil)
+	location, err := r.Location()
+	if err != nil {
+		t.Fatalf("expected login redirect, got status %d", r.StatusCode)
+	}
+	if location.Host != "login.example.com" || location.Path != "/signin" || location.Query().Get("theme") != "dark" {
+		t.Fatalf("expected redirect to the external login URL, got %q", location.String())
+	}
+	return location.Query().Get("login_challenge")
+}
+
+func TestHeadlessLogin_Details(t *testing.T) {
+	f := newTestFixture(t, withTestLoginURL())
+
+	challenge := startTestHeadlessLogin(t, f.Mux)
+	r := doTestRequest(t, f.Mux, http.MethodGet, "/oauth2/auth/requests/login?"+url.Values{"login_challenge": {challenge}}.Encode(), nil, map[string]string{
+		"Authorization": generateTestSuperuserToken(t, f.App),
+	})
+	if r.StatusCode != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", r.StatusCode)
+	}
+	details := decodeTestJSONResponse(t, r)
+	if details["challenge"] != challenge || details["client_id"] != testClientID {
+		t.Errorf("unexpected login request details %v", details)
+	}
+	if requestURL, _ := details["request_url"].(string); !strings.Contains(requestURL, "/oauth2/auth?") {
+		t.Errorf("unexpected request_url %v", details["request_url"])
+	}
+}
+
+func TestHeadlessLogin_AcceptLoginAndConsent(t *testing.T) {
+	f := newTestFixture(t, withTestLoginURL())
+
+	token := generateTestSuperuserToken(t, f.App)
+	location := resolveTestLoginChallenge(t, f.Mux, "login", startTestHeadlessLogin(t, f.Mux), "accept", url.Values{
+		"subject":  {f.User.Id},
+		"remember": {"true"},
+		"acr":      {"urn:example:mfa"},
+		"amr":      {"pwd", "otp"},
+	}, token)
+	if location.Host != "login.example.com" || location.Query().Get("consent_challenge") == "" {
+		t.Fatalf("expected redirect to the external consent screen, got %q", location.String())
+	}
+	location = resolveTestLoginChallenge(t, f.Mux, "consent", location.Query().Get("consent_challenge"), "accept", url.Values{
+		"granted_scopes": {"openid", "profile"},
+		"remember":       {"false"},
+	}, token)
+
+	code := location.Query().Get("code")
+	if code == "" {
+		t.Fatalf("expected authorization code, got %q", location.String())
+	}
+	res := exchangeTestCode(t, f.Mux, code, nil)
+	if res["scope"] != "openid profile" {
+		t.Errorf("scope = %v, want %q", res["scope"], "openid profile")
+	}
+	claims := decodeTestJWTClaims(t, res["id_token"].(string))
+	if claims["sub"] != f.User.Id || claims["acr"] != "urn:example:mfa" {
+		t.Errorf("unexpected id token claims %v", claims)
+	}
+	if amr, _ := claims["amr"].([]any); len(amr) != 2 || amr[0] != "pwd" || amr[1] != "otp" {
+		t.Errorf("amr = %v, want [pwd otp]", claims["amr"])
+	}
+
+	// The consent was not remembered.
+	if n, _ := f.App.CountRecords(consts.ConsentCollectionName); n != 0 {
+		t.Errorf("expected no stored consent grants, got %d", n)
+	}
+}
+
+func TestHeadlessLogin_AcceptLoginRequiresSubject(t *testing.T) {
+	f := newTestFixture(t, withTestLoginURL())
+
+	challenge := startTestHeadlessLogin(t, f.Mux)
+	target := "/oauth2/auth/requests/login/accept?" + url.Values{"login_challenge": {challenge}}.Encode()
+	for name, form := range map[string]url.Values{
+		"missing subject": {},
+		"unknown subject": {"subject": {"unknown"}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			r := doTestRequest(t, f.Mux, http.MethodPost, target, form, map[string]string{
+				"Authorization": generateTestSuperuserToken(t, f.App),
+			})
+			if r.StatusCode != http.StatusBadRequest {
+				t.Errorf("expected status 400, got %d", r.StatusCode)
+			}
+		})
+	}
+}
+
+func TestHeadlessLogin_UserCannotSetACR(t *testing.T) {
+	f := newTestFixture(t, withTestLoginURL())
+
+	location := resolveTestLoginChallenge(t, f.Mux, "login", startTestHeadlessLogin(t, f.Mux), "accept", url.Values{
+		"acr": {"urn:example:mfa"},
+		"amr": {"hwk"},
+	}, generateTestUserToken(t, f.App))
+	location = resolveTestLoginChallenge(t, f.Mux, "consent", location.Query().Get("consent_challenge"), "accept", nil, generateTestUserToken(t, f.App))
+
+	res := exchangeTestCode(t, f.Mux, location.Query().Get("code"), nil)
+	if claims := decodeTestJWTClaims(t, res["id_token"].(string)); claims["acr"] == "urn:example:mfa" {
+		t.Errorf("expected the user's acr to be ignored, got %v", claims["acr"])
+	}
+}
+
+func TestHeadlessLogin_RejectWithDescription(t *testing.T) {
+	f := newTestFixture(t, withTestLoginURL())
+
+	location := resolveTestLoginChallenge(t, f.Mux, "login", startTestHeadlessLogin(t, f.Mux), "reject", url.Values{
+		"error":             {"access_denied"},
+		"error_description": {"The account is locked."},
+	}, generateTestSuperuserToken(t, f.App))
+	if got := location.Query().Get("error"); got != "access_denied" {
+		t.Errorf("error = %q, want %q", got, "access_denied")
+	}
+	if got := location.Query().Get("error_description"); !strings.Contains(got, "The account is locked.") {
+		t.Errorf("error_description = %q, want it to contain the rejection reason", got)
+	}
+}
@@ -0,0 +1,121 @@
+package oauth2
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	oauth2 "github.com/benjamesfleming/pocketbase-ext-oauth2"
+)
+
+// signTestIDTokenHint signs an ID token with the provider's key, for use as an
+// id_token_hint.
+func signTestIDTokenHint(t testing.TB, claims map[string]any) string {
+	t.Helper()
+	token, err := oauth2.NewAggregatedClaimsJWT(context.Background(), claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestIDTokenHint_PromptNone(t *testing.T) {
+	f := newTestFixture(t)
+
+	r := authorizeTestBrowserRequest(t, f.App, f.Mux, nil, nil)
+	res := exchangeTestCode(t, f.Mux, getTestAuthorizationCode(t, r), nil)
+	idToken, _ := res["id_token"].(string)
+	if idToken == "" {
+		t.Fatalf("expected id token, got %v", res)
+	}
+
+	r = authorizeTestBrowserRequest(t, f.App, f.Mux, url.Values{"prompt": {"none"}, "id_token_hint": {idToken}}, getTestBrowserSessionCookie(t, r))
+	getTestAuthorizationCode(t, r)
+}
+
+func TestIDTokenHint_AcceptsExpiredToken(t *testing.T) {
+	f := newTestFixture(t)
+
+	hint := signTestIDTokenHint(t, map[string]any{
+		"sub": f.User.Id,
+		"aud": []string{testClientID},
+		"exp": time.Now().Add(-time.Hour).Unix(),
+	})
+	location := authorizeTestRequest(t, f.App, f.Mux, url.Values{"id_token_hint": {hint}, "consent": {"granted"}})
+	if location.Query().Get("code") == "" {
+		t.Errorf("expected authorization code, got %q", location.String())
+	}
+}
+
+func TestIDTokenHint_SubjectMismatch(t *testing.T) {
+	f := newTestFixture(t)
+
+	hint := signTestIDTokenHint(t, map[string]any{
+		"sub": "someoneelse1234",
+		"aud": []string{testClientID},
+		"exp": time.Now().Add(time.Hour).Unix(),
+	})
+	for _, prompt := range []string{"", "none"} {
+		location := authorizeTestRequest(t, f.App, f.Mux, url.Values{"prompt": {prompt}, "id_token_hint": {hint}, "consent": {"granted"}})
+		assertTestAuthorizeError(t, location, "login_required")
+	}
+}
+
+func TestIDTokenHint_Invalid(t *testing.T) {
+	f := newTestFixture(t)
+
+	valid := signTestIDTokenHint(t, map[string]any{
+		"sub": f.User.Id,
+		"aud": []string{testClientID},
+		"exp": time.Now().Add(time.Hour).Unix(),
+	})
+	for name, hint := range map[string]string{
+		"malformed":      "not-a-jwt",
+		"bad signature":  valid[:len(valid)-4] + "AAAA",
+		"wrong audience": signTestIDTokenHint(t, map[string]any{"sub": f.User.Id, "aud": []string{"other-client"}}),
+		"no subject":     signTestIDTokenHint(t, map[string]any{"aud": []string{testClientID}}),
+	} {
+		t.Run(name, func(t *testing.T) {
+			r := doTestRequest(t, f.Mux, http.MethodGet, "/oauth2/auth?"+url.Values{
+				"response_type": {"code"},
+				"client_id":     {testClientID},
+				"redirect_uri":  {testRedirectURI},
+				"scope":         {"openid"},
+				"state":         {"teststate1234"},
+				"id_token_hint": {hint},
+			}.Encode(), nil, nil)
+			location, err := r.Location()
+			if err != nil {
+				t.Fatalf("expected error redirect, got status %d", r.StatusCode)
+			}
+			assertTestAuthorizeError(t, location, "invalid_request")
+		})
+	}
+}
+
+func TestIDTokenHint_LoginChallengeState(t *testing.T) {
+	f := newTestFixture(t)
+
+	hint := signTestIDTokenHint(t, map[string]any{
+		"sub": f.User.Id,
+		"aud": testClientID,
+		"exp": time.Now().Add(time.Hour).Unix(),
+	})
+	challenge := startTestLoginChallenge(t, f.Mux, url.Values{"id_token_hint": {hint}})
+	state := decodeTestLoginState(t, f.Mux, &url.URL{RawQuery: url.Values{"login_challenge": {challenge}}.Encode()})
+	if state["id_token_hint_subject"] != f.User.Id {
+		t.Errorf("id_token_hint_subject = %v, want %q", state["id_token_hint_subject"], f.User.Id)
+	}
+}
+
+func TestIDTokenHint_AccountSelectionRequired(t *testing.T) {
+	f := newTestFixture(t)
+
+	challenge := startTestLoginChallenge(t, f.Mux, nil)
+	location := resolveTestLoginChallenge(t, f.Mux, "login", challenge, "reject", url.Values{"error": {"account_selection_required"}}, "")
+	if got := location.Query().Get("error"); got != "account_selection_required" {
+		t.Errorf("error = %q, want %q", got, "account_selection_required")
+	}
+}
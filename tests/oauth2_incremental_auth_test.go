@@ -0,0 +1,72 @@
+package oauth2
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestIncrementalAuth_IncludeGrantedScopes(t *testing.T) {
+	f := newTestFixture(t, withTestClient(map[string]any{"scope": "openid profile email offline_access"}))
+
+	code := authorizeTestUser(t, f.App, f.Mux, url.Values{"scope": {"openid offline_access"}})
+	exchangeTestCode(t, f.Mux, code, nil)
+
+	code = authorizeTestUser(t, f.App, f.Mux, url.Values{
+		"scope":                  {"openid profile"},
+		"include_granted_scopes": {"true"},
+	})
+	res := exchangeTestCode(t, f.Mux, code, nil)
+	if res["scope"] != "openid profile offline_access" {
+		t.Fatalf("scope = %v, want %q", res["scope"], "openid profile offline_access")
+	}
+
+	// The refresh token covers the combined set of scopes.
+	refreshToken, _ := res["refresh_token"].(string)
+	if refreshToken == "" {
+		t.Fatalf("expected refresh token in response, got %v", res)
+	}
+	res = decodeTestJSONResponse(t, doTestRequest(t, f.Mux, http.MethodPost, "/oauth2/token", url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {refreshToken},
+		"client_id":     {testClientID},
+		"client_secret": {testClientSecret},
+	}, nil))
+	if res["scope"] != "openid profile offline_access" {
+		t.Errorf("refreshed scope = %v, want %q", res["scope"], "openid profile offline_access")
+	}
+}
+
+func TestIncrementalAuth_WithoutIncludeGrantedScopes(t *testing.T) {
+	f := newTestFixture(t, withTestClient(map[string]any{"scope": "openid profile email offline_access"}))
+
+	code := authorizeTestUser(t, f.App, f.Mux, url.Values{"scope": {"openid offline_access"}})
+	exchangeTestCode(t, f.Mux, code, nil)
+
+	code = authorizeTestUser(t, f.App, f.Mux, url.Values{"scope": {"openid profile"}})
+	res := exchangeTestCode(t, f.Mux, code, nil)
+	if res["scope"] != "openid profile" {
+		t.Errorf("scope = %v, want %q", res["scope"], "openid profile")
+	}
+}
+
+func TestIncrementalAuth_SkipsScopesNoLongerAllowed(t *testing.T) {
+	f := newTestFixture(t, withTestClient(map[string]any{"scope": "openid profile email offline_access"}))
+
+	code := authorizeTestUser(t, f.App, f.Mux, url.Values{"scope": {"openid email"}})
+	exchangeTestCode(t, f.Mux, code, nil)
+
+	f.Client.Set("scope", "openid profile")
+	if err := f.App.SaveNoValidate(f.Client); err != nil {
+		t.Fatal(err)
+	}
+
+	code = authorizeTestUser(t, f.App, f.Mux, url.Values{
+		"scope":                  {"openid profile"},
+		"include_granted_scopes": {"true"},
+	})
+	res := exchangeTestCode(t, f.Mux, code, nil)
+	if res["scope"] != "openid profile" {
+		t.Errorf("scope = %v, want %q", res["scope"], "openid profile")
+	}
+}
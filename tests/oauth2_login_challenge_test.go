@@ -0,0 +1,204 @@
+package oauth2
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/benjamesfleming/pocketbase-ext-oauth2/consts"
+	"github.com/pocketbase/pocketbase/tests"
+)
+
+// startTestLoginChallenge starts an authorization request and returns the
+// login challenge from the redirect to the login UI.
+func startTestLoginChallenge(t testing.TB, mux http.Handler, params url.Values) string {
+	t.Helper()
+	form := url.Values{
+		"response_type": {"code"},
+		"client_id":     {testClientID},
+		"redirect_uri":  {testRedirectURI},
+		"scope":         {"openid profile email"},
+		"state":         {"teststate1234"},
+	}
+	for k, v := range params {
+		form[k] = v
+	}
+	res := doTestRequest(t, mux, http.MethodPost, "/oauth2/auth", form, nil)
+	location, err := res.Location()
+	if err != nil {
+		t.Fatalf("expected login redirect, got status %d", res.StatusCode)
+	}
+	challenge := location.Query().Get("login_challenge")
+	if challenge == "" {
+		t.Fatalf("expected login challenge in redirect, got %q", location.String())
+	}
+	return challenge
+}
+
+// acceptTestLoginChallenge accepts the login challenge as the test user and
+// returns the redirect_to URL.
+func acceptTestLoginChallenge(t testing.TB, app *tests.TestApp, mux http.Handler, challenge string) *url.URL {
+	t.Helper()
+	res := doTestRequest(t, mux, http.MethodPost, "/oauth2/auth/requests/login/accept?"+url.Values{"login_challenge": {challenge}}.Encode(), nil, map[string]string{
+		"Authorization": generateTestUserToken(t, app),
+	})
+	ret := decodeTestJSONResponse(t, res)
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %v", res.StatusCode, ret)
+	}
+	redirectTo, err := url.Parse(ret["redirect_to"].(string))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return redirectTo
+}
+
+func TestLoginChallenge_IgnoresForgedParams(t *testing.T) {
+	f := newTestFixture(t)
+
+	challenge := startTestLoginChallenge(t, f.Mux, url.Values{
+		"pb_token": {generateTestUserToken(t, f.App)},
+		"consent":  {"granted"},
+		"error":    {"login_required"},
+		"rat":      {"1"},
+	})
+
+	// None of the forged params are stored with the request.
+	state := decodeTestLoginState(t, f.Mux, &url.URL{RawQuery: url.Values{"login_challenge": {challenge}}.Encode()})
+	if state["client_id"] != testClientID {
+		t.Errorf("unexpected login state %v", state)
+	}
+	record, err := f.App.FindFirstRecordByData(consts.LoginChallengeCollectionName, "client_id", testClientID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, param := range []string{"pb_token", "consent", "error", "rat"} {
+		if strings.Contains(record.GetString("request_form"), param+"=") {
+			t.Errorf("expected %s to be removed from the request form %q", param, record.GetString("request_form"))
+		}
+	}
+}
+
+func TestLoginChallenge_InvalidSignature(t *testing.T) {
+	f := newTestFixture(t)
+
+	challenge := startTestLoginChallenge(t, f.Mux, nil)
+	id, _, _ := strings.Cut(challenge, ".")
+
+	for name, target := range map[string]string{
+		"unsigned":        "/oauth2/auth/requests/login?login_challenge=" + id,
+		"bad signature":   "/oauth2/auth/requests/login?login_challenge=" + id + ".invalid",
+		"wrong phase":     "/oauth2/auth/requests/consent?consent_challenge=" + url.QueryEscape(challenge),
+		"accept unsigned": "/oauth2/auth/requests/login/accept?login_challenge=" + id,
+	} {
+		t.Run(name, func(t *testing.T) {
+			method := http.MethodGet
+			if strings.Contains(target, "/accept") {
+				method = http.MethodPost
+			}
+			r := doTestRequest(t, f.Mux, method, target, nil, map[string]string{
+				"Authorization": generateTestUserToken(t, f.App),
+			})
+			if r.StatusCode != http.StatusNotFound {
+				t.Errorf("expected status 404, got %d", r.StatusCode)
+			}
+		})
+	}
+}
+
+func TestLoginChallenge_AcceptRequiresUserToken(t *testing.T) {
+	f := newTestFixture(t)
+
+	challenge := startTestLoginChallenge(t, f.Mux, nil)
+	r := doTestRequest(t, f.Mux, http.MethodPost, "/oauth2/auth/requests/login/accept?"+url.Values{"login_challenge": {challenge}}.Encode(), nil, nil)
+	if r.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected status 401, got %d", r.StatusCode)
+	}
+}
+
+func TestLoginChallenge_VerifierIsOneTime(t *testing.T) {
+	f := newTestFixture(t)
+
+	redirectTo := acceptTestLoginChallenge(t, f.App, f.Mux, startTestLoginChallenge(t, f.Mux, nil))
+
+	r := doTestRequest(t, f.Mux, http.MethodGet, redirectTo.RequestURI(), nil, nil)
+	location, err := r.Location()
+	if err != nil || location.Query().Get("consent_challenge") == "" {
+		t.Fatalf("expected consent redirect, got status %d", r.StatusCode)
+	}
+
+	r = doTestRequest(t, f.Mux, http.MethodGet, redirectTo.RequestURI(), nil, nil)
+	location, err = r.Location()
+	if err != nil {
+		t.Fatalf("expected error redirect, got status %d", r.StatusCode)
+	}
+	if got := location.Query().Get("error"); got != "invalid_request" {
+		t.Errorf("error = %q, want %q", got, "invalid_request")
+	}
+}
+
+func TestLoginChallenge_VerifierRequiresBrowser(t *testing.T) {
+	for name, forgeCookie := range map[string]bool{
+		"another browser": false,
+		"forged cookie":   true,
+	} {
+		t.Run(name, func(t *testing.T) {
+			f := newTestFixture(t)
+
+			challenge := startTestLoginChallenge(t, f.Mux, nil)
+			redirectTo := acceptTestLoginChallenge(t, f.App, f.Mux, challenge)
+			headers := map[string]string{}
+			if forgeCookie {
+				id, _, _ := strings.Cut(challenge, ".")
+				headers["Cookie"] = "pb_oauth2_login_" + id + "=forged"
+			}
+
+			// Only the browser that started the request can redeem the
+			// verifier, so it can't be handed to another user.
+			r := doTestRequest(t, f.Mux.Handler, http.MethodGet, redirectTo.RequestURI(), nil, headers)
+			location, err := r.Location()
+			if err != nil {
+				t.Fatalf("expected error redirect, got status %d", r.StatusCode)
+			}
+			assertTestAuthorizeError(t, location, "invalid_request")
+		})
+	}
+}
+
+func TestLoginChallenge_RequestMismatch(t *testing.T) {
+	f := newTestFixture(t)
+
+	redirectTo := acceptTestLoginChallenge(t, f.App, f.Mux, startTestLoginChallenge(t, f.Mux, url.Values{"scope": {"openid"}}))
+
+	// The verifier can't be used to authorize a different request.
+	query := redirectTo.Query()
+	query.Set("scope", "openid profile email")
+	r := doTestRequest(t, f.Mux, http.MethodGet, "/oauth2/auth?"+query.Encode(), nil, nil)
+	location, err := r.Location()
+	if err != nil {
+		t.Fatalf("expected error redirect, got status %d", r.StatusCode)
+	}
+	if got := location.Query().Get("error"); got != "invalid_request" {
+		t.Errorf("error = %q, want %q", got, "invalid_request")
+	}
+}
+
+func TestLoginChallenge_Reject(t *testing.T) {
+	f := newTestFixture(t)
+
+	challenge := startTestLoginChallenge(t, f.Mux, nil)
+	target := "/oauth2/auth/requests/login/reject?" + url.Values{"login_challenge": {challenge}}.Encode()
+
+	if r := doTestRequest(t, f.Mux, http.MethodPost, target, url.Values{"error": {"server_error"}}, nil); r.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected status 400 for an unsupported error, got %d", r.StatusCode)
+	}
+
+	location := resolveTestLoginChallenge(t, f.Mux, "login", challenge, "reject", url.Values{"error": {"login_required"}}, "")
+	if got := location.Query().Get("error"); got != "login_required" {
+		t.Errorf("error = %q, want %q", got, "login_required")
+	}
+	if n, _ := f.App.CountRecords(consts.LoginChallengeCollectionName); n != 0 {
+		t.Errorf("expected the rejected challenge to be deleted, got %d", n)
+	}
+}
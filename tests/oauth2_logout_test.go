@@ -0,0 +1,311 @@
+package oauth2
+
+import (
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"testing"
+
+	oauth2 "github.com/benjamesfleming/pocketbase-ext-oauth2"
+	"github.com/benjamesfleming/pocketbase-ext-oauth2/consts"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tests"
+)
+
+const testPostLogoutRedirectURI = "http://localhost:8090/logged-out"
+
+// logoutTestOptions register the post-logout redirect URI of the test client,
+// which may request refresh tokens.
+var logoutTestOptions = []testFixtureOption{
+	withTestClient(map[string]any{
+		"scope":                     "openid profile email offline_access",
+		"post_logout_redirect_uris": []string{testPostLogoutRedirectURI},
+	}),
+}
+
+// startTestLogout sends the logout request and returns the logout challenge
+// handed to the login UI.
+func startTestLogout(t testing.TB, mux http.Handler, params url.Values) string {
+	t.Helper()
+	r := doTestRequest(t, mux, http.MethodGet, "/oauth2/logout?"+params.Encode(), nil, nil)
+	location, err := r.Location()
+	if err != nil {
+		t.Fatalf("expected redirect to the login UI, got status %d: %v", r.StatusCode, decodeTestJSONResponse(t, r))
+	}
+	challenge := location.Query().Get("logout_challenge")
+	if challenge == "" {
+		t.Fatalf("expected logout challenge, got %q", location.String())
+	}
+	return challenge
+}
+
+func getTestLogoutState(t testing.TB, mux http.Handler, challenge string) map[string]any {
+	t.Helper()
+	r := doTestRequest(t, mux, http.MethodGet, "/oauth2/auth/requests/logout?logout_challenge="+url.QueryEscape(challenge), nil, nil)
+	if r.StatusCode != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", r.StatusCode)
+	}
+	return decodeTestJSONResponse(t, r)
+}
+
+// acceptTestLogout accepts the logout challenge as the login UI would, with
+// the browser session cookie if set, and returns where the user is sent next.
+func acceptTestLogout(t testing.TB, mux http.Handler, challenge string, cookie *http.Cookie) string {
+	t.Helper()
+	r := doTestLogoutAccept(t, mux, challenge, cookie)
+	res := decodeTestJSONResponse(t, r)
+	if r.StatusCode != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %v", r.StatusCode, res)
+	}
+	redirectTo, _ := res["redirect_to"].(string)
+	return redirectTo
+}
+
+func doTestLogoutAccept(t testing.TB, mux http.Handler, challenge string, cookie *http.Cookie) *http.Response {
+	t.Helper()
+	headers := map[string]string{}
+	if cookie != nil {
+		headers["Cookie"] = cookie.String()
+	}
+	return doTestRequest(t, mux, http.MethodPost, "/oauth2/auth/requests/logout/accept?logout_challenge="+url.QueryEscape(challenge), nil, headers)
+}
+
+// loginTestBrowser logs the test user in to the test client with a browser
+// session, and returns the session cookie and the token response.
+func loginTestBrowser(t testing.TB, f *testFixture, params url.Values) (*http.Cookie, map[string]any) {
+	t.Helper()
+	res := authorizeTestBrowserRequest(t, f.App, f.Mux, params, nil)
+	return getTestBrowserSessionCookie(t, res), exchangeTestCode(t, f.Mux, getTestAuthorizationCode(t, res), nil)
+}
+
+// forgetTestBrowserSessionClients removes the clients of the accounts of the
+// browser session, as if the user had signed in to them with another browser.
+func forgetTestBrowserSessionClients(t testing.TB, app core.App) {
+	t.Helper()
+	record := findTestBrowserSession(t, app)
+	accounts := []map[string]any{}
+	_ = record.UnmarshalJSONField("accounts", &accounts)
+	for _, account := range accounts {
+		account["clients"] = []string{}
+	}
+	record.Set("accounts", accounts)
+	if err := app.Save(record); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLogout_Discovery(t *testing.T) {
+	scenario := tests.ApiScenario{
+		Method:          http.MethodGet,
+		URL:             "/.well-known/openid-configuration",
+		ExpectedStatus:  200,
+		ExpectedContent: []string{`"end_session_endpoint":"` + testAppURL + `/oauth2/logout"`},
+		TestAppFactory:  newTestScenarioApp(nil, logoutTestOptions...),
+	}
+	scenario.Test(t)
+}
+
+func TestLogout_IDTokenHint(t *testing.T) {
+	f := newTestFixture(t, logoutTestOptions...)
+
+	res := exchangeTestCode(t, f.Mux, authorizeTestUser(t, f.App, f.Mux, nil), nil)
+	idToken, _ := res["id_token"].(string)
+	challenge := startTestLogout(t, f.Mux, url.Values{
+		"id_token_hint":            {idToken},
+		"post_logout_redirect_uri": {testPostLogoutRedirectURI},
+		"state":                    {"logoutstate"},
+	})
+
+	// The client proved who the user is, so the logout isn't confirmed.
+	state := getTestLogoutState(t, f.Mux, challenge)
+	if state["confirm"] != false || state["client_id"] != testClientID || state["id_token_hint_subject"] != f.User.Id {
+		t.Errorf("unexpected logout state %v", state)
+	}
+
+	if got, want := acceptTestLogout(t, f.Mux, challenge, nil), testPostLogoutRedirectURI+"?state=logoutstate"; got != want {
+		t.Errorf("redirect_to = %q, want %q", got, want)
+	}
+
+	// The challenge can only be used once.
+	r := doTestLogoutAccept(t, f.Mux, challenge, nil)
+	if r.StatusCode != http.StatusNotFound {
+		t.Errorf("expected status 404, got %d", r.StatusCode)
+	}
+}
+
+func TestLogout_ConfirmWithoutHint(t *testing.T) {
+	f := newTestFixture(t, logoutTestOptions...)
+
+	challenge := startTestLogout(t, f.Mux, url.Values{"client_id": {testClientID}})
+	state := getTestLogoutState(t, f.Mux, challenge)
+	if state["confirm"] != true || state["client_name"] != testClientName {
+		t.Errorf("unexpected logout state %v", state)
+	}
+	if got := acceptTestLogout(t, f.Mux, challenge, nil); got != "" {
+		t.Errorf("expected no redirect, got %q", got)
+	}
+
+	// Anyone can send the user to the logout endpoint, without a client.
+	startTestLogout(t, f.Mux, nil)
+}
+
+func TestLogout_InvalidRequest(t *testing.T) {
+	f := newTestFixture(t, logoutTestOptions...)
+
+	otherClientHint := signTestIDTokenHint(t, map[string]any{"sub": f.User.Id, "aud": []string{"another-client"}})
+	for name, params := range map[string]url.Values{
+		"unregistered redirect uri": {"client_id": {testClientID}, "post_logout_redirect_uri": {testRedirectURI}},
+		"redirect uri of no client": {"post_logout_redirect_uri": {testPostLogoutRedirectURI}},
+		"unknown client":            {"client_id": {"unknown-client"}},
+		"invalid id token hint":     {"id_token_hint": {"not-a-token"}},
+		"hint of another client":    {"client_id": {testClientID}, "id_token_hint": {otherClientHint}},
+	} {
+		r := doTestRequest(t, f.Mux, http.MethodGet, "/oauth2/logout?"+params.Encode(), nil, nil)
+		if r.StatusCode != http.StatusBadRequest {
+			t.Errorf("%s: expected status 400, got %d", name, r.StatusCode)
+		}
+	}
+}
+
+func TestLogout_UnsafeRedirectURI(t *testing.T) {
+	const unsafeURI = "javascript://localhost/%0aalert(1)"
+	f := newTestFixture(t, withTestClient(map[string]any{
+		"post_logout_redirect_uris": []string{unsafeURI},
+	}))
+
+	challenge := startTestLogout(t, f.Mux, url.Values{
+		"client_id":                {testClientID},
+		"post_logout_redirect_uri": {unsafeURI},
+	})
+	if got := acceptTestLogout(t, f.Mux, challenge, nil); got != "" {
+		t.Errorf("expected the unsafe redirect to be dropped, got %q", got)
+	}
+}
+
+func TestLogout_RegisterUnsafeRedirectURI(t *testing.T) {
+	scenario := tests.ApiScenario{
+		Name:   "register - javascript post_logout_redirect_uri",
+		Method: http.MethodPost,
+		URL:    "/oauth2/register",
+		Body: strings.NewReader(`{
+			"client_name": "Bad Client",
+			"redirect_uris": ["http://localhost:3000/callback"],
+			"post_logout_redirect_uris": ["javascript:alert(1)"]
+		}`),
+		Headers: map[string]string{
+			"Content-Type": "application/json",
+		},
+		ExpectedStatus:  400,
+		ExpectedContent: []string{`"error":"invalid_client_metadata"`},
+		TestAppFactory: func(t testing.TB) *tests.TestApp {
+			return setupTestAppForScenario(t)
+		},
+	}
+	scenario.Test(t)
+}
+
+func TestLogout_RevokeRefreshTokens(t *testing.T) {
+	f := newTestFixture(t, slices.Concat(logoutTestOptions, []testFixtureOption{
+		withTestConfig(func(cfg *oauth2.Config) {
+			cfg.RevokeRefreshTokensOnLogout = true
+		}),
+	})...)
+
+	cookie, res := loginTestBrowser(t, f, url.Values{"scope": {"openid offline_access"}})
+	idToken, _ := res["id_token"].(string)
+	refreshToken, _ := res["refresh_token"].(string)
+	if refreshToken == "" {
+		t.Fatalf("expected refresh token, got %v", res)
+	}
+
+	acceptTestLogout(t, f.Mux, startTestLogout(t, f.Mux, url.Values{"id_token_hint": {idToken}}), cookie)
+
+	r := doTestRequest(t, f.Mux, http.MethodPost, "/oauth2/token", url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {refreshToken},
+		"client_id":     {testClientID},
+		"client_secret": {testClientSecret},
+	}, nil)
+	if res := decodeTestJSONResponse(t, r); res["error"] != "invalid_grant" {
+		t.Errorf("error = %v, want %q", res["error"], "invalid_grant")
+	}
+}
+
+func TestLogout_KeepsRefreshTokensByDefault(t *testing.T) {
+	f := newTestFixture(t, logoutTestOptions...)
+
+	cookie, res := loginTestBrowser(t, f, url.Values{"scope": {"openid offline_access"}})
+	idToken, _ := res["id_token"].(string)
+	refreshToken, _ := res["refresh_token"].(string)
+
+	acceptTestLogout(t, f.Mux, startTestLogout(t, f.Mux, url.Values{"id_token_hint": {idToken}}), cookie)
+
+	r := doTestRequest(t, f.Mux, http.MethodPost, "/oauth2/token", url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {refreshToken},
+		"client_id":     {testClientID},
+		"client_secret": {testClientSecret},
+	}, nil)
+	if res := decodeTestJSONResponse(t, r); res["access_token"] == nil {
+		t.Errorf("expected the refresh token to still be valid, got %v", res)
+	}
+}
+
+func TestLogout_OtherBrowser(t *testing.T) {
+	f := newTestFixture(t, slices.Concat(logoutTestOptions, []testFixtureOption{
+		withTestBackChannelLogout(false),
+	})...)
+
+	cookie, res := loginTestBrowser(t, f, nil)
+	idToken, _ := res["id_token"].(string)
+	challenge := startTestLogout(t, f.Mux, url.Values{"id_token_hint": {idToken}})
+
+	// Another browser can't accept the logout challenge, even with the
+	// user's session.
+	r := doTestLogoutAccept(t, f.Mux.Handler, challenge, cookie)
+	if r.StatusCode != http.StatusForbidden {
+		t.Errorf("expected status 403, got %d", r.StatusCode)
+	}
+	if n, _ := f.App.CountRecords(consts.BrowserSessionCollectionName); n != 1 {
+		t.Errorf("expected the browser session to be kept, got %d", n)
+	}
+	if n, _ := f.App.CountRecords(consts.BackChannelLogoutCollectionName); n != 0 {
+		t.Errorf("expected no deliveries, got %d", n)
+	}
+}
+
+func TestLogout_HintOutsideBrowserSession(t *testing.T) {
+	f := newTestFixture(t, slices.Concat(logoutTestOptions, []testFixtureOption{
+		withTestBackChannelLogout(false),
+		withTestConfig(func(cfg *oauth2.Config) {
+			cfg.RevokeRefreshTokensOnLogout = true
+		}),
+	})...)
+
+	res := exchangeTestCode(t, f.Mux, authorizeTestUser(t, f.App, f.Mux, url.Values{"scope": {"openid offline_access"}}), nil)
+	idToken, _ := res["id_token"].(string)
+	refreshToken, _ := res["refresh_token"].(string)
+
+	// The user isn't signed in to the browser accepting the logout, so the
+	// id_token_hint alone doesn't log them out of anything.
+	acceptTestLogout(t, f.Mux, startTestLogout(t, f.Mux, url.Values{"id_token_hint": {idToken}}), nil)
+	if n, _ := f.App.CountRecords(consts.BackChannelLogoutCollectionName); n != 0 {
+		t.Errorf("expected no deliveries, got %d", n)
+	}
+	select {
+	case <-f.RP.tokens:
+		t.Error("expected no logout token")
+	default:
+	}
+
+	r := doTestRequest(t, f.Mux, http.MethodPost, "/oauth2/token", url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {refreshToken},
+		"client_id":     {testClientID},
+		"client_secret": {testClientSecret},
+	}, nil)
+	if res := decodeTestJSONResponse(t, r); res["access_token"] == nil {
+		t.Errorf("expected the refresh token to still be valid, got %v", res)
+	}
+}
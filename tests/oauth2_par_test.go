@@ -0,0 +1,182 @@
+package oauth2
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/benjamesfleming/pocketbase-ext-oauth2/consts"
+	"github.com/pocketbase/pocketbase/tests"
+)
+
+// pushTestAuthorizeRequest pushes the authorization request of the test client,
+// with any additional params, and returns its request_uri.
+func pushTestAuthorizeRequest(t testing.TB, mux http.Handler, params url.Values) string {
+	t.Helper()
+	form := url.Values{
+		"response_type": {"code"},
+		"client_id":     {testClientID},
+		"client_secret": {testClientSecret},
+		"redirect_uri":  {testRedirectURI},
+		"scope":         {"openid profile email"},
+		"state":         {"teststate1234"},
+	}
+	for k, v := range params {
+		form[k] = v
+	}
+	res := decodeTestJSONResponse(t, doTestRequest(t, mux, http.MethodPost, "/oauth2/par", form, nil))
+	requestURI, _ := res["request_uri"].(string)
+	if requestURI == "" {
+		t.Fatalf("expected a request_uri, got %v", res)
+	}
+	return requestURI
+}
+
+// newTestPARRequest returns the body of a pushed authorization request of the
+// test client, with the params set or, if empty, removed.
+func newTestPARRequest(params url.Values) *strings.Reader {
+	form := url.Values{
+		"response_type": {"code"},
+		"client_id":     {testClientID},
+		"client_secret": {testClientSecret},
+		"redirect_uri":  {testRedirectURI},
+		"scope":         {"openid"},
+		"state":         {"teststate1234"},
+	}
+	for k, v := range params {
+		if len(v) == 0 || v[0] == "" {
+			form.Del(k)
+		} else {
+			form[k] = v
+		}
+	}
+	return strings.NewReader(form.Encode())
+}
+
+func TestPAR(t *testing.T) {
+	formHeaders := map[string]string{"Content-Type": "application/x-www-form-urlencoded"}
+
+	scenarios := []tests.ApiScenario{
+		{
+			Name:           "pushed",
+			Method:         http.MethodPost,
+			URL:            "/oauth2/par",
+			Body:           newTestPARRequest(nil),
+			Headers:        formHeaders,
+			ExpectedStatus: 201,
+			ExpectedContent: []string{
+				`"request_uri":"urn:ietf:params:oauth:request_uri:`,
+				`"expires_in":300`,
+			},
+			TestAppFactory: newTestScenarioApp(nil, authorizationDetailsTestOptions...),
+			AfterTestFunc: func(t testing.TB, app *tests.TestApp, res *http.Response) {
+				records, err := app.FindAllRecords(consts.PARCollectionName)
+				if err != nil || len(records) != 1 {
+					t.Fatalf("expected one pushed authorization request, got %d (%v)", len(records), err)
+				}
+				// The client credentials are not stored with the request.
+				if form := records[0].GetString("form_data"); strings.Contains(form, "client_secret") {
+					t.Errorf("expected the client_secret to be removed, got %q", form)
+				}
+			},
+		},
+		{
+			Name:            "invalid client secret",
+			Method:          http.MethodPost,
+			URL:             "/oauth2/par",
+			Body:            newTestPARRequest(url.Values{"client_secret": {"wrong-secret"}}),
+			Headers:         formHeaders,
+			ExpectedStatus:  401,
+			ExpectedContent: []string{`"error":"invalid_client"`},
+			TestAppFactory:  newTestScenarioApp(nil, authorizationDetailsTestOptions...),
+		},
+		{
+			Name:            "unregistered redirect_uri",
+			Method:          http.MethodPost,
+			URL:             "/oauth2/par",
+			Body:            newTestPARRequest(url.Values{"redirect_uri": {testAppURL + "/other"}}),
+			Headers:         formHeaders,
+			ExpectedStatus:  400,
+			ExpectedContent: []string{`"error":"invalid_request"`},
+			TestAppFactory:  newTestScenarioApp(nil, authorizationDetailsTestOptions...),
+		},
+		{
+			Name:            "invalid authorization details",
+			Method:          http.MethodPost,
+			URL:             "/oauth2/par",
+			Body:            newTestPARRequest(url.Values{"authorization_details": {`[{"type":"unknown"}]`}}),
+			Headers:         formHeaders,
+			ExpectedStatus:  400,
+			ExpectedContent: []string{`"error":"invalid_authorization_details"`},
+			TestAppFactory:  newTestScenarioApp(nil, authorizationDetailsTestOptions...),
+		},
+		{
+			Name:            "with request_uri",
+			Method:          http.MethodPost,
+			URL:             "/oauth2/par",
+			Body:            newTestPARRequest(url.Values{"request_uri": {"urn:ietf:params:oauth:request_uri:abc"}}),
+			Headers:         formHeaders,
+			ExpectedStatus:  400,
+			ExpectedContent: []string{`"error":"invalid_request"`},
+			TestAppFactory:  newTestScenarioApp(nil, authorizationDetailsTestOptions...),
+		},
+		{
+			Name:            "discovery",
+			Method:          http.MethodGet,
+			URL:             "/.well-known/openid-configuration",
+			ExpectedStatus:  200,
+			ExpectedContent: []string{`"pushed_authorization_request_endpoint":"` + testAppURL + `/oauth2/par"`},
+			TestAppFactory:  newTestScenarioApp(nil),
+		},
+	}
+	for _, scenario := range scenarios {
+		scenario.Test(t)
+	}
+}
+
+func TestPAR_Authorize(t *testing.T) {
+	f := newTestFixture(t, authorizationDetailsTestOptions...)
+
+	requestURI := pushTestAuthorizeRequest(t, f.Mux, url.Values{"authorization_details": {testPaymentDetails}})
+
+	// The authorization request only carries the client_id and request_uri,
+	// the login and consent screens resume it with the pushed params.
+	pushed := url.Values{
+		"response_type": {""},
+		"redirect_uri":  {""},
+		"scope":         {""},
+		"state":         {""},
+		"request_uri":   {requestURI},
+		"consent":       {"granted"},
+	}
+	location := authorizeTestRequest(t, f.App, f.Mux, pushed)
+	if location.Query().Get("state") != "teststate1234" {
+		t.Errorf("state = %q, want %q", location.Query().Get("state"), "teststate1234")
+	}
+	code := location.Query().Get("code")
+	if code == "" {
+		t.Fatalf("expected authorization code in redirect, got %q", location.String())
+	}
+
+	res := exchangeTestCode(t, f.Mux, code, nil)
+	token, _ := res["access_token"].(string)
+	if details, _ := decodeTestJWTClaims(t, token)["authorization_details"].([]any); len(details) != 1 {
+		t.Errorf("expected the pushed authorization_details in the access token, got %v", res)
+	}
+
+	// The request_uri can only be used once.
+	if n, _ := f.App.CountRecords(consts.PARCollectionName); n != 0 {
+		t.Errorf("expected the pushed authorization request to be deleted, got %d", n)
+	}
+	r := doTestRequest(t, f.Mux, http.MethodGet, "/oauth2/auth?"+url.Values{
+		"client_id":   {testClientID},
+		"request_uri": {requestURI},
+	}.Encode(), nil, nil)
+	if location, err := r.Location(); err == nil && location.Query().Get("code") != "" {
+		t.Errorf("expected the request_uri to be rejected, got %q", location.String())
+	}
+	if r.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected status 400, got %d", r.StatusCode)
+	}
+}
@@ -0,0 +1,173 @@
+package oauth2
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pocketbase/pocketbase/tests"
+)
+
+func assertTestAuthorizeError(t testing.TB, location *url.URL, want string) {
+	t.Helper()
+	if got := location.Query().Get("error"); got != want {
+		t.Errorf("error = %q, want %q (redirect %q)", got, want, location.String())
+	}
+	if location.Query().Get("code") != "" {
+		t.Error("expected no authorization code")
+	}
+}
+
+// expectTestAuthorizeError returns an ApiScenario AfterTestFunc, which checks
+// that the authorization request was redirected back with the error.
+func expectTestAuthorizeError(want string) func(t testing.TB, app *tests.TestApp, res *http.Response) {
+	return func(t testing.TB, app *tests.TestApp, res *http.Response) {
+		location, err := res.Location()
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertTestAuthorizeError(t, location, want)
+	}
+}
+
+// setupTestBrowserSession logs the test user in to a browser session, and
+// sends its cookie with the scenario request.
+func setupTestBrowserSession(t testing.TB, f *testFixture) {
+	cookie := getTestBrowserSessionCookie(t, authorizeTestBrowserRequest(t, f.App, f.Mux, nil, nil))
+	f.setScenarioHeader("Cookie", cookie.String())
+}
+
+// newTestAuthorizeURL returns the authorization request URL of the test
+// client, with any additional params.
+func newTestAuthorizeURL(params url.Values) string {
+	form := url.Values{
+		"response_type": {"code"},
+		"client_id":     {testClientID},
+		"redirect_uri":  {testRedirectURI},
+		"scope":         {"openid profile email"},
+		"state":         {"teststate1234"},
+	}
+	for k, v := range params {
+		form[k] = v
+	}
+	return "/oauth2/auth?" + form.Encode()
+}
+
+func TestPrompt_MaxAge(t *testing.T) {
+	f := newTestFixture(t)
+
+	token := generateTestUserTokenIssuedAt(t, f.App, time.Hour)
+
+	location := authorizeTestRequestWithToken(t, f.Mux, token, url.Values{"max_age": {"60"}, "consent": {"granted"}})
+	assertTestAuthorizeError(t, location, "login_required")
+
+	location = authorizeTestRequestWithToken(t, f.Mux, token, url.Values{"max_age": {"7200"}, "consent": {"granted"}})
+	if location.Query().Get("code") == "" {
+		t.Errorf("expected authorization code for a recent enough login, got %q", location.String())
+	}
+}
+
+func TestPrompt_MaxAgeZero(t *testing.T) {
+	f := newTestFixture(t)
+
+	token := generateTestUserTokenIssuedAt(t, f.App, time.Minute)
+	location := authorizeTestRequestWithToken(t, f.Mux, token, url.Values{"max_age": {"0"}, "consent": {"granted"}})
+	assertTestAuthorizeError(t, location, "login_required")
+}
+
+func TestPrompt_Login(t *testing.T) {
+	f := newTestFixture(t)
+
+	token := generateTestUserTokenIssuedAt(t, f.App, time.Minute)
+	location := authorizeTestRequestWithToken(t, f.Mux, token, url.Values{"prompt": {"login"}, "consent": {"granted"}})
+	assertTestAuthorizeError(t, location, "login_required")
+
+	// Logging in again during the request satisfies prompt=login.
+	location = authorizeTestRequest(t, f.App, f.Mux, url.Values{"prompt": {"login"}, "consent": {"granted"}})
+	if location.Query().Get("code") == "" {
+		t.Errorf("expected authorization code after logging in again, got %q", location.String())
+	}
+}
+
+func TestPrompt_LoginWithoutAuthTime(t *testing.T) {
+	f := newTestFixture(t)
+
+	// The auth token doesn't record when the user logged in, so it can't
+	// satisfy prompt=login.
+	token, err := f.User.NewAuthToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	location := authorizeTestRequestWithToken(t, f.Mux, token, url.Values{"prompt": {"login"}, "consent": {"granted"}})
+	assertTestAuthorizeError(t, location, "login_required")
+}
+
+func TestPrompt_None(t *testing.T) {
+	scenarios := []tests.ApiScenario{
+		{
+			Name:           "without a browser session",
+			Method:         http.MethodGet,
+			URL:            newTestAuthorizeURL(url.Values{"prompt": {"none"}}),
+			ExpectedStatus: 303,
+			TestAppFactory: newTestScenarioApp(nil),
+			AfterTestFunc:  expectTestAuthorizeError("login_required"),
+		},
+		{
+			Name:           "login_hint of another user",
+			Method:         http.MethodGet,
+			URL:            newTestAuthorizeURL(url.Values{"prompt": {"none"}, "login_hint": {"someone@example.com"}}),
+			ExpectedStatus: 303,
+			TestAppFactory: newTestScenarioApp(setupTestBrowserSession),
+			AfterTestFunc:  expectTestAuthorizeError("login_required"),
+		},
+		{
+			// The browser session logs the user in, without the login UI.
+			Name:           "matching login_hint",
+			Method:         http.MethodGet,
+			URL:            newTestAuthorizeURL(url.Values{"prompt": {"none"}, "login_hint": {strings.ToUpper(testUserEmail)}}),
+			ExpectedStatus: 307,
+			TestAppFactory: newTestScenarioApp(setupTestBrowserSession),
+			AfterTestFunc: func(t testing.TB, app *tests.TestApp, res *http.Response) {
+				location, err := res.Location()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if location.Path != "/oauth2/auth" || !location.Query().Has("login_verifier") {
+					t.Errorf("expected a redirect back to the authorization endpoint, got %q", location.String())
+				}
+			},
+		},
+	}
+	for _, scenario := range scenarios {
+		scenario.Test(t)
+	}
+}
+
+func TestPrompt_InteractiveLoginHintIsOnlyAHint(t *testing.T) {
+	f := newTestFixture(t)
+
+	location := authorizeTestRequest(t, f.App, f.Mux, url.Values{"login_hint": {"someone@example.com"}, "consent": {"granted"}})
+	if location.Query().Get("code") == "" {
+		t.Errorf("expected authorization code, got %q", location.String())
+	}
+}
+
+func TestPrompt_SelectAccount(t *testing.T) {
+	f := newTestFixture(t)
+
+	location := authorizeTestRequest(t, f.App, f.Mux, url.Values{"prompt": {"select_account"}, "consent": {"granted"}})
+	if location.Query().Get("code") == "" {
+		t.Errorf("expected authorization code, got %q", location.String())
+	}
+
+	scenario := tests.ApiScenario{
+		Method:          http.MethodGet,
+		URL:             "/.well-known/openid-configuration",
+		ExpectedStatus:  200,
+		ExpectedContent: []string{`"select_account"`},
+		TestAppFactory:  newTestScenarioApp(nil),
+	}
+	scenario.Test(t)
+}
@@ -0,0 +1,164 @@
+package oauth2
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/benjamesfleming/pocketbase-ext-oauth2/consts"
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tests"
+)
+
+// grantTestRefreshToken signs the test user in to the test client, and returns
+// the refresh token.
+func grantTestRefreshToken(t testing.TB, app *tests.TestApp, mux http.Handler) string {
+	t.Helper()
+	code := authorizeTestUser(t, app, mux, url.Values{"scope": {"openid offline_access"}})
+	res := exchangeTestCode(t, mux, code, nil)
+	refreshToken, _ := res["refresh_token"].(string)
+	if refreshToken == "" {
+		t.Fatal("expected a refresh token")
+	}
+	return refreshToken
+}
+
+// countTestSessions counts the sessions and consent grants matching the
+// expression.
+func countTestSessions(t testing.TB, app core.App, exp dbx.Expression) int64 {
+	t.Helper()
+	var total int64
+	for _, collection := range []string{
+		consts.AccessCollectionName,
+		consts.RefreshCollectionName,
+		consts.OpenIDConnectCollectionName,
+		consts.ConsentCollectionName,
+	} {
+		n, err := app.CountRecords(collection, exp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		total += n
+	}
+	return total
+}
+
+func TestRecordHooks_UserPasswordChange(t *testing.T) {
+	f := newTestFixture(t, revokeSessionsTestOptions...)
+
+	refreshToken := grantTestRefreshToken(t, f.App, f.Mux)
+
+	f.User.SetPassword("a-new-password-123")
+	if err := f.App.Save(f.User); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := refreshTestToken(t, f.Mux, refreshToken); err != "invalid_grant" {
+		t.Errorf("refresh error = %v, want %q", err, "invalid_grant")
+	}
+	if n, _ := f.App.CountRecords(consts.RefreshCollectionName); n != 0 {
+		t.Errorf("expected the refresh tokens to be revoked, got %d", n)
+	}
+	// The consent grant is kept.
+	if n, _ := f.App.CountRecords(consts.ConsentCollectionName); n != 1 {
+		t.Errorf("expected the consent grant to be kept, got %d", n)
+	}
+
+	if claims := decodeTestJWTClaims(t, f.RP.waitForTestLogoutToken(t)); claims["sub"] != f.User.Id {
+		t.Errorf("sub = %v, want %q", claims["sub"], f.User.Id)
+	}
+	waitForTestDeliveries(t, f.App, func(records []*core.Record) bool { return len(records) == 0 })
+}
+
+func TestRecordHooks_UserUpdate(t *testing.T) {
+	f := newTestFixture(t, revokeSessionsTestOptions...)
+
+	refreshToken := grantTestRefreshToken(t, f.App, f.Mux)
+
+	// Changes that keep the token key don't revoke the sessions.
+	f.User.Set("name", "Renamed User")
+	if err := f.App.Save(f.User); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := refreshTestToken(t, f.Mux, refreshToken); err != nil {
+		t.Errorf("expected the refresh to succeed, got %v", err)
+	}
+}
+
+func TestRecordHooks_TokenKeyChanged(t *testing.T) {
+	f := newTestFixture(t, revokeSessionsTestOptions...)
+
+	refreshToken := grantTestRefreshToken(t, f.App, f.Mux)
+
+	// Change the token key without the hooks, so that the session survives.
+	_, err := f.App.DB().Update(f.User.Collection().Name, dbx.Params{"tokenKey": "changed"}, dbx.HashExp{"id": f.User.Id}).Execute()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := refreshTestToken(t, f.Mux, refreshToken); err != "invalid_grant" {
+		t.Errorf("refresh error = %v, want %q", err, "invalid_grant")
+	}
+}
+
+func TestRecordHooks_UserDelete(t *testing.T) {
+	f := newTestFixture(t, revokeSessionsTestOptions...)
+
+	refreshToken := grantTestRefreshToken(t, f.App, f.Mux)
+
+	if err := f.App.Delete(f.User); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := countTestSessions(t, f.App, dbx.HashExp{"subject": f.User.Id}); n != 0 {
+		t.Errorf("expected the sessions and consent grants to be deleted, got %d", n)
+	}
+	if err := refreshTestToken(t, f.Mux, refreshToken); err != "invalid_grant" {
+		t.Errorf("refresh error = %v, want %q", err, "invalid_grant")
+	}
+	waitForTestDeliveries(t, f.App, func(records []*core.Record) bool { return len(records) == 0 })
+}
+
+func TestRecordHooks_ClientSecretChange(t *testing.T) {
+	f := newTestFixture(t, revokeSessionsTestOptions...)
+
+	refreshToken := grantTestRefreshToken(t, f.App, f.Mux)
+
+	client, err := f.App.FindFirstRecordByData(consts.ClientCollectionName, "client_id", testClientID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Set("client_secret", "rotated")
+	if err := f.App.SaveNoValidate(client); err != nil {
+		t.Fatal(err)
+	}
+
+	if n, _ := f.App.CountRecords(consts.RefreshCollectionName, dbx.HashExp{"client_id": testClientID}); n != 0 {
+		t.Errorf("expected the refresh tokens to be revoked, got %d", n)
+	}
+	if err := refreshTestToken(t, f.Mux, refreshToken); err == nil {
+		t.Error("expected the refresh to fail")
+	}
+	waitForTestDeliveries(t, f.App, func(records []*core.Record) bool { return len(records) == 0 })
+}
+
+func TestRecordHooks_ClientDelete(t *testing.T) {
+	f := newTestFixture(t, revokeSessionsTestOptions...)
+
+	grantTestRefreshToken(t, f.App, f.Mux)
+
+	client, err := f.App.FindFirstRecordByData(consts.ClientCollectionName, "client_id", testClientID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.App.Delete(client); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := countTestSessions(t, f.App, dbx.HashExp{"client_id": testClientID}); n != 0 {
+		t.Errorf("expected the sessions and consent grants to be deleted, got %d", n)
+	}
+	waitForTestDeliveries(t, f.App, func(records []*core.Record) bool { return len(records) == 0 })
+}
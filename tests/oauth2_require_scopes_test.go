@@ -0,0 +1,231 @@
+package oauth2
+
+import (
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/benjamesfleming/pocketbase-ext-oauth2/rfc9728"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tests"
+)
+
+// requireScopesTestOptions serve "/api/notes/{id}", which requires the
+// "notes:read" scope, and the "/api/admin" group, which requires the
+// "notes:write" scope. The test client may request both scopes.
+var requireScopesTestOptions = []testFixtureOption{
+	withTestRoutes(func(se *core.ServeEvent) {
+		handler := func(e *core.RequestEvent) error {
+			return e.NoContent(http.StatusNoContent)
+		}
+		se.Router.GET("/api/notes/{id}", handler).Bind(rfc9728.RequireScopes("/api/notes", "notes:read"))
+		admin := se.Router.Group("/api/admin").Bind(rfc9728.RequireScopes("/api/admin", "notes:write"))
+		admin.POST("/notes", handler)
+	}),
+	withTestClient(map[string]any{
+		"scope": "openid profile email offline_access notes:read notes:write",
+	}),
+}
+
+// issueTestScopedAccessToken returns an access token granted the scopes.
+func issueTestScopedAccessToken(t testing.TB, app *tests.TestApp, mux http.Handler, params url.Values) string {
+	t.Helper()
+	code := authorizeTestUser(t, app, mux, params)
+	res := exchangeTestCode(t, mux, code, nil)
+	token, _ := res["access_token"].(string)
+	if token == "" {
+		t.Fatalf("expected access token, got %v", res)
+	}
+	return token
+}
+
+// newRequireScopesTestApp returns an ApiScenario TestAppFactory, which
+// authorizes the scenario request with an access token issued with the
+// params.
+func newRequireScopesTestApp(params url.Values) func(t testing.TB) *tests.TestApp {
+	return newTestScenarioApp(func(t testing.TB, f *testFixture) {
+		f.setScenarioHeader("Authorization", "Bearer "+issueTestScopedAccessToken(t, f.App, f.Mux, params))
+	}, requireScopesTestOptions...)
+}
+
+// expectTestWWWAuthenticate returns an ApiScenario AfterTestFunc, which checks
+// that the WWW-Authenticate header has the params.
+func expectTestWWWAuthenticate(params ...string) func(t testing.TB, app *tests.TestApp, res *http.Response) {
+	return func(t testing.TB, app *tests.TestApp, res *http.Response) {
+		h := res.Header.Get("WWW-Authenticate")
+		for _, param := range params {
+			if !strings.Contains(h, strings.ReplaceAll(param, "{appURL}", app.Settings().Meta.AppURL)) {
+				t.Errorf("expected %s in WWW-Authenticate header %q", param, h)
+			}
+		}
+	}
+}
+
+func TestRequireScopes(t *testing.T) {
+	scenarios := []tests.ApiScenario{
+		{
+			Name:           "insufficient scope",
+			Method:         http.MethodGet,
+			URL:            "/api/notes/1",
+			ExpectedStatus: 403,
+			TestAppFactory: newRequireScopesTestApp(nil),
+			AfterTestFunc: expectTestWWWAuthenticate(
+				`error="insufficient_scope"`,
+				`scope="notes:read"`,
+				`resource_metadata="{appURL}/.well-known/oauth-protected-resource/api/notes"`,
+			),
+		},
+		{
+			Name:           "granted scope",
+			Method:         http.MethodGet,
+			URL:            "/api/notes/1",
+			ExpectedStatus: 204,
+			TestAppFactory: newRequireScopesTestApp(url.Values{"scope": {"openid notes:read"}}),
+		},
+		{
+			Name:           "group scope not granted",
+			Method:         http.MethodPost,
+			URL:            "/api/admin/notes",
+			ExpectedStatus: 403,
+			TestAppFactory: newRequireScopesTestApp(url.Values{"scope": {"openid notes:read"}}),
+			AfterTestFunc: expectTestWWWAuthenticate(
+				`scope="notes:write"`,
+				`resource_metadata="{appURL}/.well-known/oauth-protected-resource/api/admin"`,
+			),
+		},
+		{
+			Name:           "unauthenticated",
+			Method:         http.MethodGet,
+			URL:            "/api/notes/1",
+			ExpectedStatus: 401,
+			TestAppFactory: newTestScenarioApp(nil, requireScopesTestOptions...),
+			AfterTestFunc:  expectTestWWWAuthenticate(`error="invalid_token"`),
+		},
+		{
+			// Regular PocketBase auth tokens aren't OAuth2 access tokens, so
+			// the scopes don't apply to them.
+			Name:           "pocketbase token",
+			Method:         http.MethodGet,
+			URL:            "/api/notes/1",
+			ExpectedStatus: 204,
+			TestAppFactory: newTestScenarioApp(func(t testing.TB, f *testFixture) {
+				f.setScenarioHeader("Authorization", generateTestUserToken(t, f.App))
+			}, requireScopesTestOptions...),
+		},
+	}
+	for _, scenario := range scenarios {
+		scenario.Test(t)
+	}
+}
+
+func TestRequireScopes_Audience(t *testing.T) {
+	// The guarded routes are protected resources, so they can be requested as
+	// the audience of the token.
+	withAudience := newTestScenarioApp(func(t testing.TB, f *testFixture) {
+		token := issueTestScopedAccessToken(t, f.App, f.Mux, url.Values{
+			"scope":    {"openid notes:read notes:write"},
+			"resource": {f.App.Settings().Meta.AppURL + "/api/admin"},
+		})
+		f.setScenarioHeader("Authorization", "Bearer "+token)
+	}, requireScopesTestOptions...)
+
+	scenarios := []tests.ApiScenario{
+		{
+			Name:           "audience",
+			Method:         http.MethodPost,
+			URL:            "/api/admin/notes",
+			ExpectedStatus: 204,
+			TestAppFactory: withAudience,
+		},
+		{
+			Name:           "other resource",
+			Method:         http.MethodGet,
+			URL:            "/api/notes/1",
+			ExpectedStatus: 401,
+			TestAppFactory: withAudience,
+			AfterTestFunc:  expectTestWWWAuthenticate(`error="invalid_token"`),
+		},
+	}
+	for _, scenario := range scenarios {
+		scenario.Test(t)
+	}
+}
+
+func TestRequireScopes_InactiveAccessToken(t *testing.T) {
+	// issueTestRefreshableToken authorizes the scenario request with an
+	// access token, and returns the refresh token issued with it.
+	issueTestRefreshableToken := func(t testing.TB, f *testFixture) string {
+		code := authorizeTestUser(t, f.App, f.Mux, url.Values{"scope": {"openid offline_access notes:read"}})
+		res := exchangeTestCode(t, f.Mux, code, nil)
+		accessToken, _ := res["access_token"].(string)
+		refreshToken, _ := res["refresh_token"].(string)
+		if accessToken == "" || refreshToken == "" {
+			t.Fatalf("expected access and refresh tokens, got %v", res)
+		}
+		f.setScenarioHeader("Authorization", "Bearer "+accessToken)
+		return refreshToken
+	}
+
+	scenarios := []tests.ApiScenario{
+		{
+			// The access token is replaced by the refresh.
+			Name:           "refreshed",
+			Method:         http.MethodGet,
+			URL:            "/api/notes/1",
+			ExpectedStatus: 401,
+			TestAppFactory: newTestScenarioApp(func(t testing.TB, f *testFixture) {
+				if err := refreshTestToken(t, f.Mux, issueTestRefreshableToken(t, f)); err != nil {
+					t.Fatalf("expected the refresh to succeed, got %v", err)
+				}
+			}, requireScopesTestOptions...),
+			AfterTestFunc: expectTestWWWAuthenticate(`error="invalid_token"`),
+		},
+		{
+			Name:           "revoked",
+			Method:         http.MethodGet,
+			URL:            "/api/notes/1",
+			ExpectedStatus: 401,
+			TestAppFactory: newTestScenarioApp(func(t testing.TB, f *testFixture) {
+				refreshToken := issueTestRefreshableToken(t, f)
+				r := doTestRequest(t, f.Mux, http.MethodPost, "/oauth2/revoke", url.Values{
+					"token":         {refreshToken},
+					"client_id":     {testClientID},
+					"client_secret": {testClientSecret},
+				}, nil)
+				if r.StatusCode != http.StatusOK {
+					t.Fatalf("expected status 200, got %d", r.StatusCode)
+				}
+			}, requireScopesTestOptions...),
+			AfterTestFunc: expectTestWWWAuthenticate(`error="invalid_token"`),
+		},
+	}
+	for _, scenario := range scenarios {
+		scenario.Test(t)
+	}
+}
+
+func TestRequireScopes_ProtectedResourceMetadata(t *testing.T) {
+	f := newTestFixture(t, requireScopesTestOptions...)
+
+	for path, scope := range map[string]string{"api/notes": "notes:read", "api/admin": "notes:write"} {
+		r := doTestRequest(t, f.Mux, http.MethodGet, "/.well-known/oauth-protected-resource/"+path, nil, nil)
+		if r.StatusCode != http.StatusOK {
+			t.Fatalf("expected status 200 for %s, got %d", path, r.StatusCode)
+		}
+		res := decodeTestJSONResponse(t, r)
+		if res["resource"] != f.App.Settings().Meta.AppURL+"/"+path {
+			t.Errorf("resource = %v, want %q", res["resource"], f.App.Settings().Meta.AppURL+"/"+path)
+		}
+		if scopes, _ := res["scopes_supported"].([]any); !slices.Equal(scopes, []any{scope}) {
+			t.Errorf("scopes_supported of %s = %v, want [%s]", path, scopes, scope)
+		}
+	}
+
+	r := doTestRequest(t, f.Mux, http.MethodGet, "/.well-known/openid-configuration", nil, nil)
+	scopes, _ := decodeTestJSONResponse(t, r)["scopes_supported"].([]any)
+	if !slices.Contains(scopes, "notes:read") || !slices.Contains(scopes, "notes:write") {
+		t.Errorf("expected the route scopes in scopes_supported, got %v", scopes)
+	}
+}
@@ -0,0 +1,204 @@
+package oauth2
+
+import (
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"testing"
+
+	oauth2 "github.com/benjamesfleming/pocketbase-ext-oauth2"
+	"github.com/benjamesfleming/pocketbase-ext-oauth2/rfc9728"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tests"
+)
+
+const (
+	testResourceA = testAppURL + "/api/a"
+	testResourceB = testAppURL + "/api/b"
+)
+
+// resourceTestOptions register two protected resources, "/api/a" and
+// "/api/b", and let the test client request a refresh token.
+var resourceTestOptions = []testFixtureOption{
+	withTestRoutes(func(se *core.ServeEvent) {
+		for _, path := range []string{"/api/a", "/api/b"} {
+			oauth2.RegisterProtectedResourceMetadata(&rfc9728.ProtectedResourceMetadata{
+				Resource:             se.App.Settings().Meta.AppURL + path,
+				AuthorizationServers: []string{se.App.Settings().Meta.AppURL},
+			})
+			se.Router.GET(path, func(e *core.RequestEvent) error {
+				return e.NoContent(http.StatusNoContent)
+			}).Bind(rfc9728.RequireAuthRFC9728WWWAuthenticateResponse())
+		}
+	}),
+	withTestClient(map[string]any{
+		"scope": "openid profile email offline_access",
+	}),
+}
+
+// newResourceTestApp returns an ApiScenario TestAppFactory, which authorizes
+// the scenario request with the access token issued by the code exchange.
+func newResourceTestApp(authorize url.Values, exchange url.Values, opts ...testFixtureOption) func(t testing.TB) *tests.TestApp {
+	return newTestScenarioApp(func(t testing.TB, f *testFixture) {
+		res := exchangeTestCode(t, f.Mux, authorizeTestUser(t, f.App, f.Mux, authorize), exchange)
+		token, _ := res["access_token"].(string)
+		f.setScenarioHeader("Authorization", "Bearer "+token)
+	}, slices.Concat(resourceTestOptions, opts)...)
+}
+
+func TestResourceIndicators(t *testing.T) {
+	scenarios := []tests.ApiScenario{
+		{
+			Name:           "audience",
+			Method:         http.MethodGet,
+			URL:            "/api/a",
+			ExpectedStatus: 204,
+			TestAppFactory: newResourceTestApp(url.Values{"resource": {testResourceA}}, nil),
+		},
+		{
+			Name:           "other resource",
+			Method:         http.MethodGet,
+			URL:            "/api/b",
+			ExpectedStatus: 401,
+			TestAppFactory: newResourceTestApp(url.Values{"resource": {testResourceA}}, nil),
+			AfterTestFunc:  expectTestWWWAuthenticate(`error="invalid_token"`),
+		},
+		{
+			// Tokens granted the openid scope remain valid at the userinfo
+			// endpoint.
+			Name:            "userinfo",
+			Method:          http.MethodGet,
+			URL:             "/oauth2/userinfo",
+			ExpectedStatus:  200,
+			ExpectedContent: []string{`"sub":"` + testUserID + `"`},
+			TestAppFactory:  newResourceTestApp(url.Values{"resource": {testResourceA}}, nil),
+		},
+		{
+			// A token without an audience is accepted by every resource.
+			Name:           "no resource",
+			Method:         http.MethodGet,
+			URL:            "/api/b",
+			ExpectedStatus: 204,
+			TestAppFactory: newResourceTestApp(nil, nil),
+		},
+		{
+			Name:           "narrowed at the token endpoint",
+			Method:         http.MethodGet,
+			URL:            "/api/a",
+			ExpectedStatus: 401,
+			TestAppFactory: newResourceTestApp(
+				url.Values{"resource": {testResourceA, testResourceB}},
+				url.Values{"resource": {testResourceB}},
+			),
+		},
+		{
+			Name:           "narrowed resource",
+			Method:         http.MethodGet,
+			URL:            "/api/b",
+			ExpectedStatus: 204,
+			TestAppFactory: newResourceTestApp(
+				url.Values{"resource": {testResourceA, testResourceB}},
+				url.Values{"resource": {testResourceB}},
+			),
+		},
+		{
+			// The refresh token keeps the full grant of a narrowed exchange.
+			Name:           "refreshed after narrowing",
+			Method:         http.MethodGet,
+			URL:            "/api/a",
+			ExpectedStatus: 204,
+			TestAppFactory: newTestScenarioApp(func(t testing.TB, f *testFixture) {
+				code := authorizeTestUser(t, f.App, f.Mux, url.Values{
+					"scope":    {"openid offline_access"},
+					"resource": {testResourceA, testResourceB},
+				})
+				res := exchangeTestCode(t, f.Mux, code, url.Values{"resource": {testResourceB}})
+				refreshToken, _ := res["refresh_token"].(string)
+				res = decodeTestJSONResponse(t, doTestRequest(t, f.Mux, http.MethodPost, "/oauth2/token", url.Values{
+					"grant_type":    {"refresh_token"},
+					"refresh_token": {refreshToken},
+					"client_id":     {testClientID},
+					"client_secret": {testClientSecret},
+				}, nil))
+				token, _ := res["access_token"].(string)
+				if token == "" {
+					t.Fatalf("expected the refresh to succeed, got %v", res)
+				}
+				f.setScenarioHeader("Authorization", "Bearer "+token)
+			}, resourceTestOptions...),
+		},
+		{
+			// The client may request tokens for the resources in its audience.
+			Name:           "client audience",
+			Method:         http.MethodGet,
+			URL:            "/api/a",
+			ExpectedStatus: 401,
+			TestAppFactory: newResourceTestApp(
+				url.Values{"resource": {"https://external.example.com/api"}},
+				nil,
+				withTestClient(map[string]any{"audience": []string{"https://external.example.com"}}),
+			),
+		},
+	}
+	for _, scenario := range scenarios {
+		scenario.Test(t)
+	}
+}
+
+func TestResourceIndicators_NotInGrantAtTokenEndpoint(t *testing.T) {
+	f := newTestFixture(t, resourceTestOptions...)
+
+	code := authorizeTestUser(t, f.App, f.Mux, url.Values{
+		"resource": {testResourceA},
+	})
+	r := doTestRequest(t, f.Mux, http.MethodPost, "/oauth2/token", url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"client_id":     {testClientID},
+		"client_secret": {testClientSecret},
+		"redirect_uri":  {testRedirectURI},
+		"resource":      {testResourceB},
+	}, nil)
+	if r.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected status 400, got %d", r.StatusCode)
+	}
+}
+
+func TestResourceIndicators_InvalidTarget(t *testing.T) {
+	scenarios := []tests.ApiScenario{}
+	for name, resource := range map[string]string{
+		"unknown resource": "https://unknown.example.com/api",
+		"relative uri":     "/api/a",
+		"fragment":         testResourceA + "#frag",
+	} {
+		scenarios = append(scenarios, tests.ApiScenario{
+			Name:   name,
+			Method: http.MethodPost,
+			URL:    "/oauth2/auth",
+			Body: strings.NewReader(url.Values{
+				"response_type": {"code"},
+				"client_id":     {testClientID},
+				"redirect_uri":  {testRedirectURI},
+				"scope":         {"openid"},
+				"state":         {"teststate1234"},
+				"resource":      {resource},
+			}.Encode()),
+			Headers:        map[string]string{"Content-Type": "application/x-www-form-urlencoded"},
+			ExpectedStatus: 303,
+			TestAppFactory: newTestScenarioApp(nil, resourceTestOptions...),
+			AfterTestFunc: func(t testing.TB, app *tests.TestApp, res *http.Response) {
+				location, err := res.Location()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got := location.Query().Get("error"); got != "invalid_target" {
+					t.Errorf("error = %q, want %q", got, "invalid_target")
+				}
+			},
+		})
+	}
+	for _, scenario := range scenarios {
+		scenario.Test(t)
+	}
+}
@@ -0,0 +1,299 @@
+package oauth2
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"testing"
+
+	oauth2 "github.com/benjamesfleming/pocketbase-ext-oauth2"
+	"github.com/benjamesfleming/pocketbase-ext-oauth2/consts"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tests"
+)
+
+// revokeSessionsTestOptions serve "/api/whoami", which only accepts
+// authenticated requests, and let the test client request a refresh token and
+// receive back-channel logouts.
+var revokeSessionsTestOptions = []testFixtureOption{
+	withTestRoutes(func(se *core.ServeEvent) {
+		se.Router.GET("/api/whoami", func(e *core.RequestEvent) error {
+			if e.Auth == nil {
+				return e.UnauthorizedError("", nil)
+			}
+			return e.NoContent(http.StatusNoContent)
+		})
+	}),
+	withTestClient(map[string]any{
+		"scope": "openid profile email offline_access",
+	}),
+	withTestBackChannelLogout(false),
+}
+
+// isTestTokenAccepted reports whether PocketBase accepts the auth token.
+func isTestTokenAccepted(t testing.TB, mux http.Handler, token string) bool {
+	t.Helper()
+	r := doTestRequest(t, mux, http.MethodGet, "/api/whoami", nil, map[string]string{
+		"Authorization": token,
+	})
+	return r.StatusCode == http.StatusNoContent
+}
+
+// refreshTestToken reports the error of the refresh token grant, if any.
+func refreshTestToken(t testing.TB, mux http.Handler, refreshToken string) any {
+	t.Helper()
+	r := doTestRequest(t, mux, http.MethodPost, "/oauth2/token", url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {refreshToken},
+		"client_id":     {testClientID},
+		"client_secret": {testClientSecret},
+	}, nil)
+	return decodeTestJSONResponse(t, r)["error"]
+}
+
+// revokeSessionsTestTokens are the tokens issued to the test client and the
+// test user before the scenario request.
+type revokeSessionsTestTokens struct {
+	f            *testFixture
+	accessToken  string
+	refreshToken string
+	userToken    string
+}
+
+// newRevokeSessionsTestApp returns an ApiScenario TestAppFactory, which signs
+// the test user in to the test client and authorizes the scenario request as
+// a superuser.
+func newRevokeSessionsTestApp(tokens *revokeSessionsTestTokens) func(t testing.TB) *tests.TestApp {
+	return newTestScenarioApp(func(t testing.TB, f *testFixture) {
+		code := authorizeTestUser(t, f.App, f.Mux, url.Values{"scope": {"openid offline_access"}})
+		res := exchangeTestCode(t, f.Mux, code, nil)
+		tokens.f = f
+		tokens.accessToken, _ = res["access_token"].(string)
+		tokens.refreshToken, _ = res["refresh_token"].(string)
+		tokens.userToken = generateTestUserToken(t, f.App)
+		if !isTestTokenAccepted(t, f.Mux, tokens.accessToken) || !isTestTokenAccepted(t, f.Mux, tokens.userToken) {
+			t.Fatal("expected the tokens to be accepted before the revocation")
+		}
+		f.setScenarioHeader("Authorization", generateTestSuperuserToken(t, f.App))
+	}, revokeSessionsTestOptions...)
+}
+
+func TestRevokeSessions(t *testing.T) {
+	bySubject := &revokeSessionsTestTokens{}
+	byClientID := &revokeSessionsTestTokens{}
+	browserSession := &revokeSessionsTestTokens{}
+
+	scenarios := []tests.ApiScenario{
+		{
+			Name:           "by subject",
+			Method:         http.MethodDelete,
+			URL:            "/oauth2/sessions?subject=" + testUserID,
+			ExpectedStatus: 204,
+			TestAppFactory: newRevokeSessionsTestApp(bySubject),
+			AfterTestFunc: func(t testing.TB, app *tests.TestApp, res *http.Response) {
+				tokens := bySubject
+				if err := refreshTestToken(t, tokens.f.Mux, tokens.refreshToken); err != "invalid_grant" {
+					t.Errorf("refresh error = %v, want %q", err, "invalid_grant")
+				}
+				if isTestTokenAccepted(t, tokens.f.Mux, tokens.accessToken) {
+					t.Error("expected the access token to be rejected")
+				}
+				// The user is signed out of PocketBase too.
+				if isTestTokenAccepted(t, tokens.f.Mux, tokens.userToken) {
+					t.Error("expected the user's PocketBase token to be rejected")
+				}
+				if claims := decodeTestJWTClaims(t, tokens.f.RP.waitForTestLogoutToken(t)); claims["sub"] != testUserID {
+					t.Errorf("sub = %v, want %q", claims["sub"], testUserID)
+				}
+				waitForTestDeliveries(t, app, func(records []*core.Record) bool { return len(records) == 0 })
+			},
+		},
+		{
+			Name:           "by client_id",
+			Method:         http.MethodDelete,
+			URL:            "/oauth2/sessions?client_id=" + testClientID,
+			ExpectedStatus: 204,
+			TestAppFactory: newRevokeSessionsTestApp(byClientID),
+			AfterTestFunc: func(t testing.TB, app *tests.TestApp, res *http.Response) {
+				tokens := byClientID
+				if err := refreshTestToken(t, tokens.f.Mux, tokens.refreshToken); err != "invalid_grant" {
+					t.Errorf("refresh error = %v, want %q", err, "invalid_grant")
+				}
+				if isTestTokenAccepted(t, tokens.f.Mux, tokens.accessToken) {
+					t.Error("expected the access token to be rejected")
+				}
+				// The user stays signed in to PocketBase.
+				if !isTestTokenAccepted(t, tokens.f.Mux, tokens.userToken) {
+					t.Error("expected the user's PocketBase token to be accepted")
+				}
+				if n, _ := app.CountRecords(consts.RevokedTokenCollectionName); n != 1 {
+					t.Errorf("expected one revoked token, got %d", n)
+				}
+				if claims := decodeTestJWTClaims(t, tokens.f.RP.waitForTestLogoutToken(t)); claims["sub"] != testUserID {
+					t.Errorf("sub = %v, want %q", claims["sub"], testUserID)
+				}
+				waitForTestDeliveries(t, app, func(records []*core.Record) bool { return len(records) == 0 })
+			},
+		},
+		{
+			Name:           "browser session",
+			Method:         http.MethodDelete,
+			URL:            "/oauth2/sessions?subject=" + testUserID,
+			ExpectedStatus: 204,
+			TestAppFactory: newTestScenarioApp(func(t testing.TB, f *testFixture) {
+				browserSession.f = f
+				res := authorizeTestBrowserRequest(t, f.App, f.Mux, nil, nil)
+				exchangeTestCode(t, f.Mux, getTestAuthorizationCode(t, res), nil)
+				f.setScenarioHeader("Authorization", generateTestSuperuserToken(t, f.App))
+			}, revokeSessionsTestOptions...),
+			AfterTestFunc: func(t testing.TB, app *tests.TestApp, res *http.Response) {
+				// The logout token carries the sid of the browser session.
+				bs := findTestBrowserSession(t, app)
+				claims := decodeTestJWTClaims(t, browserSession.f.RP.waitForTestLogoutToken(t))
+				if claims["sid"] != bs.GetString("sid") {
+					t.Errorf("sid = %v, want %q", claims["sid"], bs.GetString("sid"))
+				}
+				// The user is no longer logged in to the browser session.
+				if accounts := bs.GetString("accounts"); accounts != "[]" {
+					t.Errorf("expected no accounts in the browser session, got %s", accounts)
+				}
+				waitForTestDeliveries(t, app, func(records []*core.Record) bool { return len(records) == 0 })
+			},
+		},
+		{
+			Name:            "without subject or client_id",
+			Method:          http.MethodDelete,
+			URL:             "/oauth2/sessions",
+			ExpectedStatus:  400,
+			ExpectedContent: []string{`"status":400`},
+			TestAppFactory: newTestScenarioApp(func(t testing.TB, f *testFixture) {
+				f.setScenarioHeader("Authorization", generateTestSuperuserToken(t, f.App))
+			}, revokeSessionsTestOptions...),
+		},
+		{
+			Name:            "as a user",
+			Method:          http.MethodDelete,
+			URL:             "/oauth2/sessions?subject=" + testUserID,
+			ExpectedStatus:  403,
+			ExpectedContent: []string{`"status":403`},
+			TestAppFactory: newTestScenarioApp(func(t testing.TB, f *testFixture) {
+				f.setScenarioHeader("Authorization", generateTestUserToken(t, f.App))
+			}, revokeSessionsTestOptions...),
+		},
+	}
+	for _, scenario := range scenarios {
+		scenario.Test(t)
+	}
+}
+
+func TestRevokeSessions_RevokedAccessToken(t *testing.T) {
+	// The access token is rejected by PocketBase once its refresh token is
+	// revoked with RFC 7009, or refreshed.
+	scenarios := []tests.ApiScenario{
+		{
+			Name:            "revoked",
+			Method:          http.MethodGet,
+			URL:             "/api/whoami",
+			ExpectedStatus:  401,
+			ExpectedContent: []string{`"status":401`},
+			TestAppFactory: newTestScenarioApp(func(t testing.TB, f *testFixture) {
+				res := exchangeTestCode(t, f.Mux, authorizeTestUser(t, f.App, f.Mux, url.Values{"scope": {"openid offline_access"}}), nil)
+				accessToken, _ := res["access_token"].(string)
+				refreshToken, _ := res["refresh_token"].(string)
+				r := doTestRequest(t, f.Mux, http.MethodPost, "/oauth2/revoke", url.Values{
+					"token":         {refreshToken},
+					"client_id":     {testClientID},
+					"client_secret": {testClientSecret},
+				}, nil)
+				if r.StatusCode != http.StatusOK {
+					t.Fatalf("expected status 200, got %d", r.StatusCode)
+				}
+				f.setScenarioHeader("Authorization", accessToken)
+			}, revokeSessionsTestOptions...),
+		},
+		{
+			Name:            "refreshed",
+			Method:          http.MethodGet,
+			URL:             "/api/whoami",
+			ExpectedStatus:  401,
+			ExpectedContent: []string{`"status":401`},
+			TestAppFactory: newTestScenarioApp(func(t testing.TB, f *testFixture) {
+				res := exchangeTestCode(t, f.Mux, authorizeTestUser(t, f.App, f.Mux, url.Values{"scope": {"openid offline_access"}}), nil)
+				accessToken, _ := res["access_token"].(string)
+				refreshToken, _ := res["refresh_token"].(string)
+				if err := refreshTestToken(t, f.Mux, refreshToken); err != nil {
+					t.Fatalf("expected the refresh to succeed, got %v", err)
+				}
+				f.setScenarioHeader("Authorization", accessToken)
+			}, revokeSessionsTestOptions...),
+		},
+		{
+			// The access token issued by the refresh is still accepted, even
+			// when it is issued within the same second as the revoked one.
+			Name:           "replaced by a refresh",
+			Method:         http.MethodGet,
+			URL:            "/api/whoami",
+			ExpectedStatus: 204,
+			TestAppFactory: newTestScenarioApp(func(t testing.TB, f *testFixture) {
+				res := exchangeTestCode(t, f.Mux, authorizeTestUser(t, f.App, f.Mux, url.Values{"scope": {"openid offline_access"}}), nil)
+				refreshToken, _ := res["refresh_token"].(string)
+				res = decodeTestJSONResponse(t, doTestRequest(t, f.Mux, http.MethodPost, "/oauth2/token", url.Values{
+					"grant_type":    {"refresh_token"},
+					"refresh_token": {refreshToken},
+					"client_id":     {testClientID},
+					"client_secret": {testClientSecret},
+				}, nil))
+				accessToken, _ := res["access_token"].(string)
+				if accessToken == "" {
+					t.Fatalf("expected the refresh to succeed, got %v", res)
+				}
+				f.setScenarioHeader("Authorization", accessToken)
+			}, revokeSessionsTestOptions...),
+		},
+	}
+	for _, scenario := range scenarios {
+		scenario.Test(t)
+	}
+}
+
+func TestRevokeSessions_Store(t *testing.T) {
+	f := newTestFixture(t, revokeSessionsTestOptions...)
+
+	store := oauth2.NewOAuth2Store(f.App)
+	if err := store.RevokeSessionsBySubject(context.Background(), ""); err == nil {
+		t.Error("expected an error for an empty subject")
+	}
+	if err := store.RevokeSessionsByClientID(context.Background(), ""); err == nil {
+		t.Error("expected an error for an empty client_id")
+	}
+
+	for name, revoke := range map[string]func() error{
+		"subject": func() error {
+			return store.RevokeSessionsBySubject(context.Background(), f.User.Id)
+		},
+		"client_id": func() error {
+			return store.RevokeSessionsByClientID(context.Background(), testClientID)
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			code := authorizeTestUser(t, f.App, f.Mux, url.Values{"scope": {"openid offline_access"}})
+			exchangeTestCode(t, f.Mux, code, nil)
+
+			if err := revoke(); err != nil {
+				t.Fatal(err)
+			}
+			waitForTestDeliveries(t, f.App, func(records []*core.Record) bool { return len(records) == 0 })
+			for _, collection := range []string{
+				consts.AuthCodeCollectionName,
+				consts.AccessCollectionName,
+				consts.RefreshCollectionName,
+				consts.PKCECollectionName,
+				consts.OpenIDConnectCollectionName,
+			} {
+				if n, _ := f.App.CountRecords(collection); n != 0 {
+					t.Errorf("expected no %s records, got %d", collection, n)
+				}
+			}
+		})
+	}
+}
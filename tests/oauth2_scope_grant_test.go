@@ -0,0 +1,116 @@
+package oauth2
+
+import (
+	"net/http"
+	"net/url"
+	"slices"
+	"testing"
+
+	oauth2 "github.com/benjamesfleming/pocketbase-ext-oauth2"
+	"github.com/ory/fosite"
+	"github.com/pocketbase/pocketbase/core"
+)
+
+// scopeGrantTestOptions only grant the "admin:*" scopes to users with the
+// admin role. The test client may request them.
+var scopeGrantTestOptions = []testFixtureOption{
+	withTestConfig(func(cfg *oauth2.Config) {
+		cfg.ScopeGrantFilters = oauth2.ScopeGrantFilters{
+			"admin:*": "role = 'admin'",
+		}
+	}),
+	withTestClient(map[string]any{"scope": "openid profile offline_access admin:read admin:write"}),
+	withTestUserFields(&core.TextField{Name: "role"}),
+}
+
+// setTestUserRole updates the role of the test user.
+func setTestUserRole(t testing.TB, app core.App, user *core.Record, role string) {
+	t.Helper()
+	user.Set("role", role)
+	if err := app.Save(user); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestScopeGrant_FilterDeniesScopes(t *testing.T) {
+	f := newTestFixture(t, scopeGrantTestOptions...)
+
+	code := authorizeTestUser(t, f.App, f.Mux, url.Values{"scope": {"openid profile admin:read admin:write"}})
+	res := exchangeTestCode(t, f.Mux, code, nil)
+	if res["scope"] != "openid profile" {
+		t.Errorf("scope = %v, want %q", res["scope"], "openid profile")
+	}
+}
+
+func TestScopeGrant_FilterAllowsScopes(t *testing.T) {
+	f := newTestFixture(t, scopeGrantTestOptions...)
+
+	setTestUserRole(t, f.App, f.User, "admin")
+
+	code := authorizeTestUser(t, f.App, f.Mux, url.Values{"scope": {"openid profile admin:read admin:write"}})
+	res := exchangeTestCode(t, f.Mux, code, nil)
+	if res["scope"] != "openid profile admin:read admin:write" {
+		t.Errorf("scope = %v, want %q", res["scope"], "openid profile admin:read admin:write")
+	}
+}
+
+func TestScopeGrant_ConsentOmitsDeniedScopes(t *testing.T) {
+	f := newTestFixture(t, scopeGrantTestOptions...)
+
+	location := authorizeTestRequest(t, f.App, f.Mux, url.Values{"scope": {"openid admin:read"}})
+	assertConsentRedirect(t, f.Mux, location, f.User)
+	scopes, _ := decodeTestLoginState(t, f.Mux, location)["requested_scopes"].([]any)
+	if len(scopes) != 1 || scopes[0] != "openid" {
+		t.Errorf("requested_scopes = %v, want [openid]", scopes)
+	}
+}
+
+func TestScopeGrant_RefreshReevaluatesScopes(t *testing.T) {
+	f := newTestFixture(t, scopeGrantTestOptions...)
+
+	setTestUserRole(t, f.App, f.User, "admin")
+
+	code := authorizeTestUser(t, f.App, f.Mux, url.Values{"scope": {"openid offline_access admin:read"}})
+	res := exchangeTestCode(t, f.Mux, code, nil)
+	refreshToken, _ := res["refresh_token"].(string)
+	if refreshToken == "" {
+		t.Fatalf("expected refresh token in response, got %v", res)
+	}
+
+	setTestUserRole(t, f.App, f.User, "")
+
+	res = decodeTestJSONResponse(t, doTestRequest(t, f.Mux, http.MethodPost, "/oauth2/token", url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {refreshToken},
+		"client_id":     {testClientID},
+		"client_secret": {testClientSecret},
+	}, nil))
+	if res["scope"] != "openid offline_access" {
+		t.Errorf("refreshed scope = %v, want %q", res["scope"], "openid offline_access")
+	}
+}
+
+// staticScopeGrantStrategy grants a fixed set of scopes.
+type staticScopeGrantStrategy []string
+
+func (s staticScopeGrantStrategy) GetGrantedScopes(e *core.RequestEvent, user *core.Record, client fosite.Client, audience []string, scopes []string) ([]string, error) {
+	ret := []string{}
+	for _, scope := range scopes {
+		if slices.Contains(s, scope) {
+			ret = append(ret, scope)
+		}
+	}
+	return ret, nil
+}
+
+func TestScopeGrant_CustomStrategy(t *testing.T) {
+	f := newTestFixture(t, withTestConfig(func(cfg *oauth2.Config) {
+		cfg.ScopeGrantStrategy = staticScopeGrantStrategy{"openid"}
+	}))
+
+	code := authorizeTestUser(t, f.App, f.Mux, nil)
+	res := exchangeTestCode(t, f.Mux, code, nil)
+	if res["scope"] != "openid" {
+		t.Errorf("scope = %v, want %q", res["scope"], "openid")
+	}
+}
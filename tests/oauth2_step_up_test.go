@@ -0,0 +1,118 @@
+package oauth2
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/benjamesfleming/pocketbase-ext-oauth2/rfc9728"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tests"
+)
+
+// stepUpTestOptions serve "/api/payouts", which requires a loa2 login in the
+// last 5 minutes, and "/api/recent", which requires a login in the last
+// minute.
+var stepUpTestOptions = []testFixtureOption{
+	withTestRoutes(func(se *core.ServeEvent) {
+		handler := func(e *core.RequestEvent) error {
+			return e.NoContent(http.StatusNoContent)
+		}
+		se.Router.GET("/api/payouts", handler).Bind(rfc9728.RequireAuthRFC9470StepUpResponse("loa2", 5*time.Minute))
+		se.Router.GET("/api/recent", handler).Bind(rfc9728.RequireAuthRFC9470StepUpResponse("", time.Minute))
+	}),
+}
+
+// issueTestAccessToken runs the authorization request with the user token and
+// returns the issued access token.
+func issueTestAccessToken(t testing.TB, mux http.Handler, token string) string {
+	t.Helper()
+	location := authorizeTestRequestWithToken(t, mux, token, url.Values{"consent": {"granted"}})
+	res := exchangeTestCode(t, mux, location.Query().Get("code"), nil)
+	accessToken, _ := res["access_token"].(string)
+	if accessToken == "" {
+		t.Fatalf("expected access token, got %v", res)
+	}
+	return accessToken
+}
+
+// newStepUpTestApp returns an ApiScenario TestAppFactory, which authorizes the
+// scenario request with an access token issued for the user token returned by
+// login.
+func newStepUpTestApp(login func(t testing.TB, f *testFixture) string) func(t testing.TB) *tests.TestApp {
+	return newTestScenarioApp(func(t testing.TB, f *testFixture) {
+		f.setScenarioHeader("Authorization", "Bearer "+issueTestAccessToken(t, f.Mux, login(t, f)))
+	}, stepUpTestOptions...)
+}
+
+func TestStepUp(t *testing.T) {
+	recentLogin := func(t testing.TB, f *testFixture) string {
+		return generateTestUserToken(t, f.App)
+	}
+	scenarios := []tests.ApiScenario{
+		{
+			Name:           "insufficient acr",
+			Method:         http.MethodGet,
+			URL:            "/api/payouts",
+			ExpectedStatus: 401,
+			TestAppFactory: newStepUpTestApp(recentLogin),
+			AfterTestFunc:  expectTestWWWAuthenticate(`error="insufficient_user_authentication"`, `acr_values="loa2"`, `max_age="300"`),
+		},
+		{
+			Name:           "sufficient acr",
+			Method:         http.MethodGet,
+			URL:            "/api/payouts",
+			ExpectedStatus: 204,
+			TestAppFactory: newStepUpTestApp(func(t testing.TB, f *testFixture) string {
+				enableTestMFA(t, f.App, f.User)
+				return loginTestUserWithMFA(t, f.App, f.Mux, f.User)
+			}),
+		},
+		{
+			Name:           "login too old",
+			Method:         http.MethodGet,
+			URL:            "/api/recent",
+			ExpectedStatus: 401,
+			TestAppFactory: newStepUpTestApp(func(t testing.TB, f *testFixture) string {
+				return generateTestUserTokenIssuedAt(t, f.App, time.Hour)
+			}),
+			AfterTestFunc: func(t testing.TB, app *tests.TestApp, res *http.Response) {
+				expectTestWWWAuthenticate(`error="insufficient_user_authentication"`, `max_age="60"`)(t, app, res)
+				if h := res.Header.Get("WWW-Authenticate"); strings.Contains(h, "acr_values") {
+					t.Errorf("expected no acr_values in WWW-Authenticate header %q", h)
+				}
+			},
+		},
+		{
+			Name:           "recent login",
+			Method:         http.MethodGet,
+			URL:            "/api/recent",
+			ExpectedStatus: 204,
+			TestAppFactory: newStepUpTestApp(recentLogin),
+		},
+		{
+			Name:           "unauthenticated",
+			Method:         http.MethodGet,
+			URL:            "/api/payouts",
+			ExpectedStatus: 401,
+			TestAppFactory: newTestScenarioApp(nil, stepUpTestOptions...),
+			AfterTestFunc:  expectTestWWWAuthenticate(`error="invalid_token"`),
+		},
+		{
+			// Regular PocketBase auth tokens aren't OAuth2 access tokens, so
+			// the step-up requirements don't apply to them.
+			Name:           "pocketbase token",
+			Method:         http.MethodGet,
+			URL:            "/api/payouts",
+			ExpectedStatus: 204,
+			TestAppFactory: newTestScenarioApp(func(t testing.TB, f *testFixture) {
+				f.setScenarioHeader("Authorization", generateTestUserToken(t, f.App))
+			}, stepUpTestOptions...),
+		},
+	}
+	for _, scenario := range scenarios {
+		scenario.Test(t)
+	}
+}
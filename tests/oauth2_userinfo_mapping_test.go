@@ -0,0 +1,240 @@
+package oauth2
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+
+	oauth2 "github.com/benjamesfleming/pocketbase-ext-oauth2"
+	"github.com/ory/fosite"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tests"
+)
+
+// seedMappedUser creates a user with non-standard field names and a "groups"
+// relation so that the claim mappings can be exercised.
+func seedMappedUser(t testing.TB, app core.App) *core.Record {
+	t.Helper()
+
+	groups := core.NewBaseCollection("groups")
+	groups.Fields.Add(&core.TextField{Name: "name"})
+	if err := app.Save(groups); err != nil {
+		t.Fatalf("failed to create groups collection: %v", err)
+	}
+
+	users := seedUsersCollection(t, app)
+	users.Fields.Add(
+		&core.TextField{Name: "first_name"},
+		&core.TextField{Name: "last_name"},
+		&core.JSONField{Name: "meta"},
+		&core.RelationField{Name: "groups", CollectionId: groups.Id, MaxSelect: 10},
+	)
+	if err := app.Save(users); err != nil {
+		t.Fatalf("failed to update users collection: %v", err)
+	}
+
+	var groupIds []string
+	for _, name := range []string{"admins", "staff"} {
+		g := core.NewRecord(groups)
+		g.Set("name", name)
+		if err := app.Save(g); err != nil {
+			t.Fatalf("failed to create group: %v", err)
+		}
+		groupIds = append(groupIds, g.Id)
+	}
+
+	user := seedTestUser(t, app)
+	user.Set("first_name", "Jane")
+	user.Set("last_name", "Doe")
+	user.Set("meta", map[string]any{"department": "Engineering"})
+	user.Set("groups", groupIds)
+	if err := app.Save(user); err != nil {
+		t.Fatalf("failed to update user: %v", err)
+	}
+	return user
+}
+
+func TestMappedUserInfoClaimStrategy(t *testing.T) {
+	app := setupTestApp(t)
+	defer app.Cleanup()
+
+	user := seedMappedUser(t, app)
+
+	strategy := &oauth2.MappedUserInfoClaimStrategy{
+		Mappings: oauth2.DefaultClaimMappings().Merge(oauth2.ClaimMappings{
+			"profile": {
+				"name":       "{first_name} {last_name}",
+				"nickname":   "",
+				"department": "meta.department",
+			},
+			"groups": {
+				"groups": "groups.name",
+			},
+		}),
+	}
+
+	e := &core.RequestEvent{App: app, Auth: user}
+
+	info, err := strategy.GetUserInfoClaims(e, []string{"openid", "profile", "email", "groups"})
+	if err != nil {
+		t.Fatalf("GetUserInfoClaims failed: %v", err)
+	}
+	claims := info.(map[string]any)
+
+	if claims["sub"] != user.Id {
+		t.Errorf("sub = %v, want %q", claims["sub"], user.Id)
+	}
+	if claims["name"] != "Jane Doe" {
+		t.Errorf("name = %v, want %q", claims["name"], "Jane Doe")
+	}
+	if claims["department"] != "Engineering" {
+		t.Errorf("department = %v, want %q", claims["department"], "Engineering")
+	}
+	if claims["email"] != testUserEmail {
+		t.Errorf("email = %v, want %q", claims["email"], testUserEmail)
+	}
+	if claims["email_verified"] != true {
+		t.Errorf("email_verified = %v, want true", claims["email_verified"])
+	}
+	if _, ok := claims["updated_at"].(int64); !ok {
+		t.Errorf("updated_at = %v (%T), want unix timestamp", claims["updated_at"], claims["updated_at"])
+	}
+	groups, ok := claims["groups"].([]any)
+	if !ok || len(groups) != 2 || groups[0] != "admins" || groups[1] != "staff" {
+		t.Errorf("groups = %v, want [admins staff]", claims["groups"])
+	}
+
+	// The relation expansion must not leak into the request event's auth record.
+	if len(user.Expand()) != 0 {
+		t.Errorf("expected auth record expand to be untouched, got %v", user.Expand())
+	}
+}
+
+func TestMappedUserInfoClaimStrategy_ScopeFiltering(t *testing.T) {
+	app := setupTestApp(t)
+	defer app.Cleanup()
+
+	user := seedMappedUser(t, app)
+
+	strategy := &oauth2.MappedUserInfoClaimStrategy{
+		Mappings: oauth2.ClaimMappings{
+			"groups": {
+				"groups": "groups.name",
+			},
+			"address": {
+				"address.locality": "meta.city",
+				"address.country":  "meta.department",
+			},
+		},
+	}
+
+	info, err := strategy.GetUserInfoClaims(&core.RequestEvent{App: app, Auth: user}, []string{"openid", "address"})
+	if err != nil {
+		t.Fatalf("GetUserInfoClaims failed: %v", err)
+	}
+	claims := info.(map[string]any)
+
+	if _, ok := claims["groups"]; ok {
+		t.Error("expected groups claim to be omitted without the groups scope")
+	}
+	address, ok := claims["address"].(map[string]any)
+	if !ok {
+		t.Fatalf("expected nested address claim, got %v", claims["address"])
+	}
+	if address["country"] != "Engineering" {
+		t.Errorf("address.country = %v, want %q", address["country"], "Engineering")
+	}
+	if _, ok := address["locality"]; ok {
+		t.Error("expected empty address.locality to be omitted")
+	}
+}
+
+func TestMappedUserInfoClaimStrategy_UnsupportedFormat(t *testing.T) {
+	app := setupTestApp(t)
+	defer app.Cleanup()
+
+	user := seedTestUser(t, app)
+
+	strategy := &oauth2.MappedUserInfoClaimStrategy{
+		Mappings: oauth2.ClaimMappings{
+			"profile": {"name": "name|unknown"},
+		},
+	}
+
+	if _, err := strategy.GetUserInfoClaims(&core.RequestEvent{App: app, Auth: user}, []string{"profile"}); err == nil {
+		t.Error("expected error for unsupported format, got nil")
+	}
+}
+
+func TestMappedUserInfoClaimStrategy_Unauthenticated(t *testing.T) {
+	app := setupTestApp(t)
+	defer app.Cleanup()
+
+	strategy := &oauth2.MappedUserInfoClaimStrategy{Mappings: oauth2.DefaultClaimMappings()}
+	if _, err := strategy.GetUserInfoClaims(&core.RequestEvent{App: app}, []string{"profile"}); !errors.Is(err, oauth2.ErrInvalidToken) {
+		t.Errorf("expected invalid_token error, got %v", err)
+	}
+}
+
+func TestClaimMappings_Discovery(t *testing.T) {
+	scenario := tests.ApiScenario{
+		Name:            "openid-configuration - advertises mapped scopes and claims",
+		Method:          http.MethodGet,
+		URL:             "/.well-known/openid-configuration",
+		ExpectedStatus:  200,
+		ExpectedContent: []string{`"groups"`},
+		TestAppFactory: func(t testing.TB) *tests.TestApp {
+			oauth2.ResetGlobalStateForTests()
+			app, err := tests.NewTestApp(t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = oauth2.Register(app, &oauth2.Config{
+				BaseConfig:     &fosite.Config{},
+				UserCollection: testUserCollection,
+				UserInfoClaimMappings: oauth2.ClaimMappings{
+					"groups": {"groups": "groups.name"},
+				},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, ok := oauth2.GetOAuth2Config().UserInfoClaimStrategy.(*oauth2.MappedUserInfoClaimStrategy); !ok {
+				t.Errorf("expected MappedUserInfoClaimStrategy, got %T", oauth2.GetOAuth2Config().UserInfoClaimStrategy)
+			}
+			return app
+		},
+	}
+	scenario.Test(t)
+}
+
+func TestClaimMappings_DiscoveryCustomStrategy(t *testing.T) {
+	scenario := tests.ApiScenario{
+		Name:               "openid-configuration - ignores the mappings of an unused strategy",
+		Method:             http.MethodGet,
+		URL:                "/.well-known/openid-configuration",
+		ExpectedStatus:     200,
+		ExpectedContent:    []string{`"scopes_supported"`},
+		NotExpectedContent: []string{`"groups"`},
+		TestAppFactory: func(t testing.TB) *tests.TestApp {
+			oauth2.ResetGlobalStateForTests()
+			app, err := tests.NewTestApp(t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = oauth2.Register(app, &oauth2.Config{
+				BaseConfig:            &fosite.Config{},
+				UserCollection:        testUserCollection,
+				UserInfoClaimStrategy: &oauth2.DefaultUserInfoClaimStrategy{},
+				UserInfoClaimMappings: oauth2.ClaimMappings{
+					"groups": {"groups": "groups.name"},
+				},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			return app
+		},
+	}
+	scenario.Test(t)
+}
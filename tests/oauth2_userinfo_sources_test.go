@@ -0,0 +1,158 @@
+package oauth2
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	oauth2 "github.com/benjamesfleming/pocketbase-ext-oauth2"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tests"
+)
+
+func TestClaimSources_JSON(t *testing.T) {
+	info := &oauth2.UserInfoClaims{Sub: "user123"}
+	info.AddAggregated("src1", "header.payload.signature", "employee_id", "department")
+	info.AddDistributed("src2", "https://verify.example.com/claims", "abc", "verified_identity")
+
+	raw, err := json.Marshal(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := map[string]any{}
+	if err := json.Unmarshal(raw, &got); err != nil {
+		t.Fatal(err)
+	}
+
+	names, ok := got["_claim_names"].(map[string]any)
+	if !ok {
+		t.Fatalf("expected _claim_names member, got %s", raw)
+	}
+	if names["employee_id"] != "src1" || names["department"] != "src1" || names["verified_identity"] != "src2" {
+		t.Errorf("unexpected _claim_names %v", names)
+	}
+
+	sources, ok := got["_claim_sources"].(map[string]any)
+	if !ok {
+		t.Fatalf("expected _claim_sources member, got %s", raw)
+	}
+	if src := sources["src1"].(map[string]any); src["JWT"] != "header.payload.signature" {
+		t.Errorf("unexpected aggregated source %v", src)
+	}
+	if src := sources["src2"].(map[string]any); src["endpoint"] != "https://verify.example.com/claims" || src["access_token"] != "abc" {
+		t.Errorf("unexpected distributed source %v", src)
+	}
+}
+
+func TestClaimSources_OmittedWhenEmpty(t *testing.T) {
+	raw, err := json.Marshal(&oauth2.UserInfoClaims{Sub: "user123"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(raw) != `{"sub":"user123"}` {
+		t.Errorf("expected only sub claim, got %s", raw)
+	}
+}
+
+func TestNewAggregatedClaimsJWT(t *testing.T) {
+	app := setupTestApp(t)
+	defer app.Cleanup()
+
+	token, err := oauth2.NewAggregatedClaimsJWT(context.Background(), map[string]any{"employee_id": "E123"})
+	if err != nil {
+		t.Fatalf("NewAggregatedClaimsJWT failed: %v", err)
+	}
+
+	claims := decodeTestJWTClaims(t, token)
+	if claims["employee_id"] != "E123" {
+		t.Errorf("employee_id = %v, want %q", claims["employee_id"], "E123")
+	}
+	if claims["iss"] != app.Settings().Meta.AppURL {
+		t.Errorf("iss = %v, want %q", claims["iss"], app.Settings().Meta.AppURL)
+	}
+}
+
+// withTestClaimSources sets a claim strategy with a distributed claim source,
+// and enables the aggregated and distributed claims if enabled is set.
+func withTestClaimSources(enabled bool) testFixtureOption {
+	return withTestConfig(func(cfg *oauth2.Config) {
+		cfg.EnableAggregatedAndDistributedClaims = enabled
+		cfg.UserInfoClaimStrategy = &oauth2.MappedUserInfoClaimStrategy{
+			Mappings: oauth2.DefaultClaimMappings(),
+			ClaimSources: func(e *core.RequestEvent, scopes []string) (*oauth2.ClaimSources, error) {
+				ret := &oauth2.ClaimSources{}
+				ret.AddDistributed("hr", "https://hr.example.com/claims", "hr-token", "employee_id")
+				return ret, nil
+			},
+		}
+	})
+}
+
+func TestIDToken_ContainsClaimSources(t *testing.T) {
+	f := newTestFixture(t, withTestClaimSources(true))
+
+	res := exchangeTestCode(t, f.Mux, authorizeTestUser(t, f.App, f.Mux, nil), nil)
+	idToken, _ := res["id_token"].(string)
+	claims := decodeTestJWTClaims(t, idToken)
+
+	names, ok := claims["_claim_names"].(map[string]any)
+	if !ok || names["employee_id"] != "hr" {
+		t.Errorf("expected _claim_names in ID token, got %v", claims["_claim_names"])
+	}
+	sources, ok := claims["_claim_sources"].(map[string]any)
+	if !ok {
+		t.Fatalf("expected _claim_sources in ID token, got %v", claims)
+	}
+	if src, _ := sources["hr"].(map[string]any); src["endpoint"] != "https://hr.example.com/claims" {
+		t.Errorf("unexpected distributed source %v", sources["hr"])
+	}
+}
+
+func TestIDToken_ClaimSourcesDisabled(t *testing.T) {
+	f := newTestFixture(t, withTestClaimSources(false))
+
+	res := exchangeTestCode(t, f.Mux, authorizeTestUser(t, f.App, f.Mux, nil), nil)
+	idToken, _ := res["id_token"].(string)
+	claims := decodeTestJWTClaims(t, idToken)
+	if _, ok := claims["_claim_names"]; ok {
+		t.Errorf("expected no _claim_names in ID token when disabled, got %v", claims["_claim_names"])
+	}
+}
+
+func TestUserInfo_ClaimSources(t *testing.T) {
+	withAccessToken := func(enabled bool) func(t testing.TB) *tests.TestApp {
+		return newTestScenarioApp(func(t testing.TB, f *testFixture) {
+			res := exchangeTestCode(t, f.Mux, authorizeTestUser(t, f.App, f.Mux, nil), nil)
+			token, _ := res["access_token"].(string)
+			f.setScenarioHeader("Authorization", "Bearer "+token)
+		}, withTestClaimSources(enabled))
+	}
+
+	scenarios := []tests.ApiScenario{
+		{
+			Name:           "enabled",
+			Method:         http.MethodGet,
+			URL:            "/oauth2/userinfo",
+			ExpectedStatus: 200,
+			ExpectedContent: []string{
+				`"_claim_names":{"employee_id":"hr"}`,
+				`"endpoint":"https://hr.example.com/claims"`,
+			},
+			TestAppFactory: withAccessToken(true),
+		},
+		{
+			Name:               "disabled",
+			Method:             http.MethodGet,
+			URL:                "/oauth2/userinfo",
+			ExpectedStatus:     200,
+			ExpectedContent:    []string{`"sub":"` + testUserID + `"`},
+			NotExpectedContent: []string{"_claim_names", "_claim_sources"},
+			TestAppFactory:     withAccessToken(false),
+		},
+	}
+	for _, scenario := range scenarios {
+		scenario.Test(t)
+	}
+}
@@ -2,21 +2,35 @@ package oauth2
 
 import (
 	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	oauth2 "github.com/benjamesfleming/pocketbase-ext-oauth2"
 	"github.com/benjamesfleming/pocketbase-ext-oauth2/consts"
 	"github.com/ory/fosite"
+	"github.com/pocketbase/pocketbase/apis"
 	"github.com/pocketbase/pocketbase/core"
 	"github.com/pocketbase/pocketbase/tests"
+	"github.com/pocketbase/pocketbase/tools/hook"
+	"github.com/pocketbase/pocketbase/tools/security"
 )
 
 const (
 	testClientID          = "test-client-id"
 	testClientSecret      = "test-client-secret"
 	testClientName        = "Test Client"
-	testRedirectURI       = "http://localhost:8090/callback"
+	testAppURL            = "http://localhost:8090"
+	testRedirectURI       = testAppURL + "/callback"
+	testUserID            = "testuser0000001"
 	testUserEmail         = "testuser@example.com"
 	testUserPassword      = "Test1234!"
 	testUserCollection    = "users"
@@ -25,8 +39,9 @@ const (
 )
 
 // setupTestApp creates a fresh TestApp with the OAuth2 plugin registered.
-// The caller should defer testApp.Cleanup().
-func setupTestApp(t testing.TB) *tests.TestApp {
+// Optional configure funcs can be used to adjust the config before it is
+// registered. The caller should defer testApp.Cleanup().
+func setupTestApp(t testing.TB, configure ...func(cfg *oauth2.Config)) *tests.TestApp {
 	t.Helper()
 	oauth2.ResetGlobalStateForTests()
 	tempDir, err := os.MkdirTemp("", "pb_oauth2_test_*")
@@ -38,7 +53,7 @@ func setupTestApp(t testing.TB) *tests.TestApp {
 		os.RemoveAll(tempDir)
 		t.Fatal(err)
 	}
-	err = oauth2.Register(testApp, &oauth2.Config{
+	cfg := &oauth2.Config{
 		BaseConfig: &fosite.Config{
 			ScopeStrategy:            fosite.ExactScopeStrategy,
 			AudienceMatchingStrategy: fosite.DefaultAudienceMatchingStrategy,
@@ -47,7 +62,11 @@ func setupTestApp(t testing.TB) *tests.TestApp {
 		UserCollection:                         testUserCollection,
 		EnableRFC7591DynamicClientRegistration: true,
 		EnableRFC9728ProtectedResourceMetadata: true,
-	})
+	}
+	for _, fn := range configure {
+		fn(cfg)
+	}
+	err = oauth2.Register(testApp, cfg)
 	if err != nil {
 		testApp.Cleanup()
 		t.Fatal(err)
@@ -61,6 +80,161 @@ func setupTestAppForScenario(t testing.TB) *tests.TestApp {
 	return setupTestApp(t)
 }
 
+// testFixture is a test app with the OAuth2 plugin registered, seeded with the
+// test user and the authenticatable test client.
+type testFixture struct {
+	App    *tests.TestApp
+	Mux    *testBrowserMux
+	User   *core.Record
+	Client *core.Record
+
+	// RP receives the back-channel logout tokens of the test client, if the
+	// fixture was created withTestBackChannelLogout.
+	RP *testBackChannelRP
+
+	scenarioHeaders map[string]string
+}
+
+type testFixtureOptions struct {
+	configure  []func(cfg *oauth2.Config)
+	client     map[string]any
+	userFields []core.Field
+	routes     []func(se *core.ServeEvent)
+
+	backChannelLogout                bool
+	backChannelLogoutSessionRequired bool
+}
+
+// testFixtureOption customizes the fixture created by newTestFixture.
+type testFixtureOption func(o *testFixtureOptions)
+
+// withTestConfig adjusts the plugin config before it is registered.
+func withTestConfig(fn func(cfg *oauth2.Config)) testFixtureOption {
+	return func(o *testFixtureOptions) {
+		o.configure = append(o.configure, fn)
+	}
+}
+
+// withTestClient sets the fields of the test client.
+func withTestClient(fields map[string]any) testFixtureOption {
+	return func(o *testFixtureOptions) {
+		for k, v := range fields {
+			o.client[k] = v
+		}
+	}
+}
+
+// withTestUserFields adds the fields to the users collection, before the test
+// user is created.
+func withTestUserFields(fields ...core.Field) testFixtureOption {
+	return func(o *testFixtureOptions) {
+		o.userFields = append(o.userFields, fields...)
+	}
+}
+
+// withTestRoutes registers additional routes when the app is served.
+func withTestRoutes(fn func(se *core.ServeEvent)) testFixtureOption {
+	return func(o *testFixtureOptions) {
+		o.routes = append(o.routes, fn)
+	}
+}
+
+// withTestBackChannelLogout registers the fixture's RP as the
+// backchannel_logout_uri of the test client.
+func withTestBackChannelLogout(sessionRequired bool) testFixtureOption {
+	return func(o *testFixtureOptions) {
+		o.backChannelLogout = true
+		o.backChannelLogoutSessionRequired = sessionRequired
+	}
+}
+
+// newTestFixture creates the test app with the options, seeds the test user
+// and test client, and builds the mux. The app is cleaned up when the test
+// ends.
+func newTestFixture(t testing.TB, opts ...testFixtureOption) *testFixture {
+	t.Helper()
+	o := &testFixtureOptions{client: map[string]any{}}
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	f := &testFixture{scenarioHeaders: map[string]string{}}
+	if o.backChannelLogout {
+		f.RP = newTestBackChannelRP(t)
+		o.client["backchannel_logout_uri"] = f.RP.URL + "/backchannel-logout"
+		o.client["backchannel_logout_session_required"] = o.backChannelLogoutSessionRequired
+	}
+
+	f.App = setupTestApp(t, o.configure...)
+	t.Cleanup(f.App.Cleanup)
+
+	f.App.OnServe().BindFunc(func(se *core.ServeEvent) error {
+		// Authorize the scenario requests, see setScenarioHeader.
+		se.Router.Bind(&hook.Handler[*core.RequestEvent]{
+			Func: func(e *core.RequestEvent) error {
+				for k, v := range f.scenarioHeaders {
+					if e.Request.Header.Get(k) == "" {
+						e.Request.Header.Set(k, v)
+					}
+				}
+				return e.Next()
+			},
+			Priority: apis.DefaultLoadAuthTokenMiddlewarePriority - 1,
+		})
+		for _, fn := range o.routes {
+			fn(se)
+		}
+		return se.Next()
+	})
+
+	f.Client = seedAuthenticatableTestClient(t, f.App)
+	if len(o.client) > 0 {
+		for k, v := range o.client {
+			f.Client.Set(k, v)
+		}
+		if err := f.App.SaveNoValidate(f.Client); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(o.userFields) > 0 {
+		users := seedUsersCollection(t, f.App)
+		users.Fields.Add(o.userFields...)
+		if err := f.App.Save(users); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Reload the user, so that its original state is the saved one, as for a
+	// record loaded by a request.
+	user, err := f.App.FindRecordById(testUserCollection, seedTestUser(t, f.App).Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.User = user
+
+	f.Mux = newTestMux(t, f.App)
+	return f
+}
+
+// setScenarioHeader sets the header of the requests that don't have it, so
+// that an ApiScenario can send the tokens issued by its TestAppFactory.
+func (f *testFixture) setScenarioHeader(key string, value string) {
+	f.scenarioHeaders[key] = value
+}
+
+// newTestScenarioApp returns an ApiScenario TestAppFactory, which creates a
+// fixture with the options and runs setup against it before the request.
+func newTestScenarioApp(setup func(t testing.TB, f *testFixture), opts ...testFixtureOption) func(t testing.TB) *tests.TestApp {
+	return func(t testing.TB) *tests.TestApp {
+		t.Helper()
+		f := newTestFixture(t, opts...)
+		if setup != nil {
+			setup(t, f)
+		}
+		return f.App
+	}
+}
+
 // seedUsersCollection creates a "users" auth collection if it doesn't exist.
 func seedUsersCollection(t testing.TB, app core.App) *core.Collection {
 	t.Helper()
@@ -83,6 +257,7 @@ func seedTestUser(t testing.TB, app core.App) *core.Record {
 	t.Helper()
 	c := seedUsersCollection(t, app)
 	record := core.NewRecord(c)
+	record.Id = testUserID
 	record.SetEmail(testUserEmail)
 	record.SetPassword(testUserPassword)
 	record.Set("name", "Test User")
@@ -138,16 +313,360 @@ func seedTestClient(t testing.TB, app core.App) *core.Record {
 	return record
 }
 
-// generateTestUserToken generates a PocketBase auth token for the test user.
+// seedAuthenticatableTestClient creates the test client and resets its secret,
+// which the create hook hashes a second time, so that the client can
+// authenticate at the token endpoint with testClientSecret.
+func seedAuthenticatableTestClient(t testing.TB, app core.App) *core.Record {
+	t.Helper()
+	record := seedTestClient(t, app)
+	h, _ := oauth2.GetOAuth2Config().GetSecretsHasher(context.Background()).Hash(
+		context.Background(),
+		[]byte(testClientSecret),
+	)
+	record.Set("client_secret", string(h))
+	if err := app.SaveNoValidate(record); err != nil {
+		t.Fatalf("failed to update test client secret: %v", err)
+	}
+	return record
+}
+
+// generateTestUserToken generates a PocketBase auth token for the test user,
+// with the auth_time the login UI records when the user logs in.
 func generateTestUserToken(t testing.TB, app core.App) string {
+	t.Helper()
+	return generateTestUserTokenIssuedAt(t, app, 0)
+}
+
+// generateTestSuperuserToken creates the test superuser, if it doesn't exist,
+// and generates a PocketBase auth token for it.
+func generateTestSuperuserToken(t testing.TB, app core.App) string {
+	t.Helper()
+	record, err := app.FindAuthRecordByEmail(core.CollectionNameSuperusers, testSuperuserEmail)
+	if err != nil {
+		c, err := app.FindCollectionByNameOrId(core.CollectionNameSuperusers)
+		if err != nil {
+			t.Fatalf("failed to find superusers collection: %v", err)
+		}
+		record = core.NewRecord(c)
+		record.SetEmail(testSuperuserEmail)
+		record.SetPassword(testSuperuserPassword)
+		if err := app.Save(record); err != nil {
+			t.Fatalf("failed to create test superuser: %v", err)
+		}
+	}
+	token, err := record.NewAuthToken()
+	if err != nil {
+		t.Fatalf("failed to generate superuser token: %v", err)
+	}
+	return token
+}
+
+// generateTestUserTokenIssuedAt generates a PocketBase auth token for the test
+// user that appears to have been issued, by logging in with the login UI, the
+// given duration ago.
+func generateTestUserTokenIssuedAt(t testing.TB, app core.App, ago time.Duration) string {
 	t.Helper()
 	record, err := app.FindAuthRecordByEmail(testUserCollection, testUserEmail)
 	if err != nil {
 		t.Fatalf("failed to find test user: %v", err)
 	}
-	token, err := record.NewAuthToken()
+	token, err := security.NewJWT(
+		map[string]any{
+			core.TokenClaimId:           record.Id,
+			core.TokenClaimType:         core.TokenTypeAuth,
+			core.TokenClaimCollectionId: record.Collection().Id,
+			core.TokenClaimRefreshable:  true,
+			"auth_time":                 time.Now().Add(-ago).Unix(),
+		},
+		record.TokenKey()+record.Collection().AuthToken.Secret,
+		record.Collection().AuthToken.DurationTime()-ago,
+	)
 	if err != nil {
 		t.Fatalf("failed to generate user token: %v", err)
 	}
 	return token
 }
+
+// testBrowserMux is the app router of newTestMux. Like the browser that starts
+// an authorization request, it keeps the login challenge cookies set by the
+// responses, and sends them with the later requests that don't have them.
+// The embedded Handler serves the requests without them, as another browser.
+type testBrowserMux struct {
+	http.Handler
+
+	mu      sync.Mutex
+	cookies map[string]*http.Cookie
+}
+
+func (m *testBrowserMux) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	for name, cookie := range m.cookies {
+		if _, err := r.Cookie(name); err != nil {
+			r.AddCookie(cookie)
+		}
+	}
+	m.mu.Unlock()
+
+	m.Handler.ServeHTTP(w, r)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, cookie := range (&http.Response{Header: w.Header()}).Cookies() {
+		if !strings.HasPrefix(cookie.Name, "pb_oauth2_login_") {
+			continue
+		}
+		if cookie.MaxAge < 0 {
+			delete(m.cookies, cookie.Name)
+		} else {
+			m.cookies[cookie.Name] = &http.Cookie{Name: cookie.Name, Value: cookie.Value}
+		}
+	}
+}
+
+// newTestMux builds the app router with the OAuth2 routes registered, for
+// tests that need to perform multiple requests against the same app.
+func newTestMux(t testing.TB, app *tests.TestApp) *testBrowserMux {
+	t.Helper()
+	r, err := apis.NewRouter(app)
+	if err != nil {
+		t.Fatal(err)
+	}
+	se := &core.ServeEvent{App: app, Router: r}
+	var mux http.Handler
+	err = app.OnServe().Trigger(se, func(e *core.ServeEvent) error {
+		m, err := e.Router.BuildMux()
+		mux = m
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testBrowserMux{Handler: mux, cookies: map[string]*http.Cookie{}}
+}
+
+// doTestRequest performs a request against the mux and returns the response.
+func doTestRequest(t testing.TB, mux http.Handler, method string, target string, form url.Values, headers map[string]string) *http.Response {
+	t.Helper()
+	var req *http.Request
+	if form != nil {
+		req = httptest.NewRequest(method, target, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	} else {
+		req = httptest.NewRequest(method, target, nil)
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	return rec.Result()
+}
+
+// authorizeTestUser runs the authorization request for the test user and
+// test client, granting consent, and returns the authorization code from the
+// redirect.
+func authorizeTestUser(t testing.TB, app *tests.TestApp, mux http.Handler, params url.Values) string {
+	t.Helper()
+	form := url.Values{"consent": {"granted"}}
+	for k, v := range params {
+		form[k] = v
+	}
+	location := authorizeTestRequest(t, app, mux, form)
+	code := location.Query().Get("code")
+	if code == "" {
+		t.Fatalf("expected authorization code in redirect, got %q", location.String())
+	}
+	return code
+}
+
+// authorizeTestRequest runs the authorization request for the test user and
+// test client, with any additional params, and returns the final redirect
+// location. The login UI is driven through the login challenge endpoints: the
+// test user accepts the login, and accepts and remembers the consent if the
+// "consent" param is "granted", approving the "granted_scopes" param if set. Params with an
+// empty value are removed from the request.
+func authorizeTestRequest(t testing.TB, app *tests.TestApp, mux http.Handler, params url.Values) *url.URL {
+	t.Helper()
+	// Generate the token before the request, so the login doesn't appear to
+	// happen during the request.
+	return authorizeTestRequestWithToken(t, mux, generateTestUserToken(t, app), params)
+}
+
+// authorizeTestRequestWithToken is like authorizeTestRequest, but logs in
+// with the given user token.
+func authorizeTestRequestWithToken(t testing.TB, mux http.Handler, token string, params url.Values) *url.URL {
+	t.Helper()
+	form := url.Values{
+		"response_type": {"code"},
+		"client_id":     {testClientID},
+		"redirect_uri":  {testRedirectURI},
+		"scope":         {"openid profile email"},
+		"state":         {"teststate1234"},
+	}
+	for k, v := range params {
+		if len(v) == 0 || v[0] == "" {
+			form.Del(k)
+		} else {
+			form[k] = v
+		}
+	}
+	consent := url.Values{"remember": {"true"}}
+	if form.Has("granted_scopes") {
+		consent["granted_scopes"] = form["granted_scopes"]
+	}
+	consentGranted := form.Get("consent") == "granted"
+	form.Del("consent")
+	form.Del("granted_scopes")
+
+	res := doTestRequest(t, mux, http.MethodPost, "/oauth2/auth", form, nil)
+	location, err := res.Location()
+	if err != nil {
+		t.Fatalf("expected authorization redirect, got status %d: %v", res.StatusCode, err)
+	}
+	if challenge := location.Query().Get("login_challenge"); challenge != "" {
+		location = resolveTestLoginChallenge(t, mux, "login", challenge, "accept", nil, token)
+	}
+	if challenge := location.Query().Get("consent_challenge"); challenge != "" && consentGranted {
+		location = resolveTestLoginChallenge(t, mux, "consent", challenge, "accept", consent, token)
+	}
+	return location
+}
+
+// resolveTestLoginChallenge accepts or rejects the login or consent challenge
+// as the login UI would, follows the returned redirect to the authorization
+// endpoint and returns its redirect location.
+func resolveTestLoginChallenge(t testing.TB, mux http.Handler, phase string, challenge string, action string, form url.Values, token string) *url.URL {
+	t.Helper()
+	if form == nil {
+		form = url.Values{}
+	}
+	target := "/oauth2/auth/requests/" + phase + "/" + action + "?" + url.Values{phase + "_challenge": {challenge}}.Encode()
+	res := doTestRequest(t, mux, http.MethodPost, target, form, map[string]string{"Authorization": token})
+	ret := decodeTestJSONResponse(t, res)
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("failed to %s the %s challenge with status %d: %v", action, phase, res.StatusCode, ret)
+	}
+	redirectTo, err := url.Parse(ret["redirect_to"].(string))
+	if err != nil {
+		t.Fatalf("invalid redirect_to %v: %v", ret["redirect_to"], err)
+	}
+	res = doTestRequest(t, mux, http.MethodGet, redirectTo.RequestURI(), nil, nil)
+	location, err := res.Location()
+	if err != nil {
+		t.Fatalf("expected authorization redirect, got status %d: %v", res.StatusCode, err)
+	}
+	return location
+}
+
+// exchangeTestCode exchanges the authorization code at the token endpoint,
+// with any additional params, and returns the decoded token response.
+func exchangeTestCode(t testing.TB, mux http.Handler, code string, params url.Values) map[string]any {
+	t.Helper()
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"client_id":     {testClientID},
+		"client_secret": {testClientSecret},
+		"redirect_uri":  {testRedirectURI},
+	}
+	for k, v := range params {
+		form[k] = v
+	}
+	res := doTestRequest(t, mux, http.MethodPost, "/oauth2/token", form, nil)
+	ret := map[string]any{}
+	if err := json.NewDecoder(res.Body).Decode(&ret); err != nil {
+		t.Fatalf("failed to decode token response: %v", err)
+	}
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("token exchange failed with status %d: %v", res.StatusCode, ret)
+	}
+	return ret
+}
+
+// decodeTestJWTClaims decodes the claims of a JWT without verifying it.
+func decodeTestJWTClaims(t testing.TB, token string) map[string]any {
+	t.Helper()
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		t.Fatalf("malformed JWT %q", token)
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		t.Fatalf("failed to decode JWT payload: %v", err)
+	}
+	ret := map[string]any{}
+	if err := json.Unmarshal(raw, &ret); err != nil {
+		t.Fatalf("failed to unmarshal JWT payload: %v", err)
+	}
+	return ret
+}
+
+// decodeTestJSONResponse decodes a JSON object response body.
+func decodeTestJSONResponse(t testing.TB, res *http.Response) map[string]any {
+	t.Helper()
+	ret := map[string]any{}
+	if err := json.NewDecoder(res.Body).Decode(&ret); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	return ret
+}
+
+// decodeTestLoginState returns the state shown by the login UI for the
+// redirect location, either fetched from the login challenge endpoints or
+// decoded from the state param.
+func decodeTestLoginState(t testing.TB, mux http.Handler, location *url.URL) map[string]any {
+	t.Helper()
+	for _, phase := range []string{"login", "consent"} {
+		challenge := location.Query().Get(phase + "_challenge")
+		if challenge == "" {
+			continue
+		}
+		res := doTestRequest(t, mux, http.MethodGet, "/oauth2/auth/requests/"+phase+"?"+url.Values{phase + "_challenge": {challenge}}.Encode(), nil, nil)
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("failed to fetch the %s challenge, got status %d", phase, res.StatusCode)
+		}
+		return decodeTestJSONResponse(t, res)
+	}
+	payload, _, _ := strings.Cut(location.Query().Get("state"), ".")
+	raw, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		t.Fatalf("failed to decode login state: %v", err)
+	}
+	ret := map[string]any{}
+	if err := json.Unmarshal(raw, &ret); err != nil {
+		t.Fatalf("failed to unmarshal login state: %v", err)
+	}
+	return ret
+}
+
+// testBackChannelRP is a relying party that receives back-channel logout
+// tokens, responding with the status set in status.
+type testBackChannelRP struct {
+	*httptest.Server
+	status atomic.Int32
+	tokens chan string
+}
+
+func newTestBackChannelRP(t testing.TB) *testBackChannelRP {
+	t.Helper()
+	rp := &testBackChannelRP{tokens: make(chan string, 10)}
+	rp.status.Store(http.StatusOK)
+	rp.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rp.tokens <- r.PostFormValue("logout_token")
+		w.WriteHeader(int(rp.status.Load()))
+	}))
+	t.Cleanup(rp.Close)
+	return rp
+}
+
+// waitForTestLogoutToken waits for the RP to receive a logout token.
+func (rp *testBackChannelRP) waitForTestLogoutToken(t testing.TB) string {
+	t.Helper()
+	select {
+	case token := <-rp.tokens:
+		return token
+	case <-time.After(time.Second * 5):
+		t.Fatal("timed out waiting for the logout token")
+		return ""
+	}
+}
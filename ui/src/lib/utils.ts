@@ -57,6 +57,32 @@ export function postRedirect(location: string, data: Record<string, any>): void
     // document.body.removeChild(form); 
 }
 
+/**
+ * Renders each URL in a hidden iframe, and resolves once they have all loaded
+ * or the timeout has passed.
+ * @param {string[]} urls The URLs to render.
+ * @param {number} [timeout] The maximum time to wait, in milliseconds.
+ */
+export function renderHiddenFrames(urls: string[], timeout = 5000): Promise<void> {
+    if (!urls.length) {
+        return Promise.resolve();
+    }
+
+    const loaded = urls.map((url) => new Promise<void>((resolve) => {
+        const iframe = document.createElement('iframe');
+        iframe.style.display = 'none';
+        iframe.onload = () => resolve();
+        iframe.onerror = () => resolve();
+        iframe.src = url;
+        document.body.appendChild(iframe);
+    }));
+
+    return Promise.race([
+        Promise.all(loaded).then(() => undefined),
+        new Promise<void>((resolve) => setTimeout(resolve, timeout)),
+    ]);
+}
+
 export function base64UrlDecode(base64UrlString: string): string {
     let base64 = base64UrlString.replace(/-/g, "+").replace(/_/g, "/");
     while (base64.length % 4) {
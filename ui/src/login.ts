@@ -2,13 +2,23 @@ import Alpine from "alpinejs";
 import PocketBase, { type AuthRecord, type AuthMethodsList } from "pocketbase";
 import MultiAuthStore from "./lib/multi-auth-store";
 import toastStore from "./lib/toast-store";
-import { postRedirect, sentenize, base64UrlDecode } from "./lib/utils";
+import { sentenize, base64UrlDecode, renderHiddenFrames } from "./lib/utils";
 import "./login.style.min.css";
 
 //
 
+type ConnectedApp = {
+    client_id: string;
+    client_name: string;
+    client_uri: string;
+    logo_uri: string;
+    scopes: string[];
+    last_used_at: string;
+    signed_in: boolean;
+};
+
 type LoginState = {
-    page: "account-selection" | "login-password" | "login-otp" | "consent";
+    page: "account-selection" | "login-password" | "login-otp" | "consent" | "connected-apps" | "logout";
     state: {
         passwordLoginForm: {
             submitting: boolean;
@@ -25,21 +35,38 @@ type LoginState = {
         };
         consentForm: {
             submitting: boolean;
+            scopes: string[];
         };
         mfaId: string;
         methods: AuthMethodsList | null;
         authRecord: AuthRecord | null;
         validAccountsForReq: AuthRecord[];
+        connectedApps: ConnectedApp[];
+        revoking: string;
+        loggingOut: boolean;
+        loggedOut: boolean;
     };
 
     params: {
+        mode: "authorize" | "connected-apps";
         collection: string;
         client_id: string;
         client_name: string;
-        redirect_uri: string;
-        prompt: "login" | "none" | "consent";
+        challenge: string;
+        challenge_phase: "login" | "consent" | "logout";
+        requests_path: string;
+        prompt: "login" | "none" | "consent" | "select_account";
         max_age?: number;
+        login_hint: string;
+        id_token_hint_subject: string;
+        acr_amr: string[][];
+        acr_essential: boolean;
         requested_scopes: string[];
+        optional_scopes: string[];
+        authorization_details: { type: string; description: string }[];
+        consent_subject: string;
+        connected_apps_path: string;
+        logout_confirm: boolean;
     };
 
     error: string;
@@ -53,11 +80,14 @@ type LoginState = {
     showLoginRequestOtp(): boolean;
     showLoginOtp(): boolean;
     showConsent(): boolean;
+    showConnectedApps(): boolean;
+    showLogout(): boolean;
     uiUserLabel(record: AuthRecord): string;
     uiUserLabelShort(record: AuthRecord): string;
     uiIdentityLabel(): string;
     uiClientNameLabel(): string;
     uiConsentButtonLabel(): string;
+    uiConnectedAppLabel(app: ConnectedApp): string;
     selectAccount: (record: AuthRecord) => Promise<void>;
     switchAccount: () => void;
     newAccount: () => void;
@@ -65,6 +95,12 @@ type LoginState = {
     submitAuthWithOTP: () => Promise<void>;
     requestOTP: () => Promise<void>;
     submitConsent: () => Promise<void>;
+    loadConnectedApps: () => Promise<void>;
+    revokeConnectedApp: (app: ConnectedApp) => Promise<void>;
+    loadChallenge: () => Promise<void>;
+    acceptLogin: () => Promise<void>;
+    acceptLogout: () => Promise<void>;
+    rejectChallenge: (error: string) => Promise<void>;
     handleSuccessfulLogin: () => void;
     handleSuccessfulConsent: () => void;
     handleErr: (err: any) => void;
@@ -85,12 +121,34 @@ Alpine.data<Partial<LoginState>, any>('oauth', () => {
                     item.record?.collectionName === ret.params.collection
                 ) &&
                 (
-                    item.iat + (ret.params.max_age ?? 0) > Math.floor(Date.now() / 1000)
-                )
+                    ret.params.max_age === undefined ||
+                    item.iat + ret.params.max_age >= Math.floor(Date.now() / 1000)
+                ) &&
+                (
+                    !ret.params.id_token_hint_subject ||
+                    item.record?.id === ret.params.id_token_hint_subject
+                ) &&
+                meetsACRValues(item.token)
             )
             .map(item => item.record);
     };
 
+    // The server records the methods the user logged in with in the auth
+    // token, an account can be used if it reaches one of the requested acr
+    // values.
+    const meetsACRValues = (token: string): boolean => {
+        if (ret.params.acr_amr.length === 0) {
+            return true;
+        }
+        let amr: string[] = [];
+        try {
+            amr = Array.from<any>(JSON.parse(base64UrlDecode(token.split(".")[1] || "")).amr || []).map(String);
+        } catch {
+            return false;
+        }
+        return ret.params.acr_amr.some(required => required.every(method => amr.includes(method)));
+    };
+
     //
 
     const ret: LoginState = {
@@ -111,21 +169,38 @@ Alpine.data<Partial<LoginState>, any>('oauth', () => {
             },
             consentForm: {
                 submitting: false,
+                scopes: [],
             },
             mfaId: "",
             methods: null,
             authRecord: null,
             validAccountsForReq: [],
+            connectedApps: [],
+            revoking: "",
+            loggingOut: false,
+            loggedOut: false,
         },
 
         params: {
+            mode: "authorize",
             collection: "",
             client_id: "",
             client_name: "",
-            redirect_uri: "",
+            challenge: "",
+            challenge_phase: "login",
+            requests_path: "",
             prompt: "login",
-            max_age: 7 * 24 * 60 * 60, // 7 days in seconds
+            max_age: undefined,
+            login_hint: "",
+            id_token_hint_subject: "",
+            acr_amr: [],
+            acr_essential: false,
             requested_scopes: [],
+            optional_scopes: [],
+            authorization_details: [],
+            consent_subject: "",
+            connected_apps_path: "",
+            logout_confirm: false,
         },
 
         error: "",
@@ -134,31 +209,33 @@ Alpine.data<Partial<LoginState>, any>('oauth', () => {
 
         async init() {
 
+            if (this.params.mode !== "connected-apps") {
+                try {
+                    await this.loadChallenge();
+                } catch (err) {
+                    this.error = "Invalid request: " + (err instanceof Error ? err.message : String(err));
+                    return;
+                }
+            }
+
             this.state!.validAccountsForReq = getValidAccountsForReq();
 
-            if (this.params.prompt === "none") {
-                if (this.state.validAccountsForReq.length === 1) {
-                    // TODO/conformance: Check login_hint if provided. Return "login_required" if it doesn't match.
-                    const { token, iat } = pbAuthStore.selectByRecord(this.state.validAccountsForReq[0])!;
-                    postRedirect(this.params.redirect_uri, { pb_token: token, pb_token_iat: iat });
-                } else if (this.state.validAccountsForReq.length > 1) {
-                    // TODO/conformance: Check login_hint if provided. 
-                    //       - If it matches exactly one account, return that.
-                    //       - If it doesn't match any, return "login_required".
-                    postRedirect(this.params.redirect_uri, { error: "account_selection_required" });
-                } else {
-                    postRedirect(this.params.redirect_uri, { error: "login_required" });
+            if (this.params.mode === "connected-apps") {
+                // The user picks an account to manage the apps connected to it.
+                this.page = "account-selection";
+            } else if (this.params.challenge_phase === "logout") {
+                // The user confirms the logout, unless the client proved who
+                // they are with an id_token_hint.
+                this.page = "logout";
+                if (!this.params.logout_confirm) {
+                    await this.acceptLogout();
                 }
                 return;
-
-            } else if (this.params.prompt === "consent") {
-                if (this.state.validAccountsForReq.length === 1) {
-                    this.state!.authRecord = pbAuthStore.selectByRecord(this.state.validAccountsForReq[0])?.record || null;
-                    this.page = "consent";
-                } else {
-                    // TODO/conformance: Check login_hint if provided. If it matches exactly, go to consent, else go to account-selection.
-                    this.page = "account-selection";
-                }
+            } else if (this.params.challenge_phase === "consent") {
+                // The server has asked for the user's consent after login.
+                const item = pbAuthStore.records.find(item => item.record?.id === this.params.consent_subject);
+                this.state!.authRecord = item ? pbAuthStore.selectByRecord(item.record)?.record || null : null;
+                this.page = this.state!.authRecord ? "consent" : "account-selection";
             } else if (this.params.prompt === "login") {
                 this.page = "login-password";
             }
@@ -168,7 +245,7 @@ Alpine.data<Partial<LoginState>, any>('oauth', () => {
             try {
                 this.state!.methods = await pb.collection(this.params!.collection).listAuthMethods();
 
-                if (this.state.validAccountsForReq.length === 0 || this.params.prompt === "login") {
+                if (this.page !== "consent" && (this.state.validAccountsForReq.length === 0 || this.params.prompt === "login")) {
                     if (this.state!.methods.password.enabled) {
                         this.page = "login-password";
                     } else if (this.state!.methods.otp.enabled) {
@@ -209,6 +286,12 @@ Alpine.data<Partial<LoginState>, any>('oauth', () => {
         showConsent() {
             return !this.error && !!this.state!.methods && this.page === "consent";
         },
+        showConnectedApps() {
+            return !this.error && !!this.state!.methods && this.page === "connected-apps";
+        },
+        showLogout() {
+            return !this.error && this.page === "logout";
+        },
 
         //
 
@@ -243,6 +326,9 @@ Alpine.data<Partial<LoginState>, any>('oauth', () => {
         uiConsentButtonLabel() {
             return "Authorize " + (this.params.client_name || `Third-Party App`);
         },
+        uiConnectedAppLabel(app: ConnectedApp) {
+            return app.client_name || `Unnamed OAuth2 Client (${app.client_id.substr(0, 8)}...)`;
+        },
 
         //
 
@@ -275,7 +361,7 @@ Alpine.data<Partial<LoginState>, any>('oauth', () => {
             try {
                 await pb
                     .collection(this.params!.collection)
-                    .authWithPassword(identity, password)
+                    .authWithPassword(identity, password, { query: this.loginChallengeQuery() })
                     .then(() => this.handleSuccessfulLogin());
             } catch (err: any) {
                 if (err.status === 401) {
@@ -313,7 +399,7 @@ Alpine.data<Partial<LoginState>, any>('oauth', () => {
             try {
                 await pb
                     .collection(this.params!.collection)
-                    .authWithOTP(this.state!.otpLoginForm.id || this.state!.otpLoginForm.prevId, this.state!.otpLoginForm.password, { mfaId: this.state!.mfaId })
+                    .authWithOTP(this.state!.otpLoginForm.id || this.state!.otpLoginForm.prevId, this.state!.otpLoginForm.password, { mfaId: this.state!.mfaId, query: this.loginChallengeQuery() })
                     .then(() => this.handleSuccessfulLogin());
             } catch (err) {
                 this.handleErr(err);
@@ -350,24 +436,184 @@ Alpine.data<Partial<LoginState>, any>('oauth', () => {
             this.handleSuccessfulConsent();
         },
 
+        async loadConnectedApps() {
+            try {
+                this.state!.connectedApps = await pb.send<ConnectedApp[]>(this.params.connected_apps_path, {});
+            } catch (err) {
+                this.handleErr(err);
+            }
+        },
+
+        async revokeConnectedApp(app: ConnectedApp) {
+            if (this.state!.revoking) {
+                return;
+            }
+
+            this.state!.revoking = app.client_id;
+
+            try {
+                await pb.send(`${this.params.connected_apps_path}/${encodeURIComponent(app.client_id)}`, { method: "DELETE" });
+                this.state!.connectedApps = this.state!.connectedApps.filter(item => item.client_id !== app.client_id);
+                Alpine.store("toast").addToast("success", `Removed access for ${this.uiConnectedAppLabel(app)}`);
+            } catch (err) {
+                this.handleErr(err);
+            }
+
+            this.state!.revoking = "";
+        },
+
+        //
+
+        async loadChallenge() {
+            const phase = this.params.challenge_phase;
+            const stateData = await pb.send<Record<string, any>>(`${this.params.requests_path}/${phase}`, {
+                query: { [`${phase}_challenge`]: this.params.challenge },
+            });
+
+            if (phase === "logout") {
+                this.params.collection = String(stateData.collection || "");
+                this.params.client_id = String(stateData.client_id || "");
+                this.params.client_name = String(stateData.client_name || "");
+                this.params.logout_confirm = Boolean(stateData.confirm);
+                return;
+            }
+
+            const { collection, client_id, login_hint } = stateData;
+
+            if (!collection) {
+                throw new Error("Missing collection");
+            }
+            if (!client_id) {
+                throw new Error("Missing client_id");
+            }
+            if (login_hint) {
+                this.state!.passwordLoginForm.identity = String(login_hint);
+            }
+            const maxAge = parseInt(String(stateData.max_age ?? ""), 10);
+
+            this.params.collection = String(collection);
+            this.params.client_id = String(client_id);
+            this.params.client_name = String(stateData.client_name);
+            this.params.prompt = String(stateData.prompt || "consent") as any;
+            this.params.max_age = Number.isNaN(maxAge) ? undefined : maxAge;
+            this.params.login_hint = String(login_hint || "");
+            this.params.id_token_hint_subject = String(stateData.id_token_hint_subject || "");
+            this.params.acr_amr = Array.from<any>(stateData.acr_amr || []).map(amr => Array.from<any>(amr || []).map(String));
+            this.params.acr_essential = Boolean(stateData.acr_essential);
+            this.params.requested_scopes = Array.from<any>(stateData.requested_scopes || []).map(String);
+            this.params.optional_scopes = Array.from<any>(stateData.optional_scopes || []).map(String);
+            this.state!.consentForm.scopes = [...this.params.requested_scopes];
+            this.params.consent_subject = String(stateData.consent_subject || "");
+            this.params.authorization_details = Array.from<any>(stateData.authorization_details || []).map(item => ({
+                type: String(item.type),
+                description: String(item.description || item.type),
+            }));
+        },
+
+        //
+
+        async acceptLogin() {
+            // The selected account's token authorizes the login, the server
+            // returns the authorization endpoint URL to resume the request.
+            // The accounts are remembered on this device, so is the session.
+            const { redirect_to } = await pb.send<{ redirect_to: string }>(`${this.params.requests_path}/login/accept`, {
+                method: "POST",
+                query: { login_challenge: this.params.challenge },
+                body: { remember: true },
+            });
+            window.location.assign(redirect_to);
+        },
+
+        //
+
+        async acceptLogout() {
+            if (this.state!.loggingOut) {
+                return;
+            }
+
+            this.state!.loggingOut = true;
+
+            try {
+                // Forget the accounts remembered on this device, the server
+                // returns where the client asked to send the user next.
+                pbAuthStore.clear();
+                const { redirect_to, frontchannel_logout_uris } = await pb.send<{ redirect_to: string; frontchannel_logout_uris?: string[] }>(`${this.params.requests_path}/logout/accept`, {
+                    method: "POST",
+                    query: { logout_challenge: this.params.challenge },
+                });
+                // Let the clients that keep their session in the browser sign
+                // out before leaving the page.
+                await renderHiddenFrames(frontchannel_logout_uris || []);
+                if (redirect_to) {
+                    window.location.assign(redirect_to);
+                    return;
+                }
+                this.state!.loggedOut = true;
+            } catch (err) {
+                this.handleErr(err);
+            }
+
+            this.state!.loggingOut = false;
+        },
+
+        //
+
+        async rejectChallenge(error: string) {
+            const phase = this.params.challenge_phase;
+            const { redirect_to } = await pb.send<{ redirect_to: string }>(`${this.params.requests_path}/${phase}/reject`, {
+                method: "POST",
+                query: { [`${phase}_challenge`]: this.params.challenge },
+                body: { error },
+            });
+            window.location.assign(redirect_to);
+        },
+
         //
 
+        loginChallengeQuery(): Record<string, string> {
+            // The server records how the user logs in to their auth token,
+            // only for the logins that accept a login challenge.
+            return this.params.challenge_phase === "login" ? { login_challenge: this.params.challenge } : {};
+        },
+
         handleSuccessfulLogin() {
             this.state!.authRecord = pbAuthStore.selected?.record || null;
             this.state!.validAccountsForReq = getValidAccountsForReq();
-            
-            if (this.params.prompt === "login") {
-                this.handleSuccessfulConsent();
-            } else {
-                this.page = "consent";
+
+            if (this.params.mode === "connected-apps") {
+                this.page = "connected-apps";
+                this.loadConnectedApps();
+                return;
+            }
+
+            if (this.params.challenge_phase === "consent") {
+                // The consent was asked for the account that logged in.
+                if (this.state!.authRecord?.id === this.params.consent_subject) {
+                    this.page = "consent";
+                } else {
+                    Alpine.store("toast").addToast("error", "Please sign in with the account that started this request");
+                }
+                return;
             }
+
+            // The server decides whether the user needs to consent, and sends
+            // them back here with a consent challenge if they do.
+            this.acceptLogin().catch(err => this.handleErr(err));
         },
 
         //
 
         handleSuccessfulConsent() {
-            const { token, iat } = pbAuthStore.selected!;
-            postRedirect(this.params.redirect_uri, { pb_token: token, pb_token_iat: iat });
+            pb.send<{ redirect_to: string }>(`${this.params.requests_path}/consent/accept`, {
+                method: "POST",
+                query: { consent_challenge: this.params.challenge },
+                body: { granted_scopes: this.state!.consentForm.scopes, remember: true },
+            }).then(({ redirect_to }) => {
+                window.location.assign(redirect_to);
+            }).catch(err => {
+                this.state!.consentForm.submitting = false;
+                this.handleErr(err);
+            });
         },
 
         //
@@ -387,40 +633,35 @@ Alpine.data<Partial<LoginState>, any>('oauth', () => {
     //
 
     try {
-        const stateURLParam = new URLSearchParams(window.location.search).get("state") || "";
-        const stateJSON = base64UrlDecode(stateURLParam);
+        const query = new URLSearchParams(window.location.search);
+
+        // The authorization endpoint hands the request over with a signed
+        // challenge, the details of the request are fetched from the server.
+        for (const phase of ["login", "consent", "logout"] as const) {
+            const challenge = query.get(`${phase}_challenge`);
+            if (challenge) {
+                ret.params!.challenge = challenge;
+                ret.params!.challenge_phase = phase;
+                ret.params!.requests_path = window.location.pathname.replace(/\/login\/?$/, "") + "/auth/requests";
+                return ret;
+            }
+        }
+
+        const stateJSON = base64UrlDecode((query.get("state") || "").split(".")[0]);
         const stateData = JSON.parse(stateJSON);
         if (typeof stateData !== "object" || stateData === null) {
             throw new Error("Unexpected format");
         }
-
-        const {
-            collection,
-            client_id,
-            redirect_uri,
-            login_hint,
-        } = stateData;
-
-        if (!collection) {
-            throw new Error("Missing collection");
-        }
-        if (!client_id) {
-            throw new Error("Missing client_id");
+        if (stateData.mode !== "connected-apps") {
+            throw new Error("Unexpected mode");
         }
-        if (!redirect_uri) {
-            throw new Error("Missing redirect_uri");
-        }
-        if (login_hint) {
-            ret.state!.passwordLoginForm.identity = String(login_hint);
+        if (!stateData.collection) {
+            throw new Error("Missing collection");
         }
 
-        ret.params!.collection = String(collection);
-        ret.params!.client_id = String(client_id);
-        ret.params!.client_name = String(stateData.client_name);
-        ret.params!.redirect_uri = String(redirect_uri);
-        ret.params!.prompt = String(stateData.prompt || "consent") as any;
-        ret.params!.max_age = Number(stateData.max_age) || 7 * 24 * 60 * 60;
-        ret.params!.requested_scopes = Array.from(stateData.requested_scopes || []).map(String);
+        ret.params!.mode = "connected-apps";
+        ret.params!.collection = String(stateData.collection);
+        ret.params!.connected_apps_path = String(stateData.connected_apps_path);
     } catch (e) {
         return { error: "Invalid state: " + (e instanceof Error ? e.message : String(e)) }
     }
@@ -27,11 +27,31 @@ func init() {
 //
 
 type Plugin struct {
-	PathPrefix     string `json:"prefix"`
-	UserCollection string `json:"user_collection"`
-	EnableRFC7591  bool   `json:"enable_rfc7591"`
-	EnableRFC9728  bool   `json:"enable_rfc9728"`
-	EnforcePKCE    string `json:"enforce_pkce"` // "all", "public", "none"
+	PathPrefix         string `json:"prefix"`
+	UserCollection     string `json:"user_collection"`
+	EnableRFC7591      bool   `json:"enable_rfc7591"`
+	EnableRFC9728      bool   `json:"enable_rfc9728"`
+	EnableClaimSources bool   `json:"enable_claim_sources"`
+	EnforcePKCE        string `json:"enforce_pkce"` // "all", "public", "none"
+
+	// LoginURL is the URL of an external login and consent UI, the embedded
+	// UI is used if it is empty.
+	LoginURL string `json:"login_url"`
+
+	// Claims are merged on top of the default claim mappings, see [oauth2.ClaimMappings].
+	Claims oauth2.ClaimMappings `json:"claims"`
+
+	// ScopeFilters are the filters the user record must satisfy for a scope to
+	// be granted, see [oauth2.ScopeGrantFilters].
+	ScopeFilters oauth2.ScopeGrantFilters `json:"scope_filters"`
+
+	// LevelsOfAssurance map the methods a user logged in with to the acr
+	// claim, see [oauth2.LevelsOfAssurance].
+	LevelsOfAssurance oauth2.LevelsOfAssurance `json:"levels_of_assurance"`
+
+	// RevokeRefreshTokensOnLogout revokes the refresh tokens of the client
+	// when it logs the user out.
+	RevokeRefreshTokensOnLogout bool `json:"revoke_refresh_tokens_on_logout"`
 }
 
 // Validate implements validation.Validatable.
@@ -54,6 +74,9 @@ func (p *Plugin) Validate() error {
 			validation.Required,
 			is.Alphanumeric,
 		),
+		validation.Field(&p.LoginURL,
+			is.URL,
+		),
 	)
 }
 
@@ -74,6 +97,10 @@ func (p *Plugin) Description() string {
 
 // Init implements xpb.Plugin.
 func (p *Plugin) Init(app core.App) error {
+	var claimMappings oauth2.ClaimMappings
+	if len(p.Claims) > 0 {
+		claimMappings = oauth2.DefaultClaimMappings().Merge(p.Claims)
+	}
 	return oauth2.Register(
 		app,
 		&oauth2.Config{
@@ -86,8 +113,14 @@ func (p *Plugin) Init(app core.App) error {
 			},
 			PathPrefix:                             p.PathPrefix,
 			UserCollection:                         p.UserCollection,
+			LoginURL:                               p.LoginURL,
 			EnableRFC7591DynamicClientRegistration: p.EnableRFC7591,
 			EnableRFC9728ProtectedResourceMetadata: p.EnableRFC9728,
+			UserInfoClaimMappings:                  claimMappings,
+			EnableAggregatedAndDistributedClaims:   p.EnableClaimSources,
+			ScopeGrantFilters:                      p.ScopeFilters,
+			LevelsOfAssurance:                      p.LevelsOfAssurance,
+			RevokeRefreshTokensOnLogout:            p.RevokeRefreshTokensOnLogout,
 		},
 	)
 }